@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+)
+
+// statusClientClosedRequest is nginx's non-standard status for requests the client
+// abandoned before the response was complete
+const statusClientClosedRequest = "499 Client Closed Request"
+
+// recordClientAbort counts a request abandoned by the client at the given stage:
+// "upstream_request" (waiting for upstream headers), "response_body" or "stream"
+func recordClientAbort(stage string) {
+	metrics.Add("openai_proxy_client_aborts_total", "Requests whose client disconnected before the response was complete.", map[string]string{"stage": stage}, 1)
+}
+
+// streamCopy relays an upstream stream to the client, flushing after every chunk so
+// events arrive as they are produced. dst is w, possibly teed into a buffer. It
+// returns the bytes written and whether the copy ended because the client went
+// away; the upstream read is cancelled along with ctx in that case.
+func streamCopy(ctx context.Context, w http.ResponseWriter, dst io.Writer, src io.Reader) (int64, bool, error) {
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	var written int64
+	for {
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			m, writeErr := dst.Write(buf[:n])
+			written += int64(m)
+			if writeErr != nil {
+				return written, true, writeErr
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if readErr == io.EOF {
+			return written, false, nil
+		}
+		if readErr != nil {
+			return written, ctx.Err() != nil, readErr
+		}
+	}
+}
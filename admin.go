@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// adminMux serves the trace viewer and admin endpoints, separate from the forwarder
+var adminMux = http.NewServeMux()
+
+// requireAdminToken rejects requests without the -admin-token bearer token. The
+// token may also be given as a ?token= query parameter, since browsers cannot set
+// headers on WebSocket connections.
+func requireAdminToken(next http.Handler) http.Handler {
+	if *adminToken == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" {
+			token = r.URL.Query().Get("token")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="openai-proxy admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleTraces returns the stored traces as JSON: the latest ones, or with
+// ?starred=true, ?label=<label> or ?annotated=true every matching annotated trace.
+// Soft-deleted traces are left out unless ?include_deleted=true.
+func handleTraces(w http.ResponseWriter, r *http.Request) {
+	list, filtered, err := annotatedTraces(r)
+	if !filtered {
+		list, err = traceSink.List(tracesMax)
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "storage_error", "failed to list traces: "+err.Error())
+		return
+	}
+	if r.URL.Query().Get("include_deleted") != "true" {
+		list = visibleTraces(list)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// handleTraceFeed upgrades to a WebSocket that receives traces as they are
+// recorded. With ?since=<seq>, the stored traces recorded after seq come first.
+func handleTraceFeed(w http.ResponseWriter, r *http.Request) {
+	log.Printf("🔌 WebSocket connection attempt from %s", r.RemoteAddr)
+	subscription, err := parseFeedSubscription(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("❌ WebSocket upgrade error: %v", err)
+		return
+	}
+	log.Printf("✅ WebSocket connection established with %s", r.RemoteAddr)
+	subscription.conn = conn
+	hub.register <- subscription
+	// Keep connection alive, unregister on error (e.g. client disconnects)
+	go func() {
+		defer func() {
+			log.Printf("🔌 WebSocket connection closed with %s", r.RemoteAddr)
+			hub.unregister <- conn
+			conn.Close()
+		}()
+		for {
+			// Read messages (optional, if you expect client messages)
+			// For now, just keep the connection open.
+			// If an error occurs (client disconnects), the loop will break.
+			if _, _, err := conn.NextReader(); err != nil {
+				break
+			}
+		}
+	}()
+}
+
+// startAdminServer serves the trace viewer and admin endpoints until it fails
+func startAdminServer() {
+	adminMux.HandleFunc("/traces", handleTraces)
+	adminMux.HandleFunc("/traces/replay", handleTraceReplay)
+	adminMux.HandleFunc("/traces/", handleTraceSubresource)
+	adminMux.HandleFunc("/sessions/", handleSessionSubresource)
+	adminMux.HandleFunc("/quarantine", handleQuarantine)
+	adminMux.HandleFunc("/anomalies", handleAnomalies)
+	adminMux.HandleFunc("/chaos", handleChaos)
+	adminMux.HandleFunc("/canary", handleCanary)
+	adminMux.HandleFunc("/experiments", handleExperiments)
+	adminMux.HandleFunc("/schema-drift", handleSchemaDrift)
+	adminMux.HandleFunc("/jobs", handleJobs)
+	adminMux.HandleFunc("/webhooks/deliveries", handleWebhookDeliveries)
+	adminMux.HandleFunc("/webhooks/deliveries/", handleWebhookDeliveries)
+	adminMux.HandleFunc("/usage/forecast", handleUsageForecast)
+	adminMux.HandleFunc("/upstreams", handleUpstreams)
+	adminMux.HandleFunc("/routing/audit", handleRoutingAudit)
+	adminMux.HandleFunc("/policy/simulate", handlePolicySimulate)
+	adminMux.HandleFunc("/tenant-hooks", handleTenantHooks)
+	adminMux.HandleFunc("/hooks/", handleHookVersions)
+	adminMux.HandleFunc("/hooks/profile", handleHookProfile)
+	adminMux.HandleFunc("/quarantine/", handleQuarantine)
+	adminMux.HandleFunc("/blobs/", handleBlob)
+	adminMux.HandleFunc("/metrics", handleMetrics)
+	adminMux.HandleFunc("/load", handleLoad)
+	adminMux.HandleFunc("/ws", handleTraceFeed)
+	// Paths without a built-in handler go to the hook script's admin.handle endpoints
+	adminMux.HandleFunc("/", handleLuaAdminEndpoint)
+
+	addr := net.JoinHostPort(*adminHost, fmt.Sprint(*adminPort))
+	if *adminToken == "" && *adminHost != "localhost" && *adminHost != "127.0.0.1" && *adminHost != "::1" {
+		log.Printf("⚠️ Trace server on %s is reachable without authentication; set -admin-token or -admin-host=localhost", addr)
+	}
+	var listener net.Listener
+	if inherited := inheritedListeners(true); len(inherited) > 0 {
+		// systemd passes at most one socket named admin
+		listener = inherited[0]
+		addr = listener.Addr().String()
+	} else {
+		var err error
+		if listener, err = net.Listen("tcp", addr); err != nil {
+			log.Fatalf("❌ Failed to listen on %s: %v", addr, err)
+		}
+	}
+	listenersBound.Done()
+	log.Printf("📊 Trace viewer running on %s, WebSocket on /ws", addr)
+	log.Fatal(http.Serve(listener, requireAdminToken(adminMux)))
+}
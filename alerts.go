@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// alert is a notification sent to the configured webhook and Slack sinks
+type alert struct {
+	Kind      string    `json:"kind"`
+	Key       string    `json:"key,omitempty"`
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+var alertClient = &http.Client{Timeout: 10 * time.Second}
+
+// sendAlert queues a for every configured sink; the webhook dispatcher delivers
+// it in the background, so alerting never delays the request that triggered it
+func sendAlert(a alert) {
+	if *alertWebhookURL != "" {
+		webhooks.send("alert", *alertWebhookURL, a)
+	}
+	if *alertSlackWebhookURL != "" {
+		text := fmt.Sprintf(":rotating_light: *%s* %s", a.Kind, a.Message)
+		webhooks.send("slack", *alertSlackWebhookURL, map[string]string{"text": text})
+	}
+}
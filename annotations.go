@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// annotated reports whether a trace carries notes, labels or a star, which keeps it
+// from being evicted
+func (t Trace) annotated() bool {
+	return t.Starred || t.Notes != "" || len(t.Labels) > 0
+}
+
+// traceAnnotationPatch is the body of PATCH /traces/<id>. Absent fields are left
+// unchanged; labels replaces the label list, add_labels and remove_labels edit it.
+type traceAnnotationPatch struct {
+	Notes        *string   `json:"notes"`
+	Labels       *[]string `json:"labels"`
+	AddLabels    []string  `json:"add_labels"`
+	RemoveLabels []string  `json:"remove_labels"`
+	Starred      *bool     `json:"starred"`
+}
+
+// apply returns trace with the patch applied
+func (p traceAnnotationPatch) apply(trace Trace) Trace {
+	if p.Notes != nil {
+		trace.Notes = strings.TrimSpace(*p.Notes)
+	}
+	if p.Starred != nil {
+		trace.Starred = *p.Starred
+	}
+	labels := trace.Labels
+	if p.Labels != nil {
+		labels = *p.Labels
+	}
+	labels = append(append([]string(nil), labels...), p.AddLabels...)
+	removed := make(map[string]bool)
+	for _, label := range p.RemoveLabels {
+		removed[strings.TrimSpace(label)] = true
+	}
+	seen := make(map[string]bool)
+	trace.Labels = nil
+	for _, label := range labels {
+		label = strings.TrimSpace(label)
+		if label == "" || seen[label] || removed[label] {
+			continue
+		}
+		seen[label] = true
+		trace.Labels = append(trace.Labels, label)
+	}
+	return trace
+}
+
+// handleTrace serves GET /traces/<id>, PATCH /traces/<id> to annotate a trace and
+// DELETE /traces/<id> to soft-delete it
+func handleTrace(w http.ResponseWriter, r *http.Request, id string) {
+	trace, ok, err := traceSink.Get(id)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "storage_error", "failed to read trace: "+err.Error())
+		return
+	}
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("no stored trace with id %q", id))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		var patch traceAnnotationPatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid annotation: "+err.Error())
+			return
+		}
+		trace = patch.apply(trace)
+		updated, err := traceSink.Update(trace)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "storage_error", "failed to update trace: "+err.Error())
+			return
+		}
+		if !updated {
+			writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("trace %q was evicted", id))
+			return
+		}
+		log.Printf("🔖 Annotated trace %s (starred: %v, labels: %v)", id, trace.Starred, trace.Labels)
+	case http.MethodDelete:
+		if trace.DeletedAt == nil {
+			now := time.Now()
+			trace.DeletedAt = &now
+		}
+		updateTrace(w, trace, "delete")
+		return
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "invalid_request_error", "use GET, PATCH or DELETE")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(trace)
+}
+
+// annotatedTraces returns the annotated traces selected by the starred and label
+// query parameters of GET /traces, or false when the request has neither
+func annotatedTraces(r *http.Request) ([]Trace, bool, error) {
+	query := r.URL.Query()
+	starred, label := query.Get("starred") == "true", query.Get("label")
+	if !starred && label == "" && query.Get("annotated") != "true" {
+		return nil, false, nil
+	}
+	all, err := traceSink.Annotated()
+	if err != nil {
+		return nil, true, err
+	}
+	list := []Trace{}
+	for _, trace := range all {
+		if starred && !trace.Starred {
+			continue
+		}
+		if label != "" && !containsString(trace.Labels, label) {
+			continue
+		}
+		list = append(list, trace)
+	}
+	return list, true, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
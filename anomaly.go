@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// anomalyBaselineHours is how many hours of history a key needs before its
+	// request rate is judged
+	anomalyBaselineHours = 3
+	// anomalyMinRequests keeps quiet keys from being flagged for a handful of calls
+	anomalyMinRequests = 20
+	// anomalyMinSamples is how many responses a key needs before tokens/request is judged
+	anomalyMinSamples = 20
+	// anomalyAlpha is the weight of the newest observation in the baselines
+	anomalyAlpha = 0.2
+	anomaliesMax = 500
+)
+
+// keyBaseline is the learned normal usage of one client key
+type keyBaseline struct {
+	hour          time.Time // start of the hour being counted
+	hourRequests  int
+	hoursSeen     int
+	requestsPerHr float64 // EWMA of completed hours
+	tokensPerReq  float64 // EWMA
+	samples       int
+	throttleUntil time.Time
+	lastAlert     map[string]time.Time // per anomaly kind
+}
+
+// anomaly is a detected deviation from a key's baseline
+type anomaly struct {
+	Key       string    `json:"key"`
+	Kind      string    `json:"kind"` // request_rate or tokens_per_request
+	Value     float64   `json:"value"`
+	Baseline  float64   `json:"baseline"`
+	Action    string    `json:"action"` // flag or throttle
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// anomalyDetector flags keys whose usage suddenly jumps well above their own
+// baseline, which usually means a leaked key
+type anomalyDetector struct {
+	factor   float64
+	throttle time.Duration // 0 only flags
+
+	mu        sync.Mutex
+	keys      map[string]*keyBaseline
+	anomalies []anomaly
+}
+
+// usageAnomalies is nil unless -anomaly-detection is set
+var usageAnomalies *anomalyDetector
+
+func newAnomalyDetector(factor float64, throttle time.Duration) *anomalyDetector {
+	return &anomalyDetector{factor: factor, throttle: throttle, keys: make(map[string]*keyBaseline)}
+}
+
+func (d *anomalyDetector) baseline(keyID string, now time.Time) *keyBaseline {
+	b, ok := d.keys[keyID]
+	if !ok {
+		b = &keyBaseline{hour: now.Truncate(time.Hour), lastAlert: make(map[string]time.Time)}
+		d.keys[keyID] = b
+	}
+	// Fold finished hours, including idle ones, into the rate baseline
+	for hour := now.Truncate(time.Hour); b.hour.Before(hour); b.hour = b.hour.Add(time.Hour) {
+		if b.hoursSeen == 0 {
+			b.requestsPerHr = float64(b.hourRequests)
+		} else {
+			b.requestsPerHr += anomalyAlpha * (float64(b.hourRequests) - b.requestsPerHr)
+		}
+		b.hoursSeen++
+		b.hourRequests = 0
+		if hour.Sub(b.hour) > 24*time.Hour {
+			// Skip long idle periods instead of decaying the baseline to zero, which
+			// would flag the key's normal traffic when it comes back
+			b.hour = hour.Add(-time.Hour)
+		}
+	}
+	return b
+}
+
+// record stores an anomaly, throttles the key if configured and alerts at most once
+// an hour per key and kind. Called with d.mu held.
+func (d *anomalyDetector) record(b *keyBaseline, a anomaly) {
+	a.Action = "flag"
+	if d.throttle > 0 {
+		a.Action = "throttle"
+		b.throttleUntil = a.Timestamp.Add(d.throttle)
+	}
+	if last, ok := b.lastAlert[a.Kind]; ok && a.Timestamp.Sub(last) < time.Hour {
+		return
+	}
+	b.lastAlert[a.Kind] = a.Timestamp
+
+	d.anomalies = append(d.anomalies, a)
+	if len(d.anomalies) > anomaliesMax {
+		d.anomalies = d.anomalies[len(d.anomalies)-anomaliesMax:]
+	}
+	metrics.Add("openai_proxy_usage_anomalies_total", "Key usage anomalies detected.", map[string]string{"kind": a.Kind}, 1)
+	message := fmt.Sprintf("key %s: %s is %.0f, baseline %.1f (action: %s)", a.Key, a.Kind, a.Value, a.Baseline, a.Action)
+	log.Printf("🚨 Usage anomaly: %s", message)
+	sendAlert(alert{Kind: "usage_anomaly", Key: a.Key, Message: message, Timestamp: a.Timestamp})
+}
+
+// ObserveRequest counts a request and reports how long the key remains throttled
+func (d *anomalyDetector) ObserveRequest(keyID string) time.Duration {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	b := d.baseline(keyID, now)
+	if now.Before(b.throttleUntil) {
+		return b.throttleUntil.Sub(now)
+	}
+	b.hourRequests++
+	if b.hoursSeen >= anomalyBaselineHours && b.hourRequests >= anomalyMinRequests &&
+		float64(b.hourRequests) > d.factor*math.Max(b.requestsPerHr, 1) {
+		d.record(b, anomaly{Key: keyID, Kind: "request_rate", Value: float64(b.hourRequests), Baseline: b.requestsPerHr, Timestamp: now})
+	}
+	return 0
+}
+
+// throttledFor reports how long the key remains throttled, without counting a request
+func (d *anomalyDetector) throttledFor(keyID string) time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if b, ok := d.keys[keyID]; ok {
+		return max(time.Until(b.throttleUntil), 0)
+	}
+	return 0
+}
+
+// ObserveTokens updates the tokens/request baseline with a completed response
+func (d *anomalyDetector) ObserveTokens(keyID string, tokens int) {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	b := d.baseline(keyID, now)
+	if b.samples >= anomalyMinSamples && float64(tokens) > d.factor*math.Max(b.tokensPerReq, 1) {
+		d.record(b, anomaly{Key: keyID, Kind: "tokens_per_request", Value: float64(tokens), Baseline: b.tokensPerReq, Timestamp: now})
+		// Keep outliers out of the baseline so a leak doesn't become the new normal
+		return
+	}
+	if b.samples == 0 {
+		b.tokensPerReq = float64(tokens)
+	} else {
+		b.tokensPerReq += anomalyAlpha * (float64(tokens) - b.tokensPerReq)
+	}
+	b.samples++
+}
+
+// Anomalies returns the detected anomalies, oldest first
+func (d *anomalyDetector) Anomalies() []anomaly {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]anomaly{}, d.anomalies...)
+}
+
+// checkUsageAnomalies counts the request towards the key's baseline and rejects it
+// with a 429 while the key is throttled
+func checkUsageAnomalies(w http.ResponseWriter, keyID string) bool {
+	if usageAnomalies == nil {
+		return true
+	}
+	if wait := usageAnomalies.ObserveRequest(keyID); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeJSONError(w, http.StatusTooManyRequests, "proxy_key_throttled", "This key is temporarily throttled because its usage deviates sharply from its baseline")
+		return false
+	}
+	return true
+}
+
+// handleAnomalies lists detected usage anomalies on the admin server
+func handleAnomalies(w http.ResponseWriter, r *http.Request) {
+	if usageAnomalies == nil {
+		writeJSONError(w, http.StatusNotFound, "not_found", "anomaly detection is not enabled")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usageAnomalies.Anomalies())
+}
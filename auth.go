@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authenticator is one scheme of an authentication chain. Authenticate returns
+// the caller a request proves to be, errNoCredentials when the request carries
+// none of the scheme's credentials so the next scheme is tried, or an *authError
+// when its credentials are invalid.
+type authenticator interface {
+	Name() string
+	Authenticate(r *http.Request) (*principal, error)
+}
+
+// errNoCredentials passes a request on to the next scheme of the chain
+var errNoCredentials = errors.New("no credentials for this scheme")
+
+// authError rejects a request with an OpenAI-style error
+type authError struct {
+	status  int
+	errType string
+	message string
+}
+
+func (e *authError) Error() string { return e.message }
+
+func invalidCredentials(format string, args ...interface{}) *authError {
+	return &authError{status: http.StatusUnauthorized, errType: "invalid_api_key", message: fmt.Sprintf(format, args...)}
+}
+
+// principal is the caller an authenticator accepted
+type principal struct {
+	Scheme string
+	KeyID  string      // identifies the caller for limits, budgets, jobs and traces
+	Key    *virtualKey // the virtual key, for the vkey scheme
+	// authorize checks what the caller may do and returns the Authorization to
+	// send upstream instead of the client's, or "" to forward the client's; nil
+	// forwards the request as it came
+	authorize func(w http.ResponseWriter, r *http.Request) (string, bool)
+	// upstreamAuth is the credential Authorize picked. It is only ever set on the
+	// requests sent upstream, so traces keep the client's own credential.
+	upstreamAuth string
+}
+
+// Authorize prepares an authenticated request for the upstream. It returns false
+// if the request was rejected.
+func (p *principal) Authorize(w http.ResponseWriter, r *http.Request) bool {
+	if p.authorize == nil {
+		return true
+	}
+	auth, ok := p.authorize(w, r)
+	p.upstreamAuth = auth
+	return ok
+}
+
+// setUpstreamCredentials puts the credential picked by Authorize on a request
+// about to be sent upstream
+func (p *principal) setUpstreamCredentials(header http.Header) {
+	if p.upstreamAuth != "" {
+		header.Set("Authorization", p.upstreamAuth)
+	}
+}
+
+// upstreamHeader returns a copy of header with the upstream credential
+func (p *principal) upstreamHeader(header http.Header) http.Header {
+	upstream := header.Clone()
+	p.setUpstreamCredentials(upstream)
+	return upstream
+}
+
+// authSchemes builds the authenticators a chain can name
+var authSchemes = map[string]func() (authenticator, error){
+	"vkey":        func() (authenticator, error) { return vkeyAuth{}, nil },
+	"passthrough": func() (authenticator, error) { return passthroughAuth{}, nil },
+	"token":       newTokenAuth,
+	"hmac":        newHMACAuth,
+	"jwt":         newJWTAuth,
+}
+
+// parseAuthChain builds a comma-separated chain of schemes. Schemes are built once
+// and shared between the chains that name them.
+func parseAuthChain(spec string, built map[string]authenticator) ([]authenticator, error) {
+	var chain []authenticator
+	for _, name := range strings.Split(spec, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if a, ok := built[name]; ok {
+			chain = append(chain, a)
+			continue
+		}
+		build, ok := authSchemes[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown authentication scheme %q: expected vkey, token, hmac, jwt or passthrough", name)
+		}
+		a, err := build()
+		if err != nil {
+			return nil, err
+		}
+		built[name] = a
+		chain = append(chain, a)
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("empty authentication chain %q", spec)
+	}
+	return chain, nil
+}
+
+// defaultAuthChain is -auth; listenerAuthChains holds the -listener-auth chains by
+// listen address or systemd socket name
+var (
+	defaultAuthChain   []authenticator
+	listenerAuthChains map[string][]authenticator
+)
+
+// configureAuth parses -auth and -listener-auth
+func configureAuth() error {
+	built := make(map[string]authenticator)
+	chain, err := parseAuthChain(*authChainSpec, built)
+	if err != nil {
+		return fmt.Errorf("invalid -auth: %v", err)
+	}
+	defaultAuthChain = chain
+	listenerAuthChains = make(map[string][]authenticator)
+	for _, entry := range strings.Split(*listenerAuthSpec, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, spec, ok := strings.Cut(entry, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("invalid -listener-auth entry %q: expected address=schemes", entry)
+		}
+		chain, err := parseAuthChain(spec, built)
+		if err != nil {
+			return fmt.Errorf("invalid -listener-auth entry %q: %v", entry, err)
+		}
+		listenerAuthChains[normalizeListenerName(name)] = chain
+	}
+	return nil
+}
+
+// normalizeListenerName lets -listener-auth name an address as -host does, with
+// or without brackets around IPv6 hosts
+func normalizeListenerName(name string) string {
+	if host, port, err := net.SplitHostPort(name); err == nil {
+		return net.JoinHostPort(host, port)
+	}
+	return name
+}
+
+// authChainFor returns the chain of a listener, by address or socket name
+func authChainFor(name string) ([]authenticator, bool) {
+	chain, ok := listenerAuthChains[normalizeListenerName(name)]
+	if !ok {
+		return defaultAuthChain, false
+	}
+	return chain, true
+}
+
+func authChainNames(chain []authenticator) string {
+	names := make([]string, len(chain))
+	for i, a := range chain {
+		names[i] = a.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+type authChainKey struct{}
+type principalKey struct{}
+
+// withAuthChain serves a listener's requests with its authentication chain
+func withAuthChain(chain []authenticator, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authChainKey{}, chain)))
+	})
+}
+
+// withPrincipal marks a request as already authenticated, for job attempts that
+// run long after the client's credentials were checked
+func withPrincipal(ctx context.Context, p *principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// authenticate runs the request's chain and returns the first principal a scheme
+// accepts. A rejected request has been answered and false is returned.
+func authenticate(w http.ResponseWriter, r *http.Request) (*principal, bool) {
+	if p, ok := r.Context().Value(principalKey{}).(*principal); ok {
+		return p, true
+	}
+	chain, ok := r.Context().Value(authChainKey{}).([]authenticator)
+	if !ok {
+		chain = defaultAuthChain
+	}
+	for _, a := range chain {
+		p, err := a.Authenticate(r)
+		if err == errNoCredentials {
+			continue
+		}
+		if err != nil {
+			var rejected *authError
+			if !errors.As(err, &rejected) {
+				rejected = &authError{status: http.StatusInternalServerError, errType: "server_error", message: err.Error()}
+			}
+			log.Printf("🚫 %s authentication of %s failed: %v", a.Name(), r.RemoteAddr, err)
+			metrics.Add("openai_proxy_auth_failures_total", "Requests rejected by the authentication chain, by scheme.", map[string]string{"scheme": a.Name()}, 1)
+			if rejected.status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="openai-proxy"`)
+			}
+			writeJSONError(w, rejected.status, rejected.errType, rejected.message)
+			return nil, false
+		}
+		p.Scheme = a.Name()
+		return p, true
+	}
+	log.Printf("🚫 No credentials accepted by the %s chain from %s", authChainNames(chain), r.RemoteAddr)
+	metrics.Add("openai_proxy_auth_failures_total", "Requests rejected by the authentication chain, by scheme.", map[string]string{"scheme": "none"}, 1)
+	w.Header().Set("WWW-Authenticate", `Bearer realm="openai-proxy"`)
+	writeJSONError(w, http.StatusUnauthorized, "invalid_api_key", "No valid credentials were provided")
+	return nil, false
+}
+
+// verifyCredentials runs the -auth chain on r like authenticate does, without
+// answering the request or counting failures
+func verifyCredentials(r *http.Request) (*principal, *authError) {
+	for _, a := range defaultAuthChain {
+		p, err := a.Authenticate(r)
+		if err == errNoCredentials {
+			continue
+		}
+		if err != nil {
+			var rejected *authError
+			if !errors.As(err, &rejected) {
+				rejected = &authError{status: http.StatusInternalServerError, errType: "server_error", message: err.Error()}
+			}
+			return nil, rejected
+		}
+		p.Scheme = a.Name()
+		return p, nil
+	}
+	return nil, &authError{status: http.StatusUnauthorized, errType: "invalid_api_key", message: "No valid credentials were provided"}
+}
+
+// passthroughAuth accepts every request and forwards its credentials unchanged
+type passthroughAuth struct{}
+
+func (passthroughAuth) Name() string { return "passthrough" }
+
+func (passthroughAuth) Authenticate(r *http.Request) (*principal, error) {
+	return &principal{KeyID: clientKeyID(r)}, nil
+}
+
+// vkeyAuth accepts virtual keys, by token or mapped client certificate
+type vkeyAuth struct{}
+
+func (vkeyAuth) Name() string { return "vkey" }
+
+func (vkeyAuth) Authenticate(r *http.Request) (*principal, error) {
+	vk, ok := lookupVirtualKey(r)
+	if ok {
+		return &principal{KeyID: "vkey-" + vk.Name, Key: vk, authorize: func(w http.ResponseWriter, r *http.Request) (string, bool) {
+			return authorizeVirtualKey(w, r, vk)
+		}}, nil
+	}
+	if clientCAs != nil && *clientCertMode == "mapped" {
+		log.Printf("🚫 Client certificate %s of %s is not mapped to a virtual key", strings.TrimPrefix(clientCertID(r), "cert-"), r.RemoteAddr)
+		metrics.Add("openai_proxy_client_cert_denied_total", "Requests rejected because their client certificate maps to no virtual key.", nil, 1)
+		return nil, &authError{status: http.StatusForbidden, errType: "unmapped_client_certificate", message: "The client certificate is not mapped to a key"}
+	}
+	return nil, errNoCredentials
+}
+
+// useUpstreamKey replaces the client's proxy credentials with -upstream-key-secret
+func useUpstreamKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	key, ok := lookupSecret(*upstreamKeySecret)
+	if *upstreamKeySecret == "" || !ok {
+		log.Printf("❌ Secret %q for the upstream key is not set", *upstreamKeySecret)
+		writeJSONError(w, http.StatusInternalServerError, "server_error", "The proxy has no upstream credentials for this client")
+		return "", false
+	}
+	return "Bearer " + key, true
+}
+
+// parseCredentialPairs parses comma-separated name:value pairs
+func parseCredentialPairs(flagName, spec string) (map[string]string, error) {
+	pairs := make(map[string]string)
+	for _, entry := range strings.Split(spec, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, ":")
+		if !ok || name == "" || value == "" {
+			return nil, fmt.Errorf("invalid %s entry: expected name:value", flagName)
+		}
+		pairs[name] = value
+	}
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("%s is required by its authentication scheme", flagName)
+	}
+	return pairs, nil
+}
+
+// tokenAuth accepts the static bearer tokens of -auth-tokens
+type tokenAuth struct {
+	tokens map[string]string // name -> token
+}
+
+func newTokenAuth() (authenticator, error) {
+	tokens, err := parseCredentialPairs("-auth-tokens", *authTokens)
+	if err != nil {
+		return nil, err
+	}
+	return &tokenAuth{tokens: tokens}, nil
+}
+
+func (a *tokenAuth) Name() string { return "token" }
+
+func (a *tokenAuth) Authenticate(r *http.Request) (*principal, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return nil, errNoCredentials
+	}
+	for name, expected := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1 {
+			return &principal{KeyID: "token-" + name, authorize: useUpstreamKey}, nil
+		}
+	}
+	return nil, errNoCredentials
+}
+
+// hmacSignatureHeader carries an HMAC request signature:
+// keyId=<id>,t=<unix seconds>,sig=<hex HMAC-SHA256>
+const hmacSignatureHeader = "X-Proxy-Signature"
+
+// hmacMaxSkew bounds how old a signature may be, and how long it is remembered to
+// refuse replays
+const hmacMaxSkew = 5 * time.Minute
+
+// hmacAuth accepts requests signed with a -auth-hmac-keys secret
+type hmacAuth struct {
+	keys map[string]string // key ID -> secret
+
+	mu   sync.Mutex
+	seen map[string]time.Time // signatures within hmacMaxSkew
+}
+
+func newHMACAuth() (authenticator, error) {
+	keys, err := parseCredentialPairs("-auth-hmac-keys", *authHMACKeys)
+	if err != nil {
+		return nil, err
+	}
+	return &hmacAuth{keys: keys, seen: make(map[string]time.Time)}, nil
+}
+
+func (a *hmacAuth) Name() string { return "hmac" }
+
+// hmacSignature signs the timestamp, method, path with query and body digest
+func hmacSignature(secret, timestamp, method, target string, body []byte) string {
+	digest := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "\n" + method + "\n" + target + "\n" + hex.EncodeToString(digest[:])))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (a *hmacAuth) Authenticate(r *http.Request) (*principal, error) {
+	header := r.Header.Get(hmacSignatureHeader)
+	if header == "" {
+		return nil, errNoCredentials
+	}
+	fields := make(map[string]string)
+	for _, part := range strings.Split(header, ",") {
+		if name, value, ok := strings.Cut(strings.TrimSpace(part), "="); ok {
+			fields[name] = value
+		}
+	}
+	secret, ok := a.keys[fields["keyId"]]
+	if !ok {
+		return nil, invalidCredentials("Unknown signing key %q", fields["keyId"])
+	}
+	seconds, err := strconv.ParseInt(fields["t"], 10, 64)
+	if err != nil {
+		return nil, invalidCredentials("The signature has no valid timestamp")
+	}
+	if skew := time.Since(time.Unix(seconds, 0)); skew > hmacMaxSkew || skew < -hmacMaxSkew {
+		return nil, invalidCredentials("The signature timestamp is more than %v off", hmacMaxSkew)
+	}
+	// The body is read to be signed and replaced for the forwarder
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %v", err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	expected := hmacSignature(secret, fields["t"], r.Method, r.URL.RequestURI(), body)
+	if !hmac.Equal([]byte(fields["sig"]), []byte(expected)) {
+		return nil, invalidCredentials("The request signature does not match")
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for sig, at := range a.seen {
+		if now.Sub(at) > 2*hmacMaxSkew {
+			delete(a.seen, sig)
+		}
+	}
+	if _, replayed := a.seen[expected]; replayed {
+		return nil, invalidCredentials("The request signature was already used")
+	}
+	a.seen[expected] = now
+	return &principal{KeyID: "hmac-" + fields["keyId"], authorize: func(w http.ResponseWriter, r *http.Request) (string, bool) {
+		r.Header.Del(hmacSignatureHeader)
+		if *upstreamKeySecret == "" {
+			return "", true // the client's own Authorization goes upstream
+		}
+		return useUpstreamKey(w, r)
+	}}, nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwtLeeway tolerates clock skew when checking exp and nbf
+const jwtLeeway = time.Minute
+
+// jwtAuth validates OIDC bearer tokens: signed by a key of the issuer's JWKS, with
+// the configured issuer and audience, and not expired
+type jwtAuth struct {
+	issuer   string
+	audience string
+	jwksURL  string
+	subject  string // claim that identifies the caller
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey // by kid
+	fetchedAt time.Time
+	fetchErr  error
+}
+
+func newJWTAuth() (authenticator, error) {
+	if *authJWTIssuer == "" {
+		return nil, fmt.Errorf("-auth-jwt-issuer is required by the jwt authentication scheme")
+	}
+	return &jwtAuth{
+		issuer:   strings.TrimSuffix(*authJWTIssuer, "/"),
+		audience: *authJWTAudience,
+		jwksURL:  *authJWTJWKSURL,
+		subject:  *authJWTSubjectClaim,
+	}, nil
+}
+
+func (a *jwtAuth) Name() string { return "jwt" }
+
+// jwtHeader is the protected header of a JWS
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+func (a *jwtAuth) Authenticate(r *http.Request) (*principal, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errNoCredentials
+	}
+	var header jwtHeader
+	if decodeSegment(parts[0], &header) != nil || header.Alg == "" {
+		return nil, errNoCredentials // a bearer token of another scheme
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, invalidCredentials("The token signature is not base64url")
+	}
+	key, err := a.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWS(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, invalidCredentials("The token signature is invalid: %v", err)
+	}
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, invalidCredentials("The token claims are not JSON")
+	}
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != a.issuer {
+		return nil, invalidCredentials("The token was issued by %q, not %q", iss, a.issuer)
+	}
+	if a.audience != "" && !audienceContains(claims["aud"], a.audience) {
+		return nil, invalidCredentials("The token is not meant for audience %q", a.audience)
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, invalidCredentials("The token has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, invalidCredentials("The token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, invalidCredentials("The token is not valid yet")
+	}
+	subject, _ := claims[a.subject].(string)
+	if subject == "" {
+		return nil, invalidCredentials("The token has no %q claim", a.subject)
+	}
+	return &principal{KeyID: "jwt-" + subject, authorize: useUpstreamKey}, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// audienceContains checks the aud claim, a string or a list of strings
+func audienceContains(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyJWS checks a JWS signature with the RSA, ECDSA or Ed25519 public key
+func verifyJWS(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	if len(alg) < 3 {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	var hash crypto.Hash
+	switch alg[len(alg)-3:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+	var digest []byte
+	if hash != 0 {
+		h := hash.New()
+		h.Write([]byte(signed))
+		digest = h.Sum(nil)
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch {
+		case strings.HasPrefix(alg, "RS") && hash != 0:
+			return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+		case strings.HasPrefix(alg, "PS") && hash != 0:
+			return rsa.VerifyPSS(key, hash, digest, signature, nil)
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if strings.HasPrefix(alg, "ES") && hash != 0 && len(signature) == 2*size {
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if ecdsa.Verify(key, digest, r, s) {
+				return nil
+			}
+			return fmt.Errorf("ECDSA verification failed")
+		}
+	case ed25519.PublicKey:
+		if alg == "EdDSA" {
+			if ed25519.Verify(key, []byte(signed), signature) {
+				return nil
+			}
+			return fmt.Errorf("Ed25519 verification failed")
+		}
+	}
+	return fmt.Errorf("algorithm %q does not match the signing key", alg)
+}
+
+// key returns the issuer's signing key with the kid. The JWKS is fetched on first
+// use and again, at most once a minute, when it lacks the kid, so rotated keys are
+// picked up.
+func (a *jwtAuth) key(kid string) (crypto.PublicKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(a.fetchedAt) < time.Minute {
+		if a.fetchErr != nil {
+			return nil, a.fetchErr
+		}
+		return nil, invalidCredentials("The token was signed by unknown key %q", kid)
+	}
+	a.fetchedAt = time.Now()
+	keys, err := a.fetchKeys()
+	if err != nil {
+		a.fetchErr = fmt.Errorf("failed to load the signing keys of %s: %v", a.issuer, err)
+		return nil, a.fetchErr
+	}
+	a.keys, a.fetchErr = keys, nil
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, invalidCredentials("The token was signed by unknown key %q", kid)
+}
+
+// jsonWebKey is a public key of a JWKS
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetchKeys reads the issuer's JWKS, found through OIDC discovery unless
+// -auth-jwt-jwks-url is set
+func (a *jwtAuth) fetchKeys() (map[string]crypto.PublicKey, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	getJSON := func(url string, v interface{}) error {
+		resp, err := client.Get(url)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("GET %s answered %s", url, resp.Status)
+		}
+		return json.NewDecoder(resp.Body).Decode(v)
+	}
+	jwksURL := a.jwksURL
+	if jwksURL == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := getJSON(a.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, err
+		}
+		if discovery.JWKSURI == "" {
+			return nil, fmt.Errorf("the OIDC discovery document has no jwks_uri")
+		}
+		jwksURL = discovery.JWKSURI
+	}
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(jwksURL, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) *big.Int {
+		b, _ := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(b)
+	}
+	switch k.Kty {
+	case "RSA":
+		return &rsa.PublicKey{N: decode(k.N), E: int(decode(k.E).Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: decode(k.X), Y: decode(k.Y)}, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("unsupported OKP key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
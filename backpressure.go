@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// admissionQueue bounds concurrent upstream requests. Requests beyond the limit
+// wait in a bounded queue; when the queue is full, or a request has waited too
+// long, it is rejected instead of piling up until clients time out.
+type admissionQueue struct {
+	slots        chan struct{}
+	maxQueue     int
+	queueTimeout time.Duration
+
+	mu         sync.Mutex
+	queued     int
+	avgLatency float64 // exponentially weighted, in seconds
+}
+
+// overloadError describes why a request was not admitted
+type overloadError struct {
+	Reason              string  `json:"reason"`
+	QueueDepth          int     `json:"queue_depth"`
+	MaxQueue            int     `json:"max_queue"`
+	InFlight            int     `json:"in_flight"`
+	MaxConcurrency      int     `json:"max_concurrency"`
+	ExpectedWaitSeconds float64 `json:"expected_wait_seconds"`
+}
+
+func newAdmissionQueue(maxConcurrency, maxQueue int, queueTimeout time.Duration) *admissionQueue {
+	q := &admissionQueue{
+		slots:        make(chan struct{}, maxConcurrency),
+		maxQueue:     maxQueue,
+		queueTimeout: queueTimeout,
+		avgLatency:   1,
+	}
+	q.updateGauges()
+	return q
+}
+
+// expectedWait estimates how long a request joining the queue now would wait
+func (q *admissionQueue) expectedWait(queued int) float64 {
+	return float64(queued+1) * q.avgLatency / float64(cap(q.slots))
+}
+
+func (q *admissionQueue) status(reason string) *overloadError {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return &overloadError{
+		Reason:              reason,
+		QueueDepth:          q.queued,
+		MaxQueue:            q.maxQueue,
+		InFlight:            len(q.slots),
+		MaxConcurrency:      cap(q.slots),
+		ExpectedWaitSeconds: math.Round(q.expectedWait(q.queued)*100) / 100,
+	}
+}
+
+func (q *admissionQueue) updateGauges() {
+	inFlight := float64(len(q.slots))
+	metrics.Set("openai_proxy_inflight_requests", "Requests currently being forwarded upstream.", nil, inFlight)
+	metrics.Set("openai_proxy_queue_depth", "Requests waiting for a concurrency slot.", nil, float64(q.queued))
+	metrics.Set("openai_proxy_saturation", "In-flight requests as a fraction of -max-concurrency.", nil, inFlight/float64(cap(q.slots)))
+}
+
+// Acquire waits for a concurrency slot. On success it returns a release function to
+// call once the request is done; otherwise it returns why the request was refused.
+func (q *admissionQueue) Acquire(ctx context.Context) (func(), *overloadError) {
+	select {
+	case q.slots <- struct{}{}:
+		return q.releaser(), nil
+	default:
+	}
+
+	q.mu.Lock()
+	if q.queued >= q.maxQueue {
+		q.mu.Unlock()
+		return nil, q.status("queue_full")
+	}
+	q.queued++
+	q.updateGauges()
+	q.mu.Unlock()
+
+	dequeue := func() {
+		q.mu.Lock()
+		q.queued--
+		q.updateGauges()
+		q.mu.Unlock()
+	}
+
+	timer := time.NewTimer(q.queueTimeout)
+	defer timer.Stop()
+	select {
+	case q.slots <- struct{}{}:
+		dequeue()
+		return q.releaser(), nil
+	case <-timer.C:
+		dequeue()
+		return nil, q.status("queue_timeout")
+	case <-ctx.Done():
+		dequeue()
+		return nil, q.status("client_gone")
+	}
+}
+
+func (q *admissionQueue) releaser() func() {
+	started := time.Now()
+	q.mu.Lock()
+	q.updateGauges()
+	q.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-q.slots
+			q.mu.Lock()
+			q.avgLatency = 0.8*q.avgLatency + 0.2*time.Since(started).Seconds()
+			q.updateGauges()
+			q.mu.Unlock()
+		})
+	}
+}
+
+// writeOverloaded replies 503 with Retry-After and a description of the saturation
+func writeOverloaded(w http.ResponseWriter, overload *overloadError) {
+	metrics.Add("openai_proxy_rejected_requests_total", "Requests rejected because the proxy was saturated.", map[string]string{"reason": overload.Reason}, 1)
+
+	retryAfter := int(math.Max(1, math.Ceil(overload.ExpectedWaitSeconds)))
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": "Proxy is saturated, retry after the time given in Retry-After",
+			"type":    "proxy_overloaded",
+			"details": overload,
+		},
+	})
+}
+
+var upstreamAdmission *admissionQueue
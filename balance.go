@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// healthSmoothing is the weight of each new outcome in an upstream's health score
+const healthSmoothing = 0.2
+
+// minHealth is the score below which an upstream gets no traffic while any other
+// upstream is healthier
+const minHealth = 0.25
+
+// poolMember is one upstream of the load balancing pool
+type poolMember struct {
+	base   *url.URL
+	weight float64
+
+	mu         sync.Mutex
+	health     float64       // smoothed success rate of probes and requests, 0 to 1
+	latency    time.Duration // smoothed probe latency
+	lastProbe  time.Time
+	lastStatus string
+}
+
+// target returns the member's URL for path
+func (m *poolMember) target(path, rawQuery string) *url.URL {
+	return &url.URL{
+		Scheme:   m.base.Scheme,
+		Host:     m.base.Host,
+		Path:     m.base.Path + path,
+		RawQuery: rawQuery,
+	}
+}
+
+// observe folds one outcome into the member's health score
+func (m *poolMember) observe(ok bool, latency time.Duration, probe bool) {
+	sample := 0.0
+	if ok {
+		sample = 1
+	}
+	m.mu.Lock()
+	m.health += healthSmoothing * (sample - m.health)
+	if probe && ok {
+		if m.latency == 0 {
+			m.latency = latency
+		} else {
+			m.latency += time.Duration(healthSmoothing * float64(latency-m.latency))
+		}
+	}
+	health := m.health
+	m.mu.Unlock()
+	metrics.Set("openai_proxy_upstream_health", "Health score of each load balanced upstream, from 0 to 1.", map[string]string{"upstream": m.base.Host}, health)
+}
+
+// upstreamBalancer spreads requests over several upstreams in proportion to their
+// weight and health, probing each one in the background
+type upstreamBalancer struct {
+	members   []*poolMember
+	probePath string
+}
+
+// upstreamPool is nil unless -upstream-pool is set
+var upstreamPool *upstreamBalancer
+
+// parseUpstreamPool reads -upstream-pool, e.g. "https://eu.example.com=3,https://us.example.com"
+func parseUpstreamPool(spec string) (*upstreamBalancer, error) {
+	balancer := &upstreamBalancer{probePath: *upstreamProbePath}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		weight := 1.0
+		if i := strings.LastIndex(entry, "="); i > 0 {
+			parsed, err := strconv.ParseFloat(entry[i+1:], 64)
+			if err != nil || parsed <= 0 {
+				return nil, fmt.Errorf("invalid -upstream-pool entry %q: weight must be a positive number", entry)
+			}
+			entry, weight = entry[:i], parsed
+		}
+		base, err := url.Parse(entry)
+		if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+			return nil, fmt.Errorf("invalid -upstream-pool entry %q: expected an http(s) base URL", entry)
+		}
+		base.Path = strings.TrimSuffix(base.Path, "/")
+		balancer.members = append(balancer.members, &poolMember{base: base, weight: weight, health: 1})
+	}
+	if len(balancer.members) == 0 {
+		return nil, nil
+	}
+	return balancer, nil
+}
+
+// effectiveWeights returns each member's share of traffic: its weight scaled by the
+// square of its health, so a flaky upstream loses traffic quickly, and by how much
+// slower than the fastest member its probes answer
+func (b *upstreamBalancer) effectiveWeights() []float64 {
+	var fastest time.Duration
+	for _, m := range b.members {
+		m.mu.Lock()
+		if m.latency > 0 && (fastest == 0 || m.latency < fastest) {
+			fastest = m.latency
+		}
+		m.mu.Unlock()
+	}
+	weights := make([]float64, len(b.members))
+	best, bestHealth := 0, -1.0
+	anyHealthy := false
+	for i, m := range b.members {
+		m.mu.Lock()
+		health, latency := m.health, m.latency
+		m.mu.Unlock()
+		if health > bestHealth {
+			best, bestHealth = i, health
+		}
+		if health < minHealth {
+			continue
+		}
+		anyHealthy = true
+		weights[i] = m.weight * health * health
+		if fastest > 0 && latency > fastest {
+			weights[i] *= float64(fastest) / float64(latency)
+		}
+	}
+	if !anyHealthy {
+		// Everything looks down; keep trying the least bad upstream
+		weights[best] = 1
+	}
+	return weights
+}
+
+// Pick chooses the upstream for one request
+func (b *upstreamBalancer) Pick() *poolMember {
+	weights := b.effectiveWeights()
+	total := 0.0
+	for _, weight := range weights {
+		total += weight
+	}
+	n := rand.Float64() * total
+	for i, weight := range weights {
+		if n < weight {
+			return b.members[i]
+		}
+		n -= weight
+	}
+	return b.members[len(b.members)-1]
+}
+
+// Observe records the outcome of a request sent to host, if it is a pool member
+func (b *upstreamBalancer) Observe(host string, failed bool) {
+	if b == nil {
+		return
+	}
+	for _, m := range b.members {
+		if m.base.Host == host {
+			m.observe(!failed, 0, false)
+			return
+		}
+	}
+}
+
+// probe sends one health check to a member. Any answer below 500, including an
+// authentication error, shows the upstream is up.
+func (b *upstreamBalancer) probe(m *poolMember) {
+	start := time.Now()
+	ok, status := false, ""
+	client := &http.Client{Timeout: *upstreamProbeTimeout, Transport: pinnedHostTransport{}}
+	resp, err := client.Get(m.target(b.probePath, "").String())
+	if err != nil {
+		status = err.Error()
+	} else {
+		resp.Body.Close()
+		ok, status = resp.StatusCode < 500, resp.Status
+	}
+	m.observe(ok, time.Since(start), true)
+	m.mu.Lock()
+	m.lastProbe, m.lastStatus = time.Now(), status
+	m.mu.Unlock()
+	if !ok {
+		log.Printf("🩺 Probe of %s failed: %s", m.base.Host, status)
+	}
+}
+
+// startProbing probes every member at each interval until the process exits
+func (b *upstreamBalancer) startProbing(interval time.Duration) {
+	go func() {
+		for {
+			for _, m := range b.members {
+				go b.probe(m)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+type poolMemberStatus struct {
+	Upstream     string  `json:"upstream"`
+	Weight       float64 `json:"weight"`
+	Health       float64 `json:"health"`
+	LatencyMs    float64 `json:"probe_latency_ms"`
+	Share        float64 `json:"traffic_share"`
+	LastProbe    string  `json:"last_probe,omitempty"`
+	LastResponse string  `json:"last_probe_response,omitempty"`
+}
+
+// handleUpstreams serves GET /upstreams with the health and traffic share of each
+// member of the pool
+func handleUpstreams(w http.ResponseWriter, r *http.Request) {
+	if upstreamPool == nil {
+		writeJSONError(w, http.StatusNotFound, "not_found", "no upstream pool is configured")
+		return
+	}
+	weights := upstreamPool.effectiveWeights()
+	total := 0.0
+	for _, weight := range weights {
+		total += weight
+	}
+	list := []poolMemberStatus{}
+	for i, m := range upstreamPool.members {
+		m.mu.Lock()
+		status := poolMemberStatus{
+			Upstream:     m.base.String(),
+			Weight:       m.weight,
+			Health:       m.health,
+			LatencyMs:    float64(m.latency) / float64(time.Millisecond),
+			LastResponse: m.lastStatus,
+		}
+		if !m.lastProbe.IsZero() {
+			status.LastProbe = m.lastProbe.Format(time.RFC3339)
+		}
+		m.mu.Unlock()
+		if total > 0 {
+			status.Share = weights[i] / total
+		}
+		list = append(list, status)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
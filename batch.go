@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// batchEndpoints are the endpoints the upstream Batch API accepts; scheduled jobs
+// for other paths run on the job workers when their window opens
+var batchEndpoints = []string{"/v1/chat/completions", "/v1/completions", "/v1/embeddings", "/v1/responses"}
+
+// batchWindows holds the -batch-schedule times as minutes after local midnight
+var batchWindows []int
+
+const (
+	// batchMaxPollErrors is how many checks of a batch may fail in a row
+	batchMaxPollErrors = 10
+	// batchPollDeadline bounds how long a batch is waited for, past its 24 hour
+	// completion window
+	batchPollDeadline = 25 * time.Hour
+)
+
+// parseBatchSchedule parses -batch-schedule, e.g. "02:00,14:30"
+func parseBatchSchedule(spec string) ([]int, error) {
+	var windows []int
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		t, err := time.Parse("15:04", entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -batch-schedule entry %q: expected HH:MM", entry)
+		}
+		windows = append(windows, t.Hour()*60+t.Minute())
+	}
+	return windows, nil
+}
+
+// nextBatchWindow returns the first batch window after now
+func nextBatchWindow(now time.Time) time.Time {
+	var next time.Time
+	for _, minutes := range batchWindows {
+		at := time.Date(now.Year(), now.Month(), now.Day(), 0, minutes, 0, 0, now.Location())
+		if !at.After(now) {
+			at = time.Date(now.Year(), now.Month(), now.Day()+1, 0, minutes, 0, 0, now.Location())
+		}
+		if next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	return next
+}
+
+// schedule holds a job until the next batch window, up to -batch-max-scheduled jobs
+func (s *jobStore) schedule(j *job) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.deferred) >= *batchMaxScheduled {
+		return false
+	}
+	runAfter := nextBatchWindow(time.Now())
+	j.Status, j.RunAfter = jobScheduled, &runAfter
+	s.deferred = append(s.deferred, j)
+	return true
+}
+
+// releaseBatchWindows releases the scheduled jobs at every batch window
+func (s *jobStore) releaseBatchWindows() {
+	for {
+		time.Sleep(time.Until(nextBatchWindow(time.Now())))
+		s.mu.Lock()
+		jobs := s.deferred
+		s.deferred = nil
+		s.mu.Unlock()
+		if len(jobs) == 0 {
+			continue
+		}
+		log.Printf("🗓️ Batch window open: releasing %d jobs (mode: %s)", len(jobs), *batchMode)
+		if *batchMode == "offpeak" {
+			go s.enqueue(jobs)
+			continue
+		}
+
+		// One upstream batch per endpoint and credential, the Batch API's unit
+		groups := make(map[string][]*job)
+		var unbatched []*job
+		for _, j := range jobs {
+			if !isBatchEndpoint(j.Path) || isTransparentRoute(j.Path) || !json.Valid(j.body) {
+				unbatched = append(unbatched, j)
+				continue
+			}
+			group := j.Path + "\x00" + j.upstreamAuth
+			groups[group] = append(groups[group], j)
+		}
+		for _, group := range groups {
+			for start := 0; start < len(group); start += max(*batchMaxRequests, 1) {
+				go s.runBatch(group[start:min(start+max(*batchMaxRequests, 1), len(group))])
+			}
+		}
+		if len(unbatched) > 0 {
+			go s.enqueue(unbatched)
+		}
+	}
+}
+
+func isBatchEndpoint(path string) bool {
+	for _, endpoint := range batchEndpoints {
+		if path == endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+// enqueue hands released jobs to the job workers, waiting for queue room
+func (s *jobStore) enqueue(jobs []*job) {
+	for _, j := range jobs {
+		s.update(j, func() { j.Status = jobQueued })
+		s.queue <- j
+	}
+}
+
+// upstreamBatch is the part of an OpenAI batch object the proxy reads
+type upstreamBatch struct {
+	ID           string `json:"id"`
+	Status       string `json:"status"`
+	OutputFileID string `json:"output_file_id"`
+	ErrorFileID  string `json:"error_file_id"`
+}
+
+// batchResult is one line of a batch output or error file
+type batchResult struct {
+	CustomID string `json:"custom_id"`
+	Response *struct {
+		StatusCode int             `json:"status_code"`
+		Body       json.RawMessage `json:"body"`
+	} `json:"response"`
+	Error json.RawMessage `json:"error"`
+}
+
+// batchLineKey marks a job request the forwarder only prepares as a batch line
+type batchLineKey struct{}
+
+// batchLine is a job's request as the forwarder would send it upstream
+type batchLine struct {
+	body   []byte
+	target *url.URL
+}
+
+// prepareBatch sends each job through the forwarder up to the point it would go
+// upstream, so limits, hooks, rules and quarantine apply to batch lines as to any
+// other request. Jobs the forwarder refuses are finished with its answer. Jobs
+// that are rate limited, fail, or are routed away from -upstream are returned to
+// run on the job workers, where they are retried.
+func (s *jobStore) prepareBatch(jobs []*job) (batched, unbatched []*job) {
+	for _, j := range jobs {
+		line := &batchLine{}
+		recorder, err := s.serve(context.WithValue(context.Background(), batchLineKey{}, line), j)
+		if err != nil {
+			// Only this line fails; the rest of the batch goes ahead
+			s.update(j, func() { j.Attempts = 1 })
+			s.fail(j, err)
+			continue
+		}
+		switch {
+		case line.target != nil && line.target.String() == upstreamTarget(j.Path, "").String():
+			s.update(j, func() { j.batchBody = line.body })
+			batched = append(batched, j)
+		case line.target != nil || recorder.Code >= 500 || recorder.Code == http.StatusTooManyRequests:
+			unbatched = append(unbatched, j)
+		default:
+			s.update(j, func() { j.Attempts = 1 })
+			s.finish(j, recorder.Code, recorder.Header(), recorder.Body.Bytes())
+		}
+	}
+	return batched, unbatched
+}
+
+// runBatch sends jobs of one endpoint and credential as an upstream batch, waits
+// for it to end and finishes every job with its result. If the upstream refuses
+// the batch, the jobs run on the job workers instead.
+func (s *jobStore) runBatch(jobs []*job) {
+	jobs, unbatched := s.prepareBatch(jobs)
+	if len(unbatched) > 0 {
+		s.enqueue(unbatched)
+	}
+	if len(jobs) == 0 {
+		return
+	}
+	header := batchHeader(jobs[0])
+	batch, err := submitUpstreamBatch(header, jobs)
+	if err != nil {
+		log.Printf("❌ Failed to submit batch of %d jobs, running them individually: %v", len(jobs), err)
+		metrics.Add("openai_proxy_batches_total", "Upstream batches, by outcome.", map[string]string{"outcome": "fallback"}, 1)
+		s.enqueue(jobs)
+		return
+	}
+	log.Printf("📦 Submitted batch %s with %d jobs for %s", batch.ID, len(jobs), jobs[0].Path)
+	for _, j := range jobs {
+		s.update(j, func() { j.Status, j.BatchID, j.Attempts = jobRunning, batch.ID, 1 })
+	}
+
+	// Batches end within their 24 hour completion window; one the proxy can't check
+	// for batchMaxPollErrors polls in a row, or that outlives the window, is given up
+	submitted, pollErrors := time.Now(), 0
+	for !batchEnded(batch.Status) {
+		if pollErrors >= batchMaxPollErrors || time.Since(submitted) > batchPollDeadline {
+			log.Printf("❌ Giving up on batch %s after %v (%d failed checks in a row)", batch.ID, time.Since(submitted).Round(time.Second), pollErrors)
+			batch.Status = "lost"
+			break
+		}
+		time.Sleep(*batchPollInterval)
+		resp, body, err := forwardUpstream(http.MethodGet, upstreamTarget("/v1/batches/"+batch.ID, "").String(), header, nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			pollErrors++
+			log.Printf("⚠️ Failed to check batch %s: %v", batch.ID, batchError(resp, body, err))
+			continue
+		}
+		if err := json.Unmarshal(body, &batch); err != nil {
+			pollErrors++
+			log.Printf("⚠️ Failed to parse batch %s: %v", batch.ID, err)
+			continue
+		}
+		pollErrors = 0
+	}
+	log.Printf("📦 Batch %s %s", batch.ID, batch.Status)
+	metrics.Add("openai_proxy_batches_total", "Upstream batches, by outcome.", map[string]string{"outcome": batch.Status}, 1)
+
+	results := make(map[string]batchResult)
+	for _, fileID := range []string{batch.OutputFileID, batch.ErrorFileID} {
+		if fileID == "" {
+			continue
+		}
+		if err := readBatchResults(header, fileID, results); err != nil {
+			log.Printf("❌ Failed to read results of batch %s: %v", batch.ID, err)
+		}
+	}
+	resultHeader := http.Header{"Content-Type": {"application/json"}, "X-Proxy-Batch-Id": {batch.ID}}
+	for _, j := range jobs {
+		result, ok := results[j.ID]
+		switch {
+		case ok && result.Response != nil:
+			chargeBatchUsage(j, result.Response.Body)
+			s.finish(j, result.Response.StatusCode, resultHeader, result.Response.Body)
+		case ok && len(result.Error) > 0:
+			s.finish(j, http.StatusBadGateway, resultHeader, []byte(`{"error":`+string(result.Error)+`}`))
+		default:
+			message, _ := json.Marshal(fmt.Sprintf("batch %s ended %s without a result for this job", batch.ID, batch.Status))
+			s.finish(j, http.StatusBadGateway, resultHeader, []byte(`{"error":{"type":"batch_error","message":`+string(message)+`}}`))
+		}
+	}
+}
+
+// batchHeader is the upstream header for a job's batch: its credentials and the
+// OpenAI organization and project it was sent for
+func batchHeader(j *job) http.Header {
+	header := http.Header{}
+	if j.upstreamAuth != "" {
+		header.Set("Authorization", j.upstreamAuth)
+	}
+	for _, name := range []string{"OpenAI-Organization", "OpenAI-Project"} {
+		if value := j.header.Get(name); value != "" {
+			header.Set(name, value)
+		}
+	}
+	return header
+}
+
+// submitUpstreamBatch uploads the jobs as a JSONL input file and creates the batch
+func submitUpstreamBatch(header http.Header, jobs []*job) (upstreamBatch, error) {
+	var input bytes.Buffer
+	for _, j := range jobs {
+		line, err := json.Marshal(map[string]interface{}{
+			"custom_id": j.ID,
+			"method":    http.MethodPost,
+			"url":       j.Path,
+			"body":      json.RawMessage(j.batchBody),
+		})
+		if err != nil {
+			return upstreamBatch{}, err
+		}
+		input.Write(line)
+		input.WriteByte('\n')
+	}
+
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	writer.WriteField("purpose", "batch")
+	part, err := writer.CreateFormFile("file", "openai_proxy_batch.jsonl")
+	if err != nil {
+		return upstreamBatch{}, err
+	}
+	part.Write(input.Bytes())
+	writer.Close()
+
+	uploadHeader := header.Clone()
+	uploadHeader.Set("Content-Type", writer.FormDataContentType())
+	resp, body, err := forwardUpstream(http.MethodPost, upstreamTarget("/v1/files", "").String(), uploadHeader, form.Bytes())
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return upstreamBatch{}, fmt.Errorf("failed to upload batch input: %v", batchError(resp, body, err))
+	}
+	var file struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(body, &file); err != nil || file.ID == "" {
+		return upstreamBatch{}, fmt.Errorf("failed to parse uploaded file: %s", body)
+	}
+
+	request, _ := json.Marshal(map[string]interface{}{
+		"input_file_id":     file.ID,
+		"endpoint":          jobs[0].Path,
+		"completion_window": "24h",
+		"metadata":          map[string]string{"source": "openai_proxy"},
+	})
+	createHeader := header.Clone()
+	createHeader.Set("Content-Type", "application/json")
+	resp, body, err = forwardUpstream(http.MethodPost, upstreamTarget("/v1/batches", "").String(), createHeader, request)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return upstreamBatch{}, fmt.Errorf("failed to create batch: %v", batchError(resp, body, err))
+	}
+	var batch upstreamBatch
+	if err := json.Unmarshal(body, &batch); err != nil || batch.ID == "" {
+		return upstreamBatch{}, fmt.Errorf("failed to parse batch: %s", body)
+	}
+	return batch, nil
+}
+
+// readBatchResults downloads a batch output or error file into results, by job ID
+func readBatchResults(header http.Header, fileID string, results map[string]batchResult) error {
+	resp, body, err := forwardUpstream(http.MethodGet, upstreamTarget("/v1/files/"+fileID+"/content", "").String(), header, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return batchError(resp, body, err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), len(body)+1)
+	for scanner.Scan() {
+		var result batchResult
+		if err := json.Unmarshal(scanner.Bytes(), &result); err == nil && result.CustomID != "" {
+			results[result.CustomID] = result
+		}
+	}
+	return scanner.Err()
+}
+
+// chargeBatchUsage accounts a batched job's tokens as the forwarder does for
+// requests it sends itself
+func chargeBatchUsage(j *job, body []byte) {
+	usage, ok := parseUsage(body)
+	if !ok {
+		return
+	}
+	publishUsage(usageEvent{
+		Timestamp:        time.Now(),
+		KeyID:            j.identity.KeyID,
+		KeyName:          j.identity.Name,
+		Tenant:           j.identity.Tenant,
+		Path:             j.Path,
+		Model:            bodyModel(body),
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		TotalTokens:      usage.TotalTokens,
+		CachedTokens:     usage.PromptTokensDetails.CachedTokens,
+		ReasoningTokens:  usage.CompletionTokensDetails.ReasoningTokens,
+		Fingerprint:      requestFingerprint(j.Path, j.body),
+	})
+	recordUsageHistory(j.identity, bodyModel(body), usage)
+	if requestTokenBudget != nil {
+		requestTokenBudget.Consume(j.owner, usage.TotalTokens)
+	}
+	if usageAnomalies != nil {
+		usageAnomalies.ObserveTokens(j.owner, usage.TotalTokens)
+	}
+}
+
+func batchEnded(status string) bool {
+	switch status {
+	case "completed", "failed", "expired", "cancelled":
+		return true
+	}
+	return false
+}
+
+func batchError(resp *http.Response, body []byte, err error) error {
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("upstream answered %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPrepareBatchFailsOnlyAbortedLines(t *testing.T) {
+	saved := upstreamURL
+	defer func() { upstreamURL = saved }()
+	upstreamURL, _ = url.Parse("https://api.openai.com")
+
+	s := newJobStore(0, 2)
+	s.forward = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, " ") {
+			panic(http.ErrAbortHandler)
+		}
+		line := r.Context().Value(batchLineKey{}).(*batchLine)
+		line.body, line.target = []byte(`{}`), upstreamTarget(r.URL.Path, "")
+	})
+
+	var jobs []*job
+	for _, target := range []string{"/v1/chat/completions%20x?async=batch", "/v1/chat/completions?async=batch"} {
+		r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(`{}`))
+		jobs = append(jobs, s.create(&principal{KeyID: "key-1"}, "", r, []byte(`{}`)))
+	}
+	batched, unbatched := s.prepareBatch(jobs)
+
+	if jobs[0].Status != jobFailed {
+		t.Errorf("aborted line is %s, want failed", jobs[0].Status)
+	}
+	if len(batched) != 1 || batched[0] != jobs[1] || len(unbatched) != 0 {
+		t.Fatalf("batched %d and unbatched %d jobs, want only the second batched", len(batched), len(unbatched))
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var blobHash = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// blobStore keeps large trace bodies on disk, named by the SHA-256 of their content so
+// identical payloads (the same image or audio sent twice) are stored once. Blobs are
+// only deleted when the last stored trace referring to them is redacted.
+type blobStore struct {
+	dir       string
+	threshold int
+}
+
+// traceBlobs is nil unless -blob-dir is set
+var traceBlobs *blobStore
+
+func newBlobStore(dir string, threshold int) (*blobStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create blob directory %s: %v", dir, err)
+	}
+	return &blobStore{dir: dir, threshold: threshold}, nil
+}
+
+func (b *blobStore) path(hash string) string {
+	return filepath.Join(b.dir, hash[:2], hash)
+}
+
+// Put stores data and returns its hash
+func (b *blobStore) Put(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	path := b.path(hash)
+	if _, err := os.Stat(path); err == nil {
+		metrics.Add("openai_proxy_trace_blobs_total", "Trace bodies moved to the blob store.", map[string]string{"outcome": "deduplicated"}, 1)
+		return hash, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", fmt.Errorf("failed to create blob directory: %v", err)
+	}
+	// Write to a temporary name first so readers never see a partial blob
+	tmp, err := os.CreateTemp(filepath.Dir(path), hash+".tmp*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create blob: %v", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to write blob: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to write blob: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to store blob: %v", err)
+	}
+	metrics.Add("openai_proxy_trace_blobs_total", "Trace bodies moved to the blob store.", map[string]string{"outcome": "stored"}, 1)
+	metrics.Add("openai_proxy_trace_blob_bytes_total", "Bytes written to the blob store.", nil, float64(len(data)))
+	return hash, nil
+}
+
+// Get returns the blob with the given hash
+func (b *blobStore) Get(hash string) ([]byte, error) {
+	if !blobHash.MatchString(hash) {
+		return nil, fmt.Errorf("invalid blob hash %q", hash)
+	}
+	return os.ReadFile(b.path(hash))
+}
+
+// Delete removes the blob with the given hash, if it exists
+func (b *blobStore) Delete(hash string) error {
+	if !blobHash.MatchString(hash) {
+		return fmt.Errorf("invalid blob hash %q", hash)
+	}
+	if err := os.Remove(b.path(hash)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete blob %s: %v", hash, err)
+	}
+	return nil
+}
+
+// externalize moves a body over the size threshold into the store, returning the
+// placeholder kept in the trace and the blob hash. Smaller bodies, and bodies that
+// fail to store, are returned unchanged with no hash.
+func (b *blobStore) externalize(body string) (string, string) {
+	if b == nil || len(body) <= b.threshold {
+		return body, ""
+	}
+	hash, err := b.Put([]byte(body))
+	if err != nil {
+		log.Printf("⚠️ Keeping trace body in memory: %v", err)
+		return body, ""
+	}
+	return fmt.Sprintf("[BLOB sha256:%s - %d bytes]", hash, len(body)), hash
+}
+
+// traceBodies returns the full request and response bodies of a trace, reading
+// them back from the blob store when they were moved there
+func traceBodies(trace Trace) (request, response string, err error) {
+	request, response = trace.RequestBody, trace.ResponseBody
+	for _, body := range []struct {
+		hash string
+		dst  *string
+	}{{trace.RequestBlob, &request}, {trace.ResponseBlob, &response}} {
+		if body.hash == "" {
+			continue
+		}
+		if traceBlobs == nil {
+			return "", "", fmt.Errorf("trace %s refers to blob %s but -blob-dir is not set", trace.Id, body.hash)
+		}
+		data, err := traceBlobs.Get(body.hash)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read blob %s: %v", body.hash, err)
+		}
+		*body.dst = string(data)
+	}
+	return request, response, nil
+}
+
+// handleBlob serves a stored trace body: GET /blobs/<sha256>
+func handleBlob(w http.ResponseWriter, r *http.Request) {
+	if traceBlobs == nil {
+		writeJSONError(w, http.StatusNotFound, "not_found", "the blob store is not enabled")
+		return
+	}
+	hash := strings.TrimPrefix(r.URL.Path, "/blobs/")
+	data, err := traceBlobs.Get(hash)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("no blob %q", hash))
+		return
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(data))
+	w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	w.Write(data)
+}
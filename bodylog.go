@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+const (
+	bodyLogOff       = "off"
+	bodyLogTruncated = "truncated"
+	bodyLogFull      = "full"
+)
+
+// bodyLogRoute overrides the body logging mode for requests under a path prefix
+type bodyLogRoute struct {
+	prefix string
+	mode   string
+}
+
+// bodyLogRoutes are sorted longest prefix first so the most specific route wins
+var bodyLogRoutes []bodyLogRoute
+
+func validBodyLogMode(mode string) bool {
+	return mode == bodyLogOff || mode == bodyLogTruncated || mode == bodyLogFull
+}
+
+// parseBodyLogRoutes parses -log-body-routes such as "/v1/audio/=off,/v1/chat/=full"
+func parseBodyLogRoutes(spec string) ([]bodyLogRoute, error) {
+	var routes []bodyLogRoute
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, mode, ok := strings.Cut(entry, "=")
+		if !ok || !strings.HasPrefix(prefix, "/") || !validBodyLogMode(mode) {
+			return nil, fmt.Errorf("invalid -log-body-routes entry %q: expected /path/prefix=off|truncated|full", entry)
+		}
+		routes = append(routes, bodyLogRoute{prefix: prefix, mode: mode})
+	}
+	sort.SliceStable(routes, func(i, j int) bool { return len(routes[i].prefix) > len(routes[j].prefix) })
+	return routes, nil
+}
+
+// bodyLogModeFor returns the body logging mode for a request path
+func bodyLogModeFor(path string) string {
+	for _, route := range bodyLogRoutes {
+		if strings.HasPrefix(path, route.prefix) {
+			return route.mode
+		}
+	}
+	return *logBodies
+}
+
+// logBody writes a response body to the log according to the route's mode; its
+// length is logged regardless
+func logBody(path string, body []byte) {
+	log.Printf("📏 Response body length: %d bytes", len(body))
+	switch bodyLogModeFor(path) {
+	case bodyLogFull:
+		log.Printf("📝 Body: %s", body)
+	case bodyLogTruncated:
+		if limit := *logBodyMaxBytes; len(body) > limit {
+			log.Printf("📝 Body: %s... (truncated, %d bytes total)", body[:limit], len(body))
+		} else {
+			log.Printf("📝 Body: %s", body)
+		}
+	}
+}
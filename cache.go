@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cachedResponse is a response stored for replay to later identical requests
+type cachedResponse struct {
+	StatusCode int         `json:"status_code"`
+	Status     string      `json:"status"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"-"`
+	StoredAt   time.Time   `json:"stored_at"`
+	ExpiresAt  time.Time   `json:"expires_at,omitempty"` // per-entry expiry of Lua cache module entries
+}
+
+// CacheStore stores upstream responses keyed by a request fingerprint. Besides the
+// memory and disk caches below, storage_sqlite.go and storage_redis.go implement it.
+type CacheStore interface {
+	Get(key string) (*cachedResponse, bool)
+	// Peek is Get without marking the entry as used, for lookups that don't serve it
+	Peek(key string) (*cachedResponse, bool)
+	Set(key string, response *cachedResponse)
+}
+
+// memoryCache is a size-bounded in-memory LRU cache with a fixed TTL
+type memoryCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]*list.Element
+	order      *list.List // front is most recently used
+}
+
+type memoryCacheItem struct {
+	key      string
+	response *cachedResponse
+}
+
+func newMemoryCache(ttl time.Duration, maxEntries int) *memoryCache {
+	return &memoryCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// Get returns the cached response for key if present and not expired
+func (c *memoryCache) Get(key string) (*cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	item := elem.Value.(*memoryCacheItem)
+	if time.Since(item.response.StoredAt) > c.ttl {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return item.response, true
+}
+
+// Peek returns the cached response for key if present and not expired, leaving the
+// LRU order alone
+func (c *memoryCache) Peek(key string) (*cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	item := elem.Value.(*memoryCacheItem)
+	if time.Since(item.response.StoredAt) > c.ttl {
+		return nil, false
+	}
+	return item.response, true
+}
+
+// Set stores a response under key, evicting the least recently used entries when full
+func (c *memoryCache) Set(key string, response *cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*memoryCacheItem).response = response
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&memoryCacheItem{key: key, response: response})
+	for c.maxEntries > 0 && c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*memoryCacheItem).key)
+	}
+}
+
+// diskCache stores responses as files in a directory, evicting the least recently
+// used entries once the total size exceeds maxBytes. It does not expire entries.
+type diskCache struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+}
+
+func newDiskCache(dir string, maxBytes int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory %s: %v", dir, err)
+	}
+	return &diskCache{dir: dir, maxBytes: maxBytes}, nil
+}
+
+func (c *diskCache) paths(key string) (metaPath, bodyPath string) {
+	return filepath.Join(c.dir, key+".json"), filepath.Join(c.dir, key+".body")
+}
+
+// Get returns the cached response for key and marks it as recently used
+func (c *diskCache) Get(key string) (*cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	response, ok := c.read(key)
+	if !ok {
+		return nil, false
+	}
+	// Modification time doubles as the LRU clock
+	metaPath, bodyPath := c.paths(key)
+	now := time.Now()
+	os.Chtimes(metaPath, now, now)
+	os.Chtimes(bodyPath, now, now)
+	return response, true
+}
+
+// Peek returns the cached response for key without marking it as used
+func (c *diskCache) Peek(key string) (*cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.read(key)
+}
+
+// read loads the entry for key; the caller holds c.mu
+func (c *diskCache) read(key string) (*cachedResponse, bool) {
+	metaPath, bodyPath := c.paths(key)
+	meta, err := os.ReadFile(metaPath)
+	if err != nil {
+		return nil, false
+	}
+	body, err := os.ReadFile(bodyPath)
+	if err != nil {
+		return nil, false
+	}
+	var response cachedResponse
+	if err := json.Unmarshal(meta, &response); err != nil {
+		log.Printf("⚠️ Corrupt cache entry %s: %v", metaPath, err)
+		return nil, false
+	}
+	response.Body = body
+	return &response, true
+}
+
+// Set writes a response to disk and evicts old entries beyond the size budget
+func (c *diskCache) Set(key string, response *cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.maxBytes > 0 && int64(len(response.Body)) > c.maxBytes {
+		log.Printf("⚠️ Response of %d bytes exceeds cache budget, not caching", len(response.Body))
+		return
+	}
+	meta, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("❌ Failed to encode cache entry: %v", err)
+		return
+	}
+	metaPath, bodyPath := c.paths(key)
+	// Write the body first so a visible meta file always has its body
+	if err := writeFileAtomic(bodyPath, response.Body); err != nil {
+		log.Printf("❌ Failed to write cache entry: %v", err)
+		return
+	}
+	if err := writeFileAtomic(metaPath, meta); err != nil {
+		log.Printf("❌ Failed to write cache entry: %v", err)
+		return
+	}
+	c.evict()
+}
+
+// evict removes least recently used entries until the directory fits in maxBytes
+func (c *diskCache) evict() {
+	if c.maxBytes <= 0 {
+		return
+	}
+	dirEntries, err := os.ReadDir(c.dir)
+	if err != nil {
+		log.Printf("❌ Failed to list cache directory: %v", err)
+		return
+	}
+
+	type entry struct {
+		key     string
+		size    int64
+		modTime time.Time
+	}
+	byKey := make(map[string]*entry)
+	var total int64
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		ext := filepath.Ext(name)
+		if ext != ".json" && ext != ".body" {
+			continue
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			continue
+		}
+		key := strings.TrimSuffix(name, ext)
+		e, ok := byKey[key]
+		if !ok {
+			e = &entry{key: key, modTime: info.ModTime()}
+			byKey[key] = e
+		}
+		e.size += info.Size()
+		if info.ModTime().Before(e.modTime) {
+			e.modTime = info.ModTime()
+		}
+		total += info.Size()
+	}
+	if total <= c.maxBytes {
+		return
+	}
+
+	entries := make([]*entry, 0, len(byKey))
+	for _, e := range byKey {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].modTime.Before(entries[j].modTime) })
+	for _, e := range entries {
+		if total <= c.maxBytes {
+			break
+		}
+		metaPath, bodyPath := c.paths(e.key)
+		os.Remove(metaPath)
+		os.Remove(bodyPath)
+		total -= e.size
+		log.Printf("🧹 Evicted cache entry %s (%d bytes)", shortKey(e.key), e.size)
+	}
+}
+
+// shortKey abbreviates a cache key for logging. Keys are normally hex digests, but
+// eviction rebuilds them from whatever file names are in the cache directory.
+func shortKey(key string) string {
+	return key[:min(len(key), 16)]
+}
+
+// writeFileAtomic writes data to a temporary file and renames it into place
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+var transcriptionCache CacheStore
+var speechCache CacheStore
+var completionCache CacheStore
+
+// negativeCache holds upstream rejections of requests that would fail the same
+// way again, such as a prompt over the context window
+var negativeCache CacheStore
+
+// negativeCacheStatuses are the deterministic client errors worth remembering.
+// Auth and rate limit errors are left out because they change without the
+// request changing.
+var negativeCacheStatuses = map[int]bool{
+	http.StatusBadRequest:            true,
+	http.StatusNotFound:              true,
+	http.StatusRequestEntityTooLarge: true,
+	http.StatusUnprocessableEntity:   true,
+}
+
+// completionEndpoints are the JSON endpoints whose non-streamed responses the
+// completion cache serves
+var completionEndpoints = map[string]bool{
+	"/v1/chat/completions": true,
+	"/v1/completions":      true,
+	"/v1/embeddings":       true,
+}
+
+// cacheForRequest returns the cache serving this request and its key, or nil if
+// the request is not cacheable
+func cacheForRequest(r *http.Request, body []byte) (CacheStore, string) {
+	if r.Method != http.MethodPost {
+		return nil, ""
+	}
+	switch {
+	case r.URL.Path == "/v1/audio/transcriptions" && transcriptionCache != nil:
+		key, err := transcriptionCacheKey(body, r.Header.Get("Content-Type"))
+		if err != nil {
+			log.Printf("⚠️ Transcription not cacheable: %v", err)
+			return nil, ""
+		}
+		return transcriptionCache, key
+	case r.URL.Path == "/v1/audio/speech" && speechCache != nil:
+		key, err := speechCacheKey(body)
+		if err != nil {
+			log.Printf("⚠️ Speech request not cacheable: %v", err)
+			return nil, ""
+		}
+		return speechCache, key
+	case completionEndpoints[r.URL.Path] && completionCache != nil:
+		key, cacheable, err := completionCacheKey(r.URL.Path, r.Header.Get("Authorization"), body)
+		if err != nil {
+			log.Printf("⚠️ Completion not cacheable: %v", err)
+		}
+		if !cacheable {
+			return nil, ""
+		}
+		return completionCache, key
+	}
+	return nil, ""
+}
+
+// negativeCacheKey returns the negative cache key of a JSON request, or "" when
+// the negative cache is off, bypassed or the body isn't JSON
+func negativeCacheKey(r *http.Request, body []byte, overrides requestOverrides) string {
+	if negativeCache == nil || overrides.noCache || len(body) == 0 {
+		return ""
+	}
+	key, err := jsonRequestKey("errors:"+r.URL.Path, r.Header.Get("Authorization"), body)
+	if err != nil {
+		return ""
+	}
+	return key
+}
+
+// completionCacheKey hashes the endpoint, the credential and the canonical JSON
+// body, so only the same client asking the same thing shares an entry.
+// Streamed requests are not cacheable.
+func completionCacheKey(path, authorization string, body []byte) (string, bool, error) {
+	var request map[string]interface{}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return "", false, fmt.Errorf("invalid JSON body: %v", err)
+	}
+	if stream, _ := request["stream"].(bool); stream {
+		return "", false, nil
+	}
+	key, err := jsonRequestKey(path, authorization, body)
+	return key, err == nil, err
+}
+
+// jsonRequestKey hashes a scope, the credential and the canonical form of a JSON
+// body, as the request fingerprint does
+func jsonRequestKey(scope, authorization string, body []byte) (string, error) {
+	canonical, err := canonicalRequestJSON(body)
+	if err != nil {
+		return "", err
+	}
+	credential := sha256.Sum256([]byte(authorization))
+	key := sha256.New()
+	key.Write([]byte(scope + "\n"))
+	key.Write(credential[:])
+	key.Write(canonical)
+	return hex.EncodeToString(key.Sum(nil)), nil
+}
+
+// transcriptionCacheKey hashes the uploaded audio and every form parameter of a
+// multipart transcription request. The multipart boundary differs per request, so
+// the key is built from the decoded parts rather than the raw body.
+func transcriptionCacheKey(body []byte, contentType string) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "multipart/form-data" {
+		return "", fmt.Errorf("not a multipart request: %s", contentType)
+	}
+
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	var fields []string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read multipart body: %v", err)
+		}
+		hash := sha256.New()
+		if _, err := io.Copy(hash, part); err != nil {
+			return "", fmt.Errorf("failed to read multipart part %s: %v", part.FormName(), err)
+		}
+		fields = append(fields, part.FormName()+"="+hex.EncodeToString(hash.Sum(nil)))
+	}
+	sort.Strings(fields)
+
+	key := sha256.New()
+	for _, field := range fields {
+		key.Write([]byte(field))
+		key.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(key.Sum(nil)), nil
+}
+
+// speechCacheKey hashes the parameters that determine the generated audio
+func speechCacheKey(body []byte) (string, error) {
+	var request struct {
+		Model          string   `json:"model"`
+		Voice          any      `json:"voice"` // a voice name or {"id": ...}
+		Input          string   `json:"input"`
+		ResponseFormat string   `json:"response_format"`
+		Speed          *float64 `json:"speed"`
+		Instructions   string   `json:"instructions"`
+		StreamFormat   string   `json:"stream_format"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return "", fmt.Errorf("invalid JSON body: %v", err)
+	}
+	if request.ResponseFormat == "" {
+		request.ResponseFormat = "mp3"
+	}
+	canonical, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// storeCachedResponse caches a successful response as it was sent to the client
+func storeCachedResponse(cache CacheStore, key string, resp *http.Response, header http.Header, body []byte) {
+	cached := &cachedResponse{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Header:     header.Clone(),
+		Body:       append([]byte(nil), body...),
+		StoredAt:   time.Now(),
+	}
+	// The cache status is per request, not part of the stored response
+	cached.Header.Del("X-Proxy-Cache")
+	cache.Set(key, cached)
+	log.Printf("💾 Cached response: %s (%d bytes)", shortKey(key), len(body))
+}
+
+// completionCacheStale reports whether a cached completion is past
+// -completion-cache-ttl. The store keeps entries for the extra
+// -cache-stale-while-revalidate window, in which they are served stale.
+func completionCacheStale(cache CacheStore, cached *cachedResponse) bool {
+	return cache == completionCache && *staleWhileRevalidate > 0 && time.Since(cached.StoredAt) > *completionCacheTTL
+}
+
+// revalidating holds the keys of stale entries being refreshed, so a hot prompt
+// triggers one upstream request however many clients hit it
+var revalidating sync.Map
+
+// revalidateCachedResponse refreshes a stale cache entry in the background by
+// sending the request upstream again and storing the answer if it succeeds.
+// resize is the request's embedding size policy, or nil.
+func revalidateCachedResponse(cache CacheStore, key, tenant, method, target string, header http.Header, body []byte, resize *embeddingResize) {
+	if _, busy := revalidating.LoadOrStore(key, true); busy {
+		return
+	}
+	go func() {
+		defer revalidating.Delete(key)
+		outcome := "refreshed"
+		defer func() {
+			metrics.Add("openai_proxy_cache_revalidations_total", "Background refreshes of stale cache entries, by outcome.", map[string]string{"outcome": outcome}, 1)
+		}()
+		resp, respBody, err := forwardUpstream(method, target, header, body)
+		if err != nil {
+			log.Printf("❌ Cache revalidation failed for %s: %v", shortKey(key), err)
+			outcome = "error"
+			return
+		}
+		if resp.StatusCode != http.StatusOK {
+			log.Printf("⚠️ Cache revalidation for %s got %s, keeping the stale entry", shortKey(key), resp.Status)
+			outcome = "rejected"
+			return
+		}
+		respBody, respHeader, err := runResponseHooks(nil, respBody, resp.Header)
+		if err == nil {
+			respBody, respHeader, err = scriptHooks.ExecuteResponseHook(generateTraceID(), respBody, respHeader)
+		}
+		if err != nil {
+			log.Printf("❌ Response hook error during cache revalidation: %v", err)
+			outcome = "error"
+			return
+		}
+		respBody, respHeader = tenantHooks.ExecuteResponseHook(tenant, "", respBody, respHeader)
+		if transformed, applied := applyResponseTransforms(respBody); len(applied) > 0 {
+			respBody = transformed
+			respHeader.Set("X-Proxy-Transformed", strings.Join(applied, ","))
+		}
+		// The upstream was asked for full vectors, as on the live path
+		if resize != nil {
+			respHeader.Set("X-Proxy-Embedding-Dimensions", resize.String())
+		}
+		if resized, ok := truncateEmbeddings(respBody, resize); ok {
+			respBody = resized
+		}
+		respHeader.Set("Content-Length", strconv.Itoa(len(respBody)))
+		storeCachedResponse(cache, key, resp, respHeader, respBody)
+	}()
+}
+
+// serveCachedResponse writes a cached response to the client
+func serveCachedResponse(w http.ResponseWriter, cached *cachedResponse) {
+	for name, values := range cached.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.WriteHeader(cached.StatusCode)
+	if _, err := w.Write(cached.Body); err != nil {
+		log.Printf("❌ Failed to write cached response: %v", err)
+	}
+}
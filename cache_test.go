@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRevalidationTruncatesEmbeddings(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"object":"list","data":[{"object":"embedding","index":0,"embedding":[0.5,0.5,0.5,0.5]}],"model":"nomic-embed"}`))
+	}))
+	defer upstream.Close()
+
+	savedCache, savedTTL, savedStale := completionCache, *completionCacheTTL, *staleWhileRevalidate
+	defer func() {
+		completionCache, *completionCacheTTL, *staleWhileRevalidate = savedCache, savedTTL, savedStale
+	}()
+	*completionCacheTTL = time.Minute
+	*staleWhileRevalidate = time.Hour
+	completionCache = newMemoryCache(*completionCacheTTL+*staleWhileRevalidate, 10)
+
+	const key = "stale-embedding"
+	stale := &cachedResponse{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     http.Header{},
+		Body:       []byte(`{"object":"list","data":[{"object":"embedding","index":0,"embedding":[1,0]}]}`),
+		StoredAt:   time.Now().Add(-2 * time.Minute),
+	}
+	completionCache.Set(key, stale)
+	if !completionCacheStale(completionCache, stale) {
+		t.Fatal("entry past the TTL is not stale")
+	}
+
+	resize := &embeddingResize{dimensions: 2, truncate: true}
+	revalidateCachedResponse(completionCache, key, "", http.MethodPost, upstream.URL+"/v1/embeddings", http.Header{}, []byte(`{"model":"nomic-embed","input":"hi"}`), resize)
+
+	deadline := time.Now().Add(5 * time.Second)
+	var refreshed *cachedResponse
+	for time.Now().Before(deadline) {
+		if entry, ok := completionCache.Peek(key); ok && entry != stale {
+			refreshed = entry
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if refreshed == nil {
+		t.Fatal("stale entry was not refreshed")
+	}
+
+	var response struct {
+		Data []struct {
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(refreshed.Body, &response); err != nil {
+		t.Fatalf("refreshed entry is not JSON: %v", err)
+	}
+	if len(response.Data) != 1 || len(response.Data[0].Embedding) != 2 {
+		t.Fatalf("refreshed entry has vectors %v, want one of size 2", response.Data)
+	}
+	if got := refreshed.Header.Get("X-Proxy-Embedding-Dimensions"); got != "2; truncated" {
+		t.Errorf("X-Proxy-Embedding-Dimensions = %q, want %q", got, "2; truncated")
+	}
+}
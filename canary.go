@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// canaryWindow is the number of recent requests per upstream compared for rollback
+const canaryWindow = 200
+
+// outcomeWindow keeps the outcomes of the most recent requests to one upstream
+type outcomeWindow struct {
+	failed  []bool
+	latency []time.Duration
+	next    int
+}
+
+func (o *outcomeWindow) add(failed bool, latency time.Duration) {
+	if len(o.failed) < canaryWindow {
+		o.failed = append(o.failed, failed)
+		o.latency = append(o.latency, latency)
+		return
+	}
+	o.failed[o.next], o.latency[o.next] = failed, latency
+	o.next = (o.next + 1) % canaryWindow
+}
+
+// stats returns the sample count, error rate and mean latency of the window
+func (o *outcomeWindow) stats() (int, float64, time.Duration) {
+	if len(o.failed) == 0 {
+		return 0, 0, 0
+	}
+	errors := 0
+	var total time.Duration
+	for i, failed := range o.failed {
+		if failed {
+			errors++
+		}
+		total += o.latency[i]
+	}
+	n := len(o.failed)
+	return n, float64(errors) / float64(n), total / time.Duration(n)
+}
+
+// canaryRouter sends a share of matching traffic to a canary upstream, and rolls
+// the share back to zero when the canary does clearly worse than the primary
+type canaryRouter struct {
+	base             *url.URL
+	routes           []string // path prefixes; empty means all of /v1/
+	minSamples       int
+	maxErrorDelta    float64 // allowed canary error rate above the primary's
+	maxLatencyFactor float64 // allowed canary mean latency as a multiple of the primary's
+
+	mu         sync.Mutex
+	percent    float64
+	rolledBack string // reason of the last automatic rollback
+	primary    outcomeWindow
+	canary     outcomeWindow
+}
+
+// upstreamCanary is nil unless -canary-upstream is set
+var upstreamCanary *canaryRouter
+
+func (c *canaryRouter) matches(path string) bool {
+	if c == nil {
+		return false
+	}
+	if len(c.routes) == 0 {
+		return true
+	}
+	for _, route := range c.routes {
+		if strings.HasPrefix(path, route) {
+			return true
+		}
+	}
+	return false
+}
+
+// Pick decides whether a request for path goes to the canary
+func (c *canaryRouter) Pick(path string) bool {
+	if !c.matches(path) {
+		return false
+	}
+	c.mu.Lock()
+	percent := c.percent
+	c.mu.Unlock()
+	return percent > 0 && rand.Float64()*100 < percent
+}
+
+// target returns the canary URL for path
+func (c *canaryRouter) target(path, rawQuery string) *url.URL {
+	return &url.URL{
+		Scheme:   c.base.Scheme,
+		Host:     c.base.Host,
+		Path:     c.base.Path + path,
+		RawQuery: rawQuery,
+	}
+}
+
+// Observe records the outcome of a request on a matching route, and rolls the canary
+// back if it now breaches the thresholds
+func (c *canaryRouter) Observe(path string, canary, failed bool, latency time.Duration) {
+	if !c.matches(path) {
+		return
+	}
+	upstream := "primary"
+	if canary {
+		upstream = "canary"
+	}
+	metrics.Add("openai_proxy_canary_requests_total", "Requests on canary routes, by upstream and outcome.", map[string]string{"upstream": upstream, "failed": fmt.Sprint(failed)}, 1)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !canary {
+		c.primary.add(failed, latency)
+		return
+	}
+	c.canary.add(failed, latency)
+	if c.percent == 0 {
+		return
+	}
+	if reason := c.breach(); reason != "" {
+		log.Printf("🐤 Canary rolled back to 0%% (was %.1f%%): %s", c.percent, reason)
+		metrics.Add("openai_proxy_canary_rollbacks_total", "Automatic rollbacks of the canary upstream.", nil, 1)
+		sendAlert(alert{Kind: "canary_rollback", Message: fmt.Sprintf("canary %s rolled back from %.1f%%: %s", c.base.Host, c.percent, reason), Timestamp: time.Now()})
+		routingAudit.record("proxy", "canary_rollback", reason, map[string]float64{"percent": c.percent}, map[string]float64{"percent": 0})
+		c.percent = 0
+		c.rolledBack = reason
+	}
+}
+
+// breach returns why the canary does worse than the primary, or "". Called with c.mu held.
+func (c *canaryRouter) breach() string {
+	canaryN, canaryErrors, canaryLatency := c.canary.stats()
+	primaryN, primaryErrors, primaryLatency := c.primary.stats()
+	if canaryN < c.minSamples || primaryN < c.minSamples {
+		return ""
+	}
+	if canaryErrors > primaryErrors+c.maxErrorDelta {
+		return fmt.Sprintf("error rate %.1f%% vs %.1f%% on the primary", canaryErrors*100, primaryErrors*100)
+	}
+	if c.maxLatencyFactor > 0 && float64(canaryLatency) > float64(primaryLatency)*c.maxLatencyFactor {
+		return fmt.Sprintf("mean latency %v vs %v on the primary", canaryLatency.Round(time.Millisecond), primaryLatency.Round(time.Millisecond))
+	}
+	return ""
+}
+
+type canaryUpstreamStatus struct {
+	Samples       int     `json:"samples"`
+	ErrorRate     float64 `json:"error_rate"`
+	MeanLatencyMs float64 `json:"mean_latency_ms"`
+}
+
+type canaryStatus struct {
+	Upstream   string               `json:"upstream"`
+	Routes     []string             `json:"routes,omitempty"`
+	Percent    float64              `json:"percent"`
+	RolledBack string               `json:"rolled_back,omitempty"`
+	Primary    canaryUpstreamStatus `json:"primary"`
+	Canary     canaryUpstreamStatus `json:"canary"`
+}
+
+func (c *canaryRouter) status() canaryStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	describe := func(o *outcomeWindow) canaryUpstreamStatus {
+		n, errorRate, latency := o.stats()
+		return canaryUpstreamStatus{Samples: n, ErrorRate: errorRate, MeanLatencyMs: float64(latency) / float64(time.Millisecond)}
+	}
+	return canaryStatus{
+		Upstream:   c.base.String(),
+		Routes:     c.routes,
+		Percent:    c.percent,
+		RolledBack: c.rolledBack,
+		Primary:    describe(&c.primary),
+		Canary:     describe(&c.canary),
+	}
+}
+
+// handleCanary reports the canary state (GET) or sets its traffic share (PUT or POST
+// with {"percent": 10}). Setting a share clears the canary's recorded outcomes so an
+// earlier rollback doesn't immediately repeat.
+func handleCanary(w http.ResponseWriter, r *http.Request) {
+	if upstreamCanary == nil {
+		writeJSONError(w, http.StatusNotFound, "not_found", "no canary upstream is configured")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var request struct {
+			Percent float64 `json:"percent"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid canary update: "+err.Error())
+			return
+		}
+		if request.Percent < 0 || request.Percent > 100 {
+			writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "percent must be between 0 and 100")
+			return
+		}
+		upstreamCanary.mu.Lock()
+		before := map[string]interface{}{"percent": upstreamCanary.percent, "rolled_back": upstreamCanary.rolledBack}
+		upstreamCanary.percent = request.Percent
+		upstreamCanary.rolledBack = ""
+		upstreamCanary.canary = outcomeWindow{}
+		upstreamCanary.mu.Unlock()
+		experiments.reset()
+		log.Printf("🐤 Canary traffic set to %.1f%%", request.Percent)
+		routingAudit.record(adminActor(r), "canary_percent", upstreamCanary.base.String(), before, map[string]interface{}{"percent": request.Percent})
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "invalid_request_error", "use GET or PUT")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(upstreamCanary.status())
+}
+
+// parseCanary builds the canary router from the -canary-* flags, or returns nil
+// when no canary upstream is set
+func parseCanary(upstream, routes string) (*canaryRouter, error) {
+	if upstream == "" {
+		return nil, nil
+	}
+	base, err := url.Parse(upstream)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("invalid -canary-upstream %q: expected an http(s) base URL", upstream)
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	if *canaryPercent < 0 || *canaryPercent > 100 {
+		return nil, fmt.Errorf("invalid -canary-percent %v: must be between 0 and 100", *canaryPercent)
+	}
+	c := &canaryRouter{
+		base:             base,
+		minSamples:       *canaryMinSamples,
+		maxErrorDelta:    *canaryMaxErrorDelta,
+		maxLatencyFactor: *canaryMaxLatencyFactor,
+		percent:          *canaryPercent,
+	}
+	for _, route := range strings.Split(routes, ",") {
+		if route = strings.TrimSpace(route); route != "" {
+			c.routes = append(c.routes, route)
+		}
+	}
+	return c, nil
+}
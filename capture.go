@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// captureRecord is one line of a capture file. A forwarded exchange is written as
+// request, upstream_request, response, any number of chunk records (one per read
+// from the upstream body, with its arrival offset), client_response for buffered
+// responses and a final end record.
+type captureRecord struct {
+	Type     string      `json:"type"`
+	TraceID  string      `json:"trace_id"`
+	Time     time.Time   `json:"time"`
+	OffsetMs float64     `json:"offset_ms"` // since the request record
+	Method   string      `json:"method,omitempty"`
+	URL      string      `json:"url,omitempty"`
+	Status   string      `json:"status,omitempty"`
+	Header   http.Header `json:"header,omitempty"`
+	Body     []byte      `json:"body,omitempty"` // base64 in the file, raw bytes on the wire
+	Bytes    int64       `json:"bytes,omitempty"`
+	Error    string      `json:"error,omitempty"`
+}
+
+var unsafeSessionChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// captureWriteMu serializes appends, since exchanges of one session may overlap
+var captureWriteMu sync.Mutex
+
+// captureRewrites counts, by path, how often a capture file was replaced by a
+// redaction, so sessions still writing to it reopen it. Guarded by captureWriteMu.
+var captureRewrites = make(map[string]int)
+
+// captureSession writes the raw records of one exchange. All methods are no-ops
+// on a nil session, which is what startCapture returns when capturing is disabled.
+type captureSession struct {
+	traceID string
+	path    string
+	file    *os.File
+	rewrite int // captureRewrites of path when file was opened
+	started time.Time
+	bytes   int64
+	err     error
+}
+
+// startCapture begins capturing an exchange into the file for sessionID, or for the
+// trace alone when the client didn't send a session ID
+func startCapture(traceID, sessionID string) *captureSession {
+	if *captureDir == "" {
+		return nil
+	}
+	if sessionID == "" {
+		sessionID = traceID
+	}
+	path := filepath.Join(*captureDir, unsafeSessionChars.ReplaceAllString(sessionID, "_")+".capture.jsonl")
+	captureWriteMu.Lock()
+	defer captureWriteMu.Unlock()
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("❌ Failed to open capture file: %v", err)
+		return nil
+	}
+	return &captureSession{
+		traceID: traceID,
+		path:    path,
+		file:    f,
+		rewrite: captureRewrites[path],
+		started: time.Now(),
+	}
+}
+
+// Path returns the capture file, or "" if the exchange isn't captured
+func (c *captureSession) Path() string {
+	if c == nil {
+		return ""
+	}
+	return c.path
+}
+
+func (c *captureSession) write(record captureRecord) {
+	if c == nil || c.err != nil {
+		return
+	}
+	record.TraceID = c.traceID
+	record.Time = time.Now()
+	record.OffsetMs = float64(record.Time.Sub(c.started).Microseconds()) / 1000
+	line, err := json.Marshal(record)
+	if err != nil {
+		c.err = err
+		return
+	}
+
+	captureWriteMu.Lock()
+	defer captureWriteMu.Unlock()
+	if c.rewrite != captureRewrites[c.path] {
+		// A redaction replaced the file; carry on at the end of the new one
+		f, err := os.OpenFile(c.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			log.Printf("❌ Failed to reopen capture file %s: %v", c.path, err)
+			c.err = err
+			return
+		}
+		c.file.Close()
+		c.file, c.rewrite = f, captureRewrites[c.path]
+	}
+	if _, err := c.file.Write(append(line, '\n')); err != nil {
+		// Give up on this exchange rather than logging every chunk
+		log.Printf("❌ Capture write failed for %s: %v", c.path, err)
+		c.err = err
+	}
+}
+
+// Request records the request as received from the client, before any hook ran
+func (c *captureSession) Request(method, url string, header http.Header, body []byte) {
+	c.write(captureRecord{Type: "request", Method: method, URL: url, Header: redactCaptureHeader(header), Body: body})
+}
+
+// UpstreamRequest records the request as sent upstream
+func (c *captureSession) UpstreamRequest(req *http.Request, body []byte) {
+	c.write(captureRecord{Type: "upstream_request", Method: req.Method, URL: req.URL.String(), Header: redactCaptureHeader(req.Header), Body: body})
+}
+
+// Response records the upstream status and headers and returns body wrapped so
+// every read is captured as a timed chunk
+func (c *captureSession) Response(resp *http.Response) io.ReadCloser {
+	if c == nil {
+		return resp.Body
+	}
+	c.write(captureRecord{Type: "response", Status: resp.Status, Header: resp.Header})
+	return &captureReader{ReadCloser: resp.Body, capture: c}
+}
+
+// ClientResponse records a buffered response as delivered to the client, after
+// decompression and response hooks
+func (c *captureSession) ClientResponse(status string, header http.Header, body []byte) {
+	c.write(captureRecord{Type: "client_response", Status: status, Header: header, Body: body})
+}
+
+// Fail records an error that ended the exchange
+func (c *captureSession) Fail(err error) {
+	c.write(captureRecord{Type: "error", Error: err.Error()})
+}
+
+// Close writes the end record with the number of upstream body bytes seen
+func (c *captureSession) Close() {
+	if c == nil {
+		return
+	}
+	c.write(captureRecord{Type: "end", Bytes: c.bytes})
+	c.file.Close()
+}
+
+// redactCaptureHeader masks credentials so capture files don't hold usable keys
+func redactCaptureHeader(header http.Header) http.Header {
+	redacted := header.Clone()
+	for _, name := range []string{"Authorization", "Api-Key", "Openai-Api-Key"} {
+		for i, value := range redacted[name] {
+			if len(value) > 8 {
+				redacted[name][i] = value[:4] + "***" + value[len(value)-4:]
+			} else {
+				redacted[name][i] = "***"
+			}
+		}
+	}
+	return redacted
+}
+
+type captureReader struct {
+	io.ReadCloser
+	capture *captureSession
+}
+
+func (cr *captureReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	if n > 0 {
+		cr.capture.bytes += int64(n)
+		cr.capture.write(captureRecord{Type: "chunk", Body: append([]byte(nil), p[:n]...)})
+	}
+	return n, err
+}
+
+// renderCapture prints a capture file as annotated HTTP exchanges, one per trace
+func renderCapture(path string, w io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open capture file %s: %v", path, err)
+	}
+	defer f.Close()
+
+	records := make(map[string][]captureRecord)
+	var order []string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 256<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var record captureRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("%s:%d: invalid capture record: %v", path, line, err)
+		}
+		if _, ok := records[record.TraceID]; !ok {
+			order = append(order, record.TraceID)
+		}
+		records[record.TraceID] = append(records[record.TraceID], record)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read capture file %s: %v", path, err)
+	}
+
+	for _, traceID := range order {
+		for _, record := range records[traceID] {
+			switch record.Type {
+			case "request", "upstream_request":
+				fmt.Fprintf(w, "=== %s %s (trace %s, %s) ===\n", record.Type, record.Time.Format(time.RFC3339Nano), traceID, record.URL)
+				fmt.Fprintf(w, "> %s %s\n", record.Method, record.URL)
+				writeCaptureHeader(w, "> ", record.Header)
+				fmt.Fprintf(w, ">\n%s\n", record.Body)
+			case "response":
+				fmt.Fprintf(w, "< %s [+%.1fms]\n", record.Status, record.OffsetMs)
+				writeCaptureHeader(w, "< ", record.Header)
+				fmt.Fprintln(w, "<")
+			case "client_response":
+				fmt.Fprintf(w, "=== client_response [+%.1fms] ===\n< %s\n", record.OffsetMs, record.Status)
+				writeCaptureHeader(w, "< ", record.Header)
+				fmt.Fprintf(w, "<\n%s\n", record.Body)
+			case "chunk":
+				fmt.Fprintf(w, "[+%.1fms] %d bytes\n%s\n", record.OffsetMs, len(record.Body), record.Body)
+			case "error":
+				fmt.Fprintf(w, "!!! [+%.1fms] %s\n", record.OffsetMs, record.Error)
+			case "end":
+				fmt.Fprintf(w, "=== end: %d bytes in %.1fms ===\n\n", record.Bytes, record.OffsetMs)
+			}
+		}
+	}
+	return nil
+}
+
+func writeCaptureHeader(w io.Writer, prefix string, header http.Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range header[name] {
+			fmt.Fprintf(w, "%s%s: %s\n", prefix, name, value)
+		}
+	}
+}
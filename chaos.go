@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// faultConfig describes the failures injected into forwarded requests. It is set at
+// runtime through the admin /chaos endpoint and is off by default.
+type faultConfig struct {
+	Enabled         bool     `json:"enabled"`
+	Routes          []string `json:"routes,omitempty"` // path prefixes; empty means all of /v1/
+	LatencyMs       int      `json:"latency_ms,omitempty"`
+	LatencyJitterMs int      `json:"latency_jitter_ms,omitempty"`
+	DropPercent     float64  `json:"drop_percent,omitempty"`
+	ErrorPercent    float64  `json:"error_percent,omitempty"`
+	ErrorStatuses   []int    `json:"error_statuses,omitempty"` // picked at random; default 500
+}
+
+var (
+	faultsMu sync.RWMutex
+	faults   faultConfig
+)
+
+var syntheticErrors = map[int]struct{ errType, message string }{
+	http.StatusTooManyRequests:     {"rate_limit_exceeded", "Rate limit reached (injected by proxy chaos mode)"},
+	http.StatusInternalServerError: {"server_error", "The server had an error while processing your request (injected by proxy chaos mode)"},
+	http.StatusBadGateway:          {"server_error", "Bad gateway (injected by proxy chaos mode)"},
+	http.StatusServiceUnavailable:  {"server_error", "The engine is currently overloaded (injected by proxy chaos mode)"},
+	http.StatusGatewayTimeout:      {"server_error", "Gateway timeout (injected by proxy chaos mode)"},
+}
+
+func (c faultConfig) validate() error {
+	if c.LatencyMs < 0 || c.LatencyJitterMs < 0 {
+		return fmt.Errorf("latency must not be negative")
+	}
+	if c.DropPercent < 0 || c.ErrorPercent < 0 || c.DropPercent+c.ErrorPercent > 100 {
+		return fmt.Errorf("drop_percent and error_percent must be between 0 and 100 in total")
+	}
+	for _, status := range c.ErrorStatuses {
+		if _, ok := syntheticErrors[status]; !ok {
+			return fmt.Errorf("unsupported error status %d (use 429, 500, 502, 503 or 504)", status)
+		}
+	}
+	return nil
+}
+
+func (c faultConfig) matches(path string) bool {
+	if len(c.Routes) == 0 {
+		return true
+	}
+	for _, route := range c.Routes {
+		if strings.HasPrefix(path, route) {
+			return true
+		}
+	}
+	return false
+}
+
+// injectFault applies the chaos configuration to a request. It returns false if the
+// request must not be forwarded, along with the status of the synthetic response
+// (0 if the client went away during injected latency).
+func injectFault(w http.ResponseWriter, r *http.Request) (bool, int) {
+	faultsMu.RLock()
+	config := faults
+	faultsMu.RUnlock()
+	if !config.Enabled || !config.matches(r.URL.Path) {
+		return true, 0
+	}
+
+	if config.LatencyMs > 0 || config.LatencyJitterMs > 0 {
+		delay := time.Duration(config.LatencyMs) * time.Millisecond
+		if config.LatencyJitterMs > 0 {
+			delay += time.Duration(rand.Intn(config.LatencyJitterMs+1)) * time.Millisecond
+		}
+		metrics.Add("openai_proxy_injected_faults_total", "Faults injected by chaos mode.", map[string]string{"kind": "latency"}, 1)
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return false, 0
+		}
+	}
+
+	roll := rand.Float64() * 100
+	switch {
+	case roll < config.DropPercent:
+		metrics.Add("openai_proxy_injected_faults_total", "Faults injected by chaos mode.", map[string]string{"kind": "drop"}, 1)
+		log.Printf("💥 Chaos: dropping connection for %s", r.URL.Path)
+		// Closes the connection without a response, like a network failure
+		panic(http.ErrAbortHandler)
+	case roll < config.DropPercent+config.ErrorPercent:
+		status := http.StatusInternalServerError
+		if len(config.ErrorStatuses) > 0 {
+			status = config.ErrorStatuses[rand.Intn(len(config.ErrorStatuses))]
+		}
+		metrics.Add("openai_proxy_injected_faults_total", "Faults injected by chaos mode.", map[string]string{"kind": strconv.Itoa(status)}, 1)
+		log.Printf("💥 Chaos: answering %s with %d", r.URL.Path, status)
+		if status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", "1")
+		}
+		w.Header().Set("X-Proxy-Fault", "injected")
+		synthetic := syntheticErrors[status]
+		writeJSONError(w, status, synthetic.errType, synthetic.message)
+		return false, status
+	}
+	return true, 0
+}
+
+// handleChaos reads (GET), replaces (PUT or POST) or disables (DELETE) the fault
+// injection configuration
+func handleChaos(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var config faultConfig
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid chaos configuration: "+err.Error())
+			return
+		}
+		if err := config.validate(); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			return
+		}
+		faultsMu.Lock()
+		faults = config
+		faultsMu.Unlock()
+		log.Printf("💥 Chaos configuration updated: %+v", config)
+	case http.MethodDelete:
+		faultsMu.Lock()
+		faults = faultConfig{}
+		faultsMu.Unlock()
+		log.Printf("💥 Chaos mode disabled")
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "invalid_request_error", "use GET, PUT or DELETE")
+		return
+	}
+
+	faultsMu.RLock()
+	defer faultsMu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(faults)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// clientCAs holds the -client-ca bundle; nil when client certificates aren't used
+var clientCAs *x509.CertPool
+
+// clientCertKeys maps client certificate identities to the virtual keys that list
+// them in client_certs
+var clientCertKeys map[string]*virtualKey
+
+// validClientCertMode reports whether mode is a supported -client-cert-mode
+func validClientCertMode(mode string) bool {
+	switch mode {
+	case "require", "optional", "mapped":
+		return true
+	}
+	return false
+}
+
+// loadClientCAs reads a PEM bundle of the CAs that may issue client certificates
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read -client-ca %s: %v", path, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("-client-ca %s contains no PEM certificates", path)
+	}
+	return pool, nil
+}
+
+// listenerTLSConfig is the forwarder's TLS configuration. With -client-ca, client
+// certificates are verified against it: required in require and mapped mode, and
+// checked when presented in optional mode.
+func listenerTLSConfig() *tls.Config {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCAs != nil {
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		if *clientCertMode == "optional" {
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	return config
+}
+
+// clientCertificate returns the request's verified client certificate, if any
+func clientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// certificateIdentities lists the names a client certificate can be mapped by:
+// its subject distinguished name, common name, DNS names and URIs such as SPIFFE IDs
+func certificateIdentities(cert *x509.Certificate) []string {
+	identities := []string{cert.Subject.String()}
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+	identities = append(identities, cert.DNSNames...)
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+	return identities
+}
+
+// lookupClientCertKey returns the virtual key mapped to the request's client
+// certificate, if any
+func lookupClientCertKey(r *http.Request) (*virtualKey, bool) {
+	cert := clientCertificate(r)
+	if cert == nil || clientCertKeys == nil {
+		return nil, false
+	}
+	for _, identity := range certificateIdentities(cert) {
+		if vk, ok := clientCertKeys[identity]; ok {
+			return vk, true
+		}
+	}
+	return nil, false
+}
+
+// clientCertID identifies a caller by an unmapped certificate's common name, or its
+// subject when it has none
+func clientCertID(r *http.Request) string {
+	cert := clientCertificate(r)
+	if cert == nil {
+		return ""
+	}
+	if cert.Subject.CommonName != "" {
+		return "cert-" + cert.Subject.CommonName
+	}
+	return "cert-" + cert.Subject.String()
+}
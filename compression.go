@@ -0,0 +1,121 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// supportedEncodings are the content encodings the proxy can decode
+var supportedEncodings = map[string]bool{"zstd": true, "br": true, "gzip": true}
+
+// upstreamEncodings are offered to the upstream in order of preference; empty asks
+// for identity responses
+var upstreamEncodings []string
+
+// parseUpstreamEncodings reads -upstream-encodings
+func parseUpstreamEncodings(value string) ([]string, error) {
+	var encodings []string
+	for _, encoding := range strings.Split(value, ",") {
+		encoding = strings.ToLower(strings.TrimSpace(encoding))
+		if encoding == "" || encoding == "identity" {
+			continue
+		}
+		if !supportedEncodings[encoding] {
+			return nil, fmt.Errorf("invalid -upstream-encodings entry %q: expected zstd, br, gzip or identity", encoding)
+		}
+		encodings = append(encodings, encoding)
+	}
+	return encodings, nil
+}
+
+// upstreamAcceptEncoding is the Accept-Encoding sent to the upstream
+func upstreamAcceptEncoding() string {
+	if len(upstreamEncodings) == 0 {
+		return "identity"
+	}
+	return strings.Join(upstreamEncodings, ", ")
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows encoding
+func acceptsEncoding(header, encoding string) bool {
+	wildcard := false
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		switch name {
+		case encoding:
+			return q > 0
+		case "*":
+			wildcard = q > 0
+		}
+	}
+	return wildcard
+}
+
+// responseEncoding returns the content encoding of a response, or "" for identity
+func responseEncoding(header http.Header) string {
+	encoding := strings.ToLower(strings.TrimSpace(header.Get("Content-Encoding")))
+	if encoding == "identity" {
+		return ""
+	}
+	return encoding
+}
+
+// decodingReader decompresses body according to encoding
+func decodingReader(encoding string, body io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case "gzip":
+		return gzip.NewReader(body)
+	case "br":
+		return io.NopCloser(brotli.NewReader(body)), nil
+	case "zstd":
+		decoder, err := zstd.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+}
+
+// mustDecodeResponse reports whether an encoded response has to be decompressed
+// before it reaches the client: because the proxy reads the body, or because the
+// client didn't accept the upstream's encoding. Otherwise the bytes pass through
+// compressed.
+func mustDecodeResponse(encoding, clientAcceptEncoding string, needsBody bool) bool {
+	if encoding == "" || !supportedEncodings[encoding] {
+		return false
+	}
+	decoded := needsBody || !acceptsEncoding(clientAcceptEncoding, encoding)
+	metrics.Add("openai_proxy_upstream_encoded_responses_total", "Compressed upstream responses, by encoding and whether the proxy decoded them.", map[string]string{"encoding": encoding, "decoded": strconv.FormatBool(decoded)}, 1)
+	return decoded
+}
+
+// responseBodyNeeded reports whether the proxy reads a buffered response body for
+// hooks, transforms, traces, usage accounting, caching or body logging
+func responseBodyNeeded(path string, overrides requestOverrides, cached bool) bool {
+	return cached ||
+		overrides.traceLevel == traceLevelFull ||
+		overrides.annotate ||
+		hooks.hasResponseHooks() ||
+		len(responseTransforms) > 0 ||
+		scriptHooks.HasResponseHook() ||
+		tenantHooks.hasResponseHooks() ||
+		usageAccounted() ||
+		(path == "/v1/embeddings" && len(embeddingDimensionRules) > 0) ||
+		schemaDrifts.watches(path) ||
+		bodyLogModeFor(path) != bodyLogOff
+}
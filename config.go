@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// envPrefix is prepended to the upper-cased flag name to form its environment variable
+const envPrefix = "OPENAI_PROXY_"
+
+var upstreamURL *url.URL
+
+// listenAddresses are the host:port pairs the forwarder binds to, from -host and -port
+var listenAddresses []string
+
+var hostnameRe = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*$`)
+
+// flagEnvName maps a flag such as "tts-cache-dir" to OPENAI_PROXY_TTS_CACHE_DIR
+func flagEnvName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// configPathFromArgs finds -config on the command line before flags are parsed,
+// falling back to OPENAI_PROXY_CONFIG
+func configPathFromArgs(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == arg {
+			continue
+		}
+		if value, ok := strings.CutPrefix(name, "config="); ok {
+			return value
+		}
+		if name == "config" && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return os.Getenv(flagEnvName("config"))
+}
+
+// applyConfigFile sets flags from a JSON object of flag names to values
+func applyConfigFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file %s: %v", path, err)
+	}
+	// Numbers are kept as written, so large integers aren't formatted as floats
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var values map[string]interface{}
+	if err := decoder.Decode(&values); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	for key, value := range values {
+		name := strings.ReplaceAll(key, "_", "-")
+		if flag.Lookup(name) == nil {
+			return fmt.Errorf("config file %s: unknown option %q", path, key)
+		}
+		var text string
+		switch v := value.(type) {
+		case string:
+			text = v
+		case []interface{}:
+			// Lists are accepted for comma-separated options
+			parts := make([]string, len(v))
+			for i, item := range v {
+				parts[i] = fmt.Sprint(item)
+			}
+			text = strings.Join(parts, ",")
+		default:
+			text = fmt.Sprint(v)
+		}
+		if err := flag.Set(name, text); err != nil {
+			return fmt.Errorf("config file %s: invalid value for %q: %v", path, key, err)
+		}
+	}
+	return nil
+}
+
+// applyEnv sets every flag that has a matching OPENAI_PROXY_* environment variable
+func applyEnv() error {
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		envName := flagEnvName(f.Name)
+		if value, ok := os.LookupEnv(envName); ok {
+			if setErr := flag.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value for %s: %v", envName, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// loadConfiguration resolves flag values with the precedence
+// command-line flag > environment variable > config file > default
+func loadConfiguration() error {
+	if path := configPathFromArgs(os.Args[1:]); path != "" {
+		if err := applyConfigFile(path); err != nil {
+			return err
+		}
+	}
+	if err := applyEnv(); err != nil {
+		return err
+	}
+	flag.Parse()
+
+	addresses, err := parseListenAddresses(*host, *port)
+	if err != nil {
+		return err
+	}
+	listenAddresses = addresses
+
+	parsed, err := url.Parse(*upstream)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("invalid -upstream %q: expected an http(s) base URL such as https://api.openai.com", *upstream)
+	}
+	parsed.Path = strings.TrimSuffix(parsed.Path, "/")
+	upstreamURL = parsed
+
+	if !validBodyLogMode(*logBodies) {
+		return fmt.Errorf("invalid -log-bodies %q: expected off, truncated or full", *logBodies)
+	}
+	if *logBodyMaxBytes < 0 {
+		return fmt.Errorf("invalid -log-body-max-bytes %d: must not be negative", *logBodyMaxBytes)
+	}
+	if bodyLogRoutes, err = parseBodyLogRoutes(*logBodyRoutesSpec); err != nil {
+		return err
+	}
+
+	if allowedOverrides, overrideUpstreams, err = parseOverridePolicy(*clientOverrides, *overrideUpstreamsSpec); err != nil {
+		return err
+	}
+
+	if upstreamEncodings, err = parseUpstreamEncodings(*upstreamEncodingList); err != nil {
+		return err
+	}
+
+	reasoningModels = parseReasoningModels(*reasoningModelsSpec)
+	fingerprintIgnored = parseFingerprintIgnoreFields(*fingerprintIgnoreFields)
+
+	if upstreamPool, err = parseUpstreamPool(*upstreamPoolSpec); err != nil {
+		return err
+	}
+	if err := configureUpstreamHost(); err != nil {
+		return err
+	}
+
+	if *shedMemoryMB < 0 || *shedGoroutines < 0 || *shedTraceStoreMB < 0 {
+		return fmt.Errorf("-shed-memory-mb, -shed-goroutines and -shed-trace-store-mb must not be negative")
+	}
+	if *shedDegradeAt <= 0 || *shedDegradeAt > 1 {
+		return fmt.Errorf("invalid -shed-degrade-at %v: expected a fraction above 0 and at most 1", *shedDegradeAt)
+	}
+	if _, err := parseShedDegrade(*shedDegradeItems); err != nil {
+		return err
+	}
+	if err := configureAuth(); err != nil {
+		return err
+	}
+	if !validStreamRetryMode(*streamRetryMode) {
+		return fmt.Errorf("invalid -stream-retry %q: expected off, discard or stitch", *streamRetryMode)
+	}
+	if staticCacheRules, err = parseStaticCacheRules(*staticCacheSpec); err != nil {
+		return err
+	}
+	if !validEmbeddingDimensionsMode(*embeddingDimensionsMode) {
+		return fmt.Errorf("invalid -embedding-dimensions-mode %q: expected auto, param or truncate", *embeddingDimensionsMode)
+	}
+	if embeddingDimensionRules, err = parseEmbeddingDimensions(*embeddingDimensionsSpec); err != nil {
+		return err
+	}
+	if modelTimeoutRules, err = parseModelTimeouts(*modelTimeoutsSpec); err != nil {
+		return err
+	}
+
+	if (*tlsCertFile == "") != (*tlsKeyFile == "") {
+		return fmt.Errorf("-tls-cert and -tls-key must be set together")
+	}
+	if !validClientCertMode(*clientCertMode) {
+		return fmt.Errorf("invalid -client-cert-mode %q: expected require, optional or mapped", *clientCertMode)
+	}
+	if *clientCAFile != "" {
+		if *tlsCertFile == "" {
+			return fmt.Errorf("-client-ca requires -tls-cert and -tls-key")
+		}
+		if clientCAs, err = loadClientCAs(*clientCAFile); err != nil {
+			return err
+		}
+	}
+
+	if upstreamCanary, err = parseCanary(*canaryUpstream, *canaryRoutesSpec); err != nil {
+		return err
+	}
+
+	if batchWindows, err = parseBatchSchedule(*batchSchedule); err != nil {
+		return err
+	}
+	if len(batchWindows) > 0 && !*asyncJobsEnabled {
+		return fmt.Errorf("-batch-schedule needs -async-jobs")
+	}
+	if *batchMode != "batch" && *batchMode != "offpeak" {
+		return fmt.Errorf("invalid -batch-mode %q: expected batch or offpeak", *batchMode)
+	}
+	if *batchMaxScheduled < 1 {
+		return fmt.Errorf("invalid -batch-max-scheduled %d: must be at least 1", *batchMaxScheduled)
+	}
+
+	if responseTransforms, err = parseResponseTransforms(*responseTransformSpec); err != nil {
+		return err
+	}
+
+	if *rulesFile != "" {
+		if requestRules, err = loadRules(*rulesFile); err != nil {
+			return err
+		}
+	}
+
+	if err := validateUserFieldTemplate(*userFieldTemplate); err != nil {
+		return err
+	}
+
+	routes, err := parseTransparentRoutes(*transparentRoutesSpec)
+	if err != nil {
+		return err
+	}
+	transparentRoutes = routes
+	return nil
+}
+
+// parseListenAddresses turns the comma-separated -host list into bind addresses.
+// Entries may be IPv4 or IPv6 addresses (optionally bracketed, with a zone such as
+// fe80::1%eth0) or hostnames, and may carry their own port overriding -port.
+func parseListenAddresses(hosts string, port int) ([]string, error) {
+	if port < 1 || port > 65535 {
+		return nil, fmt.Errorf("invalid -port %d: must be between 1 and 65535", port)
+	}
+	seen := make(map[string]bool)
+	var addresses []string
+	for _, entry := range strings.Split(hosts, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		hostPart, portPart := entry, strconv.Itoa(port)
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			hostPart, portPart = h, p
+		} else if strings.HasPrefix(entry, "[") && strings.HasSuffix(entry, "]") {
+			hostPart = entry[1 : len(entry)-1]
+		}
+
+		if n, err := strconv.Atoi(portPart); err != nil || n < 1 || n > 65535 {
+			return nil, fmt.Errorf("invalid -host entry %q: bad port %q", entry, portPart)
+		}
+		if _, err := netip.ParseAddr(hostPart); err != nil && !hostnameRe.MatchString(hostPart) {
+			if strings.Count(hostPart, ":") > 1 {
+				return nil, fmt.Errorf("invalid -host entry %q: not a valid IPv6 address (use brackets, e.g. [::1]:8080, to give a port)", entry)
+			}
+			return nil, fmt.Errorf("invalid -host entry %q: expected an IP address or hostname", entry)
+		}
+
+		address := net.JoinHostPort(hostPart, portPart)
+		if seen[address] {
+			return nil, fmt.Errorf("duplicate -host entry %q", entry)
+		}
+		seen[address] = true
+		addresses = append(addresses, address)
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("-host must list at least one address")
+	}
+	return addresses, nil
+}
+
+// canonicalPath reports whether a request path has no empty, "." or ".." segments
+// (a trailing slash is fine). Scopes match paths by prefix and upstreams resolve
+// such segments themselves, so only canonical paths mean the same to both.
+func canonicalPath(path string) bool {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if i == 0 || (i == len(segments)-1 && segment == "") {
+			continue
+		}
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// canonicalRequestPath reports whether the request's path is canonical and has no
+// encoded slashes, which would name another endpoint once decoded
+func canonicalRequestPath(u *url.URL) bool {
+	return canonicalPath(u.Path) && !strings.Contains(strings.ToLower(u.EscapedPath()), "%2f")
+}
+
+// upstreamTarget builds the upstream URL for a client request path and query
+func upstreamTarget(path, rawQuery string) *url.URL {
+	return &url.URL{
+		Scheme:   upstreamURL.Scheme,
+		Host:     upstreamURL.Host,
+		Path:     upstreamURL.Path + path,
+		RawQuery: rawQuery,
+	}
+}
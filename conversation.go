@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// conversationPart is one piece of message content
+type conversationPart struct {
+	Type     string `json:"type"` // text, refusal, image, audio or file
+	Text     string `json:"text,omitempty"`
+	URL      string `json:"url,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+	Format   string `json:"format,omitempty"`
+	FileID   string `json:"file_id,omitempty"`
+	Filename string `json:"filename,omitempty"`
+}
+
+type conversationToolCall struct {
+	Id        string `json:"id,omitempty"`
+	Type      string `json:"type"`
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments,omitempty"`
+}
+
+// conversationMessage is a message in the same shape whichever OpenAI API it came from
+type conversationMessage struct {
+	Role         string                 `json:"role"`
+	Name         string                 `json:"name,omitempty"`
+	Parts        []conversationPart     `json:"parts"`
+	ToolCalls    []conversationToolCall `json:"tool_calls,omitempty"`
+	ToolCallId   string                 `json:"tool_call_id,omitempty"` // for tool results
+	FinishReason string                 `json:"finish_reason,omitempty"`
+}
+
+// traceConversation is the normalized view of a traced chat exchange
+type traceConversation struct {
+	TraceId  string                `json:"trace_id"`
+	API      string                `json:"api"` // chat.completions, completions or responses
+	Model    string                `json:"model,omitempty"`
+	Messages []conversationMessage `json:"messages"`
+	Response []conversationMessage `json:"response"` // one per choice
+	Usage    *tokenUsage           `json:"usage,omitempty"`
+	Streamed bool                  `json:"streamed,omitempty"`
+	Note     string                `json:"note,omitempty"`
+}
+
+func jsonString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	}
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
+
+// conversationParts normalizes message content: a string, or an array of parts from
+// the chat completions or responses APIs
+func conversationParts(content interface{}) []conversationPart {
+	parts := []conversationPart{}
+	switch v := content.(type) {
+	case string:
+		if v != "" {
+			parts = append(parts, conversationPart{Type: "text", Text: v})
+		}
+	case []interface{}:
+		for _, item := range v {
+			part, _ := item.(map[string]interface{})
+			switch part["type"] {
+			case "text", "input_text", "output_text":
+				parts = append(parts, conversationPart{Type: "text", Text: jsonString(part["text"])})
+			case "refusal":
+				parts = append(parts, conversationPart{Type: "refusal", Text: jsonString(part["refusal"])})
+			case "image_url":
+				image, _ := part["image_url"].(map[string]interface{})
+				parts = append(parts, conversationPart{Type: "image", URL: jsonString(image["url"]), Detail: jsonString(image["detail"])})
+			case "input_image":
+				parts = append(parts, conversationPart{Type: "image", URL: jsonString(part["image_url"]), FileID: jsonString(part["file_id"]), Detail: jsonString(part["detail"])})
+			case "input_audio":
+				audio, _ := part["input_audio"].(map[string]interface{})
+				parts = append(parts, conversationPart{Type: "audio", Format: jsonString(audio["format"])})
+			case "file":
+				file, _ := part["file"].(map[string]interface{})
+				parts = append(parts, conversationPart{Type: "file", FileID: jsonString(file["file_id"]), Filename: jsonString(file["filename"])})
+			case "input_file":
+				parts = append(parts, conversationPart{Type: "file", FileID: jsonString(part["file_id"]), Filename: jsonString(part["filename"])})
+			default:
+				parts = append(parts, conversationPart{Type: jsonString(part["type"]), Text: jsonString(part["text"])})
+			}
+		}
+	}
+	return parts
+}
+
+// chatMessage normalizes a chat completions message
+func chatMessage(raw map[string]interface{}) conversationMessage {
+	message := conversationMessage{
+		Role:       jsonString(raw["role"]),
+		Name:       jsonString(raw["name"]),
+		Parts:      conversationParts(raw["content"]),
+		ToolCallId: jsonString(raw["tool_call_id"]),
+	}
+	if refusal, ok := raw["refusal"].(string); ok && refusal != "" {
+		message.Parts = append(message.Parts, conversationPart{Type: "refusal", Text: refusal})
+	}
+	if audio, ok := raw["audio"].(map[string]interface{}); ok {
+		message.Parts = append(message.Parts, conversationPart{Type: "audio", Text: jsonString(audio["transcript"])})
+	}
+	calls, _ := raw["tool_calls"].([]interface{})
+	for _, item := range calls {
+		call, _ := item.(map[string]interface{})
+		function, _ := call["function"].(map[string]interface{})
+		message.ToolCalls = append(message.ToolCalls, conversationToolCall{
+			Id:        jsonString(call["id"]),
+			Type:      jsonString(call["type"]),
+			Name:      jsonString(function["name"]),
+			Arguments: jsonString(function["arguments"]),
+		})
+	}
+	// Deprecated single function call
+	if function, ok := raw["function_call"].(map[string]interface{}); ok {
+		message.ToolCalls = append(message.ToolCalls, conversationToolCall{Type: "function", Name: jsonString(function["name"]), Arguments: jsonString(function["arguments"])})
+	}
+	return message
+}
+
+// responsesItems normalizes responses API input or output items. Function calls
+// attach to the preceding assistant message, as in chat completions.
+func responsesItems(items []interface{}) []conversationMessage {
+	var messages []conversationMessage
+	for _, entry := range items {
+		item, _ := entry.(map[string]interface{})
+		switch item["type"] {
+		case "function_call", "custom_tool_call":
+			call := conversationToolCall{Id: jsonString(item["call_id"]), Type: "function", Name: jsonString(item["name"]), Arguments: jsonString(item["arguments"])}
+			if n := len(messages); n > 0 && messages[n-1].Role == "assistant" {
+				messages[n-1].ToolCalls = append(messages[n-1].ToolCalls, call)
+			} else {
+				messages = append(messages, conversationMessage{Role: "assistant", Parts: []conversationPart{}, ToolCalls: []conversationToolCall{call}})
+			}
+		case "function_call_output", "custom_tool_call_output":
+			messages = append(messages, conversationMessage{Role: "tool", Parts: conversationParts(jsonString(item["output"])), ToolCallId: jsonString(item["call_id"])})
+		case "reasoning":
+			// Reasoning summaries are not part of the conversation
+		default:
+			if role, ok := item["role"].(string); ok {
+				messages = append(messages, conversationMessage{Role: role, Parts: conversationParts(item["content"])})
+			}
+		}
+	}
+	return messages
+}
+
+// conversationAPIs maps endpoint paths to the API names of traceConversation
+var conversationAPIs = map[string]string{
+	"/v1/chat/completions": "chat.completions",
+	"/v1/completions":      "completions",
+	"/v1/responses":        "responses",
+}
+
+// conversationRequest normalizes the messages of a request body
+func conversationRequest(conversation *traceConversation, body []byte) bool {
+	var request map[string]interface{}
+	if json.Unmarshal(body, &request) != nil {
+		return false
+	}
+	conversation.Model = jsonString(request["model"])
+	switch conversation.API {
+	case "chat.completions":
+		messages, _ := request["messages"].([]interface{})
+		for _, item := range messages {
+			raw, _ := item.(map[string]interface{})
+			conversation.Messages = append(conversation.Messages, chatMessage(raw))
+		}
+	case "responses":
+		if instructions, ok := request["instructions"].(string); ok && instructions != "" {
+			conversation.Messages = append(conversation.Messages, conversationMessage{Role: "system", Parts: conversationParts(instructions)})
+		}
+		switch input := request["input"].(type) {
+		case string:
+			conversation.Messages = append(conversation.Messages, conversationMessage{Role: "user", Parts: conversationParts(input)})
+		case []interface{}:
+			conversation.Messages = append(conversation.Messages, responsesItems(input)...)
+		}
+	case "completions":
+		conversation.Messages = append(conversation.Messages, conversationMessage{Role: "user", Parts: conversationParts(jsonString(request["prompt"]))})
+	}
+	return true
+}
+
+// conversationResponse normalizes a buffered response body
+func conversationResponse(conversation *traceConversation, body []byte) bool {
+	var response map[string]interface{}
+	if json.Unmarshal(body, &response) != nil {
+		return false
+	}
+	if usage, ok := parseUsage(body); ok && usage.TotalTokens > 0 {
+		conversation.Usage = &usage
+	}
+	if output, ok := response["output"].([]interface{}); ok {
+		messages := responsesItems(output)
+		if len(messages) > 0 {
+			messages[len(messages)-1].FinishReason = jsonString(response["status"])
+		}
+		conversation.Response = append(conversation.Response, messages...)
+		return true
+	}
+	choices, ok := response["choices"].([]interface{})
+	if !ok {
+		return false
+	}
+	for _, item := range choices {
+		choice, _ := item.(map[string]interface{})
+		var message conversationMessage
+		if raw, ok := choice["message"].(map[string]interface{}); ok {
+			message = chatMessage(raw)
+		} else {
+			message = conversationMessage{Role: "assistant", Parts: conversationParts(jsonString(choice["text"]))}
+		}
+		message.FinishReason = jsonString(choice["finish_reason"])
+		conversation.Response = append(conversation.Response, message)
+	}
+	return true
+}
+
+// reassembleStream rebuilds the response from a streamed body by merging chat
+// completion deltas, or by taking the final response of a responses API stream
+func reassembleStream(conversation *traceConversation, stream []byte) bool {
+	events, _ := parseSSE(string(stream) + "\n\n")
+	type choiceState struct {
+		message conversationMessage
+		text    strings.Builder
+		calls   map[int]*conversationToolCall
+		order   []int
+	}
+	choices := map[int]*choiceState{}
+	found := false
+	for _, event := range events {
+		if event.Data == sseDone {
+			continue
+		}
+		var chunk map[string]interface{}
+		if json.Unmarshal([]byte(event.Data), &chunk) != nil {
+			continue
+		}
+		if chunk["type"] == "response.completed" {
+			completed, _ := json.Marshal(chunk["response"])
+			conversation.Response = nil
+			return conversationResponse(conversation, completed)
+		}
+		if usage, ok := parseUsage([]byte(event.Data)); ok && usage.TotalTokens > 0 {
+			conversation.Usage = &usage
+		}
+		list, _ := chunk["choices"].([]interface{})
+		for _, item := range list {
+			found = true
+			choice, _ := item.(map[string]interface{})
+			index := int(toFloat(choice["index"]))
+			state, ok := choices[index]
+			if !ok {
+				state = &choiceState{message: conversationMessage{Role: "assistant"}, calls: map[int]*conversationToolCall{}}
+				choices[index] = state
+			}
+			if reason, ok := choice["finish_reason"].(string); ok {
+				state.message.FinishReason = reason
+			}
+			delta, ok := choice["delta"].(map[string]interface{})
+			if !ok {
+				state.text.WriteString(jsonString(choice["text"])) // legacy completions
+				continue
+			}
+			if role, ok := delta["role"].(string); ok {
+				state.message.Role = role
+			}
+			state.text.WriteString(jsonString(delta["content"]))
+			calls, _ := delta["tool_calls"].([]interface{})
+			for _, callItem := range calls {
+				callDelta, _ := callItem.(map[string]interface{})
+				callIndex := int(toFloat(callDelta["index"]))
+				call, ok := state.calls[callIndex]
+				if !ok {
+					call = &conversationToolCall{Type: "function"}
+					state.calls[callIndex] = call
+					state.order = append(state.order, callIndex)
+				}
+				if id, ok := callDelta["id"].(string); ok {
+					call.Id = id
+				}
+				function, _ := callDelta["function"].(map[string]interface{})
+				if name, ok := function["name"].(string); ok {
+					call.Name += name
+				}
+				call.Arguments += jsonString(function["arguments"])
+			}
+		}
+	}
+	indexes := make([]int, 0, len(choices))
+	for index := range choices {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	for _, index := range indexes {
+		state := choices[index]
+		state.message.Parts = conversationParts(state.text.String())
+		for _, callIndex := range state.order {
+			state.message.ToolCalls = append(state.message.ToolCalls, *state.calls[callIndex])
+		}
+		conversation.Response = append(conversation.Response, state.message)
+	}
+	return found
+}
+
+func toFloat(value interface{}) float64 {
+	f, _ := value.(float64)
+	return f
+}
+
+// capturedResponseBody collects the upstream body chunks of a trace from its capture
+// file. Chunks are captured as the upstream sent them, so each response (a retried
+// stream has several) is decompressed according to its Content-Encoding.
+func capturedResponseBody(path, traceID string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open capture file %s: %v", path, err)
+	}
+	defer f.Close()
+	var body, raw []byte
+	var encoding string
+	flush := func() error {
+		decoded, err := decodeCapturedBody(encoding, raw)
+		body, raw = append(body, decoded...), nil
+		return err
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 256<<20)
+	for scanner.Scan() {
+		var record captureRecord
+		if json.Unmarshal(scanner.Bytes(), &record) != nil || record.TraceID != traceID {
+			continue
+		}
+		switch record.Type {
+		case "response":
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			encoding = responseEncoding(record.Header)
+		case "chunk":
+			raw = append(raw, record.Body...)
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return body, scanner.Err()
+}
+
+// decodeCapturedBody decompresses a captured response body. A stream cut short
+// yields what was decoded before the cut.
+func decodeCapturedBody(encoding string, raw []byte) ([]byte, error) {
+	if encoding == "" || len(raw) == 0 {
+		return raw, nil
+	}
+	if !supportedEncodings[encoding] {
+		return nil, fmt.Errorf("captured stream has unsupported content encoding %q", encoding)
+	}
+	reader, err := decodingReader(encoding, bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s stream: %v", encoding, err)
+	}
+	defer reader.Close()
+	decoded, err := io.ReadAll(reader)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, fmt.Errorf("failed to decode %s stream: %v", encoding, err)
+	}
+	return decoded, nil
+}
+
+// buildConversation normalizes a trace's request and response
+func buildConversation(trace Trace) (*traceConversation, error) {
+	requestBody, responseBody, err := traceBodies(trace)
+	if err != nil {
+		return nil, err
+	}
+	var api string
+	if target, err := url.Parse(trace.URL); err == nil {
+		for path, name := range conversationAPIs {
+			if strings.HasSuffix(target.Path, path) {
+				api = name
+			}
+		}
+	}
+	conversation := &traceConversation{TraceId: trace.Id, API: api, Messages: []conversationMessage{}, Response: []conversationMessage{}}
+	if api == "" || !conversationRequest(conversation, []byte(requestBody)) {
+		return nil, fmt.Errorf("trace %s is not a chat completions, completions or responses request", trace.Id)
+	}
+
+	streamed := strings.HasPrefix(responseBody, "[STREAMING RESPONSE") || strings.HasPrefix(responseBody, "[CLIENT ABORTED")
+	switch {
+	case !streamed:
+		if !conversationResponse(conversation, []byte(responseBody)) {
+			conversation.Note = "the response is not a completion"
+		}
+	case trace.CaptureFile != "":
+		conversation.Streamed = true
+		stream, err := capturedResponseBody(trace.CaptureFile, trace.Id)
+		if err != nil {
+			return nil, err
+		}
+		if !reassembleStream(conversation, stream) {
+			conversation.Note = "the captured stream contains no completion chunks"
+		}
+	default:
+		conversation.Streamed = true
+		conversation.Note = "the response was streamed and not recorded; enable -capture-dir to reassemble streams"
+	}
+	return conversation, nil
+}
+
+// handleTraceSubresource serves /traces/<id> (see handleTrace),
+// GET /traces/<id>/conversation, GET /traces/<id>/events (see handleTraceEvents)
+// and POST /traces/<id>/redact and /restore (see handleTraceRedaction)
+func handleTraceSubresource(w http.ResponseWriter, r *http.Request) {
+	id, resource, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/traces/"), "/")
+	switch resource {
+	case "":
+		handleTrace(w, r, id)
+		return
+	case "events":
+		handleTraceEvents(w, r, id)
+		return
+	case "redact", "restore":
+		handleTraceRedaction(w, r, id, resource)
+		return
+	case "testcase":
+		handleTraceTestCase(w, r, id)
+		return
+	}
+	if resource != "conversation" {
+		writeJSONError(w, http.StatusNotFound, "not_found", "unknown trace resource")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "invalid_request_error", "use GET")
+		return
+	}
+	trace, ok := findTrace(id)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("no stored trace with id %q", id))
+		return
+	}
+	conversation, err := buildConversation(trace)
+	if err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, "invalid_request_error", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(conversation)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// embeddingDimensionsParamModels are the model prefixes that accept the dimensions
+// parameter; other models' vectors can only be truncated by the proxy
+var embeddingDimensionsParamModels = []string{"text-embedding-3"}
+
+// embeddingDimensionRule sets the vector size of embedding models with a prefix;
+// an empty prefix covers every model
+type embeddingDimensionRule struct {
+	prefix     string
+	dimensions int
+}
+
+// embeddingDimensionRules are the -embedding-dimensions rules, longest prefix first
+var embeddingDimensionRules []embeddingDimensionRule
+
+// validEmbeddingDimensionsMode reports whether mode is a supported -embedding-dimensions-mode
+func validEmbeddingDimensionsMode(mode string) bool {
+	switch mode {
+	case "auto", "param", "truncate":
+		return true
+	}
+	return false
+}
+
+// parseEmbeddingDimensions parses -embedding-dimensions: a vector size for every
+// model, or comma-separated model-prefix=size pairs
+func parseEmbeddingDimensions(spec string) ([]embeddingDimensionRule, error) {
+	var rules []embeddingDimensionRule
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, size, ok := strings.Cut(entry, "=")
+		if !ok {
+			prefix, size = "", entry
+		}
+		dimensions, err := strconv.Atoi(strings.TrimSpace(size))
+		if err != nil || dimensions <= 0 {
+			return nil, fmt.Errorf("invalid -embedding-dimensions entry %q: expected a positive size or model=size", entry)
+		}
+		rules = append(rules, embeddingDimensionRule{prefix: strings.TrimSpace(prefix), dimensions: dimensions})
+	}
+	sort.SliceStable(rules, func(i, j int) bool { return len(rules[i].prefix) > len(rules[j].prefix) })
+	return rules, nil
+}
+
+// embeddingResize is how the proxy brings an embedding request's vectors to the
+// policy's size
+type embeddingResize struct {
+	dimensions int
+	truncate   bool // cut and re-normalize the returned vectors
+}
+
+// String describes the resize for X-Proxy-Embedding-Dimensions
+func (e embeddingResize) String() string {
+	if e.truncate {
+		return strconv.Itoa(e.dimensions) + "; truncated"
+	}
+	return strconv.Itoa(e.dimensions) + "; param"
+}
+
+// resizeEmbeddingRequest applies the vector size policy to an embeddings request.
+// Models that accept it get the dimensions parameter; for the others, or in
+// truncate mode, the client's dimensions is dropped so the full vectors come back
+// to be truncated. It returns nil when no rule covers the request's model.
+func resizeEmbeddingRequest(path string, body []byte) ([]byte, *embeddingResize) {
+	if len(embeddingDimensionRules) == 0 || path != "/v1/embeddings" {
+		return body, nil
+	}
+	model := bodyModel(body)
+	var resize *embeddingResize
+	for _, rule := range embeddingDimensionRules {
+		if strings.HasPrefix(model, rule.prefix) {
+			resize = &embeddingResize{dimensions: rule.dimensions}
+			break
+		}
+	}
+	if resize == nil {
+		return body, nil
+	}
+	switch *embeddingDimensionsMode {
+	case "truncate":
+		resize.truncate = true
+	case "auto":
+		resize.truncate = true
+		for _, prefix := range embeddingDimensionsParamModels {
+			if strings.HasPrefix(model, prefix) {
+				resize.truncate = false
+			}
+		}
+	}
+
+	doc, err := parseJSONDocument(body)
+	if err != nil {
+		return body, nil
+	}
+	object, ok := doc.root.(map[string]interface{})
+	if !ok {
+		return body, nil
+	}
+	if resize.truncate {
+		delete(object, "dimensions")
+	} else {
+		object["dimensions"] = resize.dimensions
+	}
+	encoded, err := doc.encode()
+	if err != nil {
+		return body, nil
+	}
+	return encoded, resize
+}
+
+// truncateEmbeddings cuts every vector of an embeddings response to the policy's
+// size and scales it back to unit length. Vectors no longer than that are left
+// alone. It returns the body and whether it changed.
+func truncateEmbeddings(body []byte, resize *embeddingResize) ([]byte, bool) {
+	if resize == nil || !resize.truncate {
+		return body, false
+	}
+	var response map[string]json.RawMessage
+	if err := json.Unmarshal(body, &response); err != nil {
+		return body, false
+	}
+	var data []map[string]json.RawMessage
+	if err := json.Unmarshal(response["data"], &data); err != nil {
+		return body, false
+	}
+	truncated := 0
+	for _, item := range data {
+		resized, size, err := truncateEmbedding(item["embedding"], resize.dimensions)
+		if err != nil {
+			log.Printf("⚠️ Failed to truncate embedding: %v", err)
+			return body, false
+		}
+		if resized != nil {
+			item["embedding"] = resized
+			truncated++
+		} else if size < resize.dimensions {
+			metrics.Add("openai_proxy_embeddings_too_short_total", "Embedding vectors shorter than their -embedding-dimensions size, passed on unchanged.", map[string]string{"dimensions": strconv.Itoa(resize.dimensions)}, 1)
+		}
+	}
+	if truncated == 0 {
+		return body, false
+	}
+	encodedData, err := json.Marshal(data)
+	if err != nil {
+		return body, false
+	}
+	response["data"] = encodedData
+	encoded, err := json.Marshal(response)
+	if err != nil {
+		return body, false
+	}
+	metrics.Add("openai_proxy_embeddings_truncated_total", "Embedding vectors truncated and re-normalized by the proxy, by size.", map[string]string{"dimensions": strconv.Itoa(resize.dimensions)}, float64(truncated))
+	return encoded, true
+}
+
+// truncateEmbedding resizes one embedding, a JSON float array or, with
+// encoding_format base64, little-endian float32s, keeping its encoding. It returns
+// the vector's original size, and no embedding when it isn't longer than dimensions.
+func truncateEmbedding(raw json.RawMessage, dimensions int) (json.RawMessage, int, error) {
+	var encoded string
+	if json.Unmarshal(raw, &encoded) == nil {
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(data)%4 != 0 {
+			return nil, 0, fmt.Errorf("invalid base64 embedding")
+		}
+		vector := make([]float64, len(data)/4)
+		for i := range vector {
+			vector[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:])))
+		}
+		size := len(vector)
+		if size <= dimensions {
+			return nil, size, nil
+		}
+		vector = normalizeVector(vector[:dimensions])
+		data = make([]byte, 4*dimensions)
+		for i, value := range vector {
+			binary.LittleEndian.PutUint32(data[4*i:], math.Float32bits(float32(value)))
+		}
+		resized, err := json.Marshal(base64.StdEncoding.EncodeToString(data))
+		return resized, size, err
+	}
+	var vector []float64
+	if err := json.Unmarshal(raw, &vector); err != nil {
+		return nil, 0, fmt.Errorf("embedding is neither a float array nor base64")
+	}
+	size := len(vector)
+	if size <= dimensions {
+		return nil, size, nil
+	}
+	vector = normalizeVector(vector[:dimensions])
+	// float32 precision, as the upstream sends
+	values := make([]float32, len(vector))
+	for i, value := range vector {
+		values[i] = float32(value)
+	}
+	resized, err := json.Marshal(values)
+	return resized, size, err
+}
+
+// normalizeVector scales a vector to unit L2 length, as the API's own shortened
+// embeddings are
+func normalizeVector(vector []float64) []float64 {
+	var norm float64
+	for _, value := range vector {
+		norm += value * value
+	}
+	if norm = math.Sqrt(norm); norm > 0 {
+		for i := range vector {
+			vector[i] /= norm
+		}
+	}
+	return vector
+}
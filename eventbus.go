@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// busEvent is one message queued for the event bus
+type busEvent struct {
+	kind    string // "trace" or "usage"
+	topic   string
+	key     string
+	payload interface{}
+}
+
+// usageEvent is published for every buffered response that reports token usage
+type usageEvent struct {
+	TraceID          string    `json:"trace_id"`
+	Timestamp        time.Time `json:"timestamp"`
+	KeyID            string    `json:"key_id"`
+	KeyName          string    `json:"key_name"`
+	Tenant           string    `json:"tenant"`
+	Path             string    `json:"path"`
+	Model            string    `json:"model"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	TotalTokens      int       `json:"total_tokens"`
+	CachedTokens     int       `json:"cached_tokens,omitempty"`
+	ReasoningTokens  int       `json:"reasoning_tokens,omitempty"`
+	Fingerprint      string    `json:"fingerprint,omitempty"` // of the request, see requestFingerprint
+}
+
+// eventBusPublisher sends encoded events to Kafka or NATS
+type eventBusPublisher interface {
+	Publish(ctx context.Context, topic, key string, data []byte) error
+}
+
+type kafkaEventPublisher struct{}
+
+func (kafkaEventPublisher) Publish(ctx context.Context, topic, key string, data []byte) error {
+	return kafkaProduce(ctx, topic, []byte(key), data, nil)
+}
+
+type natsEventPublisher struct {
+	conn *nats.Conn
+}
+
+func (p natsEventPublisher) Publish(ctx context.Context, topic, key string, data []byte) error {
+	return p.conn.PublishMsg(&nats.Msg{Subject: topic, Data: data, Header: nats.Header{"Key": []string{key}}})
+}
+
+// eventBus is nil unless -event-bus is set
+var eventBus eventBusPublisher
+
+// eventQueue decouples request handling from the bus, like the stream tee queue
+var eventQueue chan busEvent
+
+// openEventBus connects to the bus selected by -event-bus
+func openEventBus() error {
+	switch *eventBusName {
+	case "":
+		return nil
+	case "kafka":
+		if *kafkaBrokers == "" {
+			return fmt.Errorf("-event-bus kafka needs -kafka-brokers")
+		}
+		eventBus = kafkaEventPublisher{}
+	case "nats":
+		conn, err := nats.Connect(*natsURL, nats.Name("openai_proxy"), nats.MaxReconnects(-1))
+		if err != nil {
+			return fmt.Errorf("failed to connect to NATS at %s: %v", *natsURL, err)
+		}
+		eventBus = natsEventPublisher{conn: conn}
+	default:
+		return fmt.Errorf("invalid -event-bus %q: expected kafka or nats", *eventBusName)
+	}
+	if *eventFormat != "json" && *eventFormat != "cloudevents" {
+		return fmt.Errorf("invalid -event-format %q: expected json or cloudevents", *eventFormat)
+	}
+	eventQueue = make(chan busEvent, 1024)
+	go func() {
+		for event := range eventQueue {
+			deliverBusEvent(event)
+		}
+	}()
+	return nil
+}
+
+// publishTrace queues a completed trace for -event-trace-topic. Credentials are
+// masked as in capture files, since the bus is outside the proxy.
+func publishTrace(trace Trace) {
+	if eventBus != nil && *eventTraceTopic != "" {
+		trace.RequestHeader = redactCaptureHeader(trace.RequestHeader)
+		queueBusEvent(busEvent{kind: "trace", topic: *eventTraceTopic, key: trace.Id, payload: trace})
+	}
+}
+
+// publishUsage queues a usage event for -event-usage-topic
+func publishUsage(event usageEvent) {
+	if eventBus != nil && *eventUsageTopic != "" {
+		queueBusEvent(busEvent{kind: "usage", topic: *eventUsageTopic, key: event.KeyID, payload: event})
+	}
+}
+
+func queueBusEvent(event busEvent) {
+	select {
+	case eventQueue <- event:
+	default:
+		log.Printf("⚠️ Event bus queue full, dropping %s event %s", event.kind, event.key)
+		metrics.Add("openai_proxy_events_published_total", "Events published to the event bus, by kind and outcome.", map[string]string{"kind": event.kind, "outcome": "dropped"}, 1)
+	}
+}
+
+// encodeBusEvent serializes an event as plain JSON or as a structured-mode
+// CloudEvents 1.0 JSON envelope
+func encodeBusEvent(event busEvent) ([]byte, error) {
+	if *eventFormat != "cloudevents" {
+		return json.Marshal(event.payload)
+	}
+	return json.Marshal(map[string]interface{}{
+		"specversion":     "1.0",
+		"id":              generateTraceID(),
+		"source":          "openai_proxy",
+		"type":            "openai_proxy." + event.kind,
+		"subject":         event.key,
+		"time":            time.Now().UTC().Format(time.RFC3339Nano),
+		"datacontenttype": "application/json",
+		"data":            event.payload,
+	})
+}
+
+func deliverBusEvent(event busEvent) {
+	outcome := "ok"
+	defer func() {
+		metrics.Add("openai_proxy_events_published_total", "Events published to the event bus, by kind and outcome.", map[string]string{"kind": event.kind, "outcome": outcome}, 1)
+	}()
+	data, err := encodeBusEvent(event)
+	if err != nil {
+		log.Printf("❌ Failed to encode %s event %s: %v", event.kind, event.key, err)
+		outcome = "error"
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := eventBus.Publish(ctx, event.topic, event.key, data); err != nil {
+		log.Printf("❌ Failed to publish %s event %s to %s: %v", event.kind, event.key, event.topic, err)
+		outcome = "error"
+	}
+}
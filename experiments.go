@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// experimentLatencySamples is how many recent latencies per arm the percentiles
+// are computed over
+const experimentLatencySamples = 2000
+
+// experimentArm accumulates the outcomes of one side of the canary split
+type experimentArm struct {
+	requests int
+	errors   int // 5xx answers and failed upstream calls, as for rollbacks
+	// latencies holds the latest durations in seconds, from sending the request
+	// upstream to the end of the response
+	latencies  []float64
+	next       int
+	latencySum float64
+
+	usageResponses   int // buffered responses that reported token usage
+	promptTokens     int
+	completionTokens int
+	reasoningTokens  int
+	cost             float64
+	costed           int // responses priced from the price table
+}
+
+func (a *experimentArm) add(failed bool, latency time.Duration, body []byte) {
+	a.requests++
+	if failed {
+		a.errors++
+	}
+	seconds := latency.Seconds()
+	a.latencySum += seconds
+	if len(a.latencies) < experimentLatencySamples {
+		a.latencies = append(a.latencies, seconds)
+	} else {
+		a.latencies[a.next] = seconds
+		a.next = (a.next + 1) % experimentLatencySamples
+	}
+	if usage, ok := parseUsage(body); ok {
+		a.usageResponses++
+		a.promptTokens += usage.PromptTokens
+		a.completionTokens += usage.CompletionTokens
+		a.reasoningTokens += usage.CompletionTokensDetails.ReasoningTokens
+		if cost, ok := estimateCost(bodyModel(body), usage); ok {
+			a.cost += cost
+			a.costed++
+		}
+	}
+}
+
+// experimentScoreboard compares the primary and canary upstreams over every
+// request on the canary's routes since the experiment started
+type experimentScoreboard struct {
+	mu      sync.Mutex
+	started time.Time
+	primary experimentArm
+	canary  experimentArm
+}
+
+var experiments = &experimentScoreboard{started: time.Now()}
+
+// Observe records a finished request. body is the buffered response, or nil for
+// streams and failed calls, whose tokens aren't known.
+func (s *experimentScoreboard) Observe(path string, canary, failed bool, latency time.Duration, body []byte) {
+	if !upstreamCanary.matches(path) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if canary {
+		s.canary.add(failed, latency, body)
+	} else {
+		s.primary.add(failed, latency, body)
+	}
+}
+
+// reset starts a new experiment
+func (s *experimentScoreboard) reset() {
+	s.mu.Lock()
+	s.started, s.primary, s.canary = time.Now(), experimentArm{}, experimentArm{}
+	s.mu.Unlock()
+}
+
+type experimentLatency struct {
+	MeanMs float64 `json:"mean_ms"`
+	P50Ms  float64 `json:"p50_ms"`
+	P95Ms  float64 `json:"p95_ms"`
+	P99Ms  float64 `json:"p99_ms"`
+}
+
+type experimentTokens struct {
+	Responses           int     `json:"responses"` // buffered responses reporting usage
+	Prompt              int     `json:"prompt"`
+	Completion          int     `json:"completion"`
+	Reasoning           int     `json:"reasoning,omitempty"`
+	MeanPerResponse     float64 `json:"mean_per_response"`
+	EstimatedCostUSD    float64 `json:"estimated_cost_usd"`
+	MeanCostPerResponse float64 `json:"mean_cost_per_response_usd"`
+}
+
+type experimentArmReport struct {
+	Arm       string            `json:"arm"` // primary or canary
+	Requests  int               `json:"requests"`
+	Errors    int               `json:"errors"`
+	ErrorRate float64           `json:"error_rate"`
+	Latency   experimentLatency `json:"latency"`
+	Tokens    experimentTokens  `json:"tokens"`
+}
+
+// experimentComparison sets the canary against the primary; ratios are 0 while
+// either arm lacks the data
+type experimentComparison struct {
+	ErrorRateDelta    float64 `json:"error_rate_delta"` // canary minus primary
+	LatencyP50Ratio   float64 `json:"latency_p50_ratio"`
+	LatencyP95Ratio   float64 `json:"latency_p95_ratio"`
+	TokensPerResponse float64 `json:"tokens_per_response_ratio"`
+	CostPerResponse   float64 `json:"cost_per_response_ratio"`
+	EnoughSamples     bool    `json:"enough_samples"` // both arms have -canary-min-samples requests
+}
+
+type experimentReport struct {
+	Experiment string                `json:"experiment"`
+	Upstream   string                `json:"upstream"`
+	Routes     []string              `json:"routes,omitempty"`
+	Percent    float64               `json:"percent"`
+	RolledBack string                `json:"rolled_back,omitempty"`
+	StartedAt  time.Time             `json:"started_at"`
+	Arms       []experimentArmReport `json:"arms"`
+	Comparison experimentComparison  `json:"comparison"`
+}
+
+func (a *experimentArm) report(name string) experimentArmReport {
+	report := experimentArmReport{Arm: name, Requests: a.requests, Errors: a.errors}
+	if a.requests > 0 {
+		report.ErrorRate = float64(a.errors) / float64(a.requests)
+		report.Latency.MeanMs = a.latencySum / float64(a.requests) * 1000
+	}
+	if len(a.latencies) > 0 {
+		sorted := append([]float64(nil), a.latencies...)
+		sort.Float64s(sorted)
+		percentile := func(p float64) float64 {
+			return sorted[min(len(sorted)-1, int(p*float64(len(sorted))))] * 1000
+		}
+		report.Latency.P50Ms, report.Latency.P95Ms, report.Latency.P99Ms = percentile(0.50), percentile(0.95), percentile(0.99)
+	}
+	report.Tokens = experimentTokens{
+		Responses:        a.usageResponses,
+		Prompt:           a.promptTokens,
+		Completion:       a.completionTokens,
+		Reasoning:        a.reasoningTokens,
+		EstimatedCostUSD: a.cost,
+	}
+	if a.usageResponses > 0 {
+		report.Tokens.MeanPerResponse = float64(a.promptTokens+a.completionTokens) / float64(a.usageResponses)
+	}
+	if a.costed > 0 {
+		report.Tokens.MeanCostPerResponse = a.cost / float64(a.costed)
+	}
+	return report
+}
+
+func experimentRatio(canary, primary float64) float64 {
+	if canary == 0 || primary == 0 {
+		return 0
+	}
+	return canary / primary
+}
+
+func (s *experimentScoreboard) report() experimentReport {
+	status := upstreamCanary.status()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	primary, canary := s.primary.report("primary"), s.canary.report("canary")
+	return experimentReport{
+		Experiment: "canary",
+		Upstream:   status.Upstream,
+		Routes:     status.Routes,
+		Percent:    status.Percent,
+		RolledBack: status.RolledBack,
+		StartedAt:  s.started,
+		Arms:       []experimentArmReport{primary, canary},
+		Comparison: experimentComparison{
+			ErrorRateDelta:    canary.ErrorRate - primary.ErrorRate,
+			LatencyP50Ratio:   experimentRatio(canary.Latency.P50Ms, primary.Latency.P50Ms),
+			LatencyP95Ratio:   experimentRatio(canary.Latency.P95Ms, primary.Latency.P95Ms),
+			TokensPerResponse: experimentRatio(canary.Tokens.MeanPerResponse, primary.Tokens.MeanPerResponse),
+			CostPerResponse:   experimentRatio(canary.Tokens.MeanCostPerResponse, primary.Tokens.MeanCostPerResponse),
+			EnoughSamples:     canary.Requests >= *canaryMinSamples && primary.Requests >= *canaryMinSamples,
+		},
+	}
+}
+
+// handleExperiments serves GET /experiments, the scoreboard of the canary split,
+// and DELETE /experiments to start counting afresh
+func handleExperiments(w http.ResponseWriter, r *http.Request) {
+	if upstreamCanary == nil {
+		writeJSONError(w, http.StatusNotFound, "not_found", "no experiment is running; set -canary-upstream")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		experiments.reset()
+		log.Printf("🧪 Experiment scoreboard reset")
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "invalid_request_error", "use GET or DELETE")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(experiments.report())
+}
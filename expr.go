@@ -0,0 +1,712 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Rule conditions are written in a small CEL-like expression language, such as
+//
+//	body.model == "gpt-4o" && size(body.messages) > 20
+//	path.startsWith("/v1/embeddings") || headers["x-team"] in ["search", "ads"]
+//
+// Values are JSON values: null, booleans, numbers, strings, lists and maps. Fields
+// that don't exist are null instead of an error, so conditions on optional fields
+// need no guards. Expressions are compiled once into closures; evaluating one only
+// walks the already parsed request.
+
+// exprEnv holds the variables a condition can use
+type exprEnv struct {
+	vars map[string]interface{}
+}
+
+// compiledExpr evaluates a parsed expression against an environment
+type compiledExpr func(env *exprEnv) (interface{}, error)
+
+// exprToken is one lexical token of an expression
+type exprToken struct {
+	kind  string // "ident", "number", "string", "op" or "eof"
+	text  string
+	value interface{}
+	pos   int
+}
+
+var exprOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "*", "/", "%", "(", ")", "[", "]", ",", "."}
+
+func lexExpr(source string) ([]exprToken, error) {
+	var tokens []exprToken
+	i := 0
+	for i < len(source) {
+		c := source[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			end := i + 1
+			for end < len(source) && source[end] != c {
+				if source[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(source) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			raw := source[i+1 : end]
+			if c == '\'' {
+				raw = strings.ReplaceAll(strings.ReplaceAll(raw, `\'`, `'`), `"`, `\"`)
+			}
+			text, err := strconv.Unquote(`"` + raw + `"`)
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at %d: %v", i, err)
+			}
+			tokens = append(tokens, exprToken{kind: "string", value: text, pos: i})
+			i = end + 1
+		case c >= '0' && c <= '9':
+			end := i
+			for end < len(source) && (source[end] >= '0' && source[end] <= '9' || source[end] == '.' || source[end] == 'e' || source[end] == 'E') {
+				end++
+			}
+			number, err := strconv.ParseFloat(source[i:end], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q at %d", source[i:end], i)
+			}
+			tokens = append(tokens, exprToken{kind: "number", value: number, pos: i})
+			i = end
+		case c == '_' || unicode.IsLetter(rune(c)):
+			end := i
+			for end < len(source) && (source[end] == '_' || unicode.IsLetter(rune(source[end])) || unicode.IsDigit(rune(source[end]))) {
+				end++
+			}
+			tokens = append(tokens, exprToken{kind: "ident", text: source[i:end], pos: i})
+			i = end
+		default:
+			matched := false
+			for _, op := range exprOperators {
+				if strings.HasPrefix(source[i:], op) {
+					tokens = append(tokens, exprToken{kind: "op", text: op, pos: i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+		}
+	}
+	return append(tokens, exprToken{kind: "eof", pos: len(source)}), nil
+}
+
+// exprParser is a recursive descent parser producing closures
+type exprParser struct {
+	tokens []exprToken
+	next   int
+}
+
+// compileExpr parses an expression into an evaluable closure
+func compileExpr(source string) (compiledExpr, error) {
+	tokens, err := lexExpr(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %v", source, err)
+	}
+	p := &exprParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err == nil && p.peek().kind != "eof" {
+		err = fmt.Errorf("unexpected %s at %d", p.describe(p.peek()), p.peek().pos)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %v", source, err)
+	}
+	return expr, nil
+}
+
+func (p *exprParser) peek() exprToken { return p.tokens[p.next] }
+
+func (p *exprParser) advance() exprToken {
+	token := p.tokens[p.next]
+	if token.kind != "eof" {
+		p.next++
+	}
+	return token
+}
+
+func (p *exprParser) accept(op string) bool {
+	if token := p.peek(); (token.kind == "op" || token.kind == "ident") && token.text == op {
+		p.next++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(op string) error {
+	if !p.accept(op) {
+		return fmt.Errorf("expected %q at %d, found %s", op, p.peek().pos, p.describe(p.peek()))
+	}
+	return nil
+}
+
+func (p *exprParser) describe(token exprToken) string {
+	if token.kind == "eof" {
+		return "end of expression"
+	}
+	if token.text != "" {
+		return strconv.Quote(token.text)
+	}
+	return fmt.Sprint(token.value)
+}
+
+func (p *exprParser) parseOr() (compiledExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalExpr(left, right, true)
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (compiledExpr, error) {
+	left, err := p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalExpr(left, right, false)
+	}
+	return left, nil
+}
+
+// logicalExpr short-circuits && (stopAt false) and || (stopAt true)
+func logicalExpr(left, right compiledExpr, stopAt bool) compiledExpr {
+	return func(env *exprEnv) (interface{}, error) {
+		l, err := left(env)
+		if err != nil {
+			return nil, err
+		}
+		lb, err := exprBool(l)
+		if err != nil || lb == stopAt {
+			return lb, err
+		}
+		r, err := right(env)
+		if err != nil {
+			return nil, err
+		}
+		return exprBool(r)
+	}
+}
+
+func (p *exprParser) parseComparison() (compiledExpr, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">", "in"} {
+		if !p.accept(op) {
+			continue
+		}
+		right, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		return binaryExpr(left, right, func(l, r interface{}) (interface{}, error) { return compareValues(op, l, r) }), nil
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAdditive() (compiledExpr, error) {
+	left, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek().text
+		if p.peek().kind != "op" || (op != "+" && op != "-") {
+			return left, nil
+		}
+		p.advance()
+		right, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr(left, right, func(l, r interface{}) (interface{}, error) { return arithmetic(op, l, r) })
+	}
+}
+
+func (p *exprParser) parseMultiplicative() (compiledExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek().text
+		if p.peek().kind != "op" || (op != "*" && op != "/" && op != "%") {
+			return left, nil
+		}
+		p.advance()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr(left, right, func(l, r interface{}) (interface{}, error) { return arithmetic(op, l, r) })
+	}
+}
+
+func binaryExpr(left, right compiledExpr, apply func(l, r interface{}) (interface{}, error)) compiledExpr {
+	return func(env *exprEnv) (interface{}, error) {
+		l, err := left(env)
+		if err != nil {
+			return nil, err
+		}
+		r, err := right(env)
+		if err != nil {
+			return nil, err
+		}
+		return apply(l, r)
+	}
+}
+
+func (p *exprParser) parseUnary() (compiledExpr, error) {
+	switch {
+	case p.accept("!"):
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(env *exprEnv) (interface{}, error) {
+			v, err := operand(env)
+			if err != nil {
+				return nil, err
+			}
+			b, err := exprBool(v)
+			return !b, err
+		}, nil
+	case p.accept("-"):
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(env *exprEnv) (interface{}, error) {
+			v, err := operand(env)
+			if err != nil {
+				return nil, err
+			}
+			return arithmetic("-", 0.0, v)
+		}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *exprParser) parsePostfix() (compiledExpr, error) {
+	expr, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("."):
+			name := p.advance()
+			if name.kind != "ident" {
+				return nil, fmt.Errorf("expected a field name at %d", name.pos)
+			}
+			if p.accept("(") {
+				args, err := p.parseArgs()
+				if err != nil {
+					return nil, err
+				}
+				if expr, err = methodExpr(name.text, expr, args); err != nil {
+					return nil, fmt.Errorf("%v at %d", err, name.pos)
+				}
+				continue
+			}
+			object, field := expr, name.text
+			expr = func(env *exprEnv) (interface{}, error) {
+				v, err := object(env)
+				if err != nil {
+					return nil, err
+				}
+				return indexValue(v, field)
+			}
+		case p.accept("["):
+			index, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			expr = binaryExpr(expr, index, indexValue)
+		default:
+			return expr, nil
+		}
+	}
+}
+
+// parseArgs parses call arguments after the opening parenthesis
+func (p *exprParser) parseArgs() ([]compiledExpr, error) {
+	var args []compiledExpr
+	if p.accept(")") {
+		return args, nil
+	}
+	for {
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.accept(")") {
+			return args, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *exprParser) parsePrimary() (compiledExpr, error) {
+	token := p.advance()
+	switch token.kind {
+	case "number", "string":
+		return constantExpr(token.value), nil
+	case "ident":
+		switch token.text {
+		case "true":
+			return constantExpr(true), nil
+		case "false":
+			return constantExpr(false), nil
+		case "null":
+			return constantExpr(nil), nil
+		}
+		if p.accept("(") {
+			args, err := p.parseArgs()
+			if err != nil {
+				return nil, err
+			}
+			expr, err := functionExpr(token.text, args)
+			if err != nil {
+				return nil, fmt.Errorf("%v at %d", err, token.pos)
+			}
+			return expr, nil
+		}
+		name := token.text
+		return func(env *exprEnv) (interface{}, error) {
+			v, ok := env.vars[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown variable %q", name)
+			}
+			return v, nil
+		}, nil
+	case "op":
+		switch token.text {
+		case "(":
+			expr, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return expr, p.expect(")")
+		case "[":
+			var items []compiledExpr
+			if !p.accept("]") {
+				for {
+					item, err := p.parseOr()
+					if err != nil {
+						return nil, err
+					}
+					items = append(items, item)
+					if p.accept("]") {
+						break
+					}
+					if err := p.expect(","); err != nil {
+						return nil, err
+					}
+				}
+			}
+			return func(env *exprEnv) (interface{}, error) {
+				list := make([]interface{}, len(items))
+				for i, item := range items {
+					v, err := item(env)
+					if err != nil {
+						return nil, err
+					}
+					list[i] = v
+				}
+				return list, nil
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %s at %d", p.describe(token), token.pos)
+}
+
+func constantExpr(value interface{}) compiledExpr {
+	return func(*exprEnv) (interface{}, error) { return value, nil }
+}
+
+// functionExpr compiles a global function call
+func functionExpr(name string, args []compiledExpr) (compiledExpr, error) {
+	var apply func(v interface{}) (interface{}, error)
+	switch name {
+	case "size":
+		apply = func(v interface{}) (interface{}, error) {
+			switch v := v.(type) {
+			case nil:
+				return 0.0, nil
+			case string:
+				return float64(len([]rune(v))), nil
+			case []interface{}:
+				return float64(len(v)), nil
+			case map[string]interface{}:
+				return float64(len(v)), nil
+			}
+			return nil, fmt.Errorf("size() of %s", exprTypeName(v))
+		}
+	case "lower":
+		apply = func(v interface{}) (interface{}, error) {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("lower() of %s", exprTypeName(v))
+			}
+			return strings.ToLower(s), nil
+		}
+	case "has":
+		// Fields that don't exist are null, so has() only checks for that
+		apply = func(v interface{}) (interface{}, error) { return v != nil, nil }
+	default:
+		return nil, fmt.Errorf("unknown function %s()", name)
+	}
+	if len(args) != 1 {
+		return nil, fmt.Errorf("%s() takes one argument", name)
+	}
+	arg := args[0]
+	return func(env *exprEnv) (interface{}, error) {
+		v, err := arg(env)
+		if err != nil {
+			return nil, err
+		}
+		return apply(v)
+	}, nil
+}
+
+// methodExpr compiles a string method call such as s.startsWith("x")
+func methodExpr(name string, target compiledExpr, args []compiledExpr) (compiledExpr, error) {
+	var test func(s, arg string) (bool, error)
+	switch name {
+	case "contains":
+		test = func(s, arg string) (bool, error) { return strings.Contains(s, arg), nil }
+	case "startsWith":
+		test = func(s, arg string) (bool, error) { return strings.HasPrefix(s, arg), nil }
+	case "endsWith":
+		test = func(s, arg string) (bool, error) { return strings.HasSuffix(s, arg), nil }
+	case "matches":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%s() takes one argument", name)
+		}
+		// Compile constant patterns once instead of on every request
+		var compiled *regexp.Regexp
+		if pattern, err := args[0](&exprEnv{}); err == nil {
+			if pattern, ok := pattern.(string); ok {
+				if compiled, err = regexp.Compile(pattern); err != nil {
+					return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+				}
+			}
+		}
+		test = func(s, arg string) (bool, error) {
+			if compiled != nil {
+				return compiled.MatchString(s), nil
+			}
+			re, err := regexp.Compile(arg)
+			if err != nil {
+				return false, fmt.Errorf("invalid pattern %q: %v", arg, err)
+			}
+			return re.MatchString(s), nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown method %s()", name)
+	}
+	if len(args) != 1 {
+		return nil, fmt.Errorf("%s() takes one argument", name)
+	}
+	arg := args[0]
+	return func(env *exprEnv) (interface{}, error) {
+		v, err := target(env)
+		if err != nil {
+			return nil, err
+		}
+		a, err := arg(env)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			return false, nil
+		}
+		s, ok := v.(string)
+		as, argOK := a.(string)
+		if !ok || !argOK {
+			return nil, fmt.Errorf("%s() on %s with %s", name, exprTypeName(v), exprTypeName(a))
+		}
+		return test(s, as)
+	}, nil
+}
+
+// indexValue looks up a map key or list index; missing entries are null
+func indexValue(v, index interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		key, ok := index.(string)
+		if !ok {
+			return nil, fmt.Errorf("map index must be a string, not %s", exprTypeName(index))
+		}
+		return v[key], nil
+	case []interface{}:
+		n, ok := index.(float64)
+		if !ok || n != math.Trunc(n) {
+			return nil, fmt.Errorf("list index must be an integer, not %v", index)
+		}
+		if i, ok := resolveIndex(int(n), len(v)); ok {
+			return v[i], nil
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("cannot index %s", exprTypeName(v))
+}
+
+func exprBool(v interface{}) (bool, error) {
+	switch v := v.(type) {
+	case bool:
+		return v, nil
+	case nil:
+		return false, nil
+	}
+	return false, fmt.Errorf("expected a boolean, got %s", exprTypeName(v))
+}
+
+func exprTypeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "list"
+	case map[string]interface{}:
+		return "map"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func compareValues(op string, l, r interface{}) (interface{}, error) {
+	switch op {
+	case "==":
+		return reflect.DeepEqual(l, r), nil
+	case "!=":
+		return !reflect.DeepEqual(l, r), nil
+	case "in":
+		switch r := r.(type) {
+		case nil:
+			return false, nil
+		case []interface{}:
+			for _, item := range r {
+				if reflect.DeepEqual(l, item) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case map[string]interface{}:
+			key, ok := l.(string)
+			_, found := r[key]
+			return ok && found, nil
+		}
+		return nil, fmt.Errorf("in needs a list or map, not %s", exprTypeName(r))
+	}
+	// Ordering comparisons with a missing value are false rather than errors
+	if l == nil || r == nil {
+		return false, nil
+	}
+	var cmp int
+	switch l := l.(type) {
+	case float64:
+		rn, ok := r.(float64)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare number with %s", exprTypeName(r))
+		}
+		switch {
+		case l < rn:
+			cmp = -1
+		case l > rn:
+			cmp = 1
+		}
+	case string:
+		rs, ok := r.(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare string with %s", exprTypeName(r))
+		}
+		cmp = strings.Compare(l, rs)
+	default:
+		return nil, fmt.Errorf("cannot order %s", exprTypeName(l))
+	}
+	switch op {
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	}
+	return cmp >= 0, nil
+}
+
+func arithmetic(op string, l, r interface{}) (interface{}, error) {
+	if op == "+" {
+		if ls, ok := l.(string); ok {
+			if rs, ok := r.(string); ok {
+				return ls + rs, nil
+			}
+		}
+		if ll, ok := l.([]interface{}); ok {
+			if rl, ok := r.([]interface{}); ok {
+				return append(append([]interface{}{}, ll...), rl...), nil
+			}
+		}
+	}
+	ln, lok := l.(float64)
+	rn, rok := r.(float64)
+	if !lok || !rok {
+		return nil, fmt.Errorf("cannot apply %s to %s and %s", op, exprTypeName(l), exprTypeName(r))
+	}
+	switch op {
+	case "+":
+		return ln + rn, nil
+	case "-":
+		return ln - rn, nil
+	case "*":
+		return ln * rn, nil
+	case "/":
+		if rn == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return ln / rn, nil
+	}
+	if rn == 0 {
+		return nil, fmt.Errorf("division by zero")
+	}
+	return math.Mod(ln, rn), nil
+}
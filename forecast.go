@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// usageHistoryPrefix namespaces the forecast's counters in usageStore, apart from
+// the token budget's: history:<tokens|cost>:<key|tenant>:<id>, cost in micro-dollars
+const usageHistoryPrefix = "history:"
+
+// recordUsageHistory adds a response's tokens and estimated cost to the daily
+// totals of its key and tenant, when -usage-history-days is set
+func recordUsageHistory(id userIdentity, model string, usage tokenUsage) {
+	if *usageHistoryDays <= 0 {
+		return
+	}
+	day := budgetDay()
+	cost, _ := estimateCost(model, usage)
+	microDollars := int64(math.Round(cost * 1e6))
+	for _, scope := range []string{"key:" + id.KeyID, "tenant:" + id.Tenant} {
+		counters := map[string]int64{"tokens:": int64(usage.TotalTokens), "cost:": microDollars}
+		for metric, value := range counters {
+			if value == 0 {
+				continue
+			}
+			if _, err := usageStore.Add(usageHistoryPrefix+metric+scope, day, value); err != nil {
+				log.Printf("❌ Failed to record usage history for %s: %v", scope, err)
+			}
+		}
+	}
+}
+
+// usageProjection is an end-of-month total predicted by one trend model
+type usageProjection struct {
+	Tokens  int64   `json:"tokens"`
+	CostUSD float64 `json:"cost_usd"`
+}
+
+// usageForecast is one key's or tenant's entry of GET /usage/forecast
+type usageForecast struct {
+	Scope        string          `json:"scope"` // key or tenant
+	ID           string          `json:"id"`
+	TokensToDate int64           `json:"tokens_to_date"`
+	CostToDate   float64         `json:"cost_to_date_usd"`
+	RunRate      usageProjection `json:"run_rate"`
+	Linear       usageProjection `json:"linear"`
+	BudgetTokens int64           `json:"budget_tokens,omitempty"`
+	BudgetUSD    float64         `json:"budget_usd,omitempty"`
+	OverBudget   bool            `json:"over_budget"`
+}
+
+// usageSeries is one key's or tenant's daily totals; index 0 is the first day loaded
+type usageSeries struct {
+	tokens, cost []float64
+}
+
+// projectRunRate extends the month's usage at its average rate so far
+func projectRunRate(toDate, elapsedDays float64, daysInMonth int) float64 {
+	if elapsedDays <= 0 {
+		return toDate
+	}
+	return toDate / elapsedDays * float64(daysInMonth)
+}
+
+// projectLinear fits a least-squares line to the complete days before today,
+// over at most window days and starting at the first day with usage, and adds
+// its predictions for today through the end of the month to the usage so far.
+// Today counts whichever is higher, the prediction or what was already used.
+func projectLinear(daily []float64, today, monthStart, daysInMonth, window int) float64 {
+	first := max(today-window, 0)
+	for first < today && daily[first] == 0 {
+		first++
+	}
+	var n, sumX, sumY, sumXY, sumXX float64
+	for x := first; x < today; x++ {
+		n++
+		sumX += float64(x)
+		sumY += daily[x]
+		sumXY += float64(x) * daily[x]
+		sumXX += float64(x) * float64(x)
+	}
+	predict := func(x int) float64 { return sumY / max(n, 1) }
+	if n >= 2 {
+		slope := (n*sumXY - sumX*sumY) / (n*sumXX - sumX*sumX)
+		intercept := (sumY - slope*sumX) / n
+		predict = func(x int) float64 { return intercept + slope*float64(x) }
+	}
+
+	var total float64
+	for x := monthStart; x < today; x++ {
+		total += daily[x]
+	}
+	total += max(predict(today), daily[today])
+	for x := today + 1; x < monthStart+daysInMonth; x++ {
+		total += max(predict(x), 0)
+	}
+	return total
+}
+
+// handleUsageForecast serves GET /usage/forecast on the admin server: month-to-date
+// usage of every key and tenant and its end-of-month projection. Filter with
+// ?scope=key|tenant and ?id=.
+func handleUsageForecast(w http.ResponseWriter, r *http.Request) {
+	if *usageHistoryDays <= 0 {
+		writeJSONError(w, http.StatusNotFound, "not_found", "usage history is not enabled; set -usage-history-days")
+		return
+	}
+	now := time.Now().UTC()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	daysInMonth := monthStart.AddDate(0, 1, 0).Sub(monthStart).Hours() / 24
+	window := max(*usageForecastWindow, 2)
+
+	// Load the month so far plus the fitting window before it, bounded by retention
+	loadStart := monthStart.AddDate(0, 0, -max(window-now.Day()+1, 0))
+	if oldest := now.AddDate(0, 0, -*usageHistoryDays+1); loadStart.Before(oldest) {
+		loadStart = time.Date(oldest.Year(), oldest.Month(), oldest.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	days := int(now.Sub(loadStart).Hours()/24) + 1
+	series := make(map[string]*usageSeries)
+	for i := 0; i < days; i++ {
+		totals, err := usageStore.Totals(loadStart.AddDate(0, 0, i).Format("2006-01-02"), usageHistoryPrefix)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "server_error", err.Error())
+			return
+		}
+		for name, value := range totals {
+			metric, entity, ok := strings.Cut(strings.TrimPrefix(name, usageHistoryPrefix), ":")
+			if !ok {
+				continue
+			}
+			s := series[entity]
+			if s == nil {
+				s = &usageSeries{tokens: make([]float64, days), cost: make([]float64, days)}
+				series[entity] = s
+			}
+			switch metric {
+			case "tokens":
+				s.tokens[i] = float64(value)
+			case "cost":
+				s.cost[i] = float64(value) / 1e6
+			}
+		}
+	}
+
+	today := days - 1
+	monthOffset := int(monthStart.Sub(loadStart).Hours() / 24)
+	if monthOffset < 0 {
+		monthOffset = 0
+	}
+	elapsed := now.Sub(monthStart).Hours() / 24
+	monthBudgets := monthlyBudgets()
+	forecasts := []usageForecast{}
+	for entity, s := range series {
+		scope, id, _ := strings.Cut(entity, ":")
+		if want := r.URL.Query().Get("scope"); want != "" && want != scope {
+			continue
+		}
+		if want := r.URL.Query().Get("id"); want != "" && want != id {
+			continue
+		}
+		var tokensToDate, costToDate float64
+		for x := monthOffset; x <= today; x++ {
+			tokensToDate += s.tokens[x]
+			costToDate += s.cost[x]
+		}
+		f := usageForecast{
+			Scope:        scope,
+			ID:           id,
+			TokensToDate: int64(tokensToDate),
+			CostToDate:   roundUSD(costToDate),
+			RunRate: usageProjection{
+				Tokens:  int64(projectRunRate(tokensToDate, elapsed, int(daysInMonth))),
+				CostUSD: roundUSD(projectRunRate(costToDate, elapsed, int(daysInMonth))),
+			},
+			Linear: usageProjection{
+				Tokens:  int64(projectLinear(s.tokens, today, monthOffset, int(daysInMonth), window)),
+				CostUSD: roundUSD(projectLinear(s.cost, today, monthOffset, int(daysInMonth), window)),
+			},
+			BudgetUSD: monthBudgets[entity],
+		}
+		if scope == "key" && *tokenBudgetDaily > 0 {
+			f.BudgetTokens = *tokenBudgetDaily * int64(daysInMonth)
+		}
+		f.OverBudget = (f.BudgetTokens > 0 && max(f.RunRate.Tokens, f.Linear.Tokens) > f.BudgetTokens) ||
+			(f.BudgetUSD > 0 && max(f.RunRate.CostUSD, f.Linear.CostUSD) > f.BudgetUSD)
+		forecasts = append(forecasts, f)
+	}
+	sort.Slice(forecasts, func(i, j int) bool {
+		if forecasts[i].Scope != forecasts[j].Scope {
+			return forecasts[i].Scope < forecasts[j].Scope
+		}
+		return forecasts[i].ID < forecasts[j].ID
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"month":         monthStart.Format("2006-01"),
+		"generated_at":  now,
+		"days_elapsed":  math.Round(elapsed*100) / 100,
+		"days_in_month": int(daysInMonth),
+		"forecasts":     forecasts,
+	})
+}
+
+// monthlyBudgets maps "key:<id>" and "tenant:<tenant>" to the monthly_budget_usd
+// of virtual keys; a tenant's budget is the sum of its keys'
+func monthlyBudgets() map[string]float64 {
+	budgets := make(map[string]float64)
+	for _, vk := range configuredVirtualKeys() {
+		if vk.MonthlyBudgetUSD <= 0 {
+			continue
+		}
+		id := newUserIdentity("vkey-"+vk.Name, vk)
+		budgets["key:"+id.KeyID] += vk.MonthlyBudgetUSD
+		budgets["tenant:"+id.Tenant] += vk.MonthlyBudgetUSD
+	}
+	return budgets
+}
+
+func roundUSD(v float64) float64 {
+	return math.Round(v*1e6) / 1e6
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"maps"
+	"math"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// hookRun is one hook call of a forwarded request, kept on its trace
+type hookRun struct {
+	Phase           string  `json:"phase"` // request or response
+	Hook            string  `json:"hook"`  // Go hook name, script or tenant:<tenant>
+	DurationMs      float64 `json:"duration_ms"`
+	BytesChanged    int     `json:"bytes_changed"` // body size after the hook minus before
+	BodyModified    bool    `json:"body_modified"`
+	HeadersModified bool    `json:"headers_modified"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// hookRecorder collects the hook calls of one request. A nil recorder runs hooks
+// without recording them, for calls outside a forwarded request. With skip set,
+// as under load shedding, no hook runs at all.
+type hookRecorder struct {
+	runs []hookRun
+	skip bool
+}
+
+// run calls a hook and records how long it took and what it changed
+func (rec *hookRecorder) run(phase, name string, body []byte, headers http.Header, fn func([]byte, http.Header) ([]byte, http.Header, error)) ([]byte, http.Header, error) {
+	if rec == nil {
+		return fn(body, headers)
+	}
+	if rec.skip {
+		return body, headers, nil
+	}
+	// Hooks may edit the headers in place, so compare against a copy
+	before := headers.Clone()
+	started := time.Now()
+	modifiedBody, modifiedHeaders, err := fn(body, headers)
+	run := hookRun{
+		Phase:      phase,
+		Hook:       name,
+		DurationMs: float64(time.Since(started).Microseconds()) / 1000,
+	}
+	if err != nil {
+		run.Error = err.Error()
+	} else {
+		run.BytesChanged = len(modifiedBody) - len(body)
+		run.BodyModified = !bytes.Equal(body, modifiedBody)
+		run.HeadersModified = !sameHeaders(before, modifiedHeaders)
+	}
+	rec.runs = append(rec.runs, run)
+	hookProfile.observe(run)
+	return modifiedBody, modifiedHeaders, err
+}
+
+// sameHeaders compares headers by canonical name, since script hooks hand them
+// back with lowercase names
+func sameHeaders(a, b http.Header) bool {
+	canonical := func(header http.Header) http.Header {
+		c := make(http.Header, len(header))
+		for name, values := range header {
+			key := http.CanonicalHeaderKey(name)
+			c[key] = append(c[key], values...)
+		}
+		return c
+	}
+	return maps.EqualFunc(canonical(a), canonical(b), slices.Equal[[]string])
+}
+
+// scriptHookName names the -hook script in hook runs
+func scriptHookName() string {
+	return "script:" + filepath.Base(*luaFile)
+}
+
+// Runs returns the recorded calls, nil if there were none
+func (rec *hookRecorder) Runs() []hookRun {
+	if rec == nil || len(rec.runs) == 0 {
+		return nil
+	}
+	return append([]hookRun(nil), rec.runs...)
+}
+
+// hookStats aggregates the calls of one hook in one phase
+type hookStats struct {
+	Phase           string  `json:"phase"`
+	Hook            string  `json:"hook"`
+	Calls           int64   `json:"calls"`
+	Errors          int64   `json:"errors"`
+	BodyModified    int64   `json:"body_modified"`
+	HeadersModified int64   `json:"headers_modified"`
+	BytesChanged    int64   `json:"bytes_changed"`
+	TotalMs         float64 `json:"total_ms"`
+	AvgMs           float64 `json:"avg_ms"`
+	MaxMs           float64 `json:"max_ms"`
+	SlowestAt       string  `json:"slowest_at,omitempty"`
+}
+
+// hookProfiler aggregates hook calls since startup or the last reset
+type hookProfiler struct {
+	mu    sync.Mutex
+	since time.Time
+	stats map[string]*hookStats
+}
+
+var hookProfile = &hookProfiler{since: time.Now(), stats: make(map[string]*hookStats)}
+
+func (p *hookProfiler) observe(run hookRun) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := run.Phase + "\x00" + run.Hook
+	s := p.stats[key]
+	if s == nil {
+		s = &hookStats{Phase: run.Phase, Hook: run.Hook}
+		p.stats[key] = s
+	}
+	s.Calls++
+	if run.Error != "" {
+		s.Errors++
+	}
+	if run.BodyModified {
+		s.BodyModified++
+	}
+	if run.HeadersModified {
+		s.HeadersModified++
+	}
+	s.BytesChanged += int64(run.BytesChanged)
+	s.TotalMs += run.DurationMs
+	if run.DurationMs > s.MaxMs {
+		s.MaxMs, s.SlowestAt = run.DurationMs, time.Now().UTC().Format(time.RFC3339)
+	}
+}
+
+// handleHookProfile serves the hook profile on the admin server: GET returns every
+// hook's calls, slowest total time first, and DELETE starts a new profile
+func handleHookProfile(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		hookProfile.mu.Lock()
+		hookProfile.since, hookProfile.stats = time.Now(), make(map[string]*hookStats)
+		hookProfile.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "invalid_request_error", "use GET or DELETE")
+		return
+	}
+	hookProfile.mu.Lock()
+	since := hookProfile.since
+	profile := make([]hookStats, 0, len(hookProfile.stats))
+	for _, s := range hookProfile.stats {
+		entry := *s
+		entry.AvgMs = math.Round(entry.TotalMs/float64(entry.Calls)*1000) / 1000
+		entry.TotalMs = math.Round(entry.TotalMs*1000) / 1000
+		profile = append(profile, entry)
+	}
+	hookProfile.mu.Unlock()
+	sort.Slice(profile, func(i, j int) bool {
+		if profile[i].TotalMs != profile[j].TotalMs {
+			return profile[i].TotalMs > profile[j].TotalMs
+		}
+		return profile[i].Phase+profile[i].Hook < profile[j].Phase+profile[j].Hook
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"since": since,
+		"hooks": profile,
+	})
+}
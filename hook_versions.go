@@ -0,0 +1,303 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hookVersion is one hook script the proxy has loaded
+type hookVersion struct {
+	Version  int       `json:"version"`
+	LoadedAt time.Time `json:"loaded_at"`
+	Origin   string    `json:"origin"` // startup or reload
+	SHA256   string    `json:"sha256"`
+	Lines    int       `json:"lines"`
+	Active   bool      `json:"active"`
+	source   string
+}
+
+// hookHistory keeps the last -hook-versions scripts loaded from -hook, so a bad
+// push can be rolled back without the old file or a restart
+type hookHistory struct {
+	mu       sync.Mutex
+	versions []*hookVersion // oldest first
+	next     int
+	active   int
+}
+
+var hookVersions = &hookHistory{next: 1}
+
+// load loads source into the script backend and records it as the newest
+// version. A script identical to the active one is not loaded again.
+func (h *hookHistory) load(origin, source string) (*hookVersion, bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sum := sha256.Sum256([]byte(source))
+	digest := hex.EncodeToString(sum[:])
+	if current := h.find(h.active); current != nil && current.SHA256 == digest {
+		return current, false, nil
+	}
+	if err := scriptHooks.LoadHookSource(*luaFile, source); err != nil {
+		return nil, false, err
+	}
+	v := &hookVersion{
+		Version:  h.next,
+		LoadedAt: time.Now(),
+		Origin:   origin,
+		SHA256:   digest,
+		Lines:    len(scriptLines(source)),
+		source:   source,
+	}
+	h.next++
+	h.versions = append(h.versions, v)
+	if keep := max(*hookVersionsKept, 1); len(h.versions) > keep {
+		h.versions = h.versions[len(h.versions)-keep:]
+	}
+	h.activate(v)
+	return v, true, nil
+}
+
+// rollback loads a kept version again and makes it the active one
+func (h *hookHistory) rollback(version int) (*hookVersion, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	v := h.find(version)
+	if v == nil {
+		return nil, fmt.Errorf("no hook version %d", version)
+	}
+	if err := scriptHooks.LoadHookSource(*luaFile, v.source); err != nil {
+		return nil, err
+	}
+	h.activate(v)
+	return v, nil
+}
+
+func (h *hookHistory) activate(v *hookVersion) {
+	for _, other := range h.versions {
+		other.Active = other == v
+	}
+	h.active = v.Version
+}
+
+// find returns a kept version; callers hold mu
+func (h *hookHistory) find(version int) *hookVersion {
+	for _, v := range h.versions {
+		if v.Version == version {
+			return v
+		}
+	}
+	return nil
+}
+
+// reloadHookScript reads -hook again and loads it as a new version
+func reloadHookScript(origin string) (*hookVersion, bool, error) {
+	data, err := os.ReadFile(*luaFile)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read hook script %s: %v", *luaFile, err)
+	}
+	return hookVersions.load(origin, string(data))
+}
+
+func scriptLines(source string) []string {
+	return strings.Split(strings.TrimSuffix(source, "\n"), "\n")
+}
+
+// diffLines returns a unified diff of two scripts with three lines of context
+func diffLines(fromName, toName, from, to string) string {
+	a, b := scriptLines(from), scriptLines(to)
+
+	// Longest common subsequence table; hook scripts are small enough for O(n*m)
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	type edit struct {
+		op         byte // ' ', '-' or '+'
+		line       string
+		aPos, bPos int // 0-based line positions in a and b
+	}
+	var edits []edit
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, edit{' ', a[i], i, j})
+			i, j = i+1, j+1
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, edit{'-', a[i], i, j})
+			i++
+		default:
+			edits = append(edits, edit{'+', b[j], i, j})
+			j++
+		}
+	}
+
+	const context = 3
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+	for start := 0; start < len(edits); {
+		// Find the next change and the extent of its hunk
+		first := start
+		for first < len(edits) && edits[first].op == ' ' {
+			first++
+		}
+		if first == len(edits) {
+			break
+		}
+		end := first
+		for k := first; k < len(edits); k++ {
+			if edits[k].op != ' ' {
+				end = k
+			} else if k-end > 2*context {
+				break
+			}
+		}
+		lo, hi := max(first-context, 0), min(end+context+1, len(edits))
+		var aCount, bCount int
+		for _, e := range edits[lo:hi] {
+			if e.op != '+' {
+				aCount++
+			}
+			if e.op != '-' {
+				bCount++
+			}
+		}
+		// Unified diffs number an empty range by the line before it
+		aStart, bStart := edits[lo].aPos, edits[lo].bPos
+		if aCount > 0 {
+			aStart++
+		}
+		if bCount > 0 {
+			bStart++
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", aStart, aCount, bStart, bCount)
+		for _, e := range edits[lo:hi] {
+			out.WriteByte(e.op)
+			out.WriteString(e.line)
+			out.WriteByte('\n')
+		}
+		start = hi
+	}
+	return out.String()
+}
+
+// handleHookVersions serves the hook version API on the admin server:
+//
+//	GET  /hooks/versions                  versions kept, newest last
+//	GET  /hooks/versions/<n>              the source of version n
+//	GET  /hooks/versions/<n>/diff?to=<m>  unified diff from n to m (default: the active version)
+//	POST /hooks/versions/<n>/rollback     make version n active again
+//	POST /hooks/reload                    load -hook from disk as a new version
+func handleHookVersions(w http.ResponseWriter, r *http.Request) {
+	if *luaFile == "" {
+		writeJSONError(w, http.StatusNotFound, "not_found", "no hook script is configured")
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/hooks/")
+	if path == "reload" {
+		if r.Method != http.MethodPost {
+			writeJSONError(w, http.StatusMethodNotAllowed, "invalid_request_error", "use POST")
+			return
+		}
+		v, loaded, err := reloadHookScript("reload")
+		if err != nil {
+			log.Printf("❌ Hook reload failed, keeping the running script: %v", err)
+			writeJSONError(w, http.StatusUnprocessableEntity, "invalid_hook_script", err.Error())
+			return
+		}
+		if loaded {
+			log.Printf("🔁 Loaded hook script version %d", v.Version)
+		}
+		writeHookVersion(w, v)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(path, "versions"), "/")
+	if path == "versions" || path == "versions/" {
+		hookVersions.mu.Lock()
+		list := make([]hookVersion, 0, len(hookVersions.versions))
+		for _, v := range hookVersions.versions {
+			list = append(list, *v)
+		}
+		hookVersions.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+		return
+	}
+	if len(parts) < 2 || parts[0] != "" {
+		writeJSONError(w, http.StatusNotFound, "not_found", "unknown hook endpoint")
+		return
+	}
+	version, err := strconv.Atoi(parts[1])
+	hookVersions.mu.Lock()
+	v := hookVersions.find(version)
+	var snapshot hookVersion
+	var active *hookVersion
+	if v != nil {
+		snapshot = *v
+		active = hookVersions.find(hookVersions.active)
+	}
+	hookVersions.mu.Unlock()
+	if err != nil || v == nil {
+		writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("no hook version %q", parts[1]))
+		return
+	}
+
+	switch action := strings.Join(parts[2:], "/"); {
+	case action == "" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Hook-Version", strconv.Itoa(snapshot.Version))
+		fmt.Fprint(w, snapshot.source)
+	case action == "diff" && r.Method == http.MethodGet:
+		to := active
+		if other := r.URL.Query().Get("to"); other != "" {
+			n, _ := strconv.Atoi(other)
+			hookVersions.mu.Lock()
+			to = hookVersions.find(n)
+			hookVersions.mu.Unlock()
+			if to == nil {
+				writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("no hook version %q", other))
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+		fmt.Fprint(w, diffLines(fmt.Sprintf("v%d", snapshot.Version), fmt.Sprintf("v%d", to.Version), snapshot.source, to.source))
+	case action == "rollback" && r.Method == http.MethodPost:
+		v, err := hookVersions.rollback(version)
+		if err != nil {
+			log.Printf("❌ Hook rollback to version %d failed: %v", version, err)
+			writeJSONError(w, http.StatusUnprocessableEntity, "invalid_hook_script", err.Error())
+			return
+		}
+		log.Printf("⏪ Rolled hook script back to version %d", v.Version)
+		writeHookVersion(w, v)
+	default:
+		writeJSONError(w, http.StatusNotFound, "not_found", "unknown hook endpoint")
+	}
+}
+
+func writeHookVersion(w http.ResponseWriter, v *hookVersion) {
+	hookVersions.mu.Lock()
+	snapshot := *v
+	hookVersions.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// namedRequestHook is a request hook registered under a name used in logs and metrics
+type namedRequestHook struct {
+	name string
+	fn   RequestHook
+}
+
+// namedResponseHook is a response hook registered under a name used in logs and metrics
+type namedResponseHook struct {
+	name string
+	fn   ResponseHook
+}
+
+// hookRegistry holds the native Go hooks, run in registration order before any Lua hooks.
+// Hooks are registered by Go files compiled into this binary, typically from an init
+// function; as package main, the registry can't be reached from other modules.
+type hookRegistry struct {
+	mu       sync.RWMutex
+	request  []namedRequestHook
+	response []namedResponseHook
+}
+
+var hooks = &hookRegistry{}
+
+// UseRequestHook appends a request hook to the chain. Each hook receives the body
+// and headers returned by the previous one.
+func UseRequestHook(name string, hook RequestHook) {
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+	hooks.request = append(hooks.request, namedRequestHook{name: name, fn: hook})
+}
+
+// UseResponseHook appends a response hook to the chain. Each hook receives the body
+// and headers returned by the previous one.
+func UseResponseHook(name string, hook ResponseHook) {
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+	hooks.response = append(hooks.response, namedResponseHook{name: name, fn: hook})
+}
+
+// legacyHookName is the name SetRequestHook and SetResponseHook register under
+const legacyHookName = "legacy"
+
+// SetRequestHook installs a request hook with the signature used before hooks
+// received the request path. It replaces the hook set by an earlier call, and runs
+// after the hooks registered before that first call.
+//
+// Deprecated: use UseRequestHook, which also passes the request path.
+func SetRequestHook(hook func(body []byte, headers http.Header) ([]byte, http.Header, error)) {
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+	wrapped := namedRequestHook{name: legacyHookName, fn: func(path string, body []byte, headers http.Header) ([]byte, http.Header, error) {
+		return hook(body, headers)
+	}}
+	for i := range hooks.request {
+		if hooks.request[i].name == legacyHookName {
+			hooks.request[i] = wrapped
+			return
+		}
+	}
+	hooks.request = append(hooks.request, wrapped)
+}
+
+// SetResponseHook installs a response hook, replacing the hook set by an earlier
+// call.
+//
+// Deprecated: use UseResponseHook, which registers named hooks in a chain.
+func SetResponseHook(hook ResponseHook) {
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+	for i := range hooks.response {
+		if hooks.response[i].name == legacyHookName {
+			hooks.response[i].fn = hook
+			return
+		}
+	}
+	hooks.response = append(hooks.response, namedResponseHook{name: legacyHookName, fn: hook})
+}
+
+// observeHook records the outcome and duration of a single hook call
+func observeHook(phase, name string, started time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	metrics.Add("openai_proxy_hook_calls_total", "Calls of native Go hooks.", map[string]string{"phase": phase, "hook": name, "result": result}, 1)
+	metrics.Observe("openai_proxy_hook_duration_seconds", "Duration of native Go hook calls.", map[string]string{"phase": phase, "hook": name}, time.Since(started).Seconds())
+}
+
+// runRequestHooks runs the request hook chain for a request path, stopping at the
+// first error. Calls are recorded in rec, which may be nil.
+func runRequestHooks(rec *hookRecorder, path string, body []byte, headers http.Header) ([]byte, http.Header, error) {
+	if rec != nil && rec.skip {
+		return body, headers, nil
+	}
+	hooks.mu.RLock()
+	chain := hooks.request
+	hooks.mu.RUnlock()
+
+	for _, hook := range chain {
+		started := time.Now()
+		modifiedBody, modifiedHeaders, err := rec.run("request", hook.name, body, headers, func(body []byte, headers http.Header) ([]byte, http.Header, error) {
+			return hook.fn(path, body, headers)
+		})
+		observeHook("request", hook.name, started, err)
+		if err != nil {
+			return body, headers, fmt.Errorf("request hook %q: %v", hook.name, err)
+		}
+		body, headers = modifiedBody, modifiedHeaders
+	}
+	return body, headers, nil
+}
+
+// hasResponseHooks reports whether any native response hook is registered
+func (h *hookRegistry) hasResponseHooks() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.response) > 0
+}
+
+// runResponseHooks runs the response hook chain, stopping at the first error. Calls are
+// recorded in rec, which may be nil.
+func runResponseHooks(rec *hookRecorder, body []byte, headers http.Header) ([]byte, http.Header, error) {
+	if rec != nil && rec.skip {
+		return body, headers, nil
+	}
+	hooks.mu.RLock()
+	chain := hooks.response
+	hooks.mu.RUnlock()
+
+	for _, hook := range chain {
+		started := time.Now()
+		modifiedBody, modifiedHeaders, err := rec.run("response", hook.name, body, headers, hook.fn)
+		observeHook("response", hook.name, started, err)
+		if err != nil {
+			return body, headers, fmt.Errorf("response hook %q: %v", hook.name, err)
+		}
+		body, headers = modifiedBody, modifiedHeaders
+	}
+	return body, headers, nil
+}
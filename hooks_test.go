@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSetRequestHookReplacesLegacyHook(t *testing.T) {
+	saved := hooks.request
+	defer func() { hooks.request = saved }()
+	hooks.request = nil
+
+	SetRequestHook(func(body []byte, headers http.Header) ([]byte, http.Header, error) {
+		return []byte("first"), headers, nil
+	})
+	SetRequestHook(func(body []byte, headers http.Header) ([]byte, http.Header, error) {
+		return append(body, "-second"...), headers, nil
+	})
+	if len(hooks.request) != 1 {
+		t.Fatalf("%d request hooks registered, want 1", len(hooks.request))
+	}
+	body, _, err := runRequestHooks(nil, "/v1/chat/completions", []byte("body"), http.Header{})
+	if err != nil || string(body) != "body-second" {
+		t.Fatalf("hook chain returned %q, %v", body, err)
+	}
+}
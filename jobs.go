@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	jobScheduled = "scheduled"
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+// jobResponse is the upstream answer stored with a finished job
+type jobResponse struct {
+	StatusCode int             `json:"status_code"`
+	Header     http.Header     `json:"headers,omitempty"`
+	Body       json.RawMessage `json:"body,omitempty"` // the JSON body, or the raw body as a JSON string
+}
+
+// job is one asynchronously executed request
+type job struct {
+	ID          string       `json:"id"`
+	Object      string       `json:"object"`
+	Status      string       `json:"status"`
+	Method      string       `json:"method"`
+	Path        string       `json:"path"`
+	CreatedAt   time.Time    `json:"created_at"`
+	CompletedAt *time.Time   `json:"completed_at,omitempty"`
+	Attempts    int          `json:"attempts"`
+	TraceID     string       `json:"trace_id,omitempty"`  // trace of the last attempt
+	BatchID     string       `json:"batch_id,omitempty"`  // upstream batch that ran the job
+	RunAfter    *time.Time   `json:"run_after,omitempty"` // batch window a scheduled job waits for
+	Response    *jobResponse `json:"response,omitempty"`
+	Error       string       `json:"error,omitempty"`
+
+	owner        string // client key ID; only the owner can read the job
+	identity     userIdentity
+	caller       *principal // authenticated at submission, trusted on every attempt
+	upstreamAuth string     // Authorization after virtual key substitution, for batches
+	batchBody    []byte     // the body as the forwarder would send it, for batches
+	rawPath      string // the path as the client escaped it, if it differs from the default
+	query        string
+	header       http.Header
+	body         []byte
+	remote       string
+	tls          *tls.ConnectionState // for client certificate mapping on every attempt
+}
+
+// jobStore keeps jobs in memory until -job-ttl after they finish
+type jobStore struct {
+	mu       sync.Mutex
+	jobs     map[string]*job
+	queue    chan *job
+	deferred []*job       // ?async=batch jobs waiting for the next batch window
+	forward  http.Handler // the forwarder, which runs each attempt
+}
+
+// asyncJobs is nil unless -async-jobs is set
+var asyncJobs *jobStore
+
+func newJobStore(workers, maxPending int) *jobStore {
+	s := &jobStore{jobs: make(map[string]*job), queue: make(chan *job, maxPending)}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for j := range s.queue {
+				s.run(j)
+			}
+		}()
+	}
+	go func() {
+		for range time.Tick(time.Minute) {
+			s.expire()
+		}
+	}()
+	return s
+}
+
+// isAsyncRequest reports whether a request asks to run as a job, now (?async=1) or
+// in the next batch window (?async=batch)
+func isAsyncRequest(r *http.Request) bool {
+	if asyncJobs == nil || r.Method != http.MethodPost {
+		return false
+	}
+	async := r.URL.Query().Get("async")
+	return async == "1" || async == "batch"
+}
+
+// create registers a queued job for a request the proxy will send later
+func (s *jobStore) create(caller *principal, upstreamAuth string, r *http.Request, body []byte) *job {
+	id := newUserIdentity(caller.KeyID, caller.Key)
+	query := r.URL.Query()
+	query.Del("async")
+	j := &job{
+		ID:           "job_" + generateTraceID(),
+		Object:       "proxy.job",
+		Status:       jobQueued,
+		Method:       r.Method,
+		Path:         r.URL.Path,
+		CreatedAt:    time.Now(),
+		owner:        id.KeyID,
+		identity:     id,
+		caller:       caller,
+		upstreamAuth: upstreamAuth,
+		rawPath:      r.URL.RawPath,
+		query:        query.Encode(),
+		header:       r.Header.Clone(),
+		body:         body,
+		remote:       r.RemoteAddr,
+		tls:          r.TLS,
+	}
+	s.mu.Lock()
+	s.jobs[j.ID] = j
+	s.mu.Unlock()
+	return j
+}
+
+// Submit answers an async request with 202 and its job, and queues the request,
+// or with -batch-schedule holds ?async=batch requests for the next batch window
+func (s *jobStore) Submit(w http.ResponseWriter, r *http.Request, caller *principal, upstreamAuth string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+		return
+	}
+	j := s.create(caller, upstreamAuth, r, body)
+	if r.URL.Query().Get("async") == "batch" && len(batchWindows) > 0 {
+		if !s.schedule(j) {
+			s.mu.Lock()
+			delete(s.jobs, j.ID)
+			s.mu.Unlock()
+			writeJSONError(w, http.StatusTooManyRequests, "job_queue_full", "Too many scheduled jobs; retry later")
+			return
+		}
+		log.Printf("📥 Scheduled job %s for %s in the batch window at %s", j.ID, r.URL.Path, j.RunAfter.Format("15:04"))
+		metrics.Add("openai_proxy_jobs_total", "Asynchronous jobs, by final status.", map[string]string{"status": jobScheduled}, 1)
+	} else {
+		select {
+		case s.queue <- j:
+		default:
+			s.mu.Lock()
+			delete(s.jobs, j.ID)
+			s.mu.Unlock()
+			writeJSONError(w, http.StatusTooManyRequests, "job_queue_full", "Too many pending jobs; retry later")
+			return
+		}
+		log.Printf("📥 Queued job %s for %s", j.ID, r.URL.Path)
+		metrics.Add("openai_proxy_jobs_total", "Asynchronous jobs, by final status.", map[string]string{"status": jobQueued}, 1)
+	}
+	w.Header().Set("Location", "/jobs/"+j.ID)
+	writeJob(w, http.StatusAccepted, s.snapshot(j))
+}
+
+// request rebuilds the job's request for the forwarder, keeping the path as the
+// client escaped it
+func (j *job) request(ctx context.Context) (*http.Request, error) {
+	target := &url.URL{Path: j.Path, RawPath: j.rawPath, RawQuery: j.query}
+	// The caller was authenticated when the job was submitted; its credentials may
+	// have expired since
+	req, err := http.NewRequestWithContext(withPrincipal(ctx, j.caller), j.Method, target.String(), bytes.NewReader(j.body))
+	if err != nil {
+		return nil, err
+	}
+	req.RequestURI = target.RequestURI()
+	req.Header = j.header.Clone()
+	req.RemoteAddr = j.remote
+	req.TLS = j.tls
+	return req, nil
+}
+
+// serve sends the job's request through the forwarder once. net/http recovers
+// from a handler's panic, such as a chaos drop's http.ErrAbortHandler, for client
+// requests; for a job it is returned as an error instead of ending the proxy.
+func (s *jobStore) serve(ctx context.Context, j *job) (recorder *httptest.ResponseRecorder, err error) {
+	req, err := j.request(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %v", err)
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			if v != http.ErrAbortHandler {
+				log.Printf("❌ Forwarder panic in job %s: %v\n%s", j.ID, v, debug.Stack())
+			}
+			recorder, err = nil, fmt.Errorf("the forwarder aborted the request: %v", v)
+		}
+	}()
+	recorder = httptest.NewRecorder()
+	s.forward.ServeHTTP(recorder, req)
+	return recorder, nil
+}
+
+// run executes a job, retrying upstream errors and rate limits with exponential backoff
+func (s *jobStore) run(j *job) {
+	s.update(j, func() { j.Status = jobRunning })
+	backoff := time.Second
+	var recorder *httptest.ResponseRecorder
+	for attempt := 1; ; attempt++ {
+		var err error
+		if recorder, err = s.serve(context.Background(), j); err != nil {
+			s.update(j, func() { j.Attempts = attempt })
+			s.fail(j, err)
+			return
+		}
+		s.update(j, func() {
+			j.Attempts = attempt
+			j.TraceID = recorder.Header().Get("X-Proxy-Trace-Id")
+		})
+		retryable := recorder.Code >= 500 || recorder.Code == http.StatusTooManyRequests
+		if !retryable || attempt >= *jobMaxAttempts {
+			break
+		}
+		log.Printf("🔁 Job %s attempt %d got %d, retrying in %v", j.ID, attempt, recorder.Code, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	s.finish(j, recorder.Code, recorder.Header(), recorder.Body.Bytes())
+}
+
+// finish stores a job's final response and notifies -job-webhook-url
+func (s *jobStore) finish(j *job, statusCode int, header http.Header, body []byte) {
+	s.complete(j, statusCode, header, body, "")
+}
+
+// fail finishes a job the forwarder couldn't answer
+func (s *jobStore) fail(j *job, err error) {
+	log.Printf("❌ Job %s failed: %v", j.ID, err)
+	body, _ := json.Marshal(map[string]interface{}{"error": map[string]string{"type": "proxy_error", "message": err.Error()}})
+	s.complete(j, http.StatusBadGateway, http.Header{"Content-Type": {"application/json"}}, body, err.Error())
+}
+
+// complete stores a job's final response, with failure as its error if not empty,
+// and notifies -job-webhook-url
+func (s *jobStore) complete(j *job, statusCode int, header http.Header, body []byte, failure string) {
+	status := jobSucceeded
+	if statusCode >= 400 {
+		status = jobFailed
+	}
+	raw := json.RawMessage(body)
+	if !json.Valid(body) {
+		raw, _ = json.Marshal(string(body))
+	}
+	var snapshot job
+	s.update(j, func() {
+		now := time.Now()
+		j.Status, j.CompletedAt = status, &now
+		j.Response = &jobResponse{StatusCode: statusCode, Header: header.Clone(), Body: raw}
+		if failure != "" {
+			j.Error = failure
+		} else if status == jobFailed {
+			j.Error = fmt.Sprintf("upstream answered %d %s", statusCode, http.StatusText(statusCode))
+		}
+		j.header, j.body, j.batchBody, j.upstreamAuth = nil, nil, nil, ""
+		snapshot = *j
+	})
+	log.Printf("📤 Job %s %s after %d attempts", j.ID, status, snapshot.Attempts)
+	metrics.Add("openai_proxy_jobs_total", "Asynchronous jobs, by final status.", map[string]string{"status": status}, 1)
+	if *jobWebhookURL != "" {
+		webhooks.send("job", *jobWebhookURL, snapshot)
+	}
+}
+
+func (s *jobStore) update(j *job, fn func()) {
+	s.mu.Lock()
+	fn()
+	s.mu.Unlock()
+}
+
+func (s *jobStore) snapshot(j *job) job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *j
+}
+
+// expire drops jobs that finished more than -job-ttl ago
+func (s *jobStore) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, j := range s.jobs {
+		if j.CompletedAt != nil && time.Since(*j.CompletedAt) > *jobTTL {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+func writeJob(w http.ResponseWriter, status int, j interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(j)
+}
+
+// handleJob serves GET /jobs/<id> on the proxy port. Clients only see their own jobs.
+func handleJob(w http.ResponseWriter, r *http.Request) {
+	if asyncJobs == nil {
+		writeJSONError(w, http.StatusNotFound, "not_found", "asynchronous jobs are not enabled")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "invalid_request_error", "use GET")
+		return
+	}
+	caller, authenticated := authenticate(w, r)
+	if !authenticated {
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	asyncJobs.mu.Lock()
+	j, ok := asyncJobs.jobs[id]
+	if ok && j.owner != caller.KeyID {
+		ok = false
+	}
+	var snapshot job
+	if ok {
+		snapshot = *j
+	}
+	asyncJobs.mu.Unlock()
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("no job with id %q", id))
+		return
+	}
+	writeJob(w, http.StatusOK, snapshot)
+}
+
+// handleJobs serves GET /jobs on the admin server, listing every job, newest first
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	if asyncJobs == nil {
+		writeJSONError(w, http.StatusNotFound, "not_found", "asynchronous jobs are not enabled")
+		return
+	}
+	asyncJobs.mu.Lock()
+	list := make([]job, 0, len(asyncJobs.jobs))
+	for _, j := range asyncJobs.jobs {
+		if status := r.URL.Query().Get("status"); status == "" || j.Status == status {
+			list = append(list, *j)
+		}
+	}
+	asyncJobs.mu.Unlock()
+	sort.Slice(list, func(i, k int) bool { return list[i].CreatedAt.After(list[k].CreatedAt) })
+	writeJob(w, http.StatusOK, list)
+}
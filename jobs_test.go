@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestJobKeepsEscapedPath(t *testing.T) {
+	s := newJobStore(0, 1)
+	var forwarded string
+	s.forward = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.URL.Path + " " + r.RequestURI
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions%20x?async=1", strings.NewReader(`{}`))
+	j := s.create(&principal{KeyID: "key-1"}, "", r, []byte(`{}`))
+	s.run(j)
+
+	if j.Status != jobSucceeded {
+		t.Fatalf("job %s: %s", j.Status, j.Error)
+	}
+	if want := "/v1/chat/completions x /v1/chat/completions%20x"; forwarded != want {
+		t.Errorf("forwarded %q, want %q", forwarded, want)
+	}
+}
+
+func TestJobFailsWhenForwarderPanics(t *testing.T) {
+	s := newJobStore(0, 1)
+	s.forward = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions?async=1", strings.NewReader(`{}`))
+	j := s.create(&principal{KeyID: "key-1"}, "", r, []byte(`{}`))
+	s.run(j)
+
+	if j.Status != jobFailed || j.Response == nil || j.Response.StatusCode != http.StatusBadGateway {
+		t.Fatalf("job %s with response %+v, want failed with a 502", j.Status, j.Response)
+	}
+	if !strings.Contains(j.Error, "aborted") {
+		t.Errorf("job error %q", j.Error)
+	}
+}
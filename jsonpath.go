@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// pathSegment is one step of a JSONPath-style path: an object key or an array index
+type pathSegment struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+func (s pathSegment) String() string {
+	if s.isIndex {
+		return fmt.Sprintf("[%d]", s.index)
+	}
+	return "." + s.key
+}
+
+// parsePath parses paths such as "$.messages[0].content", "messages[-1]" or
+// "$['response_format'].type". Negative indexes count from the end of an array.
+func parsePath(path string) ([]pathSegment, error) {
+	rest := strings.TrimPrefix(path, "$")
+	var segments []pathSegment
+	for rest != "" {
+		switch {
+		case rest[0] == '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("invalid path %q: empty key", path)
+			}
+			segments = append(segments, pathSegment{key: rest[:end]})
+			rest = rest[end:]
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid path %q: unterminated [", path)
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				segments = append(segments, pathSegment{key: inner[1 : len(inner)-1]})
+				continue
+			}
+			index, err := strconv.Atoi(inner)
+			if err != nil {
+				return nil, fmt.Errorf("invalid path %q: bad index %q", path, inner)
+			}
+			segments = append(segments, pathSegment{index: index, isIndex: true})
+		default:
+			// A bare leading key, as in "messages[0]"
+			if len(segments) > 0 {
+				return nil, fmt.Errorf("invalid path %q near %q", path, rest)
+			}
+			rest = "." + rest
+		}
+	}
+	return segments, nil
+}
+
+// resolveIndex turns a possibly negative index into a position in an array of length n
+func resolveIndex(index, n int) (int, bool) {
+	if index < 0 {
+		index += n
+	}
+	return index, index >= 0 && index < n
+}
+
+// pathGet returns the value at segments within root
+func pathGet(root interface{}, segments []pathSegment) (interface{}, bool) {
+	current := root
+	for _, segment := range segments {
+		if segment.isIndex {
+			array, ok := current.([]interface{})
+			if !ok {
+				return nil, false
+			}
+			i, ok := resolveIndex(segment.index, len(array))
+			if !ok {
+				return nil, false
+			}
+			current = array[i]
+			continue
+		}
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = object[segment.key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// pathSet stores value at segments, creating missing objects along the way. An
+// index equal to the array length appends. It returns the possibly new root.
+func pathSet(root interface{}, segments []pathSegment, value interface{}) (interface{}, error) {
+	if len(segments) == 0 {
+		return value, nil
+	}
+	segment := segments[0]
+	if segment.isIndex {
+		array, ok := root.([]interface{})
+		if !ok {
+			return root, fmt.Errorf("%s: not an array", segment)
+		}
+		if segment.index == len(array) {
+			child, err := pathSet(nil, segments[1:], value)
+			if err != nil {
+				return root, err
+			}
+			return append(array, child), nil
+		}
+		i, ok := resolveIndex(segment.index, len(array))
+		if !ok {
+			return root, fmt.Errorf("%s: index out of range (length %d)", segment, len(array))
+		}
+		child, err := pathSet(array[i], segments[1:], value)
+		if err != nil {
+			return root, err
+		}
+		array[i] = child
+		return array, nil
+	}
+
+	object, ok := root.(map[string]interface{})
+	if root == nil {
+		object, ok = make(map[string]interface{}), true
+	}
+	if !ok {
+		return root, fmt.Errorf("%s: not an object", segment)
+	}
+	child, err := pathSet(object[segment.key], segments[1:], value)
+	if err != nil {
+		return root, err
+	}
+	object[segment.key] = child
+	return object, nil
+}
+
+// pathDelete removes the key or array element at segments. It returns the
+// possibly new root and whether anything was removed.
+func pathDelete(root interface{}, segments []pathSegment) (interface{}, bool) {
+	if len(segments) == 0 {
+		return root, false
+	}
+	parent, ok := pathGet(root, segments[:len(segments)-1])
+	if !ok {
+		return root, false
+	}
+	last := segments[len(segments)-1]
+	if !last.isIndex {
+		object, ok := parent.(map[string]interface{})
+		if !ok {
+			return root, false
+		}
+		if _, exists := object[last.key]; !exists {
+			return root, false
+		}
+		delete(object, last.key)
+		return root, true
+	}
+
+	array, ok := parent.([]interface{})
+	if !ok {
+		return root, false
+	}
+	i, ok := resolveIndex(last.index, len(array))
+	if !ok {
+		return root, false
+	}
+	shrunk := append(array[:i:i], array[i+1:]...)
+	newRoot, err := pathSet(root, segments[:len(segments)-1], shrunk)
+	if err != nil {
+		return root, false
+	}
+	return newRoot, true
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// kafkaClient is shared by every feature publishing to -kafka-brokers. It is
+// created on first use.
+var (
+	kafkaOnce      sync.Once
+	kafkaClient    *kgo.Client
+	kafkaClientErr error
+)
+
+// kafkaProduce sends one record and waits for the broker to acknowledge it
+func kafkaProduce(ctx context.Context, topic string, key, value []byte, headers map[string]string) error {
+	kafkaOnce.Do(func() {
+		var seeds []string
+		for _, broker := range strings.Split(*kafkaBrokers, ",") {
+			if broker = strings.TrimSpace(broker); broker != "" {
+				seeds = append(seeds, broker)
+			}
+		}
+		if len(seeds) == 0 {
+			kafkaClientErr = fmt.Errorf("-kafka-brokers is not set")
+			return
+		}
+		kafkaClient, kafkaClientErr = kgo.NewClient(kgo.SeedBrokers(seeds...), kgo.ProducerBatchMaxBytes(64<<20))
+	})
+	if kafkaClientErr != nil {
+		return fmt.Errorf("failed to create Kafka client: %v", kafkaClientErr)
+	}
+	record := &kgo.Record{Topic: topic, Key: key, Value: value}
+	for name, value := range headers {
+		record.Headers = append(record.Headers, kgo.RecordHeader{Key: name, Value: []byte(value)})
+	}
+	return kafkaClient.ProduceSync(ctx, record).FirstErr()
+}
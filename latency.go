@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http/httptrace"
+	"time"
+)
+
+// latencyBreakdown splits a forwarded request's time into phases, so a slow request
+// can be pinned on the proxy (queue, pacing, hooks), the network (connect) or the
+// model (time to first byte, transfer)
+type latencyBreakdown struct {
+	QueueMs         float64 `json:"queue_ms"`          // waiting for an admission slot
+	PacingMs        float64 `json:"pacing_ms"`         // held back by -pace-upstream-limits
+	RequestHooksMs  float64 `json:"request_hooks_ms"`  // Go, script and tenant request hooks
+	ConnectMs       float64 `json:"connect_ms"`        // obtaining a connection: DNS, dial and TLS unless reused
+	ConnReused      bool    `json:"conn_reused"`       // the connection came from the pool
+	TTFBMs          float64 `json:"ttfb_ms"`           // sending the request until the first response byte
+	TransferMs      float64 `json:"transfer_ms"`       // first byte until the body was read or streamed
+	ResponseHooksMs float64 `json:"response_hooks_ms"` // response hooks and transforms
+	ProxyMs         float64 `json:"proxy_ms"`          // everything outside connect, ttfb and transfer
+	TotalMs         float64 `json:"total_ms"`
+}
+
+// latencyPhases maps the phases to their metric label
+var latencyPhases = []struct {
+	name  string
+	value func(*latencyBreakdown) float64
+}{
+	{"queue", func(b *latencyBreakdown) float64 { return b.QueueMs }},
+	{"pacing", func(b *latencyBreakdown) float64 { return b.PacingMs }},
+	{"request_hooks", func(b *latencyBreakdown) float64 { return b.RequestHooksMs }},
+	{"connect", func(b *latencyBreakdown) float64 { return b.ConnectMs }},
+	{"ttfb", func(b *latencyBreakdown) float64 { return b.TTFBMs }},
+	{"transfer", func(b *latencyBreakdown) float64 { return b.TransferMs }},
+	{"response_hooks", func(b *latencyBreakdown) float64 { return b.ResponseHooksMs }},
+	{"proxy", func(b *latencyBreakdown) float64 { return b.ProxyMs }},
+}
+
+// requestTimer collects the phase timestamps of one forwarded request
+type requestTimer struct {
+	start                               time.Time
+	queue, pacing                       time.Duration
+	requestHooks, responseHooks         time.Duration
+	getConn, gotConn, firstByte, bodyAt time.Time
+	reused                              bool
+}
+
+func newRequestTimer() *requestTimer {
+	return &requestTimer{start: time.Now()}
+}
+
+// clientTrace records connection and first byte times of the upstream call. The
+// transport calls these before Do returns.
+func (t *requestTimer) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GetConn: func(string) { t.getConn = time.Now() },
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.gotConn, t.reused = time.Now(), info.Reused
+		},
+		GotFirstResponseByte: func() { t.firstByte = time.Now() },
+	}
+}
+
+// bodyDone marks the end of the response body transfer
+func (t *requestTimer) bodyDone() {
+	t.bodyAt = time.Now()
+}
+
+// breakdown returns the phases measured so far, with the total up to now
+func (t *requestTimer) breakdown() *latencyBreakdown {
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	between := func(from, to time.Time) time.Duration {
+		if from.IsZero() || to.IsZero() || to.Before(from) {
+			return 0
+		}
+		return to.Sub(from)
+	}
+	total := time.Since(t.start)
+	connect, ttfb, transfer := between(t.getConn, t.gotConn), between(t.gotConn, t.firstByte), between(t.firstByte, t.bodyAt)
+	return &latencyBreakdown{
+		QueueMs:         ms(t.queue),
+		PacingMs:        ms(t.pacing),
+		RequestHooksMs:  ms(t.requestHooks),
+		ConnectMs:       ms(connect),
+		ConnReused:      t.reused,
+		TTFBMs:          ms(ttfb),
+		TransferMs:      ms(transfer),
+		ResponseHooksMs: ms(t.responseHooks),
+		ProxyMs:         ms(max(total-connect-ttfb-transfer, 0)),
+		TotalMs:         ms(total),
+	}
+}
+
+// observeLatencyPhases adds a trace's phases to the phase histogram
+func observeLatencyPhases(b *latencyBreakdown) {
+	for _, phase := range latencyPhases {
+		metrics.Observe("openai_proxy_latency_phase_seconds", "Time forwarded requests spent in each phase.", map[string]string{"phase": phase.name}, phase.value(b)/1000)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Load levels of the proxy, from its own memory, goroutine and trace store use
+const (
+	loadNormal int32 = iota
+	loadDegraded
+	loadShedding
+)
+
+var loadLevelNames = []string{"normal", "degraded", "shedding"}
+
+// loadSnapshot is one sample of the proxy's own resource use
+type loadSnapshot struct {
+	Level           string    `json:"level"`
+	Reason          string    `json:"reason,omitempty"` // the measure closest to its limit
+	SampledAt       time.Time `json:"sampled_at"`
+	MemoryBytes     uint64    `json:"memory_bytes"`
+	MemoryLimit     uint64    `json:"memory_limit,omitempty"`
+	Goroutines      int       `json:"goroutines"`
+	GoroutineLimit  int       `json:"goroutine_limit,omitempty"`
+	TraceStoreBytes int64     `json:"trace_store_bytes"`
+	TraceStoreLimit int64     `json:"trace_store_limit,omitempty"`
+	Degrade         []string  `json:"degrade"`
+}
+
+// loadShedder samples the proxy's resource use and rejects or degrades requests
+// once it nears its limits. Past -shed-degrade-at of a limit traces keep metadata
+// only and hooks are skipped; past the limit new requests get a 503.
+type loadShedder struct {
+	memoryLimit     uint64
+	goroutineLimit  int
+	traceStoreLimit int64
+	degradeAt       float64
+	degrade         map[string]bool
+
+	level atomic.Int32
+	mu    sync.Mutex
+	last  loadSnapshot
+}
+
+// parseShedDegrade parses -shed-degrade, a comma-separated list of traces and hooks
+func parseShedDegrade(spec string) (map[string]bool, error) {
+	degrade := make(map[string]bool)
+	for _, item := range strings.Split(spec, ",") {
+		switch item = strings.TrimSpace(item); item {
+		case "":
+		case "traces", "hooks":
+			degrade[item] = true
+		default:
+			return nil, fmt.Errorf("invalid -shed-degrade item %q: expected traces or hooks", item)
+		}
+	}
+	return degrade, nil
+}
+
+func newLoadShedder(memoryMB, goroutines, traceStoreMB int, degradeAt float64, degrade map[string]bool) *loadShedder {
+	return &loadShedder{
+		memoryLimit:     uint64(memoryMB) << 20,
+		goroutineLimit:  goroutines,
+		traceStoreLimit: int64(traceStoreMB) << 20,
+		degradeAt:       degradeAt,
+		degrade:         degrade,
+	}
+}
+
+// run samples every interval until the process exits
+func (s *loadShedder) run(interval time.Duration) {
+	s.sample()
+	for range time.Tick(interval) {
+		s.sample()
+	}
+}
+
+// sample measures resource use and moves to the level of the measure closest to
+// its limit
+func (s *loadShedder) sample() {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	snapshot := loadSnapshot{
+		SampledAt:       time.Now(),
+		MemoryBytes:     mem.Sys - mem.HeapReleased,
+		MemoryLimit:     s.memoryLimit,
+		Goroutines:      runtime.NumGoroutine(),
+		GoroutineLimit:  s.goroutineLimit,
+		TraceStoreBytes: traceStoreBytes(),
+		TraceStoreLimit: s.traceStoreLimit,
+		Degrade:         []string{},
+	}
+	for _, item := range []string{"traces", "hooks"} {
+		if s.degrade[item] {
+			snapshot.Degrade = append(snapshot.Degrade, item)
+		}
+	}
+
+	pressure := 0.0
+	measure := func(name string, value, limit float64) {
+		if limit > 0 && value/limit > pressure {
+			pressure, snapshot.Reason = value/limit, name
+		}
+	}
+	measure("memory", float64(snapshot.MemoryBytes), float64(s.memoryLimit))
+	measure("goroutine", float64(snapshot.Goroutines), float64(s.goroutineLimit))
+	measure("trace_store", float64(snapshot.TraceStoreBytes), float64(s.traceStoreLimit))
+	level := loadNormal
+	switch {
+	case pressure >= 1:
+		level = loadShedding
+	case pressure >= s.degradeAt && len(s.degrade) > 0:
+		level = loadDegraded
+	}
+	if level == loadNormal {
+		snapshot.Reason = ""
+	}
+	snapshot.Level = loadLevelNames[level]
+
+	s.mu.Lock()
+	s.last = snapshot
+	s.mu.Unlock()
+	if previous := s.level.Swap(level); previous != level {
+		sdNotify("STATUS=Load " + snapshot.Level)
+		if level == loadNormal {
+			log.Printf("🩺 Load back to normal (memory: %d MiB, goroutines: %d)", snapshot.MemoryBytes>>20, snapshot.Goroutines)
+		} else {
+			log.Printf("🩺 Load %s (%s at %.0f%% of its limit; memory: %d MiB, goroutines: %d)", snapshot.Level, snapshot.Reason, pressure*100, snapshot.MemoryBytes>>20, snapshot.Goroutines)
+		}
+	}
+	metrics.Set("openai_proxy_memory_bytes", "Memory the Go runtime holds from the operating system.", nil, float64(snapshot.MemoryBytes))
+	metrics.Set("openai_proxy_goroutines", "Goroutines of the proxy.", nil, float64(snapshot.Goroutines))
+	metrics.Set("openai_proxy_trace_store_bytes", "Bytes of bodies and transcripts held by the in-memory trace store.", nil, float64(snapshot.TraceStoreBytes))
+	metrics.Set("openai_proxy_load_level", "Load shedding level: 0 normal, 1 degraded, 2 shedding.", nil, float64(level))
+}
+
+// degrades reports whether item (traces or hooks) is degraded right now
+func (s *loadShedder) degrades(item string) bool {
+	return s != nil && s.level.Load() >= loadDegraded && s.degrade[item]
+}
+
+// shedding reports whether new requests are rejected right now
+func (s *loadShedder) shedding() bool {
+	return s != nil && s.level.Load() == loadShedding
+}
+
+// snapshot returns the latest sample
+func (s *loadShedder) snapshot() loadSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+// traceStoreBytes approximates the memory held by the in-memory trace sink; other
+// sinks keep their traces outside the proxy
+func traceStoreBytes() int64 {
+	sink, ok := traceSink.(*memoryTraceSink)
+	if !ok {
+		return 0
+	}
+	sink.mu.RLock()
+	defer sink.mu.RUnlock()
+	var size int64
+	for _, trace := range sink.traces {
+		size += int64(len(trace.RequestBody) + len(trace.ResponseBody))
+		for _, entry := range trace.Transcript {
+			size += int64(len(entry.Text))
+		}
+	}
+	return size
+}
+
+// metadataOnly strips a trace recorded while degraded down to its metadata
+func metadataOnly(trace Trace) Trace {
+	trace.RequestBody, trace.ResponseBody = "", ""
+	trace.RequestHeader = nil
+	trace.Transcript = nil
+	trace.Degraded = true
+	return trace
+}
+
+// writeShed replies 503 to a request rejected under resource pressure
+func writeShed(w http.ResponseWriter, snapshot loadSnapshot) {
+	metrics.Add("openai_proxy_rejected_requests_total", "Requests rejected because the proxy was saturated.", map[string]string{"reason": snapshot.Reason + "_pressure"}, 1)
+
+	w.Header().Set("Retry-After", "5")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": "Proxy is low on resources, retry after the time given in Retry-After",
+			"type":    "proxy_overloaded",
+			"details": snapshot,
+		},
+	})
+}
+
+// handleLoad serves GET /load on the admin server: the latest resource sample and
+// load level
+func handleLoad(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "invalid_request_error", "use GET")
+		return
+	}
+	if loadShed == nil {
+		writeJSONError(w, http.StatusNotFound, "not_found", "load shedding is disabled; set -shed-memory-mb, -shed-goroutines or -shed-trace-store-mb")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(loadShed.snapshot())
+}
+
+// loadShed is nil unless a -shed-* limit is set
+var loadShed *loadShedder
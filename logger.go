@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// logLevel orders log messages by severity
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[logLevel]string{
+	levelDebug: "DEBUG",
+	levelInfo:  "INFO",
+	levelWarn:  "WARN",
+	levelError: "ERROR",
+}
+
+var logLevelIcons = map[logLevel]string{
+	levelDebug: "🐛",
+	levelInfo:  "ℹ️",
+	levelWarn:  "⚠️",
+	levelError: "❌",
+}
+
+// minLogLevel is the lowest level that is written, set from -log-level
+var minLogLevel = levelInfo
+
+// parseLogLevel converts a level name such as "warn" to a logLevel
+func parseLogLevel(name string) (logLevel, error) {
+	for level, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	if strings.EqualFold(name, "warning") {
+		return levelWarn, nil
+	}
+	return levelInfo, fmt.Errorf("unknown log level %q (expected debug, info, warn or error)", name)
+}
+
+// logEvent writes a leveled log line tagged with its source and trace ID, followed
+// by sorted key=value fields
+func logEvent(level logLevel, source, traceID, message string, fields map[string]string) {
+	if level < minLogLevel {
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s [%s]", logLevelIcons[level], logLevelNames[level], source)
+	if traceID != "" {
+		fmt.Fprintf(&b, " [trace_id=%s]", traceID)
+	}
+	b.WriteString(" ")
+	b.WriteString(message)
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, " %s=%q", name, fields[name])
+	}
+	log.Print(b.String())
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	luajson "layeh.com/gopher-json"
+)
+
+// maxLuaAdminBody is the largest request body handed to a Lua admin endpoint
+const maxLuaAdminBody = 1 << 20
+
+// luaAdminEndpoints serves the admin endpoints registered by a hook script with
+// admin.handle. Like scheduled tasks, they share one long-lived Lua state, so
+// calls into it are serialized.
+type luaAdminEndpoints struct {
+	mu       sync.Mutex
+	L        *lua.LState
+	handlers map[string]*lua.LFunction
+	timeout  time.Duration
+	closed   bool
+}
+
+// luaAdminLoader returns the module loader for require("admin"). Hook calls and
+// scheduled tasks load the script with nil endpoints, which makes admin.handle a
+// no-op so endpoints are only registered once, in their own state.
+func luaAdminLoader(e *luaAdminEndpoints) lua.LGFunction {
+	return func(L *lua.LState) int {
+		mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+			"handle": func(L *lua.LState) int {
+				path := L.CheckString(1)
+				fn := L.CheckFunction(2)
+				if !strings.HasPrefix(path, "/") || strings.ContainsAny(path, "?#") {
+					L.ArgError(1, "path must start with / and have no query")
+					return 0
+				}
+				if e != nil {
+					e.handlers[path] = fn
+				}
+				return 0
+			},
+		})
+		L.Push(mod)
+		return 1
+	}
+}
+
+// startLuaAdminEndpoints loads script into a dedicated state and collects the
+// endpoints it registers. It returns nil if the script registers none.
+func startLuaAdminEndpoints(script string, timeout time.Duration) (*luaAdminEndpoints, error) {
+	e := &luaAdminEndpoints{
+		L:        lua.NewState(),
+		handlers: make(map[string]*lua.LFunction),
+		timeout:  timeout,
+	}
+	preloadLuaModules(e.L, "")
+	e.L.PreloadModule("admin", luaAdminLoader(e))
+
+	if err := e.L.DoString(script); err != nil {
+		e.L.Close()
+		return nil, fmt.Errorf("failed to load Lua script for admin endpoints: %v", err)
+	}
+	if len(e.handlers) == 0 {
+		e.L.Close()
+		return nil, nil
+	}
+	for _, path := range e.paths() {
+		log.Printf("🧩 Lua admin endpoint %s registered", path)
+	}
+	return e, nil
+}
+
+// paths returns the registered endpoint paths, sorted
+func (e *luaAdminEndpoints) paths() []string {
+	paths := make([]string, 0, len(e.handlers))
+	for path := range e.handlers {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// luaAdminRequest converts an admin request to the table passed to handlers
+func luaAdminRequest(L *lua.LState, r *http.Request, body []byte) *lua.LTable {
+	request := L.NewTable()
+	request.RawSetString("method", lua.LString(r.Method))
+	request.RawSetString("path", lua.LString(r.URL.Path))
+	query := L.NewTable()
+	for name, values := range r.URL.Query() {
+		query.RawSetString(name, lua.LString(values[0]))
+	}
+	request.RawSetString("query", query)
+	request.RawSetString("headers", httpHeaderToLuaTable(L, r.Header))
+	request.RawSetString("body", lua.LString(body))
+	return request
+}
+
+// serve calls the handler of the request's path with a timeout. The handler's
+// first return value is encoded as the JSON response and its optional second one
+// is the status code.
+func (e *luaAdminEndpoints) serve(w http.ResponseWriter, r *http.Request, fn *lua.LFunction) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxLuaAdminBody))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "failed to read request body: "+err.Error())
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		writeJSONError(w, http.StatusServiceUnavailable, "hook_reloaded", "the hook script was reloaded; retry the request")
+		return
+	}
+
+	started := time.Now()
+	result := "ok"
+	defer func() {
+		if rec := recover(); rec != nil {
+			log.Printf("❌ Lua admin endpoint %s panicked: %v", r.URL.Path, rec)
+			result = "panic"
+			e.L.SetTop(0)
+			writeJSONError(w, http.StatusInternalServerError, "hook_error", fmt.Sprintf("admin endpoint panicked: %v", rec))
+		}
+		metrics.Add("openai_proxy_lua_admin_requests_total", "Requests to admin endpoints registered by Lua scripts.", map[string]string{"path": r.URL.Path, "result": result}, 1)
+		metrics.Observe("openai_proxy_lua_admin_duration_seconds", "Duration of Lua admin endpoint calls.", map[string]string{"path": r.URL.Path}, time.Since(started).Seconds())
+	}()
+
+	ctx, cancel := context.WithTimeout(r.Context(), e.timeout)
+	defer cancel()
+	e.L.SetContext(ctx)
+	defer e.L.RemoveContext()
+
+	e.L.Push(fn)
+	e.L.Push(luaAdminRequest(e.L, r, body))
+	if err := e.L.PCall(1, 2, nil); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			log.Printf("❌ Lua admin endpoint %s timed out after %v", r.URL.Path, e.timeout)
+			result = "timeout"
+			writeJSONError(w, http.StatusGatewayTimeout, "hook_timeout", fmt.Sprintf("admin endpoint timed out after %v", e.timeout))
+		} else {
+			log.Printf("❌ Lua admin endpoint %s failed: %v", r.URL.Path, err)
+			result = "error"
+			writeJSONError(w, http.StatusInternalServerError, "hook_error", "admin endpoint failed: "+err.Error())
+		}
+		return
+	}
+	value, statusValue := e.L.Get(-2), e.L.Get(-1)
+	e.L.Pop(2)
+
+	status := http.StatusOK
+	if code, ok := statusValue.(lua.LNumber); ok {
+		status = int(code)
+		if status < 100 || status > 599 {
+			result = "error"
+			writeJSONError(w, http.StatusInternalServerError, "hook_error", fmt.Sprintf("admin endpoint returned invalid status %d", status))
+			return
+		}
+	}
+	if value == lua.LNil {
+		w.WriteHeader(status)
+		return
+	}
+	data, err := luajson.Encode(value)
+	if err != nil {
+		result = "error"
+		writeJSONError(w, http.StatusInternalServerError, "hook_error", "admin endpoint returned a value that isn't JSON-encodable: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// Close waits for a running call to finish and closes the state
+func (e *luaAdminEndpoints) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+	e.L.Close()
+}
+
+// handleLuaAdminEndpoint serves the admin paths without a built-in handler from
+// the endpoints of the loaded hook script
+func handleLuaAdminEndpoint(w http.ResponseWriter, r *http.Request) {
+	luaHookManager.mu.RLock()
+	endpoints := luaHookManager.adminEndpoints
+	luaHookManager.mu.RUnlock()
+	if endpoints != nil {
+		if fn, ok := endpoints.handlers[r.URL.Path]; ok {
+			endpoints.serve(w, r, fn)
+			return
+		}
+	}
+	writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("no admin endpoint %s", r.URL.Path))
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	luajson "layeh.com/gopher-json"
+)
+
+// hookCache backs the Lua cache module: in memory, or in the -cache-storage backend
+// so every proxy instance sees the same entries
+var hookCache CacheStore
+
+// luaCacheLoader is the module loader for require("cache")
+var luaCacheLoader = luaCacheLoaderFor("")
+
+// luaCacheLoaderFor returns the loader for require("cache") with keys scoped to a
+// namespace, as luaKVLoaderFor does for kv
+func luaCacheLoaderFor(namespace string) lua.LGFunction {
+	return func(L *lua.LState) int {
+		mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+			"get": func(L *lua.LState) int {
+				L.Push(luaCacheGet(L, namespace+L.CheckString(1)))
+				return 1
+			},
+			"set": func(L *lua.LState) int {
+				luaCacheSet(L, namespace+L.CheckString(1))
+				return 0
+			},
+			"delete": func(L *lua.LState) int {
+				if hookCache != nil {
+					// Stores can't delete, so overwrite the entry with an expired one
+					hookCache.Set("hook:"+namespace+L.CheckString(1), &cachedResponse{StoredAt: time.Now(), ExpiresAt: time.Now()})
+				}
+				return 0
+			},
+		})
+		L.Push(mod)
+		return 1
+	}
+}
+
+// cache.get(key) returns the cached value, or nil if missing or expired
+func luaCacheGet(L *lua.LState, key string) lua.LValue {
+	if hookCache == nil {
+		return lua.LNil
+	}
+	entry, ok := hookCache.Get("hook:" + key)
+	if !ok || (!entry.ExpiresAt.IsZero() && !time.Now().Before(entry.ExpiresAt)) {
+		return lua.LNil
+	}
+	var value interface{}
+	if err := json.Unmarshal(entry.Body, &value); err != nil {
+		return lua.LNil
+	}
+	return luajson.DecodeValue(L, value)
+}
+
+// cache.set(key, value, ttl) caches a string, number, boolean or table for ttl
+// seconds, capped at -hook-cache-max-ttl (the cap when ttl is omitted)
+func luaCacheSet(L *lua.LState, key string) {
+	goValue, err := luaToGo(L.CheckAny(2))
+	if err != nil {
+		L.ArgError(2, "value must be JSON-encodable: "+err.Error())
+		return
+	}
+	ttl := *hookCacheMaxTTL
+	if seconds := float64(L.OptNumber(3, 0)); seconds > 0 {
+		ttl = min(ttl, time.Duration(seconds*float64(time.Second)))
+	}
+	if hookCache == nil {
+		return
+	}
+	body, err := json.Marshal(goValue)
+	if err != nil {
+		L.ArgError(2, "value must be JSON-encodable: "+err.Error())
+		return
+	}
+	now := time.Now()
+	hookCache.Set("hook:"+key, &cachedResponse{Body: body, StoredAt: now, ExpiresAt: now.Add(ttl)})
+}
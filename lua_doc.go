@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+
+	lua "github.com/yuin/gopher-lua"
+	luajson "layeh.com/gopher-json"
+)
+
+const luaDocumentType = "jsondoc"
+
+// jsonDocument is a request body parsed once in Go. processRequestDocument edits it
+// through targeted path operations, so only the values a hook touches are copied
+// into Lua instead of the whole multi-megabyte body.
+type jsonDocument struct {
+	root     interface{}
+	modified bool
+}
+
+// parseJSONDocument decodes body, keeping numbers exact so untouched values survive
+// re-encoding unchanged
+func parseJSONDocument(body []byte) (*jsonDocument, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var root interface{}
+	if err := decoder.Decode(&root); err != nil {
+		return nil, err
+	}
+	return &jsonDocument{root: root}, nil
+}
+
+// encode serializes the document without HTML escaping, so untouched strings keep
+// their original characters
+func (doc *jsonDocument) encode() ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc.root); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// registerLuaDocumentType installs the metatable with the document methods
+func registerLuaDocumentType(L *lua.LState) {
+	mt := L.NewTypeMetatable(luaDocumentType)
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"get":    luaDocGet,
+		"set":    luaDocSet,
+		"delete": luaDocDelete,
+		"len":    luaDocLen,
+		"append": luaDocAppend,
+	}))
+}
+
+// newLuaDocument wraps doc as a Lua userdata value
+func newLuaDocument(L *lua.LState, doc *jsonDocument) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = doc
+	L.SetMetatable(ud, L.GetTypeMetatable(luaDocumentType))
+	return ud
+}
+
+// checkDocPath returns the document receiver and the parsed path argument
+func checkDocPath(L *lua.LState) (*jsonDocument, []pathSegment) {
+	ud := L.CheckUserData(1)
+	doc, ok := ud.Value.(*jsonDocument)
+	if !ok {
+		L.ArgError(1, "document expected")
+		return nil, nil
+	}
+	segments, err := parsePath(L.OptString(2, "$"))
+	if err != nil {
+		L.ArgError(2, err.Error())
+		return nil, nil
+	}
+	return doc, segments
+}
+
+// doc:get(path) returns a copy of the value at path, or nil
+func luaDocGet(L *lua.LState) int {
+	doc, segments := checkDocPath(L)
+	value, ok := pathGet(doc.root, segments)
+	if !ok {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(luajson.DecodeValue(L, luaNumbers(value)))
+	return 1
+}
+
+// luaNumbers copies a document value with its exact json.Numbers turned into the
+// float64s Lua numbers are; luajson would hand them to Lua as strings
+func luaNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			copied[key] = luaNumbers(child)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, child := range v {
+			copied[i] = luaNumbers(child)
+		}
+		return copied
+	}
+	return value
+}
+
+// doc:set(path, value) replaces the value at path, creating missing objects
+func luaDocSet(L *lua.LState) int {
+	doc, segments := checkDocPath(L)
+	value, err := luaToGo(L.Get(3))
+	if err != nil {
+		L.ArgError(3, "value must be JSON-encodable: "+err.Error())
+		return 0
+	}
+	root, err := pathSet(doc.root, segments, value)
+	if err != nil {
+		L.RaiseError("doc:set: %v", err)
+		return 0
+	}
+	doc.root = root
+	doc.modified = true
+	return 0
+}
+
+// doc:delete(path) removes a key or array element and returns whether it existed
+func luaDocDelete(L *lua.LState) int {
+	doc, segments := checkDocPath(L)
+	root, removed := pathDelete(doc.root, segments)
+	doc.root = root
+	doc.modified = doc.modified || removed
+	L.Push(lua.LBool(removed))
+	return 1
+}
+
+// doc:len(path) returns the length of the array, object or string at path, or nil
+func luaDocLen(L *lua.LState) int {
+	doc, segments := checkDocPath(L)
+	value, _ := pathGet(doc.root, segments)
+	switch v := value.(type) {
+	case []interface{}:
+		L.Push(lua.LNumber(len(v)))
+	case map[string]interface{}:
+		L.Push(lua.LNumber(len(v)))
+	case string:
+		L.Push(lua.LNumber(len(v)))
+	default:
+		L.Push(lua.LNil)
+	}
+	return 1
+}
+
+// doc:append(path, value) appends to the array at path
+func luaDocAppend(L *lua.LState) int {
+	doc, segments := checkDocPath(L)
+	value, err := luaToGo(L.Get(3))
+	if err != nil {
+		L.ArgError(3, "value must be JSON-encodable: "+err.Error())
+		return 0
+	}
+	current, ok := pathGet(doc.root, segments)
+	array, isArray := current.([]interface{})
+	if ok && !isArray {
+		L.RaiseError("doc:append: value at path is not an array")
+		return 0
+	}
+	root, err := pathSet(doc.root, segments, append(array, value))
+	if err != nil {
+		L.RaiseError("doc:append: %v", err)
+		return 0
+	}
+	doc.root = root
+	doc.modified = true
+	return 0
+}
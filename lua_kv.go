@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+	luajson "layeh.com/gopher-json"
+)
+
+// kvStore is a process-wide key/value store shared by all Lua hook invocations.
+// Every hook call runs in a fresh Lua state, so this is the only place scripts can
+// keep data between requests. Values are stored as plain Go values so they can be
+// handed to any Lua state.
+type kvStore struct {
+	mu   sync.RWMutex
+	data map[string]interface{}
+}
+
+var luaKV = &kvStore{data: make(map[string]interface{})}
+
+// luaToGo converts a Lua value to a JSON-compatible Go value
+func luaToGo(value lua.LValue) (interface{}, error) {
+	data, err := luajson.Encode(value)
+	if err != nil {
+		return nil, err
+	}
+	var result interface{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// luaKVLoader is the module loader for require("kv")
+func luaKVLoader(L *lua.LState) int {
+	mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"get":    luaKVGet,
+		"set":    luaKVSet,
+		"incr":   luaKVIncr,
+		"delete": luaKVDelete,
+		"keys":   luaKVKeys,
+	})
+	L.Push(mod)
+	return 1
+}
+
+// kv.get(key) returns the stored value or nil
+func luaKVGet(L *lua.LState) int {
+	key := L.CheckString(1)
+	luaKV.mu.RLock()
+	value, ok := luaKV.data[key]
+	luaKV.mu.RUnlock()
+	if !ok {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(luajson.DecodeValue(L, value))
+	return 1
+}
+
+// kv.set(key, value) stores a string, number, boolean or table; nil deletes the key
+func luaKVSet(L *lua.LState) int {
+	key := L.CheckString(1)
+	value := L.Get(2)
+	if value == lua.LNil {
+		luaKV.mu.Lock()
+		delete(luaKV.data, key)
+		luaKV.mu.Unlock()
+		return 0
+	}
+	goValue, err := luaToGo(value)
+	if err != nil {
+		L.ArgError(2, "value must be JSON-encodable: "+err.Error())
+		return 0
+	}
+	luaKV.mu.Lock()
+	luaKV.data[key] = goValue
+	luaKV.mu.Unlock()
+	return 0
+}
+
+// kv.incr(key, delta) atomically adds delta (default 1) and returns the new value
+func luaKVIncr(L *lua.LState) int {
+	key := L.CheckString(1)
+	delta := float64(L.OptNumber(2, 1))
+
+	luaKV.mu.Lock()
+	current, _ := luaKV.data[key].(float64)
+	current += delta
+	luaKV.data[key] = current
+	luaKV.mu.Unlock()
+
+	L.Push(lua.LNumber(current))
+	return 1
+}
+
+// kv.delete(key) removes a key
+func luaKVDelete(L *lua.LState) int {
+	key := L.CheckString(1)
+	luaKV.mu.Lock()
+	delete(luaKV.data, key)
+	luaKV.mu.Unlock()
+	return 0
+}
+
+// kv.keys(prefix) returns the sorted keys starting with prefix (default all keys)
+func luaKVKeys(L *lua.LState) int {
+	prefix := L.OptString(1, "")
+	luaKV.mu.RLock()
+	var keys []string
+	for key := range luaKV.data {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	luaKV.mu.RUnlock()
+	sort.Strings(keys)
+
+	table := L.NewTable()
+	for _, key := range keys {
+		table.Append(lua.LString(key))
+	}
+	L.Push(table)
+	return 1
+}
+
+// luaKVLoaderFor is the loader for require("kv") scoped to a namespace: keys are
+// stored under the namespace prefix, so scripts sharing the store can't read or
+// overwrite each other's data
+func luaKVLoaderFor(namespace string) lua.LGFunction {
+	scoped := func(fn lua.LGFunction) lua.LGFunction {
+		return func(L *lua.LState) int {
+			L.Replace(1, lua.LString(namespace+L.CheckString(1)))
+			return fn(L)
+		}
+	}
+	keys := func(L *lua.LState) int {
+		prefix := namespace + L.OptString(1, "")
+		luaKV.mu.RLock()
+		var keys []string
+		for key := range luaKV.data {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, strings.TrimPrefix(key, namespace))
+			}
+		}
+		luaKV.mu.RUnlock()
+		sort.Strings(keys)
+
+		table := L.NewTable()
+		for _, key := range keys {
+			table.Append(lua.LString(key))
+		}
+		L.Push(table)
+		return 1
+	}
+	return func(L *lua.LState) int {
+		mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+			"get":    scoped(luaKVGet),
+			"set":    scoped(luaKVSet),
+			"incr":   scoped(luaKVIncr),
+			"delete": scoped(luaKVDelete),
+			"keys":   keys,
+		})
+		L.Push(mod)
+		return 1
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// luaLogLoader returns the module loader for require("log"). The trace ID of the
+// request being processed is attached to every line the script logs.
+func luaLogLoader(traceID string) lua.LGFunction {
+	return func(L *lua.LState) int {
+		mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+			"debug": luaLogFunc(levelDebug, traceID),
+			"info":  luaLogFunc(levelInfo, traceID),
+			"warn":  luaLogFunc(levelWarn, traceID),
+			"error": luaLogFunc(levelError, traceID),
+		})
+		L.Push(mod)
+		return 1
+	}
+}
+
+// luaLogFunc builds log.<level>(...). Arguments are joined like print(); a trailing
+// table is logged as key=value fields.
+func luaLogFunc(level logLevel, traceID string) lua.LGFunction {
+	return func(L *lua.LState) int {
+		top := L.GetTop()
+		var fields map[string]string
+		if top > 1 {
+			if table, ok := L.Get(top).(*lua.LTable); ok {
+				fields = make(map[string]string)
+				table.ForEach(func(key, value lua.LValue) {
+					fields[key.String()] = value.String()
+				})
+				top--
+			}
+		}
+
+		parts := make([]string, 0, top)
+		for i := 1; i <= top; i++ {
+			parts = append(parts, L.ToStringMeta(L.Get(i)).String())
+		}
+		logEvent(level, "lua", traceID, strings.Join(parts, " "), fields)
+		return 0
+	}
+}
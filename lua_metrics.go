@@ -0,0 +1,61 @@
+package main
+
+import (
+	lua "github.com/yuin/gopher-lua"
+)
+
+const luaMetricHelp = "Defined by the Lua hook script."
+
+// luaMetricsLoader is the module loader for require("metrics")
+func luaMetricsLoader(L *lua.LState) int {
+	mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"counter":   luaMetricsCounter,
+		"gauge":     luaMetricsGauge,
+		"histogram": luaMetricsHistogram,
+	})
+	L.Push(mod)
+	return 1
+}
+
+// luaMetricLabels reads an optional table of label names to values
+func luaMetricLabels(L *lua.LState, n int) map[string]string {
+	table := L.OptTable(n, nil)
+	if table == nil {
+		return nil
+	}
+	labels := make(map[string]string)
+	table.ForEach(func(key, value lua.LValue) {
+		labels[key.String()] = value.String()
+	})
+	return labels
+}
+
+// metrics.counter(name, delta, labels) increments a counter by delta (default 1)
+func luaMetricsCounter(L *lua.LState) int {
+	name := L.CheckString(1)
+	delta := float64(L.OptNumber(2, 1))
+	if err := metrics.Add(name, luaMetricHelp, luaMetricLabels(L, 3), delta); err != nil {
+		L.RaiseError("metrics.counter: %v", err)
+	}
+	return 0
+}
+
+// metrics.gauge(name, value, labels) sets a gauge
+func luaMetricsGauge(L *lua.LState) int {
+	name := L.CheckString(1)
+	value := float64(L.CheckNumber(2))
+	if err := metrics.Set(name, luaMetricHelp, luaMetricLabels(L, 3), value); err != nil {
+		L.RaiseError("metrics.gauge: %v", err)
+	}
+	return 0
+}
+
+// metrics.histogram(name, value, labels) records a histogram sample
+func luaMetricsHistogram(L *lua.LState) int {
+	name := L.CheckString(1)
+	value := float64(L.CheckNumber(2))
+	if err := metrics.Observe(name, luaMetricHelp, luaMetricLabels(L, 3), value); err != nil {
+		L.RaiseError("metrics.histogram: %v", err)
+	}
+	return 0
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// minScheduleInterval guards against scripts that would spin the scheduler
+const minScheduleInterval = time.Second
+
+// scheduledTask is a Lua function registered with schedule.every
+type scheduledTask struct {
+	name     string
+	interval time.Duration
+	fn       *lua.LFunction
+}
+
+// luaScheduler runs the periodic functions registered by a hook script. Unlike hook
+// calls, which get a fresh state per request, all tasks share one long-lived Lua
+// state, so calls into it are serialized.
+type luaScheduler struct {
+	mu      sync.Mutex
+	L       *lua.LState
+	tasks   []*scheduledTask
+	timeout time.Duration
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// luaScheduleLoader returns the module loader for require("schedule"). Hook calls
+// load the script with a nil scheduler, which makes schedule.every a no-op so tasks
+// are only registered once, in the scheduler's own state.
+func luaScheduleLoader(s *luaScheduler) lua.LGFunction {
+	return func(L *lua.LState) int {
+		mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+			"every": func(L *lua.LState) int {
+				spec := L.CheckString(1)
+				fn := L.CheckFunction(2)
+				name := L.OptString(3, fmt.Sprintf("task-%s", spec))
+
+				interval, err := time.ParseDuration(spec)
+				if err != nil {
+					L.ArgError(1, "invalid interval: "+err.Error())
+					return 0
+				}
+				if interval < minScheduleInterval {
+					L.ArgError(1, fmt.Sprintf("interval must be at least %v", minScheduleInterval))
+					return 0
+				}
+				if s != nil {
+					s.tasks = append(s.tasks, &scheduledTask{name: name, interval: interval, fn: fn})
+				}
+				return 0
+			},
+		})
+		L.Push(mod)
+		return 1
+	}
+}
+
+// startLuaScheduler loads script into a dedicated state and starts a goroutine per
+// registered task. It returns nil if the script registers no tasks.
+func startLuaScheduler(script string, timeout time.Duration) (*luaScheduler, error) {
+	s := &luaScheduler{
+		L:       lua.NewState(),
+		timeout: timeout,
+		stop:    make(chan struct{}),
+	}
+	preloadLuaModules(s.L, "")
+	s.L.PreloadModule("schedule", luaScheduleLoader(s))
+
+	if err := s.L.DoString(script); err != nil {
+		s.L.Close()
+		return nil, fmt.Errorf("failed to load Lua script for scheduler: %v", err)
+	}
+	if len(s.tasks) == 0 {
+		s.L.Close()
+		return nil, nil
+	}
+
+	for _, task := range s.tasks {
+		s.wg.Add(1)
+		go s.loop(task)
+		log.Printf("⏰ Scheduled Lua task %q every %v", task.name, task.interval)
+	}
+	return s, nil
+}
+
+func (s *luaScheduler) loop(task *scheduledTask) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(task.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.run(task)
+		}
+	}
+}
+
+// run calls a task with a timeout, isolating the scheduler from Lua errors and
+// Go panics raised inside module functions
+func (s *luaScheduler) run(task *scheduledTask) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	started := time.Now()
+	result := "ok"
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("❌ Lua task %q panicked: %v", task.name, r)
+			result = "panic"
+			// The state may be mid-call; drop whatever is left on the stack
+			s.L.SetTop(0)
+		}
+		metrics.Add("openai_proxy_lua_task_runs_total", "Runs of scheduled Lua tasks.", map[string]string{"task": task.name, "result": result}, 1)
+		metrics.Observe("openai_proxy_lua_task_duration_seconds", "Duration of scheduled Lua task runs.", map[string]string{"task": task.name}, time.Since(started).Seconds())
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	s.L.SetContext(ctx)
+	defer s.L.RemoveContext()
+
+	s.L.Push(task.fn)
+	if err := s.L.PCall(0, 0, nil); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			log.Printf("❌ Lua task %q timed out after %v", task.name, s.timeout)
+			result = "timeout"
+		} else {
+			log.Printf("❌ Lua task %q failed: %v", task.name, err)
+			result = "error"
+		}
+	}
+}
+
+// Stop stops all tasks, waits for running ones to finish and closes the state
+func (s *luaScheduler) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.L.Close()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// secretEnvPrefix namespaces environment variables readable through secrets.get, so
+// hooks cannot read arbitrary process environment
+const secretEnvPrefix = "OPENAI_PROXY_SECRET_"
+
+var (
+	hookSecretsMu sync.RWMutex
+	hookSecrets   = map[string]string{}
+)
+
+// loadSecretsFile reads a JSON object mapping secret names to values
+func loadSecretsFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read secrets file %s: %v", path, err)
+	}
+	secrets := map[string]string{}
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		return fmt.Errorf("failed to parse secrets file %s: expected a JSON object of strings: %v", path, err)
+	}
+
+	hookSecretsMu.Lock()
+	hookSecrets = secrets
+	hookSecretsMu.Unlock()
+	return nil
+}
+
+// secretEnvName maps a secret name such as "slack-token" to OPENAI_PROXY_SECRET_SLACK_TOKEN
+func secretEnvName(name string) string {
+	return secretEnvPrefix + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// lookupSecret resolves a secret from the environment first, then the secrets file
+func lookupSecret(name string) (string, bool) {
+	if value, ok := os.LookupEnv(secretEnvName(name)); ok {
+		return value, true
+	}
+	hookSecretsMu.RLock()
+	defer hookSecretsMu.RUnlock()
+	value, ok := hookSecrets[name]
+	return value, ok
+}
+
+// luaSecretsLoader is the module loader for require("secrets")
+func luaSecretsLoader(L *lua.LState) int {
+	mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		// secrets.get(name) returns the secret value or nil
+		"get": func(L *lua.LState) int {
+			value, ok := lookupSecret(L.CheckString(1))
+			if !ok {
+				L.Push(lua.LNil)
+				return 1
+			}
+			L.Push(lua.LString(value))
+			return 1
+		},
+	})
+	L.Push(mod)
+	return 1
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	lua "github.com/yuin/gopher-lua"
+	luajson "layeh.com/gopher-json"
+)
+
+// luaSSELoader is the module loader for require("sse")
+func luaSSELoader(L *lua.LState) int {
+	mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"parse":  luaSSEParse,
+		"encode": luaSSEEncode,
+	})
+	L.Push(mod)
+	return 1
+}
+
+// sse.parse(chunk) returns a list of event tables and the trailing incomplete text.
+// Each event has event, data, id and retry fields; JSON data is also decoded into
+// json, and the terminating [DONE] event has done = true.
+func luaSSEParse(L *lua.LState) int {
+	events, rest := parseSSE(L.CheckString(1))
+
+	list := L.NewTable()
+	for _, event := range events {
+		table := L.NewTable()
+		table.RawSetString("data", lua.LString(event.Data))
+		if event.Event != "" {
+			table.RawSetString("event", lua.LString(event.Event))
+		}
+		if event.Id != "" {
+			table.RawSetString("id", lua.LString(event.Id))
+		}
+		if event.Retry > 0 {
+			table.RawSetString("retry", lua.LNumber(event.Retry))
+		}
+		if event.Data == sseDone {
+			table.RawSetString("done", lua.LTrue)
+		} else if decoded, err := luajson.Decode(L, []byte(event.Data)); err == nil {
+			table.RawSetString("json", decoded)
+		}
+		list.Append(table)
+	}
+	L.Push(list)
+	L.Push(lua.LString(rest))
+	return 2
+}
+
+// sse.encode(events) renders a list of event tables as SSE text. An event's json
+// field, if present, is encoded and takes precedence over data; done = true emits
+// the [DONE] terminator.
+func luaSSEEncode(L *lua.LState) int {
+	list := L.CheckTable(1)
+
+	var events []sseEvent
+	var encodeErr error
+	list.ForEach(func(_, value lua.LValue) {
+		table, ok := value.(*lua.LTable)
+		if !ok || encodeErr != nil {
+			return
+		}
+		event := sseEvent{
+			Event: lua.LVAsString(table.RawGetString("event")),
+			Data:  lua.LVAsString(table.RawGetString("data")),
+			Id:    lua.LVAsString(table.RawGetString("id")),
+			Retry: int(lua.LVAsNumber(table.RawGetString("retry"))),
+		}
+		if lua.LVAsBool(table.RawGetString("done")) {
+			event.Data = sseDone
+		} else if payload := table.RawGetString("json"); payload != lua.LNil {
+			data, err := luajson.Encode(payload)
+			if err != nil {
+				encodeErr = err
+				return
+			}
+			event.Data = string(data)
+		}
+		events = append(events, event)
+	})
+	if encodeErr != nil {
+		L.RaiseError("sse.encode: %v", encodeErr)
+		return 0
+	}
+
+	L.Push(lua.LString(encodeSSE(events)))
+	return 1
+}
@@ -2,37 +2,45 @@ package main
 
 import (
 	"bytes"
-	"compress/gzip"
+	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"net"
 	"net/http"
-	"net/url"
+	"net/http/httptrace"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/andybalholm/brotli"
 	"github.com/gorilla/websocket"
 	lua "github.com/yuin/gopher-lua"
 	luajson "layeh.com/gopher-json"
 )
 
 // Hook functions for request and response modification
-type RequestHook func(body []byte, headers http.Header) ([]byte, http.Header, error)
+type RequestHook func(path string, body []byte, headers http.Header) ([]byte, http.Header, error)
 type ResponseHook func(body []byte, headers http.Header) ([]byte, http.Header, error)
 
 // LuaHookManager manages Lua scripts for request/response hooks
 type LuaHookManager struct {
-	mu          sync.RWMutex
-	luaScript   string
-	enabled     bool
-	hasRequest  bool
-	hasResponse bool
+	mu            sync.RWMutex
+	luaScript     string
+	enabled       bool
+	hasRequest    bool
+	hasRequestDoc bool
+	hasResponse   bool
+	hasTrace      bool
+	scheduler     *luaScheduler
+	// adminEndpoints serves the paths the script registers with admin.handle
+	adminEndpoints *luaAdminEndpoints
 }
 
 var luaHookManager = &LuaHookManager{
@@ -41,49 +49,94 @@ var luaHookManager = &LuaHookManager{
 
 // LoadHookScript loads a Lua script containing both processRequest and processResponse functions
 func (lhm *LuaHookManager) LoadHookScript(scriptPath string) error {
-	lhm.mu.Lock()
-	defer lhm.mu.Unlock()
-
 	// Read the script file
 	data, err := os.ReadFile(scriptPath)
 	if err != nil {
 		return fmt.Errorf("failed to read Lua script file %s: %v", scriptPath, err)
 	}
+	return lhm.LoadHookSource(scriptPath, string(data))
+}
 
-	script := string(data)
+// LoadHookSource loads a Lua script from its source. The running script is kept
+// if the new one fails to load.
+func (lhm *LuaHookManager) LoadHookSource(name, script string) error {
+	lhm.mu.Lock()
+	defer lhm.mu.Unlock()
 
 	// Test the script by creating a temporary Lua state
 	L := lua.NewState()
 	defer L.Close()
 
-	// Add JSON support
-	luajson.Preload(L)
+	// Add JSON support and the proxy modules
+	preloadLuaModules(L, "")
 
 	if err := L.DoString(script); err != nil {
-		return fmt.Errorf("failed to load Lua script: %v", err)
+		return fmt.Errorf("failed to load Lua script %s: %v", name, err)
 	}
 
 	// Check which functions are available
 	hasRequest := L.GetGlobal("processRequest").Type() == lua.LTFunction
+	hasRequestDoc := L.GetGlobal("processRequestDocument").Type() == lua.LTFunction
 	hasResponse := L.GetGlobal("processResponse").Type() == lua.LTFunction
+	hasTrace := L.GetGlobal("onTrace").Type() == lua.LTFunction
+
+	// Restart scheduled tasks with the new script
+	scheduler, err := startLuaScheduler(script, *scheduleTimeout)
+	if err != nil {
+		return err
+	}
+
+	adminEndpoints, err := startLuaAdminEndpoints(script, *luaAdminTimeout)
+	if err != nil {
+		if scheduler != nil {
+			scheduler.Stop()
+		}
+		return err
+	}
 
-	if !hasRequest && !hasResponse {
-		return fmt.Errorf("Lua script must define at least one of 'processRequest' or 'processResponse' functions")
+	if !hasRequest && !hasRequestDoc && !hasResponse && !hasTrace && scheduler == nil && adminEndpoints == nil {
+		return fmt.Errorf("Lua script must define at least one of 'processRequest', 'processRequestDocument', 'processResponse' or 'onTrace' functions, schedule a task or register an admin endpoint")
 	}
 
+	if lhm.scheduler != nil {
+		lhm.scheduler.Stop()
+	}
+	lhm.scheduler = scheduler
+	if lhm.adminEndpoints != nil {
+		lhm.adminEndpoints.Close()
+	}
+	lhm.adminEndpoints = adminEndpoints
+
 	lhm.luaScript = script
 	lhm.hasRequest = hasRequest
+	lhm.hasRequestDoc = hasRequestDoc
 	lhm.hasResponse = hasResponse
+	lhm.hasTrace = hasTrace
 	lhm.enabled = true
 
-	log.Printf("✅ Lua hook script loaded successfully (processRequest: %v, processResponse: %v)", hasRequest, hasResponse)
+	log.Printf("✅ Lua hook script loaded successfully (processRequest: %v, processRequestDocument: %v, processResponse: %v, onTrace: %v)", hasRequest, hasRequestDoc, hasResponse, hasTrace)
 	return nil
 }
 
-// createLuaState creates a new Lua state with JSON support
-func (lhm *LuaHookManager) createLuaState() *lua.LState {
-	L := lua.NewState()
+// preloadLuaModules makes the json and proxy-provided modules available to require().
+// traceID identifies the request being processed, if any.
+func preloadLuaModules(L *lua.LState, traceID string) {
 	luajson.Preload(L)
+	L.PreloadModule("log", luaLogLoader(traceID))
+	L.PreloadModule("kv", luaKVLoader)
+	L.PreloadModule("cache", luaCacheLoader)
+	L.PreloadModule("metrics", luaMetricsLoader)
+	L.PreloadModule("schedule", luaScheduleLoader(nil))
+	L.PreloadModule("admin", luaAdminLoader(nil))
+	L.PreloadModule("secrets", luaSecretsLoader)
+	L.PreloadModule("sse", luaSSELoader)
+	registerLuaDocumentType(L)
+}
+
+// createLuaState creates a new Lua state with JSON support for the given request
+func (lhm *LuaHookManager) createLuaState(traceID string) *lua.LState {
+	L := lua.NewState()
+	preloadLuaModules(L, traceID)
 	return L
 }
 
@@ -117,15 +170,15 @@ func luaTableToHttpHeader(L *lua.LState, table *lua.LTable) http.Header {
 }
 
 // ExecuteRequestHook executes the Lua request hook if available
-func (lhm *LuaHookManager) ExecuteRequestHook(body []byte, headers http.Header) ([]byte, http.Header, error) {
+func (lhm *LuaHookManager) ExecuteRequestHook(traceID string, body []byte, headers http.Header) ([]byte, http.Header, error) {
 	lhm.mu.RLock()
 	defer lhm.mu.RUnlock()
 
-	if !lhm.enabled || !lhm.hasRequest || lhm.luaScript == "" {
+	if !lhm.enabled || (!lhm.hasRequest && !lhm.hasRequestDoc) || lhm.luaScript == "" {
 		return body, headers, nil
 	}
 
-	L := lhm.createLuaState()
+	L := lhm.createLuaState(traceID)
 	defer L.Close()
 
 	// Load the script
@@ -134,6 +187,13 @@ func (lhm *LuaHookManager) ExecuteRequestHook(body []byte, headers http.Header)
 		return body, headers, nil // Return original on error
 	}
 
+	if lhm.hasRequestDoc {
+		body, headers = lhm.executeRequestDocumentHook(L, body, headers)
+	}
+	if !lhm.hasRequest {
+		return body, headers, nil
+	}
+
 	// Prepare arguments
 	L.Push(L.GetGlobal("processRequest"))
 	L.Push(lua.LString(string(body)))
@@ -166,8 +226,58 @@ func (lhm *LuaHookManager) ExecuteRequestHook(body []byte, headers http.Header)
 	return resultBody, resultHeaders, nil
 }
 
+// executeRequestDocumentHook calls processRequestDocument(doc, headers) with the body
+// parsed once in Go. The body is only re-encoded if the hook changed the document.
+func (lhm *LuaHookManager) executeRequestDocumentHook(L *lua.LState, body []byte, headers http.Header) ([]byte, http.Header) {
+	doc, err := parseJSONDocument(body)
+	if err != nil {
+		// Not JSON (e.g. multipart uploads); leave it to processRequest
+		return body, headers
+	}
+
+	L.Push(L.GetGlobal("processRequestDocument"))
+	L.Push(newLuaDocument(L, doc))
+	L.Push(httpHeaderToLuaTable(L, headers))
+	if err := L.PCall(2, 1, nil); err != nil {
+		log.Printf("❌ Error calling processRequestDocument function: %v", err)
+		return body, headers // Return original on error
+	}
+	modifiedHeaders := L.Get(-1)
+	L.Pop(1)
+
+	if modifiedHeaders.Type() == lua.LTTable {
+		headers = luaTableToHttpHeader(L, modifiedHeaders.(*lua.LTable))
+	}
+	if doc.modified {
+		encoded, err := doc.encode()
+		if err != nil {
+			log.Printf("❌ Error encoding modified request document: %v", err)
+			return body, headers
+		}
+		body = encoded
+	}
+
+	log.Printf("🔧 Lua request document hook executed (modified: %v)", doc.modified)
+	return body, headers
+}
+
+// HasRequestHook reports whether the loaded script defines processRequest or
+// processRequestDocument
+func (lhm *LuaHookManager) HasRequestHook() bool {
+	lhm.mu.RLock()
+	defer lhm.mu.RUnlock()
+	return lhm.enabled && (lhm.hasRequest || lhm.hasRequestDoc) && lhm.luaScript != ""
+}
+
+// HasResponseHook reports whether the loaded script defines processResponse
+func (lhm *LuaHookManager) HasResponseHook() bool {
+	lhm.mu.RLock()
+	defer lhm.mu.RUnlock()
+	return lhm.enabled && lhm.hasResponse && lhm.luaScript != ""
+}
+
 // ExecuteResponseHook executes the Lua response hook if available
-func (lhm *LuaHookManager) ExecuteResponseHook(body []byte, headers http.Header) ([]byte, http.Header, error) {
+func (lhm *LuaHookManager) ExecuteResponseHook(traceID string, body []byte, headers http.Header) ([]byte, http.Header, error) {
 	lhm.mu.RLock()
 	defer lhm.mu.RUnlock()
 
@@ -175,7 +285,7 @@ func (lhm *LuaHookManager) ExecuteResponseHook(body []byte, headers http.Header)
 		return body, headers, nil
 	}
 
-	L := lhm.createLuaState()
+	L := lhm.createLuaState(traceID)
 	defer L.Close()
 
 	// Load the script
@@ -216,19 +326,198 @@ func (lhm *LuaHookManager) ExecuteResponseHook(body []byte, headers http.Header)
 	return resultBody, resultHeaders, nil
 }
 
+// ExecuteTraceHook calls the Lua onTrace function with the completed trace.
+// It returns false if the script asked for the trace to be dropped.
+func (lhm *LuaHookManager) ExecuteTraceHook(trace Trace) bool {
+	lhm.mu.RLock()
+	defer lhm.mu.RUnlock()
+
+	if !lhm.enabled || !lhm.hasTrace || lhm.luaScript == "" {
+		return true
+	}
+
+	data, err := json.Marshal(trace)
+	if err != nil {
+		log.Printf("❌ Error encoding trace for onTrace: %v", err)
+		return true
+	}
+
+	L := lhm.createLuaState(trace.Id)
+	defer L.Close()
+
+	// Load the script
+	if err := L.DoString(lhm.luaScript); err != nil {
+		log.Printf("❌ Error executing trace hook script: %v", err)
+		return true // Keep the trace on error
+	}
+
+	traceTable, err := luajson.Decode(L, data)
+	if err != nil {
+		log.Printf("❌ Error converting trace for onTrace: %v", err)
+		return true
+	}
+
+	// Call the function
+	L.Push(L.GetGlobal("onTrace"))
+	L.Push(traceTable)
+	if err := L.PCall(1, 1, nil); err != nil {
+		log.Printf("❌ Error calling onTrace function: %v", err)
+		return true // Keep the trace on error
+	}
+
+	// Only an explicit false drops the trace
+	return L.Get(-1) != lua.LFalse
+}
+
 var (
 	port                     = flag.Int("port", 8080, "OpenAI API port to listen on")
-	host                     = flag.String("host", "localhost", "OpenAI API host to listen on")
+	tlsCertFile              = flag.String("tls-cert", "", "PEM certificate to serve the API over HTTPS with (requires -tls-key)")
+	tlsKeyFile               = flag.String("tls-key", "", "PEM private key of -tls-cert")
+	clientCAFile             = flag.String("client-ca", "", "PEM bundle of CAs that issue client certificates; enables client certificate authentication (requires -tls-cert)")
+	clientCertMode           = flag.String("client-cert-mode", "require", "With -client-ca: require a verified certificate, optional to verify it only when presented, or mapped to also require it to map to a virtual key")
+	host                     = flag.String("host", "localhost", "Comma-separated addresses to listen on: IPv4, IPv6 (e.g. ::1 or [::1]:9090) or hostnames, optionally with a port")
+	configPath               = flag.String("config", "", "JSON file of option values (command-line flags and OPENAI_PROXY_* environment variables take precedence)")
+	upstream                 = flag.String("upstream", "https://api.openai.com", "Base URL of the upstream OpenAI-compatible API")
+	upstreamHostHeader       = flag.String("upstream-host", "", "Host header sent to -upstream and -upstream-pool members instead of the one in their URL, e.g. api.openai.com when connecting to an egress IP")
+	upstreamSNI              = flag.String("upstream-sni", "", "TLS server name presented to and verified for -upstream and -upstream-pool members (default: the -upstream-host name)")
+	asyncJobsEnabled         = flag.Bool("async-jobs", false, "Accept POST requests with ?async=1 as background jobs that clients poll at GET /jobs/<id>")
+	jobWorkers               = flag.Int("job-workers", 4, "Jobs executed concurrently")
+	jobMaxPending            = flag.Int("job-max-pending", 1000, "Maximum queued jobs; further async requests get 429")
+	jobMaxAttempts           = flag.Int("job-max-attempts", 3, "Attempts per job for upstream errors and rate limits, with exponential backoff from 1s")
+	jobTTL                   = flag.Duration("job-ttl", 24*time.Hour, "How long finished jobs can be fetched")
+	jobWebhookURL            = flag.String("job-webhook-url", "", "URL receiving every finished job as a JSON POST (empty disables)")
+	batchSchedule            = flag.String("batch-schedule", "", "Comma-separated local times of day, HH:MM, at which ?async=batch jobs are released (empty runs them at once)")
+	batchMode                = flag.String("batch-mode", "batch", "How released ?async=batch jobs run: batch (the upstream Batch API) or offpeak (the job workers)")
+	batchMaxRequests         = flag.Int("batch-max-requests", 50000, "Maximum requests per upstream batch")
+	batchPollInterval        = flag.Duration("batch-poll-interval", time.Minute, "How often to check submitted upstream batches")
+	batchMaxScheduled        = flag.Int("batch-max-scheduled", 10000, "Maximum ?async=batch jobs waiting for the next batch window")
+	kafkaBrokers             = flag.String("kafka-brokers", "", "Comma-separated Kafka bootstrap brokers, host:port, for the Kafka sinks")
+	eventBusName             = flag.String("event-bus", "", "Publish traces and usage events to this bus: kafka or nats (empty disables)")
+	eventTraceTopic          = flag.String("event-trace-topic", "openai_proxy.traces", "Kafka topic or NATS subject for completed traces (empty disables)")
+	eventUsageTopic          = flag.String("event-usage-topic", "", "Kafka topic or NATS subject for token usage events (empty disables)")
+	eventFormat              = flag.String("event-format", "json", "Serialization of published events: json or cloudevents")
+	natsURL                  = flag.String("nats-url", "nats://127.0.0.1:4222", "NATS server URL for -event-bus nats")
+	streamTeeDir             = flag.String("stream-tee-dir", "", "Directory where the raw body of every streamed response is written as <trace id>.sse (empty disables)")
+	streamTeeWebhook         = flag.String("stream-tee-webhook", "", "URL receiving the raw body of every streamed response in a POST once it ends (empty disables)")
+	streamTeeKafkaTopic      = flag.String("stream-tee-kafka-topic", "", "Kafka topic receiving the raw body of every streamed response, keyed by trace ID (empty disables)")
+	streamTeeMaxBytes        = flag.Int("stream-tee-max-bytes", 16<<20, "Bytes of each streamed response kept for the tee sinks; longer streams are truncated")
+	streamRetryMode          = flag.String("stream-retry", "off", "Send a streamed request once more when the upstream cuts the stream off: off, discard to hold events back until the stream finishes, or stitch to stream live and trim the retry to the text the client lacks")
+	upstreamPoolSpec         = flag.String("upstream-pool", "", "Comma-separated upstream base URLs with optional weights, e.g. https://eu.example.com=3,https://us.example.com, to balance requests over instead of -upstream")
+	upstreamProbeInterval    = flag.Duration("upstream-probe-interval", 10*time.Second, "How often each -upstream-pool member is health checked (0 disables probing)")
+	upstreamProbePath        = flag.String("upstream-probe-path", "/v1/models", "Path requested with GET to health check -upstream-pool members")
+	upstreamProbeTimeout     = flag.Duration("upstream-probe-timeout", 5*time.Second, "Timeout of an upstream health check")
+	upstreamEncodingList     = flag.String("upstream-encodings", "zstd,br,gzip", "Content encodings offered to the upstream, preferred first; identity disables compression")
+	adminHost                = flag.String("admin-host", "", "Host the trace/admin server binds to (empty for all interfaces)")
+	adminPort                = flag.Int("admin-port", 8081, "Port of the trace/admin server")
+	adminToken               = flag.String("admin-token", "", "Bearer token required by the trace/admin server (empty disables auth)")
+	adminDisable             = flag.Bool("admin-disable", false, "Disable the trace/admin server entirely")
 	luaFile                  = flag.String("hook", "", "Path to Lua script with processRequest and processResponse functions")
+	rateLimitRPM             = flag.Int("rate-limit-rpm", 0, "Requests per minute allowed per client key (0 disables)")
+	tokenBudgetDaily         = flag.Int64("token-budget", 0, "Tokens each client key may use per UTC day (0 disables)")
+	usageHistoryDays         = flag.Int("usage-history-days", 0, "Days of per-key and per-tenant token and cost totals kept for GET /usage/forecast (0 disables)")
+	usageForecastWindow      = flag.Int("usage-forecast-window", 14, "Recent days the linear usage forecast is fitted to")
+	paceUpstreamLimits       = flag.Bool("pace-upstream-limits", false, "Hold requests back when the upstream's x-ratelimit-* headers show the key's limit is nearly used up")
+	paceRequestHeadroom      = flag.Int64("pace-request-headroom", 1, "Upstream requests per window kept in reserve by -pace-upstream-limits")
+	paceTokenHeadroom        = flag.Int64("pace-token-headroom", 0, "Upstream tokens per window kept in reserve by -pace-upstream-limits")
+	paceMaxWait              = flag.Duration("pace-max-wait", 30*time.Second, "Longest a request is held back by -pace-upstream-limits before the proxy answers 429")
+	maxConcurrency           = flag.Int("max-concurrency", 0, "Maximum concurrent upstream requests (0 for unlimited)")
+	maxQueue                 = flag.Int("max-queue", 100, "Maximum requests waiting for a slot when -max-concurrency is reached")
+	authChainSpec            = flag.String("auth", "vkey,passthrough", "Comma-separated authentication chain tried in order: vkey, token, hmac, jwt and passthrough, which accepts any request")
+	listenerAuthSpec         = flag.String("listener-auth", "", "Semicolon-separated address=schemes chains replacing -auth on one listener, e.g. 0.0.0.0:8443=jwt,vkey; systemd sockets are named by FileDescriptorName")
+	authTokens               = flag.String("auth-tokens", "", "Comma-separated name:token pairs accepted by the token scheme")
+	authHMACKeys             = flag.String("auth-hmac-keys", "", "Comma-separated id:secret pairs whose request signatures the hmac scheme accepts")
+	authJWTIssuer            = flag.String("auth-jwt-issuer", "", "OIDC issuer URL whose tokens the jwt scheme accepts; its signing keys are found through discovery")
+	authJWTAudience          = flag.String("auth-jwt-audience", "", "Audience the jwt scheme requires in the aud claim (empty accepts any)")
+	authJWTJWKSURL           = flag.String("auth-jwt-jwks-url", "", "JWKS URL of the issuer's signing keys (default: the jwks_uri from OIDC discovery)")
+	authJWTSubjectClaim      = flag.String("auth-jwt-subject-claim", "sub", "Token claim that identifies the caller for limits and traces")
+	upstreamKeySecret        = flag.String("upstream-key-secret", "", "Secret holding the upstream API key sent for requests the token, hmac or jwt scheme authenticated")
+	queueTimeout             = flag.Duration("queue-timeout", 30*time.Second, "Maximum time a request waits in the queue before a 503")
+	shedMemoryMB             = flag.Int("shed-memory-mb", 0, "Reject new requests with a 503 while the proxy holds more memory than this many MiB (0 disables)")
+	shedGoroutines           = flag.Int("shed-goroutines", 0, "Reject new requests with a 503 while the proxy runs more goroutines than this (0 disables)")
+	shedTraceStoreMB         = flag.Int("shed-trace-store-mb", 0, "Reject new requests with a 503 while the in-memory trace store holds more bodies than this many MiB (0 disables)")
+	shedDegradeAt            = flag.Float64("shed-degrade-at", 0.8, "Fraction of a -shed-* limit from which the proxy degrades as set by -shed-degrade")
+	shedDegradeItems         = flag.String("shed-degrade", "traces,hooks", "What degrades near a -shed-* limit, comma-separated: traces (metadata only) and hooks (skipped); empty only rejects")
+	hookVersionsKept         = flag.Int("hook-versions", 10, "Hook script versions kept in memory for GET /hooks/versions and rollback")
+	hookBackend              = flag.String("hook-backend", "auto", "Hook script language: lua, starlark, or auto to pick starlark for .star files")
+	starlarkMaxSteps         = flag.Uint64("starlark-max-steps", 10000000, "Maximum Starlark execution steps per hook call (0 for unlimited)")
+	logLevelName             = flag.String("log-level", "info", "Minimum level of leveled log messages: debug, info, warn or error")
+	secretsFile              = flag.String("secrets-file", "", "JSON file of secrets readable by Lua hooks through secrets.get")
+	tenantHooksDir           = flag.String("tenant-hooks-dir", "", "Directory of per-tenant Lua hook scripts named <tenant>.lua, run after the global hook for requests of that tenant (empty disables)")
+	tenantHookConcurrency    = flag.Int("tenant-hook-concurrency", 4, "Maximum concurrent hook calls per tenant")
+	tenantHookTimeout        = flag.Duration("tenant-hook-timeout", time.Second, "Maximum run time of a tenant hook call, and of the wait for a free slot")
+	tenantHookCPUQuota       = flag.Duration("tenant-hook-cpu-quota", 0, "Hook run time each tenant may use per minute; further calls are skipped (0 for unlimited)")
+	scheduleTimeout          = flag.Duration("schedule-timeout", 30*time.Second, "Maximum run time of a Lua task registered with schedule.every")
+	luaAdminTimeout          = flag.Duration("lua-admin-timeout", 10*time.Second, "Maximum run time of a call to an admin endpoint registered with admin.handle")
 	printSampleHookLuaScript = flag.Bool("print-sample-hook-lua-script", false, "Print the sample Lua script")
-
-	// Default hook implementations that can be replaced
-	requestHook  RequestHook  = func(body []byte, headers http.Header) ([]byte, http.Header, error) { return body, headers, nil }
-	responseHook ResponseHook = func(body []byte, headers http.Header) ([]byte, http.Header, error) { return body, headers, nil }
+	transcriptionCacheTTL    = flag.Duration("transcription-cache-ttl", 0, "Cache /v1/audio/transcriptions results for this long, keyed on the audio content (0 disables)")
+	transcriptionCacheSize   = flag.Int("transcription-cache-size", 1000, "Maximum number of cached transcription results")
+	hookCacheSize            = flag.Int("hook-cache-size", 10000, "Maximum number of entries in the Lua cache module when it is kept in memory")
+	hookCacheMaxTTL          = flag.Duration("hook-cache-max-ttl", 24*time.Hour, "Longest time an entry set through the Lua cache module is kept")
+	completionCacheTTL       = flag.Duration("completion-cache-ttl", 0, "Cache non-streamed chat completion, completion and embedding responses for this long, keyed on the credential and request body (0 disables)")
+	completionCacheSize      = flag.Int("completion-cache-size", 1000, "Maximum number of cached completion and embedding responses")
+	fingerprintIgnoreFields  = flag.String("fingerprint-ignore-fields", "user,request_id", "Comma-separated top-level request fields left out of request fingerprints and cache keys")
+	negativeCacheTTL         = flag.Duration("negative-cache-ttl", 0, "Answer repeats of a request the upstream rejected with 400, 404, 413 or 422 from a cache for this long (0 disables)")
+	staticCacheSpec          = flag.String("static-cache", "", "Comma-separated prefix=ttl pairs caching GET responses of rarely-changing endpoints, e.g. /v1/models=10m,/v1/assistants=1m (empty disables)")
+	staleWhileRevalidate     = flag.Duration("cache-stale-while-revalidate", 0, "Serve completion cache entries up to this long past their TTL while refreshing them in the background (0 disables)")
+	ttsCacheDir              = flag.String("tts-cache-dir", "", "Directory for caching /v1/audio/speech outputs (empty disables)")
+	ttsCacheMaxBytes         = flag.Int64("tts-cache-max-bytes", 256<<20, "Maximum total size of the speech cache directory")
+	captureDir               = flag.String("capture-dir", "", "Directory for per-session capture files of complete raw exchanges, including SSE chunk timing (empty disables)")
+	sessionInference         = flag.Bool("session-inference", true, "Assign session IDs to chat requests by fingerprinting the conversation so far")
+	blobDir                  = flag.String("blob-dir", "", "Directory for large trace bodies, stored deduplicated by content hash (empty keeps all bodies in memory)")
+	blobThreshold            = flag.Int("blob-threshold", 64<<10, "Trace bodies larger than this many bytes are moved to -blob-dir")
+	storageName              = flag.String("storage", "memory", "Backend for traces and token usage: memory, sqlite or redis")
+	cacheStorageName         = flag.String("cache-storage", "", "Backend for the transcription, completion, negative, static and hook caches: sqlite or redis (empty keeps them in memory)")
+	sqlitePath               = flag.String("sqlite-path", "openai_proxy.db", "SQLite database file used by the sqlite storage backend")
+	redisURL                 = flag.String("redis-url", "redis://localhost:6379/0", "Redis server used by the redis storage backend")
+	redisPrefix              = flag.String("redis-prefix", "openai_proxy:", "Prefix of every key the redis storage backend writes")
+	traceStoreMax            = flag.Int("trace-store-max", 10000, "Maximum number of traces kept by the sqlite and redis backends")
+	renderCapturePath        = flag.String("render-capture", "", "Print a capture file as annotated HTTP exchanges and exit")
+	responseTransformSpec    = flag.String("response-transforms", "", "Comma-separated cleanups of generated text in buffered responses, run after hooks: strip_fences, extract_json, trim, max_length=<n>")
+	rulesFile                = flag.String("rules-file", "", "JSON file of routing, trace and guardrail rules with expression conditions (empty disables)")
+	quarantineMaxBodyBytes   = flag.Int("quarantine-max-body-bytes", 0, "Quarantine requests with bodies larger than this (0 disables)")
+	quarantineBlockedModels  = flag.String("quarantine-blocked-models", "", "Comma-separated models whose requests are quarantined")
+	quarantineInjection      = flag.Bool("quarantine-injection", false, "Quarantine requests whose prompts match common prompt injection phrasings")
+	quarantineSize           = flag.Int("quarantine-size", 1000, "Maximum number of quarantined requests kept for review")
+	logBodies                = flag.String("log-bodies", "truncated", "Logging of prompt and response bodies: off, truncated or full")
+	logBodyMaxBytes          = flag.Int("log-body-max-bytes", 2000, "Bytes of each body logged with -log-bodies=truncated")
+	logBodyRoutesSpec        = flag.String("log-body-routes", "", "Comma-separated per-route body logging overrides, e.g. /v1/audio/=off,/v1/chat/=full")
+	modelCatalogEnabled      = flag.Bool("model-catalog", false, "Serve /v1/models from a cached upstream list enriched with pricing, context windows, policy and aliases")
+	modelCatalogFile         = flag.String("model-catalog-file", "", "JSON file of per-model catalog metadata: context windows, descriptions and local aliases")
+	embeddingDimensionsSpec  = flag.String("embedding-dimensions", "", "Vector size of /v1/embeddings responses, for every model or as comma-separated model-prefix=size pairs, e.g. 1024 or text-embedding-3-large=1024,nomic=768 (empty disables)")
+	embeddingDimensionsMode  = flag.String("embedding-dimensions-mode", "auto", "How -embedding-dimensions is applied: param (the dimensions parameter), truncate (proxy-side truncation and re-normalization) or auto (param for models that accept it)")
+	reasoningModelsSpec      = flag.String("reasoning-models", "", "Comma-separated model prefixes treated as reasoning models, e.g. o1,o3,o4-mini, whose chat requests get max_tokens renamed and unsupported sampling parameters dropped (empty disables)")
+	modelCatalogTTL          = flag.Duration("model-catalog-ttl", 5*time.Minute, "How long upstream model lists are cached for the model catalog (0 disables caching)")
+	pricingFile              = flag.String("pricing-file", "", "JSON file of per-model prices (USD per million tokens) overriding the built-in table")
+	userFieldTemplate        = flag.String("user-field-template", "", "Template for the \"user\" field set on forwarded request bodies, e.g. {tenant}:{key_name} (empty disables)")
+	canaryUpstream           = flag.String("canary-upstream", "", "Base URL of a canary upstream that receives a share of traffic (empty disables)")
+	canaryPercent            = flag.Float64("canary-percent", 5, "Percentage of matching requests sent to -canary-upstream")
+	canaryRoutesSpec         = flag.String("canary-routes", "", "Comma-separated path prefixes eligible for the canary (empty means all)")
+	canaryMinSamples         = flag.Int("canary-min-samples", 20, "Requests needed on both upstreams before the canary can be rolled back")
+	canaryMaxErrorDelta      = flag.Float64("canary-max-error-delta", 0.05, "Roll the canary back when its error rate exceeds the primary's by more than this fraction")
+	canaryMaxLatencyFactor   = flag.Float64("canary-max-latency-factor", 2, "Roll the canary back when its mean latency exceeds the primary's by this factor (0 disables)")
+	clientOverrides          = flag.String("client-overrides", "", "Comma-separated control headers clients may send: no-cache, timeout, upstream, trace-level (empty rejects them all)")
+	overrideUpstreamsSpec    = flag.String("override-upstreams", "", "Comma-separated upstream base URLs that X-Proxy-Upstream may select")
+	virtualKeysFile          = flag.String("virtual-keys", "", "JSON file of proxy-issued virtual keys with their upstream keys and endpoint scopes")
+	anomalyDetection         = flag.Bool("anomaly-detection", false, "Flag client keys whose requests/hour or tokens/request jump far above their baseline")
+	anomalyFactor            = flag.Float64("anomaly-factor", 5, "How many times its baseline a key's usage must reach to count as an anomaly")
+	anomalyThrottle          = flag.Duration("anomaly-throttle", 0, "Reject an anomalous key's requests for this long (0 only flags and alerts)")
+	alertWebhookURL          = flag.String("alert-webhook-url", "", "URL that receives alerts as JSON POSTs")
+	alertSlackWebhookURL     = flag.String("alert-slack-webhook-url", "", "Slack incoming webhook URL that receives alerts")
+	schemaDriftEnabled       = flag.Bool("schema-drift", false, "Compare upstream responses with the expected fields of each endpoint and alert on unknown or vanished ones")
+	schemaDriftFile          = flag.String("schema-drift-file", "", "JSON file of per-endpoint response schemas overriding the built-in ones")
+	traceWebhookURL          = flag.String("trace-webhook-url", "", "URL receiving every recorded trace as a JSON POST, credentials masked (empty disables)")
+	webhookSecret            = flag.String("webhook-secret", "", "Secret name whose value signs webhook payloads in X-Proxy-Webhook-Signature (empty sends them unsigned)")
+	webhookMaxAttempts       = flag.Int("webhook-max-attempts", 5, "Attempts per webhook delivery before it is marked failed")
+	modelTimeoutsSpec        = flag.String("model-timeouts", "", "Comma-separated model-prefix=duration upstream timeouts (e.g. o1=10m,gpt-4o-mini=20s) replacing the 30s default")
+	transparentRoutesSpec    = flag.String("transparent-routes", "", "Comma-separated path prefixes (e.g. /v1/embeddings) forwarded without buffering, hooks or caching; only metadata is traced")
 )
 
-func messagesHook(messages []map[string]interface{}) ([]map[string]interface{}, error) {
-	log.Printf("🔧 in messagesHook, Messages: %v", messages)
+func messagesHook(path string, messages []map[string]interface{}) ([]map[string]interface{}, error) {
+	// The conversation is prompt content, so it follows the route's body logging mode
+	mode := bodyLogModeFor(path)
+	if mode == bodyLogOff {
+		return messages, nil
+	}
 	messagesBuf := bytes.NewBuffer(nil)
 	for _, message := range messages {
 		content, contentOk := message["content"].(string)
@@ -240,14 +529,14 @@ func messagesHook(messages []map[string]interface{}) ([]map[string]interface{},
 		}
 	}
 	trimLog := messagesBuf.String()
-	if len(trimLog) > 2000 {
-		trimLog = trimLog[:1000] + "\n......\n" + trimLog[len(trimLog)-1000:]
+	if half := *logBodyMaxBytes / 2; mode == bodyLogTruncated && len(trimLog) > 2*half {
+		trimLog = trimLog[:half] + "\n......\n" + trimLog[len(trimLog)-half:]
 	}
 	log.Printf("🔧 Messages in session: %s", trimLog)
 	return messages, nil
 }
 
-func promptHook(body []byte, headers http.Header) ([]byte, http.Header, error) {
+func promptHook(path string, body []byte, headers http.Header) ([]byte, http.Header, error) {
 	// Parse the request body as JSON
 	var requestBody map[string]interface{}
 	if err := json.Unmarshal(body, &requestBody); err != nil {
@@ -267,7 +556,7 @@ func promptHook(body []byte, headers http.Header) ([]byte, http.Header, error) {
 		}
 
 		// Call messagesHook to process the messages
-		modifiedMessages, err := messagesHook(messagesArray)
+		modifiedMessages, err := messagesHook(path, messagesArray)
 		if err != nil {
 			return body, headers, err
 		}
@@ -284,23 +573,13 @@ func promptHook(body []byte, headers http.Header) ([]byte, http.Header, error) {
 		body = modifiedBody
 	}
 
-	// After existing processing, also apply Lua hooks if available
-	return luaHookManager.ExecuteRequestHook(body, headers)
-}
-
-// SetRequestHook allows setting a custom request hook
-func SetRequestHook(hook RequestHook) {
-	requestHook = hook
-}
-
-// SetResponseHook allows setting a custom response hook
-func SetResponseHook(hook ResponseHook) {
-	responseHook = hook
+	return body, headers, nil
 }
 
 // Trace holds information about a proxied request/response
 type Trace struct {
 	Id            string      `json:"id"`
+	Seq           int64       `json:"seq,omitempty"` // order of recording, for resuming the trace feed
 	Timestamp     time.Time   `json:"timestamp"`
 	Method        string      `json:"method"`
 	URL           string      `json:"url"`
@@ -310,10 +589,80 @@ type Trace struct {
 	RequestHeader http.Header `json:"request_headers,omitempty"`
 	RequestBody   string      `json:"request_body,omitempty"`
 	ResponseBody  string      `json:"response_body,omitempty"`
+	RequestBlob   string      `json:"request_blob,omitempty"`  // SHA-256 of the request body in the blob store
+	ResponseBlob  string      `json:"response_blob,omitempty"` // SHA-256 of the response body in the blob store
+	CacheHit      bool        `json:"cache_hit,omitempty"`
+	Transparent   bool        `json:"transparent,omitempty"` // forwarded without inspection
+	CaptureFile   string      `json:"capture_file,omitempty"`
+	Quarantine    string      `json:"quarantine,omitempty"` // ID of the quarantine entry this request belongs to
+	Fault         string      `json:"fault,omitempty"`      // synthetic failure injected by chaos mode
+	ClientAborted bool        `json:"client_aborted,omitempty"`
+	Canary        bool        `json:"canary,omitempty"` // forwarded to the canary upstream
+	// Routing records the upstream, credential and rule that served the request
+	Routing *upstreamRouting `json:"routing,omitempty"`
+	// ReasoningTokens is the part of the completion tokens a reasoning model spent thinking
+	ReasoningTokens int `json:"reasoning_tokens,omitempty"`
+	// Hooks lists the hook calls of a forwarded request in the order they ran
+	Hooks []hookRun `json:"hooks,omitempty"`
+	// Fingerprint identifies the forwarded JSON request independent of key order,
+	// whitespace and per-request fields; see requestFingerprint
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Degraded traces were recorded metadata-only under resource pressure
+	Degraded bool `json:"degraded,omitempty"`
+	// StreamRetry is set when -stream-retry sent a cut-off stream again
+	StreamRetry *streamRetry `json:"stream_retry,omitempty"`
+	// Timings splits the latency of forwarded requests into phases
+	Timings *latencyBreakdown `json:"timings,omitempty"`
+
+	// Annotations added through PATCH /traces/<id>; annotated traces survive eviction
+	Notes   string   `json:"notes,omitempty"`
+	Labels  []string `json:"labels,omitempty"`
+	Starred bool     `json:"starred,omitempty"`
+
+	// RedactedAt is set once POST /traces/<id>/redact stripped the bodies, and
+	// DeletedAt while DELETE /traces/<id> hides the trace from listings
+	RedactedAt *time.Time `json:"redacted_at,omitempty"`
+	DeletedAt  *time.Time `json:"deleted_at,omitempty"`
+
+	// Transcript holds text captured from realtime sessions; audio is never stored
+	Transcript []TranscriptEntry `json:"transcript,omitempty"`
 }
 
-var traces []Trace
-var tracesMax = 100 // keep only the latest 100 traces
+var tracesMax = 100 // the in-memory trace sink keeps only the latest 100 traces
+
+// findTrace returns the stored trace with the given ID
+func findTrace(id string) (Trace, bool) {
+	trace, ok, err := traceSink.Get(id)
+	if err != nil {
+		log.Printf("❌ Failed to read trace %s: %v", id, err)
+	}
+	return trace, ok
+}
+
+// recordTrace stores a trace and broadcasts it to WebSocket clients, unless the
+// Lua onTrace hook decides to drop it
+func recordTrace(trace Trace) {
+	recordRequestMetrics(trace)
+	if loadShed.degrades("traces") {
+		trace = metadataOnly(trace)
+		metrics.Add("openai_proxy_degraded_requests_total", "Requests whose traces or hooks were degraded under resource pressure.", map[string]string{"item": "traces"}, 1)
+	}
+	if !loadShed.degrades("hooks") && !scriptHooks.ExecuteTraceHook(trace) {
+		log.Printf("🗑️ Trace %s dropped by onTrace hook", trace.Id)
+		return
+	}
+	trace.Seq = traceSeq.Add(1)
+	// Large bodies are kept on disk so the in-memory trace list stays small
+	trace.RequestBody, trace.RequestBlob = traceBlobs.externalize(trace.RequestBody)
+	trace.ResponseBody, trace.ResponseBlob = traceBlobs.externalize(trace.ResponseBody)
+	if err := traceSink.Record(trace); err != nil {
+		log.Printf("❌ Failed to store trace %s: %v", trace.Id, err)
+	}
+	publishTrace(trace)
+	notifyTraceWebhook(trace)
+	// Broadcast trace to WebSocket clients
+	hub.broadcast <- trace
+}
 
 // WebSocket specific
 var upgrader = websocket.Upgrader{
@@ -325,33 +674,48 @@ var upgrader = websocket.Upgrader{
 type Hub struct {
 	clients    map[*websocket.Conn]bool
 	broadcast  chan Trace
-	register   chan *websocket.Conn
+	register   chan feedSubscription
 	unregister chan *websocket.Conn
 	mu         sync.Mutex
+
+	// Traces are numbered before they are stored, so they can reach the hub out of
+	// order. They are broadcast in sequence: delivered is the last one sent, and
+	// later ones wait in pending until the gap before them is filled.
+	delivered int64
+	pending   map[int64]Trace
 }
 
 func newHub() *Hub {
 	return &Hub{
 		broadcast:  make(chan Trace),
-		register:   make(chan *websocket.Conn),
+		register:   make(chan feedSubscription),
 		unregister: make(chan *websocket.Conn),
 		clients:    make(map[*websocket.Conn]bool),
+		pending:    make(map[int64]Trace),
 	}
 }
 
 func (h *Hub) run() {
+	h.delivered = traceSeq.Load()
 	for {
 		select {
-		case client := <-h.register:
+		case subscription := <-h.register:
 			h.mu.Lock()
+			client := subscription.conn
 			h.clients[client] = true
-			// Send existing traces to new client
-			for _, trace := range traces {
+			// Send existing traces, or those missed since the client's last one, to new
+			// client. Later ones are still to be broadcast.
+			backlog, err := feedBacklog(subscription, h.delivered)
+			if err != nil {
+				log.Printf("❌ Failed to list traces: %v", err)
+			}
+			for _, trace := range backlog {
 				err := client.WriteJSON(trace)
 				if err != nil {
 					log.Printf("Error sending initial traces: %v", err)
 					client.Close()
 					delete(h.clients, client)
+					break
 				}
 			}
 			h.mu.Unlock()
@@ -364,59 +728,81 @@ func (h *Hub) run() {
 			h.mu.Unlock()
 		case trace := <-h.broadcast:
 			h.mu.Lock()
-			log.Printf("📡 Broadcasting trace to %d WebSocket clients", len(h.clients))
-			for client := range h.clients {
-				err := client.WriteJSON(trace)
-				if err != nil {
-					log.Printf("Write error: %v", err)
-					client.Close()
-					delete(h.clients, client)
-				}
+			if trace.Seq <= h.delivered {
+				// Recorded before the hub started
+				h.send(trace)
+			} else {
+				h.pending[trace.Seq] = trace
 			}
+			h.flush()
 			h.mu.Unlock()
 		}
 	}
 }
 
-var hub = newHub()
-
-// decompressBody decompresses gzipped response body
-func decompressBody(body []byte, encoding string) ([]byte, error) {
-	log.Printf("🔧 Attempting to decompress body with encoding: %s", encoding)
-
-	if encoding == "gzip" {
-		reader, err := gzip.NewReader(bytes.NewReader(body))
-		if err != nil {
-			log.Printf("❌ Failed to create gzip reader: %v", err)
-			return body, err // Return original if decompression fails
+// flush broadcasts the pending traces that are next in sequence. A gap that
+// outlasts traceFeedPendingMax later traces is skipped rather than waited for.
+func (h *Hub) flush() {
+	for {
+		if trace, ok := h.pending[h.delivered+1]; ok {
+			delete(h.pending, trace.Seq)
+			h.delivered = trace.Seq
+			h.send(trace)
+			continue
 		}
-		defer reader.Close()
+		if len(h.pending) <= traceFeedPendingMax {
+			return
+		}
+		next := int64(-1)
+		for seq := range h.pending {
+			if next < 0 || seq < next {
+				next = seq
+			}
+		}
+		log.Printf("⚠️ Trace %d never reached the WebSocket feed, skipping it", h.delivered+1)
+		h.delivered = next - 1
+	}
+}
 
-		decompressed, err := io.ReadAll(reader)
+// send writes a trace to every client; the caller holds h.mu
+func (h *Hub) send(trace Trace) {
+	log.Printf("📡 Broadcasting trace to %d WebSocket clients", len(h.clients))
+	for client := range h.clients {
+		err := client.WriteJSON(trace)
 		if err != nil {
-			log.Printf("❌ Failed to decompress: %v", err)
-			return body, err // Return original if decompression fails
+			log.Printf("Write error: %v", err)
+			client.Close()
+			delete(h.clients, client)
 		}
-
-		log.Printf("✅ Successfully decompressed %d bytes -> %d bytes", len(body), len(decompressed))
-		return decompressed, nil
 	}
+}
 
-	if encoding == "br" {
-		reader := brotli.NewReader(bytes.NewReader(body))
+var hub = newHub()
 
-		decompressed, err := io.ReadAll(reader)
-		if err != nil {
-			log.Printf("❌ Failed to decompress Brotli: %v", err)
-			return body, err // Return original if decompression fails
-		}
+// decompressBody decompresses a gzip, Brotli or zstd response body
+func decompressBody(body []byte, encoding string) ([]byte, error) {
+	log.Printf("🔧 Attempting to decompress body with encoding: %s", encoding)
+
+	if !supportedEncodings[encoding] {
+		log.Printf("ℹ️ No decompression needed for encoding: %s", encoding)
+		return body, nil
+	}
 
-		log.Printf("✅ Successfully decompressed Brotli %d bytes -> %d bytes", len(body), len(decompressed))
-		return decompressed, nil
+	reader, err := decodingReader(encoding, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("❌ Failed to create %s reader: %v", encoding, err)
+		return body, err // Return original if decompression fails
 	}
+	defer reader.Close()
 
-	log.Printf("ℹ️ No decompression needed for encoding: %s", encoding)
-	return body, nil
+	decompressed, err := io.ReadAll(reader)
+	if err != nil {
+		log.Printf("❌ Failed to decompress %s: %v", encoding, err)
+		return body, err // Return original if decompression fails
+	}
+
+	log.Printf("✅ Successfully decompressed %s %d bytes -> %d bytes", encoding, len(body), len(decompressed))
+	return decompressed, nil
 }
 
 // generateTraceID generates a simple unique ID for traces
@@ -427,38 +813,194 @@ func generateTraceID() string {
 }
 
 // startOpenAIForwarder starts an HTTP server that forwards requests to OpenAI API
+// upstreamTransport is shared, through pinnedHostTransport, by the forwarder,
+// transparent routes and admin operations that call the upstream
+var upstreamTransport = &http.Transport{
+	MaxIdleConns:        100,
+	MaxIdleConnsPerHost: 10,
+	IdleConnTimeout:     30 * time.Second,
+	// Never decompress behind the caller's back; the buffered path negotiates
+	// Accept-Encoding itself and transparent routes pass bytes through as-is
+	DisableCompression: true,
+}
+
+// upstreamClient is the HTTP client for buffered upstream requests
+var upstreamClient = &http.Client{
+	Timeout:   30 * time.Second,
+	Transport: pinnedHostTransport{},
+}
+
 func startOpenAIForwarder() {
-	// Create HTTP client for forwarding requests
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-		Transport: &http.Transport{
-			MaxIdleConns:        100,
-			MaxIdleConnsPerHost: 10,
-			IdleConnTimeout:     30 * time.Second,
-		},
-	}
+	transparentProxy := newTransparentProxy(pinnedHostTransport{})
 
-	SetRequestHook(promptHook)
+	UseRequestHook("messages", promptHook)
 
 	// Handler function for forwarding requests
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Clients poll their asynchronous jobs here
+		if strings.HasPrefix(r.URL.Path, "/jobs/") {
+			handleJob(w, r)
+			return
+		}
+
 		// Only handle /v1/ paths
 		if !strings.HasPrefix(r.URL.Path, "/v1/") {
 			http.Error(w, "Only /v1/ endpoints are supported", http.StatusNotFound)
 			return
 		}
+		// Scopes, rules and upstreams must all see the same endpoint
+		if !canonicalRequestPath(r.URL) {
+			writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "Request paths may not contain empty, . or .. segments or encoded slashes")
+			return
+		}
+
+		// The listener's authentication chain identifies the client
+		caller, ok := authenticate(w, r)
+		if !ok {
+			return
+		}
+		keyID, vk := caller.KeyID, caller.Key
+
+		// An ?async=1 request is answered with a job at once and sent through this
+		// handler again in the background, where the checks below apply to it
+		if isAsyncRequest(r) {
+			authorized := r.Clone(r.Context())
+			if caller.Authorize(w, authorized) {
+				asyncJobs.Submit(w, r, caller, caller.upstreamHeader(authorized.Header).Get("Authorization"))
+			}
+			return
+		}
+
+		// Enforce the caller's scopes and the proxy's own per-client limits
+		if !caller.Authorize(w, r) {
+			return
+		}
+
+		// Polled endpoints such as the model list are answered from the static cache
+		// without counting against any limit. The control headers are checked first,
+		// so a header the policy rejects is rejected on hits too.
+		var overrides requestOverrides
+		overridesParsed := false
+		static := lookupStaticCache(r)
+		if static != nil {
+			if overrides, ok = applyRequestOverrides(w, r); !ok {
+				return
+			}
+			overridesParsed = true
+			if overrides.noCache {
+				static = nil
+			}
+		}
+		if static.fresh() {
+			traceID := generateTraceID()
+			w.Header().Set("X-Proxy-Trace-Id", traceID)
+			status := static.serve(w, static.entry, "hit")
+			overrides.recordTrace(Trace{
+				Id:            traceID,
+				Timestamp:     time.Now(),
+				Method:        r.Method,
+				URL:           r.URL.String(),
+				Status:        status,
+				RequestHeader: r.Header,
+				CacheHit:      true,
+			})
+			return
+		}
+
+		if !checkClientLimits(w, keyID) {
+			log.Printf("🚫 Client %s is over its limits", keyID)
+			return
+		}
+		if !checkUsageAnomalies(w, keyID) {
+			log.Printf("🚫 Client %s is throttled after a usage anomaly", keyID)
+			return
+		}
+
+		// Low on memory or goroutines, the proxy turns new requests away
+		if loadShed.shedding() {
+			snapshot := loadShed.snapshot()
+			log.Printf("🩺 Rejecting request under %s pressure", snapshot.Reason)
+			writeShed(w, snapshot)
+			return
+		}
+
+		// Realtime sessions are WebSocket connections relayed frame by frame
+		if websocket.IsWebSocketUpgrade(r) {
+			handleRealtime(w, r, caller)
+			return
+		}
+
+		// Wait for a concurrency slot, or fail fast with a 503 when saturated
+		timer := newRequestTimer()
+		if upstreamAdmission != nil {
+			release, overload := upstreamAdmission.Acquire(r.Context())
+			timer.queue = time.Since(timer.start)
+			if overload != nil {
+				log.Printf("🚧 Rejecting request (%s, queue depth %d)", overload.Reason, overload.QueueDepth)
+				writeOverloaded(w, overload)
+				return
+			}
+			defer release()
+		}
+
+		// Chaos mode may delay the request or answer it with a synthetic failure
+		injectedAt := time.Now()
+		if forward, status := injectFault(w, r); !forward {
+			if status != 0 {
+				recordTrace(Trace{
+					Id:            generateTraceID(),
+					Timestamp:     time.Now(),
+					Method:        r.Method,
+					URL:           r.URL.String(),
+					Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+					Latency:       time.Since(injectedAt).Seconds(),
+					RequestHeader: r.Header,
+					Fault:         "injected_error",
+				})
+			}
+			return
+		}
+
+		// The model catalog is answered from the cached, enriched upstream list
+		if *modelCatalogEnabled && r.Method == http.MethodGet && (r.URL.Path == "/v1/models" || strings.HasPrefix(r.URL.Path, "/v1/models/")) {
+			serveModelCatalog(w, r, caller)
+			return
+		}
+
+		// Transparent routes skip buffering, decompression and hooks entirely
+		if isTransparentRoute(r.URL.Path) {
+			serveTransparent(transparentProxy, w, r, caller)
+			return
+		}
 
 		startTime := time.Now()
+		traceID := generateTraceID()
+		w.Header().Set("X-Proxy-Trace-Id", traceID)
 		log.Printf("\n🔄 === [FORWARDER REQUEST] ===")
 		log.Printf("📍 Original URL: %s", r.URL.String())
 		log.Printf("🔧 Method: %s", r.Method)
 
-		// Create target URL
-		targetURL := &url.URL{
-			Scheme:   "https",
-			Host:     "api.openai.com",
-			Path:     r.URL.Path,
-			RawQuery: r.URL.RawQuery,
+		// Apply the client's control headers, if the policy allows them
+		if !overridesParsed {
+			if overrides, ok = applyRequestOverrides(w, r); !ok {
+				return
+			}
+		}
+
+		// Create target URL; a share of traffic may be routed to the canary upstream
+		targetURL := overrides.target(r.URL.Path, r.URL.RawQuery)
+		routing := &upstreamRouting{Via: "default"}
+		if overrides.upstream != nil {
+			routing.Via = "override"
+		} else if upstreamPool != nil {
+			targetURL = upstreamPool.Pick().target(r.URL.Path, r.URL.RawQuery)
+			routing.Via = "pool"
+		}
+		canary := overrides.upstream == nil && upstreamCanary.Pick(r.URL.Path)
+		if canary {
+			targetURL = upstreamCanary.target(r.URL.Path, r.URL.RawQuery)
+			routing.Via = "canary"
+			w.Header().Set("X-Proxy-Canary", "true")
 		}
 
 		log.Printf("🎯 Target URL: %s", targetURL.String())
@@ -474,8 +1016,44 @@ func startOpenAIForwarder() {
 			}
 		}
 
-		// Apply request hook
-		modifiedBody, modifiedHeaders, err := requestHook(bodyBytes, r.Header)
+		// Keep the request as the client sent it for the capture file
+		clientBody, clientHeader := bodyBytes, r.Header.Clone()
+
+		// Attribute the request to the client's identity for OpenAI's abuse monitoring
+		bodyBytes = injectUserField(r.URL.Path, bodyBytes, newUserIdentity(keyID, vk))
+
+		// Local model aliases from the catalog stand for real upstream models
+		bodyBytes = resolveModelAlias(bodyBytes)
+
+		// Reasoning models take different parameters than chat models
+		if translated, changes := translateReasoningParams(r.URL.Path, bodyBytes); len(changes) > 0 {
+			bodyBytes = translated
+			w.Header().Set("X-Proxy-Params-Translated", strings.Join(changes, ","))
+			log.Printf("🧠 Translated parameters for reasoning model: %s", strings.Join(changes, ", "))
+		}
+
+		// Embedding vectors are brought to the size downstream stores expect
+		bodyBytes, embeddingSize := resizeEmbeddingRequest(r.URL.Path, bodyBytes)
+		if embeddingSize != nil {
+			w.Header().Set("X-Proxy-Embedding-Dimensions", embeddingSize.String())
+			log.Printf("📐 Embedding dimensions: %s", embeddingSize)
+		}
+
+		// Clients may name their session; otherwise infer it from the conversation
+		sessionID := clientHeader.Get("X-Session-Id")
+		if sessionID == "" && *sessionInference {
+			sessionID = conversationSessions.Infer(keyID, clientBody)
+		}
+
+		// Apply request hooks, recording each call for the trace and the hook profile
+		hooksStart := time.Now()
+		hookCalls := &hookRecorder{skip: loadShed.degrades("hooks")}
+		if hookCalls.skip {
+			log.Printf("🩺 Skipping hooks under load")
+			w.Header().Set("X-Proxy-Degraded", "hooks")
+			metrics.Add("openai_proxy_degraded_requests_total", "Requests whose traces or hooks were degraded under resource pressure.", map[string]string{"item": "hooks"}, 1)
+		}
+		modifiedBody, modifiedHeaders, err := runRequestHooks(hookCalls, r.URL.Path, bodyBytes, r.Header)
 		if err != nil {
 			log.Printf("❌ Request hook error: %v", err)
 			http.Error(w, "Request hook error", http.StatusInternalServerError)
@@ -484,29 +1062,198 @@ func startOpenAIForwarder() {
 		bodyBytes = modifiedBody
 		r.Header = modifiedHeaders
 
+		// Then apply script hooks if available
+		modifiedBody, modifiedHeaders, err = bodyBytes, r.Header, nil
+		if scriptHooks.HasRequestHook() {
+			modifiedBody, modifiedHeaders, err = hookCalls.run("request", scriptHookName(), bodyBytes, r.Header, func(body []byte, headers http.Header) ([]byte, http.Header, error) {
+				return scriptHooks.ExecuteRequestHook(traceID, body, headers)
+			})
+		}
+		if err != nil {
+			log.Printf("❌ Script request hook error: %v", err)
+			http.Error(w, "Request hook error", http.StatusInternalServerError)
+			return
+		}
+		bodyBytes = modifiedBody
+		r.Header = modifiedHeaders
+
+		// The client's tenant may have its own, isolated hook script
+		if tenant := newUserIdentity(keyID, vk).Tenant; tenantHooks.defines(tenant, false) {
+			bodyBytes, r.Header, _ = hookCalls.run("request", "tenant:"+tenant, bodyBytes, r.Header, func(body []byte, headers http.Header) ([]byte, http.Header, error) {
+				body, headers = tenantHooks.ExecuteRequestHook(tenant, traceID, body, headers)
+				return body, headers, nil
+			})
+		}
+		timer.requestHooks = time.Since(hooksStart)
+		fingerprint := requestFingerprint(r.URL.Path, bodyBytes)
+
+		// Streams only report usage when asked to, and usage accounting needs it
+		bodyBytes, stripStreamUsage := requestStreamUsage(r.URL.Path, bodyBytes)
+
+		// Routing, trace and guardrail rules see the request as it will be forwarded
+		var ruleReasons []string
+		if requestRules != nil {
+			decision := requestRules.Evaluate(newRuleEnv(r, newUserIdentity(keyID, vk), bodyBytes))
+			if decision.traceLevel != "" {
+				overrides.traceLevel = decision.traceLevel
+			}
+			if rule := decision.guardrail; rule != nil && rule.Action == "block" {
+				message := rule.Message
+				if message == "" {
+					message = "This request was blocked by the proxy's guardrail " + rule.Name
+				}
+				log.Printf("⛔ Request %s blocked by guardrail %s", traceID, rule.Name)
+				writeJSONError(w, http.StatusForbidden, "request_blocked", message)
+				overrides.recordTrace(Trace{
+					Id:            traceID,
+					Timestamp:     time.Now(),
+					Method:        r.Method,
+					URL:           targetURL.String(),
+					Status:        "403 Forbidden",
+					Latency:       time.Since(startTime).Seconds(),
+					SessionId:     sessionID,
+					RequestHeader: r.Header,
+					RequestBody:   string(bodyBytes),
+					Fingerprint:   fingerprint,
+					Hooks:         hookCalls.Runs(),
+					ResponseBody:  "[BLOCKED by guardrail " + rule.Name + "]",
+				})
+				return
+			} else if rule != nil {
+				ruleReasons = append(ruleReasons, "rule: "+rule.Name)
+			}
+			// Client overrides and canary picks take precedence over routing rules
+			if route := decision.route; route != nil && overrides.upstream == nil && !canary {
+				log.Printf("🧭 Routing request %s to %s (rule %s)", traceID, route.target.Host, route.Name)
+				targetURL = route.targetFor(r.URL.Path, r.URL.RawQuery)
+				routing.Via, routing.Rule = "rule", route.Name
+				w.Header().Set("X-Proxy-Route", route.Name)
+			}
+		}
+
+		// Hold flagged requests for review instead of forwarding them
+		if quarantineRequest(w, traceID, caller, r.Method, targetURL.String(), r.Header, bodyBytes, ruleReasons...) {
+			overrides.recordTrace(Trace{
+				Id:            traceID,
+				Timestamp:     time.Now(),
+				Method:        r.Method,
+				URL:           targetURL.String(),
+				Status:        "403 Forbidden",
+				Latency:       time.Since(startTime).Seconds(),
+				RequestHeader: r.Header,
+				RequestBody:   string(bodyBytes),
+				Fingerprint:   fingerprint,
+				Hooks:         hookCalls.Runs(),
+				Quarantine:    traceID,
+			})
+			return
+		}
+
+		// Batch lines stop here, with every check passed; the Batch API sends them
+		if line, ok := r.Context().Value(batchLineKey{}).(*batchLine); ok {
+			line.body, line.target = bodyBytes, targetURL
+			return
+		}
+
+		// Serve repeated transcriptions, speech and completions from the cache
+		cache, cacheKey := cacheForRequest(r, bodyBytes)
+		if cache != nil && overrides.noCache {
+			w.Header().Set("X-Proxy-Cache", "bypass")
+			cache = nil
+		}
+		negativeKey := negativeCacheKey(r, bodyBytes, overrides)
+		var cached *cachedResponse
+		if cache != nil {
+			if entry, ok := cache.Get(cacheKey); ok {
+				cached = entry
+				if completionCacheStale(cache, cached) {
+					// Answer from the stale entry now and refresh it for the next client
+					log.Printf("💾 Stale cache hit: %s (age %v), revalidating", shortKey(cacheKey), time.Since(cached.StoredAt).Round(time.Second))
+					w.Header().Set("X-Proxy-Cache", "stale")
+					revalidateCachedResponse(cache, cacheKey, newUserIdentity(keyID, vk).Tenant, r.Method, targetURL.String(), caller.upstreamHeader(r.Header), bodyBytes, embeddingSize)
+				} else {
+					log.Printf("💾 Cache hit: %s", shortKey(cacheKey))
+					w.Header().Set("X-Proxy-Cache", "hit")
+				}
+			}
+		}
+		if cached == nil && negativeKey != "" {
+			// The same request was rejected a moment ago and would be again
+			if entry, ok := negativeCache.Get(negativeKey); ok {
+				cached = entry
+				log.Printf("🚫 Negative cache hit: %s (%s)", shortKey(negativeKey), cached.Status)
+				w.Header().Set("X-Proxy-Cache", "negative")
+				metrics.Add("openai_proxy_negative_cache_hits_total", "Client errors answered from the negative cache, by status.", map[string]string{"status": strconv.Itoa(cached.StatusCode)}, 1)
+			}
+		}
+		if cached != nil {
+			if overrides.annotate {
+				serveCachedResponse(w, annotateCachedResponse(cached, responseAnnotation{TraceID: traceID, Cache: w.Header().Get("X-Proxy-Cache")}))
+			} else {
+				serveCachedResponse(w, cached)
+			}
+			overrides.recordTrace(Trace{
+				Id:            traceID,
+				Timestamp:     time.Now(),
+				Method:        r.Method,
+				URL:           targetURL.String(),
+				Status:        cached.Status,
+				Latency:       time.Since(startTime).Seconds(),
+				RequestHeader: r.Header,
+				RequestBody:   string(bodyBytes),
+				Fingerprint:   fingerprint,
+				Hooks:         hookCalls.Runs(),
+				ResponseBody:  string(cached.Body),
+				CacheHit:      true,
+			})
+			return
+		}
+
+		// Tell the client what the proxy did with the request
+		if cache != nil || static != nil {
+			w.Header().Set("X-Proxy-Cache", "miss")
+		}
+		w.Header().Set("X-Proxy-Upstream", targetURL.Host)
+		if sessionID != "" {
+			w.Header().Set("X-Proxy-Session-Id", sessionID)
+		}
+		if original, forwarded := bodyModel(clientBody), bodyModel(bodyBytes); original != forwarded {
+			w.Header().Set("X-Proxy-Model-Rewritten", original+" -> "+forwarded)
+		}
+
 		// Create new request
-		req, err := http.NewRequest(r.Method, targetURL.String(), bytes.NewReader(bodyBytes))
+		// The request context is cancelled when the client disconnects, which aborts
+		// the upstream call instead of letting it burn tokens for nobody
+		ctx := r.Context()
+		if timeout := upstreamDeadline(bodyModel(bodyBytes), overrides.timeout); timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, timer.clientTrace()), r.Method, targetURL.String(), bytes.NewReader(bodyBytes))
 		if err != nil {
 			http.Error(w, "Failed to create request", http.StatusInternalServerError)
 			return
 		}
 
-		// Copy headers, but modify Accept-Encoding to disable compression for easier debugging
+		// Copy headers. The proxy negotiates compression with the upstream itself and
+		// decompresses only when it has to read the body or the client can't.
 		for name, values := range r.Header {
+			if name == "Accept-Encoding" {
+				continue
+			}
 			for _, value := range values {
-				if name == "Accept-Encoding" {
-					// Disable compression to get readable responses
-					req.Header.Set(name, "identity")
-				} else {
-					req.Header.Add(name, value)
-				}
+				req.Header.Add(name, value)
 			}
 		}
+		caller.setUpstreamCredentials(req.Header)
+		req.Header.Set("Accept-Encoding", upstreamAcceptEncoding())
+		revalidating := static.revalidate(req.Header)
 
-		// If no Accept-Encoding was set, explicitly disable compression
-		if req.Header.Get("Accept-Encoding") == "" {
-			req.Header.Set("Accept-Encoding", "identity")
-		}
+		capture := startCapture(traceID, sessionID)
+		defer capture.Close()
+		capture.Request(r.Method, r.URL.String(), clientHeader, clientBody)
+		capture.UpstreamRequest(req, bodyBytes)
 
 		// Log important headers
 		if auth := req.Header.Get("Authorization"); auth != "" {
@@ -519,14 +1266,90 @@ func startOpenAIForwarder() {
 			log.Printf("📄 Content-Type: %s", contentType)
 		}
 
+		// Stay just below the upstream's rate limit for this key instead of hitting 429s
+		limitKey := pacingKey(targetURL.Host, req.Header)
+		if upstreamPacer != nil {
+			waited, retryIn, ok := upstreamPacer.Reserve(ctx, limitKey, estimateRequestTokens(bodyBytes))
+			timer.pacing = waited
+			if !ok {
+				log.Printf("🐢 Upstream limit for %s resets in %v, beyond -pace-max-wait", limitKey, retryIn.Round(time.Millisecond))
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryIn.Seconds()))))
+				writeJSONError(w, http.StatusTooManyRequests, "upstream_rate_limit_paced", "Upstream rate limit nearly exhausted, retry after the time given in Retry-After")
+				return
+			}
+			if waited >= time.Millisecond {
+				log.Printf("🐢 Paced request for %v to stay under the upstream rate limit", waited.Round(time.Millisecond))
+				w.Header().Set("X-Proxy-Paced-Ms", strconv.FormatInt(waited.Milliseconds(), 10))
+			}
+		}
+
 		// Execute request
-		resp, err := client.Do(req)
+		routing.send(targetURL, req.Header)
+		sentAt := time.Now()
+		resp, err := upstreamClientFor(ctx).Do(req)
 		if err != nil {
+			capture.Fail(err)
+			if r.Context().Err() != nil {
+				log.Printf("🔌 Client aborted before the upstream responded")
+				recordClientAbort("upstream_request")
+				overrides.recordTrace(Trace{
+					Id:            traceID,
+					Timestamp:     time.Now(),
+					Method:        r.Method,
+					URL:           targetURL.String(),
+					Routing:       routing,
+					Status:        statusClientClosedRequest,
+					Latency:       time.Since(startTime).Seconds(),
+					SessionId:     sessionID,
+					RequestHeader: r.Header,
+					RequestBody:   string(bodyBytes),
+					Fingerprint:   fingerprint,
+					Hooks:         hookCalls.Runs(),
+					ResponseBody:  "[CLIENT ABORTED before the upstream responded]",
+					ClientAborted: true,
+					CaptureFile:   capture.Path(),
+				})
+				return
+			}
 			log.Printf("❌ Request failed: %v", err)
+			upstreamCanary.Observe(r.URL.Path, canary, true, time.Since(sentAt))
+			experiments.Observe(r.URL.Path, canary, true, time.Since(sentAt), nil)
+			upstreamPool.Observe(targetURL.Host, true)
+			if ctx.Err() == context.DeadlineExceeded {
+				metrics.Add("openai_proxy_upstream_timeouts_total", "Upstream requests that ran past their per-request or per-model timeout, by model.", map[string]string{"model": bodyModel(bodyBytes)}, 1)
+				http.Error(w, "Upstream timed out", http.StatusGatewayTimeout)
+				return
+			}
 			http.Error(w, "Failed to forward request", http.StatusBadGateway)
 			return
 		}
 		defer resp.Body.Close()
+		resp.Body = capture.Response(resp)
+
+		// The upstream confirmed the static cache's stale response is still current
+		if revalidating && resp.StatusCode == http.StatusNotModified {
+			status := static.serve(w, static.refreshed(resp.Header), "revalidated")
+			overrides.recordTrace(Trace{
+				Id:            traceID,
+				Timestamp:     time.Now(),
+				Method:        r.Method,
+				URL:           targetURL.String(),
+				Routing:       routing,
+				Status:        status,
+				Latency:       time.Since(startTime).Seconds(),
+				SessionId:     sessionID,
+				RequestHeader: r.Header,
+				Fingerprint:   fingerprint,
+				Hooks:         hookCalls.Runs(),
+				CacheHit:      true,
+			})
+			return
+		}
+		upstreamCanary.Observe(r.URL.Path, canary, resp.StatusCode >= 500, time.Since(sentAt))
+		upstreamPool.Observe(targetURL.Host, resp.StatusCode >= 500)
+		if upstreamPacer != nil {
+			upstreamPacer.Observe(limitKey, resp.Header, resp.StatusCode)
+		}
 
 		latency := time.Since(startTime).Seconds()
 		log.Printf("\n📥 === [FORWARDER RESPONSE] ===")
@@ -540,84 +1363,226 @@ func startOpenAIForwarder() {
 			}
 		}
 
-		// Set status code
-		w.WriteHeader(resp.StatusCode)
-
 		// Check if this is a streaming response (SSE)
 		contentType := resp.Header.Get("Content-Type")
-		isStreaming := strings.Contains(contentType, "text/event-stream") || strings.Contains(contentType, "text/plain")
+		transcode := streamTranscoding(clientHeader.Get("Accept"), contentType)
+		isStreaming := strings.Contains(contentType, "text/event-stream") || strings.Contains(contentType, "text/plain") || transcode != ""
+		encoding := responseEncoding(resp.Header)
+		rememberError := negativeKey != "" && negativeCacheStatuses[resp.StatusCode] && transcode == ""
+		retryStream := *streamRetryMode != "off" && resp.StatusCode == http.StatusOK && strings.Contains(contentType, "text/event-stream")
+		meterStream := usageAccounted() && resp.StatusCode == http.StatusOK && strings.Contains(contentType, "text/event-stream")
 
 		if isStreaming {
 			log.Printf("🌊 Detected streaming response (Content-Type: %s), using streaming copy", contentType)
 
-			// For streaming responses, copy directly without buffering
-			bytesWritten, err := io.Copy(w, resp.Body)
+			// Transcoding, caching and the tee sinks read the events, so they need a decoded stream
+			if mustDecodeResponse(encoding, clientHeader.Get("Accept-Encoding"), transcode != "" || cache != nil || rememberError || retryStream || meterStream || streamTeeEnabled()) {
+				decoded, err := decodingReader(encoding, resp.Body)
+				if err != nil {
+					log.Printf("❌ Failed to decode %s stream: %v", encoding, err)
+					http.Error(w, "Failed to decode upstream response", http.StatusBadGateway)
+					return
+				}
+				defer decoded.Close()
+				resp.Body = decoded
+				w.Header().Del("Content-Encoding")
+				w.Header().Del("Content-Length")
+			}
+
+			// Convert between SSE and NDJSON when the client asked for the other format
+			var transcoder *streamTranscoder
+			if transcode != "" {
+				log.Printf("🔀 Transcoding stream to %s", transcode)
+				transcoder = newStreamTranscoder(w, transcode)
+				w.Header().Del("Content-Length")
+				if transcode == "ndjson" {
+					w.Header().Set("Content-Type", contentTypeNDJSON)
+				} else {
+					w.Header().Set("Content-Type", contentTypeSSE)
+				}
+			}
+
+			// Set status code
+			w.WriteHeader(resp.StatusCode)
+
+			// For streaming responses, copy directly without buffering. Plain-text
+			// transcriptions also land here and are kept aside for the cache.
+			var dst io.Writer = w
+			var cacheBuf bytes.Buffer
+			switch {
+			case transcoder != nil:
+				dst = transcoder
+			case cache != nil || rememberError:
+				dst = io.MultiWriter(w, &cacheBuf)
+			}
+			// Keep a copy of the raw stream for the tee sinks, in memory so the client
+			// never waits on them
+			var src io.Reader = resp.Body
+			var retrying *retryingStream
+			if retryStream {
+				retrying = newRetryingStream(ctx, *streamRetryMode, resp.Body, func() (io.ReadCloser, error) {
+					return resendStream(ctx, req, bodyBytes, capture)
+				})
+				defer retrying.Close()
+				src = retrying
+			}
+			// Read the usage the stream ends with, for the budget and usage accounting
+			var meter *streamUsage
+			if meterStream {
+				meter = newStreamUsage(src, stripStreamUsage)
+				src = meter
+			}
+			var tee *streamTeeBuffer
+			if streamTeeEnabled() {
+				tee = &streamTeeBuffer{}
+				src = io.TeeReader(src, tee)
+			}
+			bytesWritten, aborted, err := streamCopy(r.Context(), w, dst, src)
+			timer.bodyDone()
+			if tee != nil {
+				teeStream(teedStream{
+					traceID:     traceID,
+					path:        r.URL.Path,
+					contentType: contentType,
+					body:        tee.buf.Bytes(),
+					truncated:   tee.truncated || err != nil,
+				})
+			}
+			if transcoder != nil && !aborted {
+				transcoder.Close()
+			}
+			responseSummary := fmt.Sprintf("[STREAMING RESPONSE - %d bytes]", bytesWritten)
 			if err != nil {
-				log.Printf("❌ Streaming copy error: %v", err)
-				return
+				capture.Fail(err)
+				if aborted {
+					log.Printf("🔌 Client aborted the stream after %d bytes", bytesWritten)
+					recordClientAbort("stream")
+					responseSummary = fmt.Sprintf("[CLIENT ABORTED - %d bytes streamed]", bytesWritten)
+				} else {
+					log.Printf("❌ Streaming copy error: %v", err)
+					responseSummary = fmt.Sprintf("[STREAMING RESPONSE - %d bytes, upstream error: %v]", bytesWritten, err)
+				}
+			} else if cache != nil && transcoder == nil && resp.StatusCode == http.StatusOK {
+				storeCachedResponse(cache, cacheKey, resp, w.Header(), cacheBuf.Bytes())
+			} else if rememberError && !aborted {
+				storeCachedResponse(negativeCache, negativeKey, resp, w.Header(), cacheBuf.Bytes())
 			}
 
 			log.Printf("📏 Streamed %d bytes", bytesWritten)
+			if meter != nil {
+				if usage, model, ok := meter.Usage(); ok {
+					chargeUsage(traceID, r.URL.Path, model, fingerprint, newUserIdentity(keyID, vk), usage)
+				}
+			}
 
 			// Extract session ID from response
 			sessionId := resp.Header.Get("X-Session-Id")
+			if sessionId == "" {
+				sessionId = sessionID
+			}
 			log.Printf("🆔 Session ID: %s", sessionId)
 
 			// Create trace for streaming request (without full response body)
 			trace := Trace{
-				Id:            generateTraceID(),
+				Id:            traceID,
 				Timestamp:     time.Now(),
 				Method:        r.Method,
 				URL:           targetURL.String(),
+				Routing:       routing,
 				Status:        resp.Status,
 				Latency:       latency,
 				SessionId:     sessionId,
 				RequestHeader: r.Header,
 				RequestBody:   string(bodyBytes),
-				ResponseBody:  fmt.Sprintf("[STREAMING RESPONSE - %d bytes]", bytesWritten),
+				Fingerprint:   fingerprint,
+				Hooks:         hookCalls.Runs(),
+				ResponseBody:  responseSummary,
+				StreamRetry:   retrying.Info(),
+				ClientAborted: aborted,
+				Canary:        canary,
+				CaptureFile:   capture.Path(),
+				Timings:       timer.breakdown(),
 			}
-			traces = append(traces, trace)
-			if len(traces) > tracesMax {
-				traces = traces[len(traces)-tracesMax:]
-			}
-			// Broadcast trace to WebSocket clients
-			hub.broadcast <- trace
+			experiments.Observe(r.URL.Path, canary, resp.StatusCode >= 500, time.Since(sentAt), nil)
+			overrides.recordTrace(trace)
 		} else {
 			log.Printf("📦 Non-streaming response, buffering response body")
 
 			// For non-streaming responses, use the original buffering approach
 			respBody, err := io.ReadAll(resp.Body)
+			timer.bodyDone()
 			if err != nil {
+				capture.Fail(err)
+				if r.Context().Err() != nil {
+					log.Printf("🔌 Client aborted while the response was being read")
+					recordClientAbort("response_body")
+					overrides.recordTrace(Trace{
+						Id:            traceID,
+						Timestamp:     time.Now(),
+						Method:        r.Method,
+						URL:           targetURL.String(),
+						Routing:       routing,
+						Status:        statusClientClosedRequest,
+						Latency:       time.Since(startTime).Seconds(),
+						SessionId:     sessionID,
+						RequestHeader: r.Header,
+						RequestBody:   string(bodyBytes),
+						Fingerprint:   fingerprint,
+						Hooks:         hookCalls.Runs(),
+						ResponseBody:  fmt.Sprintf("[CLIENT ABORTED - upstream answered %s]", resp.Status),
+						ClientAborted: true,
+						CaptureFile:   capture.Path(),
+					})
+					return
+				}
 				http.Error(w, "Failed to read response", http.StatusInternalServerError)
 				return
 			}
 
-			// Decompress if needed
-			contentEncoding := resp.Header.Get("Content-Encoding")
-			if contentEncoding != "" {
-				decompressed, err := decompressBody(respBody, contentEncoding)
+			// Decompress if the proxy reads the body or the client can't
+			hookHeaders := resp.Header.Clone()
+			if mustDecodeResponse(encoding, clientHeader.Get("Accept-Encoding"), responseBodyNeeded(r.URL.Path, overrides, cache != nil || rememberError)) {
+				decompressed, err := decompressBody(respBody, encoding)
 				if err == nil {
 					respBody = decompressed
 					// Remove Content-Encoding header since we're serving uncompressed content
 					w.Header().Del("Content-Encoding")
+					hookHeaders.Del("Content-Encoding")
 				}
 			}
 
-			// Apply response hook
-			modifiedRespBody, modifiedRespHeaders, err := responseHook(respBody, resp.Header)
+			// Compare the upstream's own answer with what clients expect to parse
+			if w.Header().Get("Content-Encoding") == "" {
+				schemaDrifts.Check(r.URL.Path, resp.StatusCode, respBody, traceID)
+			}
+
+			// Apply response hooks
+			hooksStart := time.Now()
+			modifiedRespBody, modifiedRespHeaders, err := runResponseHooks(hookCalls, respBody, hookHeaders)
 			if err != nil {
 				log.Printf("❌ Response hook error: %v", err)
 				return
 			}
 			respBody = modifiedRespBody
 
-			// Also apply Lua response hooks if available
-			modifiedRespBody, modifiedRespHeaders, err = luaHookManager.ExecuteResponseHook(respBody, modifiedRespHeaders)
+			// Also apply script response hooks if available
+			modifiedRespBody, err = respBody, nil
+			if scriptHooks.HasResponseHook() {
+				modifiedRespBody, modifiedRespHeaders, err = hookCalls.run("response", scriptHookName(), respBody, modifiedRespHeaders, func(body []byte, headers http.Header) ([]byte, http.Header, error) {
+					return scriptHooks.ExecuteResponseHook(traceID, body, headers)
+				})
+			}
 			if err != nil {
-				log.Printf("❌ Lua response hook error: %v", err)
+				log.Printf("❌ Script response hook error: %v", err)
 				return
 			}
 			respBody = modifiedRespBody
+			if tenant := newUserIdentity(keyID, vk).Tenant; tenantHooks.defines(tenant, true) {
+				respBody, modifiedRespHeaders, _ = hookCalls.run("response", "tenant:"+tenant, respBody, modifiedRespHeaders, func(body []byte, headers http.Header) ([]byte, http.Header, error) {
+					body, headers = tenantHooks.ExecuteResponseHook(tenant, traceID, body, headers)
+					return body, headers, nil
+				})
+			}
 
 			// Update headers if modified by hook
 			for name, values := range modifiedRespHeaders {
@@ -626,58 +1591,157 @@ func startOpenAIForwarder() {
 					w.Header().Add(name, value)
 				}
 			}
+			forwardRateLimitHeaders(w.Header(), resp.Header)
+
+			// Built-in cleanups of the generated text, after any hooks
+			if transformed, applied := applyResponseTransforms(respBody); len(applied) > 0 {
+				respBody = transformed
+				w.Header().Set("X-Proxy-Transformed", strings.Join(applied, ","))
+			}
+			if resized, ok := truncateEmbeddings(respBody, embeddingSize); ok {
+				respBody = resized
+			}
+			timer.responseHooks = time.Since(hooksStart)
+
+			// Charge the client's budget with the tokens this response used
+			if usage, ok := parseUsage(respBody); ok {
+				remaining := chargeUsage(traceID, r.URL.Path, bodyModel(respBody), fingerprint, newUserIdentity(keyID, vk), usage)
+				if requestTokenBudget != nil {
+					w.Header().Set("X-Proxy-Budget-Remaining", strconv.FormatInt(remaining, 10))
+				}
+				if cost, ok := estimateCost(bodyModel(respBody), usage); ok {
+					w.Header().Set("X-Proxy-Cost-Estimate", strconv.FormatFloat(cost, 'f', 6, 64))
+				}
+			}
+
+			// Hooks may have changed the body length
+			w.Header().Set("Content-Length", strconv.Itoa(len(respBody)))
+			if static != nil && resp.StatusCode == http.StatusOK {
+				static.store(resp, w.Header(), respBody)
+			}
+
+			// Caches keep the response without the client's annotation
+			clientResponse, storedHeader := respBody, w.Header()
+			if overrides.annotate && w.Header().Get("Content-Encoding") == "" {
+				annotation := responseAnnotation{TraceID: traceID, Upstream: targetURL.Host, Cache: w.Header().Get("X-Proxy-Cache")}
+				if annotated, ok := annotateResponse(respBody, annotation); ok {
+					clientResponse, storedHeader = annotated, w.Header().Clone()
+					w.Header().Set("Content-Length", strconv.Itoa(len(annotated)))
+				}
+			}
 
-			// Write response body
-			w.Write(respBody)
+			// Set status code and write response body
+			w.WriteHeader(resp.StatusCode)
+			w.Write(clientResponse)
+			capture.ClientResponse(resp.Status, w.Header(), clientResponse)
+			if cache != nil && resp.StatusCode == http.StatusOK {
+				storeCachedResponse(cache, cacheKey, resp, storedHeader, respBody)
+			}
+			if rememberError {
+				storeCachedResponse(negativeCache, negativeKey, resp, storedHeader, respBody)
+			}
 
 			// Log response body (truncated if too long)
 			responseBodyStr := string(respBody)
 			log.Printf("🔍 Response headers: %v", resp.Header)
 			log.Printf("🔍 Content-Encoding: %s", resp.Header.Get("Content-Encoding"))
-			log.Printf("📏 Response body length: %d bytes", len(respBody))
-
-			if len(respBody) > 2000 {
-				log.Printf("📝 Body: %s... (truncated, %d bytes total)", respBody[:2000], len(respBody))
-			} else {
-				log.Printf("📝 Body: %s", respBody)
-			}
+			logBody(r.URL.Path, respBody)
 
 			// Extract session ID from response
 			sessionId := resp.Header.Get("X-Session-Id")
+			if sessionId == "" {
+				sessionId = sessionID
+			}
 			log.Printf("🆔 Session ID: %s", sessionId)
 
 			// Create trace for this forwarded request
 			trace := Trace{
-				Id:            generateTraceID(),
+				Id:            traceID,
 				Timestamp:     time.Now(),
 				Method:        r.Method,
 				URL:           targetURL.String(),
+				Routing:       routing,
 				Status:        resp.Status,
 				Latency:       latency,
 				SessionId:     sessionId,
 				RequestHeader: r.Header,
 				RequestBody:   string(bodyBytes),
+				Fingerprint:   fingerprint,
+				Hooks:         hookCalls.Runs(),
 				ResponseBody:  responseBodyStr,
+				CaptureFile:   capture.Path(),
+				Canary:        canary,
+				Timings:       timer.breakdown(),
 			}
-			traces = append(traces, trace)
-			if len(traces) > tracesMax {
-				traces = traces[len(traces)-tracesMax:]
+			if usage, ok := parseUsage(respBody); ok {
+				trace.ReasoningTokens = usage.CompletionTokensDetails.ReasoningTokens
 			}
-			// Broadcast trace to WebSocket clients
-			hub.broadcast <- trace
+			experiments.Observe(r.URL.Path, canary, resp.StatusCode >= 500, time.Since(sentAt), respBody)
+			overrides.recordTrace(trace)
 		}
 
 		log.Println("=" + strings.Repeat("=", 30))
 	})
 
-	server := &http.Server{
-		Addr:    fmt.Sprintf("%s:%d", *host, *port),
-		Handler: handler,
+	if asyncJobs != nil {
+		asyncJobs.forward = handler
 	}
 
-	log.Println("🌐 OpenAI API Server running on http://localhost:8080")
-	log.Println("🔗 Example: http://localhost:8080/v1/chat/completions")
-	log.Fatal(server.ListenAndServe())
+	var tlsConfig *tls.Config
+	scheme := "http"
+	if *tlsCertFile != "" {
+		tlsConfig = listenerTLSConfig()
+		scheme = "https"
+		if clientCAs != nil {
+			log.Printf("🪪 Verifying client certificates (mode: %s)", *clientCertMode)
+		}
+	}
+
+	// Bind every address before serving so a bad one fails startup as a whole.
+	// Sockets passed by systemd replace -host and -port.
+	listeners := inheritedListeners(false)
+	names := make(map[net.Listener]string)
+	if len(listeners) > 0 {
+		log.Printf("🐧 Serving the sockets passed by systemd instead of -host and -port")
+		for _, listener := range listeners {
+			names[listener] = systemdSocketName(listener)
+		}
+	} else {
+		for _, address := range listenAddresses {
+			listener, err := net.Listen("tcp", address)
+			if err != nil {
+				log.Fatalf("❌ Failed to listen on %s: %v", address, err)
+			}
+			listeners = append(listeners, listener)
+			names[listener] = address
+		}
+	}
+	watchdogProbe = listeners[0].Addr()
+	listenersBound.Done()
+
+	// Each listener gets a server of its own to run its authentication chain
+	errs := make(chan error, len(listeners))
+	matched := 0
+	for _, listener := range listeners {
+		chain, custom := authChainFor(names[listener])
+		if custom {
+			matched++
+		}
+		log.Printf("🌐 OpenAI API Server running on %s (auth: %s)", listenerURL(scheme, listener.Addr()), authChainNames(chain))
+		server := &http.Server{Handler: withAuthChain(chain, handler), TLSConfig: tlsConfig}
+		go func(listener net.Listener) {
+			if *tlsCertFile != "" {
+				errs <- server.ServeTLS(listener, *tlsCertFile, *tlsKeyFile)
+				return
+			}
+			errs <- server.Serve(listener)
+		}(listener)
+	}
+	if matched < len(listenerAuthChains) {
+		log.Printf("⚠️ %d -listener-auth entries name no listener; listeners are named by their -host address or systemd FileDescriptorName", len(listenerAuthChains)-matched)
+	}
+	log.Printf("🔗 Example: %s/v1/chat/completions", listenerURL(scheme, listeners[0].Addr()))
+	log.Fatal(<-errs)
 }
 
 const sampleHookLuaScript = `
@@ -690,62 +1754,304 @@ function processResponse(body, headers)
     -- Modify the response body and headers here
     return body, headers
 end
+
+function onTrace(trace)
+    -- Inspect the completed trace here; return false to drop it
+    return true
+end
 `
 
 func main() {
-	flag.Parse()
+	if err := loadConfiguration(); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	level, err := parseLogLevel(*logLevelName)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	minLogLevel = level
+
+	if *renderCapturePath != "" {
+		if err := renderCapture(*renderCapturePath, os.Stdout); err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		return
+	}
+
 	if *printSampleHookLuaScript {
-		fmt.Println(sampleHookLuaScript)
+		fmt.Print(sampleHookLuaScript)
 		return
 	}
 
-	// Load Lua hook script if specified
+	cacheBackend, err := openStorage()
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+
+	if *rateLimitRPM > 0 {
+		requestRateLimiter = newRateLimiter(*rateLimitRPM)
+		log.Printf("🚦 Rate limit: %d requests/minute per client key", *rateLimitRPM)
+	}
+	if *tokenBudgetDaily > 0 {
+		requestTokenBudget = newTokenBudget(*tokenBudgetDaily)
+		log.Printf("💰 Token budget: %d tokens/day per client key", *tokenBudgetDaily)
+	}
+
+	if *paceUpstreamLimits {
+		upstreamPacer = newRateLimitPacer(*paceRequestHeadroom, *paceTokenHeadroom, *paceMaxWait)
+		log.Printf("🐢 Pacing requests by upstream rate limit headers (headroom: %d requests, %d tokens; max wait: %v)", *paceRequestHeadroom, *paceTokenHeadroom, *paceMaxWait)
+	}
+
+	if *maxConcurrency > 0 {
+		upstreamAdmission = newAdmissionQueue(*maxConcurrency, *maxQueue, *queueTimeout)
+		log.Printf("🚧 Concurrency limit: %d in flight, %d queued", *maxConcurrency, *maxQueue)
+	}
+	if *shedMemoryMB > 0 || *shedGoroutines > 0 || *shedTraceStoreMB > 0 {
+		degrade, _ := parseShedDegrade(*shedDegradeItems)
+		loadShed = newLoadShedder(*shedMemoryMB, *shedGoroutines, *shedTraceStoreMB, *shedDegradeAt, degrade)
+		go loadShed.run(time.Second)
+		log.Printf("🩺 Load shedding enabled (memory: %d MiB, goroutines: %d, trace store: %d MiB, degrading at %.0f%%)", *shedMemoryMB, *shedGoroutines, *shedTraceStoreMB, *shedDegradeAt*100)
+	}
+
+	if *transcriptionCacheTTL > 0 {
+		if cacheBackend != nil {
+			transcriptionCache = cacheBackend.CacheStore("transcriptions", *transcriptionCacheTTL)
+		} else {
+			transcriptionCache = newMemoryCache(*transcriptionCacheTTL, *transcriptionCacheSize)
+		}
+		log.Printf("💾 Transcription cache enabled (ttl: %v, size: %d)", *transcriptionCacheTTL, *transcriptionCacheSize)
+	}
+
+	if cacheBackend != nil {
+		hookCache = cacheBackend.CacheStore("hooks", *hookCacheMaxTTL)
+	} else {
+		hookCache = newMemoryCache(*hookCacheMaxTTL, *hookCacheSize)
+	}
+
+	if *completionCacheTTL > 0 {
+		// Entries stay in the store through the stale window; the forwarder decides
+		// between fresh and stale
+		retention := *completionCacheTTL + *staleWhileRevalidate
+		if cacheBackend != nil {
+			completionCache = cacheBackend.CacheStore("completions", retention)
+		} else {
+			completionCache = newMemoryCache(retention, *completionCacheSize)
+		}
+		log.Printf("💾 Completion cache enabled (ttl: %v, stale-while-revalidate: %v, size: %d)", *completionCacheTTL, *staleWhileRevalidate, *completionCacheSize)
+	}
+
+	if *negativeCacheTTL > 0 {
+		if cacheBackend != nil {
+			negativeCache = cacheBackend.CacheStore("errors", *negativeCacheTTL)
+		} else {
+			negativeCache = newMemoryCache(*negativeCacheTTL, *completionCacheSize)
+		}
+		log.Printf("🚫 Negative cache enabled (ttl: %v)", *negativeCacheTTL)
+	}
+	if len(staticCacheRules) > 0 {
+		// Entries outlive their TTL so the upstream can confirm them with a 304
+		retention := staticCacheRetention
+		var prefixes []string
+		for _, rule := range staticCacheRules {
+			retention = max(retention, rule.ttl+staticCacheRetention)
+			prefixes = append(prefixes, fmt.Sprintf("%s: %v", rule.prefix, rule.ttl))
+		}
+		if cacheBackend != nil {
+			staticCache = cacheBackend.CacheStore("static", retention)
+		} else {
+			staticCache = newMemoryCache(retention, *completionCacheSize)
+		}
+		log.Printf("💾 Static endpoint cache enabled (%s)", strings.Join(prefixes, ", "))
+	}
+	if len(modelTimeoutRules) > 0 {
+		var timeouts []string
+		for _, rule := range modelTimeoutRules {
+			timeouts = append(timeouts, fmt.Sprintf("%s: %v", rule.prefix, rule.timeout))
+		}
+		log.Printf("⏱️ Per-model upstream timeouts (%s; others: %v)", strings.Join(timeouts, ", "), upstreamClient.Timeout)
+	}
+	if *streamRetryMode != "off" {
+		log.Printf("🔁 Retrying cut-off streams once (mode: %s)", *streamRetryMode)
+	}
+
+	// Speech entries never expire, so the cache stays on disk under its size budget
+	// even with -cache-storage, whose backends don't bound a namespace's size
+	if *ttsCacheDir != "" {
+		cache, err := newDiskCache(*ttsCacheDir, *ttsCacheMaxBytes)
+		if err != nil {
+			log.Fatalf("❌ Failed to open speech cache: %v", err)
+		}
+		speechCache = cache
+		log.Printf("💾 Speech cache enabled (dir: %s, max bytes: %d)", *ttsCacheDir, *ttsCacheMaxBytes)
+	}
+
+	if *anomalyDetection {
+		usageAnomalies = newAnomalyDetector(*anomalyFactor, *anomalyThrottle)
+		log.Printf("🚨 Usage anomaly detection enabled (factor: %.1f, throttle: %v)", *anomalyFactor, *anomalyThrottle)
+	}
+
+	policy := quarantinePolicy{
+		maxBodyBytes:    *quarantineMaxBodyBytes,
+		blockedModels:   make(map[string]bool),
+		detectInjection: *quarantineInjection,
+	}
+	for _, model := range strings.Split(*quarantineBlockedModels, ",") {
+		if model = strings.TrimSpace(model); model != "" {
+			policy.blockedModels[model] = true
+		}
+	}
+	// Hooks can always flag requests, so the store exists whenever a hook is loaded
+	if policy.maxBodyBytes > 0 || len(policy.blockedModels) > 0 || policy.detectInjection || *luaFile != "" || requestRules.quarantines() {
+		requestQuarantine = newQuarantineStore(policy, *quarantineSize)
+		log.Printf("🛑 Quarantine enabled (max body bytes: %d, blocked models: %d, injection detection: %v)", policy.maxBodyBytes, len(policy.blockedModels), policy.detectInjection)
+	}
+
+	if *captureDir != "" {
+		if err := os.MkdirAll(*captureDir, 0700); err != nil {
+			log.Fatalf("❌ Failed to create capture directory: %v", err)
+		}
+		log.Printf("📼 Capturing raw exchanges to %s", *captureDir)
+	}
+
+	if *blobDir != "" {
+		store, err := newBlobStore(*blobDir, *blobThreshold)
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		traceBlobs = store
+		log.Printf("🗄️ Storing trace bodies over %d bytes in %s", *blobThreshold, *blobDir)
+	}
+
+	// Load secrets before the hook script so top-level code can use them
+	if *secretsFile != "" {
+		if err := loadSecretsFile(*secretsFile); err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+	}
+
+	if *modelCatalogFile != "" {
+		if err := loadModelCatalog(*modelCatalogFile); err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		log.Printf("📚 Loaded model catalog with %d models and %d aliases", len(modelCatalog), len(modelAliases))
+	}
+
+	if *pricingFile != "" {
+		if err := loadPricingFile(*pricingFile); err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+	}
+	if *schemaDriftEnabled {
+		if *schemaDriftFile != "" {
+			if err := loadSchemaDriftFile(*schemaDriftFile); err != nil {
+				log.Fatalf("❌ %v", err)
+			}
+		}
+		schemaDrifts = newSchemaDriftDetector()
+		log.Printf("🧬 Schema drift detection enabled for %d endpoints", len(responseSchemas))
+	}
+
+	// Virtual keys may reference secrets for their upstream keys
+	if *virtualKeysFile != "" {
+		keys, certs, err := loadVirtualKeys(*virtualKeysFile)
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		virtualKeys, clientCertKeys = keys, certs
+		log.Printf("🔑 Loaded %d virtual keys (%d client certificate mappings)", len(configuredVirtualKeys()), len(certs))
+	}
+
+	// Load hook script if specified
 	if *luaFile != "" {
-		if err := luaHookManager.LoadHookScript(*luaFile); err != nil {
-			log.Printf("❌ Failed to load Lua hook script: %v", err)
+		backend := *hookBackend
+		if backend == "auto" {
+			backend = "lua"
+			if strings.HasSuffix(*luaFile, ".star") || strings.HasSuffix(*luaFile, ".starlark") {
+				backend = "starlark"
+			}
+		}
+		switch backend {
+		case "lua":
+			scriptHooks = luaHookManager
+		case "starlark":
+			scriptHooks = starlarkHookManager
+		default:
+			log.Fatalf("❌ Unknown hook backend %q (expected lua, starlark or auto)", *hookBackend)
+		}
+		if _, _, err := reloadHookScript("startup"); err != nil {
+			log.Printf("❌ Failed to load %s hook script: %v", backend, err)
+		}
+	}
+
+	if *asyncJobsEnabled {
+		asyncJobs = newJobStore(max(*jobWorkers, 1), max(*jobMaxPending, 1))
+		log.Printf("📥 Async jobs enabled (workers: %d, max pending: %d, attempts: %d)", *jobWorkers, *jobMaxPending, *jobMaxAttempts)
+		if len(batchWindows) > 0 {
+			go asyncJobs.releaseBatchWindows()
+			log.Printf("🗓️ Batch windows at %s (mode: %s)", *batchSchedule, *batchMode)
+		}
+	}
+
+	if err := openEventBus(); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	if eventBus != nil {
+		log.Printf("📣 Publishing events to %s (traces: %q, usage: %q, format: %s)", *eventBusName, *eventTraceTopic, *eventUsageTopic, *eventFormat)
+	}
+
+	if err := startStreamTee(); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+
+	if upstreamPool != nil {
+		if *upstreamProbeInterval > 0 {
+			upstreamPool.startProbing(*upstreamProbeInterval)
+		}
+		log.Printf("⚖️ Balancing requests over %d upstreams (probe: GET %s every %v)", len(upstreamPool.members), *upstreamProbePath, *upstreamProbeInterval)
+	}
+	routingAudit.record("proxy", "startup", "", nil, currentRoutingConfig())
+
+	if *tenantHooksDir != "" {
+		hooks, err := loadTenantHooks(*tenantHooksDir)
+		if err != nil {
+			log.Fatalf("❌ %v", err)
 		}
+		tenantHooks = hooks
+		log.Printf("🏢 Tenant hooks enabled for %d tenants (concurrency: %d, timeout: %v, quota: %v/min)", len(hooks.tenants), *tenantHookConcurrency, *tenantHookTimeout, *tenantHookCPUQuota)
 	}
 
 	go hub.run()
+	go webhooks.run()
+	if *webhookSecret != "" {
+		if _, ok := lookupSecret(*webhookSecret); !ok {
+			log.Printf("⚠️ Secret %q of -webhook-secret is not set; webhook deliveries will fail until it is", *webhookSecret)
+		} else {
+			log.Printf("📮 Signing webhook payloads with secret %q", *webhookSecret)
+		}
+	}
+
+	// Under systemd, serve the sockets it passed and report readiness
+	sockets, err := systemdListeners()
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	systemdSockets = sockets
 
 	// Start the OpenAI API server
+	listenersBound.Add(1)
 	go startOpenAIForwarder()
 
 	// Start HTTP server for trace viewing
-	go func() {
-		http.HandleFunc("/traces", func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(traces)
-		})
-		http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-			log.Printf("🔌 WebSocket connection attempt from %s", r.RemoteAddr)
-			conn, err := upgrader.Upgrade(w, r, nil)
-			if err != nil {
-				log.Printf("❌ WebSocket upgrade error: %v", err)
-				return
-			}
-			log.Printf("✅ WebSocket connection established with %s", r.RemoteAddr)
-			hub.register <- conn
-			// Keep connection alive, unregister on error (e.g. client disconnects)
-			go func() {
-				defer func() {
-					log.Printf("🔌 WebSocket connection closed with %s", r.RemoteAddr)
-					hub.unregister <- conn
-					conn.Close()
-				}()
-				for {
-					// Read messages (optional, if you expect client messages)
-					// For now, just keep the connection open.
-					// If an error occurs (client disconnects), the loop will break.
-					if _, _, err := conn.NextReader(); err != nil {
-						break
-					}
-				}
-			}()
-		})
-		log.Println("📊 Trace viewer running on :8081, WebSocket on /ws")
-		log.Fatal(http.ListenAndServe(":8081", nil))
-	}()
+	if *adminDisable {
+		log.Println("📊 Trace server disabled")
+		for _, listener := range inheritedListeners(true) {
+			listener.Close()
+		}
+	} else {
+		listenersBound.Add(1)
+		go startAdminServer()
+	}
+	go notifySystemdReady()
 
 	// Keep the main goroutine running
 	select {}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	metricCounter   = "counter"
+	metricGauge     = "gauge"
+	metricHistogram = "histogram"
+)
+
+// defaultBuckets are the histogram upper bounds, matching the Prometheus client defaults
+var defaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var metricNameRe = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+var labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// metricsRegistry holds counters, gauges and histograms exported on /metrics
+type metricsRegistry struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+}
+
+type metricFamily struct {
+	name   string
+	help   string
+	kind   string
+	series map[string]*metricSeries // keyed by rendered label set
+}
+
+type metricSeries struct {
+	labels  string // rendered as {a="1",b="2"}, empty when unlabelled
+	value   float64
+	buckets []uint64 // cumulative counts per defaultBuckets entry
+	sum     float64
+	count   uint64
+}
+
+var metrics = &metricsRegistry{families: make(map[string]*metricFamily)}
+
+// renderLabels formats a label set in Prometheus text format with sorted names
+func renderLabels(labels map[string]string) (string, error) {
+	if len(labels) == 0 {
+		return "", nil
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		if !labelNameRe.MatchString(name) {
+			return "", fmt.Errorf("invalid label name %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + "=" + strconv.Quote(labels[name])
+	}
+	return "{" + strings.Join(parts, ",") + "}", nil
+}
+
+// series returns the series for name and labels, creating the family if needed
+func (m *metricsRegistry) series(name, help, kind string, labels map[string]string) (*metricSeries, error) {
+	if !metricNameRe.MatchString(name) {
+		return nil, fmt.Errorf("invalid metric name %q", name)
+	}
+	rendered, err := renderLabels(labels)
+	if err != nil {
+		return nil, err
+	}
+
+	family, ok := m.families[name]
+	if !ok {
+		family = &metricFamily{name: name, help: help, kind: kind, series: make(map[string]*metricSeries)}
+		m.families[name] = family
+	} else if family.kind != kind {
+		return nil, fmt.Errorf("metric %q is already registered as a %s", name, family.kind)
+	}
+
+	s, ok := family.series[rendered]
+	if !ok {
+		s = &metricSeries{labels: rendered}
+		if kind == metricHistogram {
+			s.buckets = make([]uint64, len(defaultBuckets))
+		}
+		family.series[rendered] = s
+	}
+	return s, nil
+}
+
+// Add increments a counter by delta, which must not be negative
+func (m *metricsRegistry) Add(name, help string, labels map[string]string, delta float64) error {
+	if delta < 0 {
+		return fmt.Errorf("counter %q cannot decrease", name)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, err := m.series(name, help, metricCounter, labels)
+	if err != nil {
+		return err
+	}
+	s.value += delta
+	return nil
+}
+
+// Set sets a gauge to value
+func (m *metricsRegistry) Set(name, help string, labels map[string]string, value float64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, err := m.series(name, help, metricGauge, labels)
+	if err != nil {
+		return err
+	}
+	s.value = value
+	return nil
+}
+
+// Observe records a histogram sample
+func (m *metricsRegistry) Observe(name, help string, labels map[string]string, value float64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, err := m.series(name, help, metricHistogram, labels)
+	if err != nil {
+		return err
+	}
+	for i, bound := range defaultBuckets {
+		if value <= bound {
+			s.buckets[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+	return nil
+}
+
+// bucketLabels merges the le label into a rendered label set
+func bucketLabels(labels, le string) string {
+	if labels == "" {
+		return `{le="` + le + `"}`
+	}
+	return labels[:len(labels)-1] + `,le="` + le + `"}`
+}
+
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// WriteText writes all metrics in the Prometheus text exposition format
+func (m *metricsRegistry) WriteText(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.families))
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		family := m.families[name]
+		if family.help != "" {
+			fmt.Fprintf(w, "# HELP %s %s\n", name, family.help)
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, family.kind)
+
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := family.series[key]
+			if family.kind != metricHistogram {
+				fmt.Fprintf(w, "%s%s %s\n", name, s.labels, formatMetricValue(s.value))
+				continue
+			}
+			for i, bound := range defaultBuckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name, bucketLabels(s.labels, formatMetricValue(bound)), s.buckets[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, bucketLabels(s.labels, "+Inf"), s.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", name, s.labels, formatMetricValue(s.sum))
+			fmt.Fprintf(w, "%s_count%s %d\n", name, s.labels, s.count)
+		}
+	}
+}
+
+// handleMetrics serves the registry on /metrics
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.WriteText(w)
+}
+
+// recordRequestMetrics updates the built-in per-request metrics
+func recordRequestMetrics(trace Trace) {
+	// "200 OK" -> "200"
+	status := strings.SplitN(trace.Status, " ", 2)[0]
+	labels := map[string]string{"method": trace.Method, "status": status}
+	metrics.Add("openai_proxy_requests_total", "Requests handled by the forwarder.", labels, 1)
+	metrics.Observe("openai_proxy_request_duration_seconds", "Upstream latency of forwarded requests.", map[string]string{"method": trace.Method}, trace.Latency)
+	if trace.Timings != nil {
+		observeLatencyPhases(trace.Timings)
+	}
+}
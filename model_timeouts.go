@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// modelTimeoutRule sets the upstream timeout of models with a prefix
+type modelTimeoutRule struct {
+	prefix  string
+	timeout time.Duration
+}
+
+// modelTimeoutRules are the -model-timeouts rules, longest prefix first
+var modelTimeoutRules []modelTimeoutRule
+
+// deadlineClient sends upstream requests whose context carries the deadline, so
+// they can run longer than upstreamClient's timeout
+var deadlineClient = &http.Client{Transport: pinnedHostTransport{}}
+
+// parseModelTimeouts parses -model-timeouts, comma-separated model-prefix=duration pairs
+func parseModelTimeouts(spec string) ([]modelTimeoutRule, error) {
+	var rules []modelTimeoutRule
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, value, ok := strings.Cut(entry, "=")
+		prefix = strings.TrimSpace(prefix)
+		if !ok || prefix == "" {
+			return nil, fmt.Errorf("invalid -model-timeouts entry %q: expected model=duration", entry)
+		}
+		timeout, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid -model-timeouts duration %q for %s: expected a positive duration such as 5m", value, prefix)
+		}
+		rules = append(rules, modelTimeoutRule{prefix: prefix, timeout: timeout})
+	}
+	sort.SliceStable(rules, func(i, j int) bool { return len(rules[i].prefix) > len(rules[j].prefix) })
+	return rules, nil
+}
+
+// modelTimeout returns the upstream timeout of a model: its -model-timeouts rule,
+// or upstreamClient's default. matched reports whether a rule applied.
+func modelTimeout(model string) (timeout time.Duration, matched bool) {
+	if model != "" {
+		for _, rule := range modelTimeoutRules {
+			if strings.HasPrefix(model, rule.prefix) {
+				return rule.timeout, true
+			}
+		}
+	}
+	return upstreamClient.Timeout, false
+}
+
+// maxUpstreamTimeout is the longest upstream timeout of any model, the limit of
+// X-Proxy-Timeout
+func maxUpstreamTimeout() time.Duration {
+	longest := upstreamClient.Timeout
+	for _, rule := range modelTimeoutRules {
+		longest = max(longest, rule.timeout)
+	}
+	return longest
+}
+
+// upstreamDeadline returns the timeout of an upstream request for a model: the
+// model's, shortened by the client's X-Proxy-Timeout. It returns 0 when the
+// request keeps upstreamClient's default.
+func upstreamDeadline(model string, override time.Duration) time.Duration {
+	timeout, matched := modelTimeout(model)
+	if override > 0 {
+		return min(override, timeout)
+	}
+	if matched {
+		return timeout
+	}
+	return 0
+}
+
+// upstreamClientFor returns the client for an upstream request: deadlineClient
+// when its context carries an upstreamDeadline, upstreamClient otherwise
+func upstreamClientFor(ctx context.Context) *http.Client {
+	if _, ok := ctx.Deadline(); ok {
+		return deadlineClient
+	}
+	return upstreamClient
+}
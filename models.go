@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// modelContextWindows are context window sizes in tokens, keyed by model name prefix
+// like modelPrices. Catalog file entries override them.
+var modelContextWindows = map[string]int{
+	"gpt-4o":                 128000,
+	"gpt-4.1":                1047576,
+	"gpt-4-turbo":            128000,
+	"gpt-4":                  8192,
+	"gpt-3.5-turbo":          16385,
+	"o1":                     200000,
+	"o1-mini":                128000,
+	"o3":                     200000,
+	"o4-mini":                200000,
+	"text-embedding-3-small": 8191,
+	"text-embedding-3-large": 8191,
+	"text-embedding-ada-002": 8191,
+}
+
+// catalogEntry is proxy-side metadata for one model from -model-catalog-file
+type catalogEntry struct {
+	ContextWindow int      `json:"context_window,omitempty"`
+	Aliases       []string `json:"aliases,omitempty"`
+	Description   string   `json:"description,omitempty"`
+}
+
+var (
+	// modelCatalog maps model IDs to their metadata
+	modelCatalog = map[string]catalogEntry{}
+	// modelAliases maps local alias names to the model IDs they stand for
+	modelAliases = map[string]string{}
+)
+
+// loadModelCatalog reads a JSON object of model IDs to catalog entries
+func loadModelCatalog(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read model catalog %s: %v", path, err)
+	}
+	catalog := map[string]catalogEntry{}
+	if err := json.Unmarshal(data, &catalog); err != nil {
+		return fmt.Errorf("failed to parse model catalog %s: %v", path, err)
+	}
+	aliases := map[string]string{}
+	for model, entry := range catalog {
+		for _, alias := range entry.Aliases {
+			if other, ok := aliases[alias]; ok {
+				return fmt.Errorf("model catalog %s: alias %q is used by both %q and %q", path, alias, other, model)
+			}
+			if _, ok := catalog[alias]; ok {
+				return fmt.Errorf("model catalog %s: alias %q is also a model", path, alias)
+			}
+			aliases[alias] = model
+		}
+	}
+	modelCatalog, modelAliases = catalog, aliases
+	return nil
+}
+
+// resolveModelAlias rewrites a request body whose model is a local alias to the
+// model it stands for
+func resolveModelAlias(body []byte) []byte {
+	if len(modelAliases) == 0 {
+		return body
+	}
+	target, ok := modelAliases[bodyModel(body)]
+	if !ok {
+		return body
+	}
+	doc, err := parseJSONDocument(body)
+	if err != nil {
+		return body
+	}
+	doc.root, _ = pathSet(doc.root, []pathSegment{{key: "model"}}, target)
+	encoded, err := doc.encode()
+	if err != nil {
+		return body
+	}
+	return encoded
+}
+
+// contextWindowForModel looks up the context window of the longest matching prefix
+func contextWindowForModel(model string) (int, bool) {
+	if entry, ok := modelCatalog[model]; ok && entry.ContextWindow > 0 {
+		return entry.ContextWindow, true
+	}
+	var best string
+	for prefix := range modelContextWindows {
+		if strings.HasPrefix(model, prefix) && len(prefix) > len(best) {
+			best = prefix
+		}
+	}
+	if best == "" {
+		return 0, false
+	}
+	return modelContextWindows[best], true
+}
+
+// modelAllowed reports whether the proxy's policy lets requests use model
+func modelAllowed(model string) bool {
+	return requestQuarantine == nil || !requestQuarantine.policy.blockedModels[model]
+}
+
+// modelMetadata is the "proxy" object added to each model in the catalog
+type modelMetadata struct {
+	Pricing       *modelPrice `json:"pricing,omitempty"`
+	ContextWindow int         `json:"context_window,omitempty"`
+	Allowed       bool        `json:"allowed"`
+	Aliases       []string    `json:"aliases,omitempty"`
+	AliasFor      string      `json:"alias_for,omitempty"`
+	Description   string      `json:"description,omitempty"`
+}
+
+func metadataForModel(id string) modelMetadata {
+	meta := modelMetadata{Allowed: modelAllowed(id)}
+	if price, ok := priceForModel(id); ok {
+		meta.Pricing = &price
+	}
+	meta.ContextWindow, _ = contextWindowForModel(id)
+	entry := modelCatalog[id]
+	meta.Aliases = entry.Aliases
+	meta.Description = entry.Description
+	return meta
+}
+
+// enrichModel adds proxy metadata to an upstream model object
+func enrichModel(model map[string]interface{}) {
+	id, _ := model["id"].(string)
+	model["proxy"] = metadataForModel(id)
+}
+
+// aliasModel builds the model object listed for a local alias of target
+func aliasModel(alias string, target map[string]interface{}) map[string]interface{} {
+	model := map[string]interface{}{"id": alias, "object": "model", "owned_by": "proxy"}
+	if created, ok := target["created"]; ok {
+		model["created"] = created
+	}
+	targetID, _ := target["id"].(string)
+	meta := metadataForModel(targetID)
+	meta.Aliases = nil
+	meta.AliasFor = targetID
+	model["proxy"] = meta
+	return model
+}
+
+// modelListCache keeps upstream model lists per upstream credential, since
+// organizations see different models
+type modelListCache struct {
+	mu      sync.Mutex
+	entries map[string]modelListEntry
+}
+
+type modelListEntry struct {
+	models  []map[string]interface{}
+	fetched time.Time
+}
+
+var upstreamModelLists = &modelListCache{entries: make(map[string]modelListEntry)}
+
+// fetch returns the upstream model list for the upstream credentials in header,
+// from the cache when it is fresher than -model-catalog-ttl
+func (c *modelListCache) fetch(header http.Header) ([]map[string]interface{}, bool, error) {
+	sum := sha256.Sum256([]byte(header.Get("Authorization")))
+	key := hex.EncodeToString(sum[:])
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && time.Since(entry.fetched) < *modelCatalogTTL {
+		return entry.models, true, nil
+	}
+
+	resp, body, err := forwardUpstream(http.MethodGet, upstreamTarget("/v1/models", "").String(), header, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, &upstreamStatusError{resp: resp, body: body}
+	}
+	var list struct {
+		Data []map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, false, fmt.Errorf("failed to parse upstream model list: %v", err)
+	}
+	if *modelCatalogTTL > 0 {
+		c.mu.Lock()
+		c.entries[key] = modelListEntry{models: list.Data, fetched: time.Now()}
+		c.mu.Unlock()
+	}
+	return list.Data, false, nil
+}
+
+// upstreamStatusError carries a non-200 upstream answer to relay to the client
+type upstreamStatusError struct {
+	resp *http.Response
+	body []byte
+}
+
+func (e *upstreamStatusError) Error() string {
+	return "upstream answered " + e.resp.Status
+}
+
+// serveModelCatalog answers GET /v1/models and GET /v1/models/<id> with the upstream
+// models plus proxy metadata and local aliases
+func serveModelCatalog(w http.ResponseWriter, r *http.Request, caller *principal) {
+	startTime := time.Now()
+	traceID := generateTraceID()
+	w.Header().Set("X-Proxy-Trace-Id", traceID)
+
+	upstreamModels, cached, err := upstreamModelLists.fetch(caller.upstreamHeader(r.Header))
+	if err != nil {
+		if statusErr, ok := err.(*upstreamStatusError); ok {
+			w.Header().Set("Content-Type", statusErr.resp.Header.Get("Content-Type"))
+			w.WriteHeader(statusErr.resp.StatusCode)
+			w.Write(statusErr.body)
+			return
+		}
+		log.Printf("❌ Model list request failed: %v", err)
+		writeJSONError(w, http.StatusBadGateway, "upstream_error", err.Error())
+		return
+	}
+	if cached {
+		w.Header().Set("X-Proxy-Cache", "hit")
+	} else if *modelCatalogTTL > 0 {
+		w.Header().Set("X-Proxy-Cache", "miss")
+	}
+
+	byID := make(map[string]map[string]interface{}, len(upstreamModels))
+	var models []map[string]interface{}
+	for _, upstreamModel := range upstreamModels {
+		// Copy so enrichment never touches the cached list
+		model := make(map[string]interface{}, len(upstreamModel)+1)
+		for key, value := range upstreamModel {
+			model[key] = value
+		}
+		enrichModel(model)
+		if id, ok := model["id"].(string); ok {
+			byID[id] = model
+		}
+		models = append(models, model)
+	}
+	aliases := make([]string, 0, len(modelAliases))
+	for alias := range modelAliases {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		if target, ok := byID[modelAliases[alias]]; ok {
+			model := aliasModel(alias, target)
+			byID[alias] = model
+			models = append(models, model)
+		}
+	}
+
+	var response interface{}
+	if id := strings.TrimPrefix(r.URL.Path, "/v1/models/"); id != r.URL.Path {
+		model, ok := byID[id]
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "invalid_request_error", fmt.Sprintf("The model '%s' does not exist", id))
+			return
+		}
+		response = model
+	} else {
+		if models == nil {
+			models = []map[string]interface{}{}
+		}
+		response = map[string]interface{}{"object": "list", "data": models}
+	}
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+	recordTrace(Trace{
+		Id:            traceID,
+		Timestamp:     time.Now(),
+		Method:        r.Method,
+		URL:           upstreamTarget(r.URL.Path, r.URL.RawQuery).String(),
+		Status:        "200 OK",
+		Latency:       time.Since(startTime).Seconds(),
+		RequestHeader: r.Header,
+		ResponseBody:  string(body),
+		CacheHit:      cached,
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"strings"
+)
+
+const (
+	contentTypeSSE    = "text/event-stream"
+	contentTypeNDJSON = "application/x-ndjson"
+)
+
+// streamTranscoding picks the conversion for a streamed response: "ndjson" when the
+// client asked for NDJSON and the upstream streams SSE, "sse" for the reverse, or ""
+// to relay the stream as is
+func streamTranscoding(accept, upstreamContentType string) string {
+	upstream, _, _ := mime.ParseMediaType(upstreamContentType)
+	wantsNDJSON, wantsSSE := false, false
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case contentTypeNDJSON:
+			wantsNDJSON = true
+		case contentTypeSSE:
+			wantsSSE = true
+		}
+	}
+	switch {
+	case upstream == contentTypeSSE && wantsNDJSON && !wantsSSE:
+		return "ndjson"
+	case upstream == contentTypeNDJSON && wantsSSE && !wantsNDJSON:
+		return "sse"
+	}
+	return ""
+}
+
+// streamTranscoder converts a stream between SSE and NDJSON as it is written,
+// holding back incomplete events or lines until the rest arrives
+type streamTranscoder struct {
+	dst     io.Writer
+	toSSE   bool
+	pending string
+}
+
+func newStreamTranscoder(dst io.Writer, to string) *streamTranscoder {
+	return &streamTranscoder{dst: dst, toSSE: to == "sse"}
+}
+
+func (t *streamTranscoder) Write(p []byte) (int, error) {
+	var out string
+	if t.toSSE {
+		text := t.pending + string(p)
+		end := strings.LastIndex(text, "\n")
+		if end < 0 {
+			t.pending = text
+			return len(p), nil
+		}
+		out, t.pending = ndjsonToSSE(text[:end+1]), text[end+1:]
+	} else {
+		var events []sseEvent
+		events, t.pending = parseSSE(t.pending + string(p))
+		out = sseToNDJSON(events)
+	}
+	if out != "" {
+		if _, err := io.WriteString(t.dst, out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Close writes what is left of the stream once the upstream has finished. SSE output
+// is terminated with [DONE], as OpenAI clients expect.
+func (t *streamTranscoder) Close() error {
+	var out string
+	if t.toSSE {
+		out = ndjsonToSSE(t.pending) + encodeSSE([]sseEvent{{Data: sseDone}})
+	} else {
+		events, _ := parseSSE(t.pending + "\n\n")
+		out = sseToNDJSON(events)
+	}
+	t.pending = ""
+	_, err := io.WriteString(t.dst, out)
+	return err
+}
+
+// sseToNDJSON renders each event's JSON data as one line, dropping [DONE]. Events
+// whose data isn't JSON are written as the event object itself.
+func sseToNDJSON(events []sseEvent) string {
+	var b strings.Builder
+	for _, event := range events {
+		if event.Data == sseDone {
+			continue
+		}
+		var line bytes.Buffer
+		if json.Compact(&line, []byte(event.Data)) != nil {
+			line.Reset()
+			if json.NewEncoder(&line).Encode(event) != nil {
+				continue
+			}
+		} else {
+			line.WriteByte('\n')
+		}
+		b.Write(line.Bytes())
+	}
+	return b.String()
+}
+
+// ndjsonToSSE turns each non-empty line into a data event
+func ndjsonToSSE(text string) string {
+	var events []sseEvent
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			events = append(events, sseEvent{Data: line})
+		}
+	}
+	return encodeSSE(events)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// normalizedTextFields are the JSON fields whose string values are prompt text, in
+// any request shape: message content and parts, completion prompts, embedding and
+// responses API input, and instructions
+var normalizedTextFields = map[string]bool{
+	"content":      true,
+	"text":         true,
+	"prompt":       true,
+	"input":        true,
+	"instructions": true,
+}
+
+// fingerprintIgnored holds the -fingerprint-ignore-fields set
+var fingerprintIgnored map[string]bool
+
+// parseFingerprintIgnoreFields parses the comma-separated -fingerprint-ignore-fields
+func parseFingerprintIgnoreFields(spec string) map[string]bool {
+	fields := make(map[string]bool)
+	for _, field := range strings.Split(spec, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields[field] = true
+		}
+	}
+	return fields
+}
+
+// canonicalRequestJSON returns the canonical form of a JSON request body: top-level
+// fields in -fingerprint-ignore-fields removed, prompt text with normalized line
+// endings and without trailing whitespace, and object keys sorted. Numbers are kept as written.
+func canonicalRequestJSON(body []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var request interface{}
+	if err := decoder.Decode(&request); err != nil {
+		return nil, fmt.Errorf("invalid JSON body: %v", err)
+	}
+	if object, ok := request.(map[string]interface{}); ok {
+		for field := range fingerprintIgnored {
+			delete(object, field)
+		}
+	}
+	return json.Marshal(normalizeRequestValue(request, false))
+}
+
+// normalizeRequestValue normalizes the strings below prompt text fields
+func normalizeRequestValue(value interface{}, text bool) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			v[key] = normalizeRequestValue(child, normalizedTextFields[key])
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = normalizeRequestValue(child, text)
+		}
+	case string:
+		if text {
+			return normalizePromptText(v)
+		}
+	}
+	return value
+}
+
+// normalizePromptText unifies line endings and strips trailing whitespace from
+// every line and around the text; indentation and blank lines are kept
+func normalizePromptText(text string) string {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// requestFingerprint identifies what a JSON request asks for, independent of key
+// order, whitespace noise and per-request fields. It is stored on traces and
+// usage events, and the completion and negative cache keys are built from the same
+// canonical form. Non-JSON bodies have no fingerprint.
+func requestFingerprint(path string, body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	canonical, err := canonicalRequestJSON(body)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(append([]byte(path+"\n"), canonical...))
+	return hex.EncodeToString(sum[:])
+}
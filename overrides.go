@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Control headers a client may send to change how the proxy handles one request.
+// They are stripped before the request reaches hooks or the upstream.
+const (
+	overrideNoCache    = "X-Proxy-No-Cache"
+	overrideTimeout    = "X-Proxy-Timeout"
+	overrideUpstream   = "X-Proxy-Upstream"
+	overrideTraceLevel = "X-Proxy-Trace-Level"
+	overrideAnnotate   = "X-Proxy-Annotate"
+)
+
+// overridePolicyNames maps the -client-overrides names to their headers
+var overridePolicyNames = map[string]string{
+	"no-cache":    overrideNoCache,
+	"timeout":     overrideTimeout,
+	"upstream":    overrideUpstream,
+	"trace-level": overrideTraceLevel,
+	"annotate":    overrideAnnotate,
+}
+
+// Trace levels for X-Proxy-Trace-Level
+const (
+	traceLevelFull     = "full"
+	traceLevelMetadata = "metadata" // no bodies
+	traceLevelNone     = "none"     // not traced at all
+)
+
+var (
+	// allowedOverrides holds the control headers clients may use; the rest are rejected
+	allowedOverrides = map[string]bool{}
+	// overrideUpstreams are the base URLs X-Proxy-Upstream may name
+	overrideUpstreams = map[string]*url.URL{}
+)
+
+// requestOverrides is the per-request behavior requested through control headers
+type requestOverrides struct {
+	noCache    bool
+	timeout    time.Duration // 0 keeps the client default
+	upstream   *url.URL      // nil keeps -upstream
+	traceLevel string
+	annotate   bool // add an x_proxy object to JSON responses
+}
+
+// parseOverridePolicy reads -client-overrides and -override-upstreams
+func parseOverridePolicy(names, upstreams string) (map[string]bool, map[string]*url.URL, error) {
+	allowed := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		header, ok := overridePolicyNames[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid -client-overrides entry %q: expected no-cache, timeout, upstream, trace-level or annotate", name)
+		}
+		allowed[header] = true
+	}
+	bases := make(map[string]*url.URL)
+	for _, entry := range strings.Split(upstreams, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		parsed, err := url.Parse(entry)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, nil, fmt.Errorf("invalid -override-upstreams entry %q: expected an http(s) base URL", entry)
+		}
+		parsed.Path = strings.TrimSuffix(parsed.Path, "/")
+		bases[parsed.String()] = parsed
+	}
+	if allowed[overrideUpstream] && len(bases) == 0 {
+		return nil, nil, fmt.Errorf("-client-overrides allows upstream but -override-upstreams is empty")
+	}
+	return allowed, bases, nil
+}
+
+// parseRequestOverrides validates the control headers of a request against the policy
+// and removes them. A header the policy doesn't allow, or an invalid value, is
+// returned as an error with the status to reject the request with.
+func parseRequestOverrides(header http.Header) (requestOverrides, int, error) {
+	overrides := requestOverrides{traceLevel: traceLevelFull}
+	for _, name := range []string{overrideNoCache, overrideTimeout, overrideUpstream, overrideTraceLevel, overrideAnnotate} {
+		if _, present := header[name]; !present {
+			continue
+		}
+		value := strings.TrimSpace(header.Get(name))
+		header.Del(name)
+		if !allowedOverrides[name] {
+			return overrides, http.StatusForbidden, fmt.Errorf("the %s header is not allowed by the proxy's policy", name)
+		}
+
+		switch name {
+		case overrideNoCache:
+			noCache, err := strconv.ParseBool(value)
+			if err != nil {
+				return overrides, http.StatusBadRequest, fmt.Errorf("invalid %s %q: expected true or false", name, value)
+			}
+			overrides.noCache = noCache
+		case overrideAnnotate:
+			annotate, err := strconv.ParseBool(value)
+			if err != nil {
+				return overrides, http.StatusBadRequest, fmt.Errorf("invalid %s %q: expected true or false", name, value)
+			}
+			overrides.annotate = annotate
+		case overrideTimeout:
+			timeout, err := time.ParseDuration(value)
+			if err != nil {
+				seconds, numErr := strconv.ParseFloat(value, 64)
+				if numErr != nil {
+					return overrides, http.StatusBadRequest, fmt.Errorf("invalid %s %q: expected a duration such as 10s", name, value)
+				}
+				timeout = time.Duration(seconds * float64(time.Second))
+			}
+			if timeout <= 0 || timeout > maxUpstreamTimeout() {
+				return overrides, http.StatusBadRequest, fmt.Errorf("invalid %s %q: must be positive and at most %v", name, value, maxUpstreamTimeout())
+			}
+			overrides.timeout = timeout
+		case overrideUpstream:
+			base, ok := overrideUpstreams[strings.TrimSuffix(value, "/")]
+			if !ok {
+				return overrides, http.StatusForbidden, fmt.Errorf("upstream %q is not in the proxy's allowed override upstreams", value)
+			}
+			overrides.upstream = base
+		case overrideTraceLevel:
+			switch value {
+			case traceLevelFull, traceLevelMetadata, traceLevelNone:
+				overrides.traceLevel = value
+			default:
+				return overrides, http.StatusBadRequest, fmt.Errorf("invalid %s %q: expected full, metadata or none", name, value)
+			}
+		}
+	}
+	return overrides, 0, nil
+}
+
+// applyRequestOverrides parses the request's control headers, answering the request
+// with the error if the policy rejects one. It returns false if it did.
+func applyRequestOverrides(w http.ResponseWriter, r *http.Request) (requestOverrides, bool) {
+	overrides, status, err := parseRequestOverrides(r.Header)
+	if err != nil {
+		log.Printf("🚫 Rejected override: %v", err)
+		errType := "invalid_request_error"
+		if status == http.StatusForbidden {
+			errType = "override_not_allowed"
+		}
+		writeJSONError(w, status, errType, err.Error())
+		return overrides, false
+	}
+	return overrides, true
+}
+
+// target returns the upstream URL for path, honoring an X-Proxy-Upstream override
+func (o requestOverrides) target(path, rawQuery string) *url.URL {
+	if o.upstream == nil {
+		return upstreamTarget(path, rawQuery)
+	}
+	return &url.URL{
+		Scheme:   o.upstream.Scheme,
+		Host:     o.upstream.Host,
+		Path:     o.upstream.Path + path,
+		RawQuery: rawQuery,
+	}
+}
+
+// recordTrace records a trace at the requested level
+func (o requestOverrides) recordTrace(trace Trace) {
+	switch o.traceLevel {
+	case traceLevelNone:
+		recordRequestMetrics(trace)
+		return
+	case traceLevelMetadata:
+		trace.RequestBody, trace.ResponseBody = "", ""
+	}
+	recordTrace(trace)
+}
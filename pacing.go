@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upstreamLimits is the last rate limit state an upstream reported for one key
+type upstreamLimits struct {
+	remainingRequests int64 // -1 when unknown
+	remainingTokens   int64 // -1 when unknown
+	resetRequests     time.Time
+	resetTokens       time.Time
+}
+
+// rateLimitPacer holds requests back when the upstream's x-ratelimit-* headers say
+// the key is about to run out, until the window resets, so requests arrive just
+// below the limit instead of failing with 429
+type rateLimitPacer struct {
+	requestHeadroom int64 // requests kept in reserve
+	tokenHeadroom   int64 // tokens kept in reserve
+	maxWait         time.Duration
+
+	mu     sync.Mutex
+	limits map[string]*upstreamLimits
+}
+
+// upstreamPacer is nil unless -pace-upstream-limits is set
+var upstreamPacer *rateLimitPacer
+
+func newRateLimitPacer(requestHeadroom, tokenHeadroom int64, maxWait time.Duration) *rateLimitPacer {
+	return &rateLimitPacer{
+		requestHeadroom: requestHeadroom,
+		tokenHeadroom:   tokenHeadroom,
+		maxWait:         maxWait,
+		limits:          make(map[string]*upstreamLimits),
+	}
+}
+
+// pacingKey identifies the upstream rate limit a request counts against: the host
+// and the credential sent to it
+func pacingKey(host string, header http.Header) string {
+	sum := sha256.Sum256([]byte(header.Get("Authorization")))
+	return host + "/" + hex.EncodeToString(sum[:8])
+}
+
+// estimateRequestTokens roughly predicts the tokens a request will use: about four
+// bytes of body per prompt token plus the completion limit, if any
+func estimateRequestTokens(body []byte) int64 {
+	var request struct {
+		MaxTokens           int64 `json:"max_tokens"`
+		MaxCompletionTokens int64 `json:"max_completion_tokens"`
+		MaxOutputTokens     int64 `json:"max_output_tokens"`
+	}
+	json.Unmarshal(body, &request)
+	return int64(len(body)/4) + max(request.MaxTokens, request.MaxCompletionTokens, request.MaxOutputTokens)
+}
+
+// delay returns how long a request needing tokens must wait before the key has room
+// for it. Called with p.mu held.
+func (p *rateLimitPacer) delay(l *upstreamLimits, tokens int64, now time.Time) time.Duration {
+	// A window that has reset has room again, to the extent the next response reports
+	if l.remainingRequests >= 0 && !now.Before(l.resetRequests) {
+		l.remainingRequests = -1
+	}
+	if l.remainingTokens >= 0 && !now.Before(l.resetTokens) {
+		l.remainingTokens = -1
+	}
+	var wait time.Duration
+	if l.remainingRequests >= 0 && l.remainingRequests <= p.requestHeadroom {
+		wait = l.resetRequests.Sub(now)
+	}
+	if l.remainingTokens >= 0 && l.remainingTokens-tokens < p.tokenHeadroom {
+		wait = max(wait, l.resetTokens.Sub(now))
+	}
+	return wait
+}
+
+// Reserve waits until the key has room for a request of the given size and counts
+// the request against it. It returns how long the request was held back, and false
+// with the remaining wait when that would exceed -pace-max-wait.
+func (p *rateLimitPacer) Reserve(ctx context.Context, key string, tokens int64) (time.Duration, time.Duration, bool) {
+	started := time.Now()
+	for {
+		p.mu.Lock()
+		l, ok := p.limits[key]
+		if !ok {
+			p.mu.Unlock()
+			return time.Since(started), 0, true
+		}
+		now := time.Now()
+		wait := p.delay(l, tokens, now)
+		if wait <= 0 {
+			// Count the request locally so concurrent requests don't all see the same room
+			if l.remainingRequests > 0 {
+				l.remainingRequests--
+			}
+			if l.remainingTokens > 0 {
+				l.remainingTokens = max(l.remainingTokens-tokens, 0)
+			}
+			p.mu.Unlock()
+			waited := time.Since(started)
+			if waited >= time.Millisecond {
+				metrics.Add("openai_proxy_paced_requests_total", "Requests held back to stay under upstream rate limits, by outcome.", map[string]string{"outcome": "delayed"}, 1)
+				metrics.Observe("openai_proxy_pacing_wait_seconds", "Time requests were held back to stay under upstream rate limits.", nil, waited.Seconds())
+			}
+			return waited, 0, true
+		}
+		p.mu.Unlock()
+
+		if now.Add(wait).Sub(started) > p.maxWait {
+			metrics.Add("openai_proxy_paced_requests_total", "Requests held back to stay under upstream rate limits, by outcome.", map[string]string{"outcome": "rejected"}, 1)
+			return time.Since(started), wait, false
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return time.Since(started), 0, true
+		}
+	}
+}
+
+// parseRateLimitReset reads an x-ratelimit-reset-* value such as "1s", "6m0s" or "20ms"
+func parseRateLimitReset(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return d, true
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), true
+	}
+	return 0, false
+}
+
+// Observe records the rate limit state reported by an upstream response
+func (p *rateLimitPacer) Observe(key string, header http.Header, statusCode int) {
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l, ok := p.limits[key]
+	if !ok {
+		l = &upstreamLimits{remainingRequests: -1, remainingTokens: -1}
+	}
+	seen := false
+	if remaining, err := strconv.ParseInt(header.Get("X-Ratelimit-Remaining-Requests"), 10, 64); err == nil {
+		if reset, ok := parseRateLimitReset(header.Get("X-Ratelimit-Reset-Requests")); ok {
+			l.remainingRequests, l.resetRequests, seen = remaining, now.Add(reset), true
+		}
+	}
+	if remaining, err := strconv.ParseInt(header.Get("X-Ratelimit-Remaining-Tokens"), 10, 64); err == nil {
+		if reset, ok := parseRateLimitReset(header.Get("X-Ratelimit-Reset-Tokens")); ok {
+			l.remainingTokens, l.resetTokens, seen = remaining, now.Add(reset), true
+		}
+	}
+	if statusCode == http.StatusTooManyRequests {
+		// Without headers, hold the key back for Retry-After (or a second)
+		retryAfter := time.Second
+		if seconds, err := strconv.Atoi(strings.TrimSpace(header.Get("Retry-After"))); err == nil {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		if l.remainingRequests != 0 || !now.Before(l.resetRequests) {
+			l.remainingRequests, l.resetRequests = 0, now.Add(retryAfter)
+		}
+		seen = true
+		log.Printf("🐢 Upstream rate limited key %s, pacing for %v", key, l.resetRequests.Sub(now).Round(time.Millisecond))
+	}
+	if seen {
+		p.limits[key] = l
+	}
+}
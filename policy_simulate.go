@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// policySimulationRequest is the body of POST /policy/simulate: a hypothetical
+// request, or the request of a stored trace with some fields replaced
+type policySimulationRequest struct {
+	TraceID    string            `json:"trace_id"`
+	Method     string            `json:"method"`
+	Path       string            `json:"path"`
+	Headers    map[string]string `json:"headers"`
+	Body       json.RawMessage   `json:"body"` // a JSON request body, or a string holding any body
+	RemoteAddr string            `json:"remote_addr"`
+}
+
+// policyCheck is one stage of the forwarder a simulated request passes through
+type policyCheck struct {
+	Stage  string `json:"stage"`
+	Result string `json:"result"` // pass, fail, match or skip
+	Detail string `json:"detail,omitempty"`
+}
+
+// policyOutcome is what the forwarder would do with the request
+type policyOutcome struct {
+	// Action is forward, reject, block, quarantine, cache_hit, static_cache,
+	// transparent, realtime or model_catalog
+	Action    string `json:"action"`
+	Status    int    `json:"status,omitempty"`
+	ErrorType string `json:"error_type,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	Stage     string `json:"stage,omitempty"` // the check that decided it
+}
+
+// simulatedRouting is where a forwarded request would go
+type simulatedRouting struct {
+	upstreamRouting
+	// CanaryPercent is the chance the canary takes the request instead
+	CanaryPercent float64 `json:"canary_percent,omitempty"`
+	// PoolShares are the current traffic shares of the pool members the request
+	// may go to
+	PoolShares map[string]float64 `json:"pool_shares,omitempty"`
+	Timeout    string             `json:"timeout"`
+}
+
+type policySimulation struct {
+	Method      string               `json:"method"`
+	Path        string               `json:"path"`
+	Model       string               `json:"model,omitempty"`
+	KeyID       string               `json:"key_id,omitempty"`
+	Tenant      string               `json:"tenant,omitempty"`
+	Outcome     policyOutcome        `json:"outcome"`
+	Checks      []policyCheck        `json:"checks"`
+	Routing     *simulatedRouting    `json:"routing,omitempty"`
+	TraceLevel  string               `json:"trace_level,omitempty"`
+	Credential  *simulatedCredential `json:"credential,omitempty"`
+	SimulatedAt time.Time            `json:"simulated_at"`
+}
+
+// simulatedCredential is the client credential a simulation authenticated with
+type simulatedCredential struct {
+	Source string `json:"source"` // trace, or request when headers set it
+	Key    string `json:"key"`    // masked
+}
+
+// check records a stage. The first failing stage decides the outcome, but later
+// stages are still evaluated so one simulation shows every policy in the way.
+func (s *policySimulation) check(stage, result, detail string) {
+	s.Checks = append(s.Checks, policyCheck{Stage: stage, Result: result, Detail: detail})
+}
+
+func (s *policySimulation) fail(stage, action string, status int, errType, reason string) {
+	s.check(stage, "fail", reason)
+	if s.Outcome.Action == "" {
+		s.Outcome = policyOutcome{Action: action, Status: status, ErrorType: errType, Reason: reason, Stage: stage}
+	}
+}
+
+// decide sets an outcome that ends the simulation unless an earlier stage failed
+func (s *policySimulation) decide(stage, action, reason string) {
+	if s.Outcome.Action == "" {
+		s.Outcome = policyOutcome{Action: action, Status: http.StatusOK, Reason: reason, Stage: stage}
+	}
+}
+
+// simulatedHTTPRequest builds the request a simulation describes
+func simulatedHTTPRequest(sim policySimulationRequest, remoteAddr string) (*http.Request, []byte, error) {
+	method, path, header, body := sim.Method, sim.Path, http.Header{}, []byte(nil)
+	if sim.TraceID != "" {
+		trace, ok := findTrace(sim.TraceID)
+		if !ok {
+			return nil, nil, fmt.Errorf("no stored trace with id %q", sim.TraceID)
+		}
+		requestBody, _, err := traceBodies(trace)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read the request body of trace %s: %v", sim.TraceID, err)
+		}
+		if method == "" {
+			method = trace.Method
+		}
+		if path == "" {
+			path = traceRequestURI(trace)
+		}
+		header = trace.RequestHeader.Clone()
+		if header == nil {
+			header = http.Header{}
+		}
+		body = []byte(requestBody)
+	}
+	for name, value := range sim.Headers {
+		header.Set(name, value)
+	}
+	if len(sim.Body) > 0 {
+		var text string
+		if err := json.Unmarshal(sim.Body, &text); err == nil {
+			body = []byte(text)
+		} else {
+			body = sim.Body
+		}
+	}
+	if method == "" {
+		method = http.MethodPost
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, nil, fmt.Errorf("path %q must start with /", path)
+	}
+	r := httptest.NewRequest(method, path, bytes.NewReader(body))
+	r.Header = header
+	if header.Get("Content-Type") == "" && json.Valid(body) {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	r.RemoteAddr = remoteAddr
+	if sim.RemoteAddr != "" {
+		r.RemoteAddr = sim.RemoteAddr
+	}
+	return r, body, nil
+}
+
+// simulatePolicy walks r through the forwarder's admission, limit, rule and routing
+// stages in the forwarder's order, reading but never changing their state
+func simulatePolicy(r *http.Request, body []byte) policySimulation {
+	sim := policySimulation{Method: r.Method, Path: r.URL.Path, Model: bodyModel(body), SimulatedAt: time.Now()}
+	recorder := httptest.NewRecorder()
+
+	if !strings.HasPrefix(r.URL.Path, "/v1/") {
+		sim.fail("path", "reject", http.StatusNotFound, "", "only /v1/ endpoints are supported")
+		return sim
+	}
+
+	// Authentication and the caller's scopes
+	caller, rejected := verifyCredentials(r)
+	if rejected != nil {
+		sim.fail("auth", "reject", rejected.status, rejected.errType, rejected.message)
+		return sim
+	}
+	sim.KeyID = caller.KeyID
+	identity := newUserIdentity(caller.KeyID, caller.Key)
+	sim.Tenant = identity.Tenant
+	sim.check("auth", "pass", fmt.Sprintf("%s scheme, key %s", caller.Scheme, caller.KeyID))
+	if vk := caller.Key; vk != nil {
+		if !vk.Allows(r.URL.Path) {
+			sim.fail("scopes", "reject", http.StatusForbidden, "insufficient_scope", fmt.Sprintf("virtual key %q is not allowed to call %s", vk.Name, r.URL.Path))
+		} else if auth, err := vk.upstreamAuthorization(); err != nil {
+			sim.fail("scopes", "reject", http.StatusInternalServerError, "server_error", err.Error())
+		} else {
+			caller.upstreamAuth = auth
+			sim.check("scopes", "pass", fmt.Sprintf("virtual key %q allows %s", vk.Name, r.URL.Path))
+		}
+	} else if caller.authorize != nil {
+		if caller.Authorize(recorder, r) {
+			sim.check("scopes", "pass", "")
+		} else {
+			sim.fail("scopes", "reject", recorder.Code, "", strings.TrimSpace(recorder.Body.String()))
+		}
+	}
+
+	// Polled endpoints may be answered from the static cache before any limit, if
+	// their control headers pass the policy; the overrides check reports those that don't
+	if r.Method == http.MethodGet && lookupStaticCache(r).fresh() {
+		if overrides, _, err := parseRequestOverrides(r.Header.Clone()); err == nil && overrides.noCache {
+			sim.check("static_cache", "bypass", "X-Proxy-No-Cache skips the stored response")
+		} else if err == nil {
+			sim.check("static_cache", "match", "a fresh stored response would be served")
+			sim.decide("static_cache", "static_cache", "answered from the static endpoint cache without counting against limits")
+		}
+	}
+
+	// The proxy's own per-client rate limit, token budget and anomaly throttle
+	if requestRateLimiter == nil {
+		sim.check("rate_limit", "skip", "no -rate-limit-rpm")
+	} else if allowed, remaining, wait := requestRateLimiter.Peek(caller.KeyID); !allowed {
+		sim.fail("rate_limit", "reject", http.StatusTooManyRequests, "proxy_rate_limit_exceeded", fmt.Sprintf("no requests left; retry after %v", wait.Round(time.Second)))
+	} else {
+		sim.check("rate_limit", "pass", fmt.Sprintf("%d requests left after this one", remaining))
+	}
+	if requestTokenBudget == nil {
+		sim.check("token_budget", "skip", "no -token-budget")
+	} else if remaining := requestTokenBudget.Remaining(caller.KeyID); remaining <= 0 {
+		sim.fail("token_budget", "reject", http.StatusTooManyRequests, "proxy_budget_exceeded", fmt.Sprintf("daily token budget exhausted; resets in %v", untilBudgetReset().Round(time.Minute)))
+	} else {
+		sim.check("token_budget", "pass", fmt.Sprintf("%d of %d tokens left today", remaining, requestTokenBudget.limit))
+	}
+	if usageAnomalies == nil {
+		sim.check("anomaly_throttle", "skip", "no -anomaly-detection")
+	} else if wait := usageAnomalies.throttledFor(caller.KeyID); wait > 0 {
+		sim.fail("anomaly_throttle", "reject", http.StatusTooManyRequests, "proxy_key_throttled", fmt.Sprintf("key throttled for another %v", wait.Round(time.Second)))
+	} else {
+		sim.check("anomaly_throttle", "pass", "")
+	}
+
+	// Load shedding and backpressure as they stand right now
+	if loadShed.shedding() {
+		sim.fail("load_shed", "reject", http.StatusServiceUnavailable, "proxy_overloaded", "shedding under "+loadShed.snapshot().Reason+" pressure")
+	} else {
+		sim.check("load_shed", "pass", "")
+	}
+	if upstreamAdmission != nil {
+		status := upstreamAdmission.status("")
+		detail := fmt.Sprintf("%d of %d slots in flight, %d of %d queued", status.InFlight, status.MaxConcurrency, status.QueueDepth, status.MaxQueue)
+		if status.InFlight >= status.MaxConcurrency && status.QueueDepth >= status.MaxQueue {
+			sim.fail("backpressure", "reject", http.StatusServiceUnavailable, "proxy_overloaded", "queue full: "+detail)
+		} else {
+			sim.check("backpressure", "pass", detail)
+		}
+	}
+
+	// Requests the forwarder hands off before its own pipeline
+	switch {
+	case websocket.IsWebSocketUpgrade(r):
+		sim.decide("realtime", "realtime", "relayed as a realtime WebSocket session to "+upstreamURL.Host)
+	case *modelCatalogEnabled && r.Method == http.MethodGet && (r.URL.Path == "/v1/models" || strings.HasPrefix(r.URL.Path, "/v1/models/")):
+		sim.decide("model_catalog", "model_catalog", "answered from the model catalog")
+	case isTransparentRoute(r.URL.Path):
+		sim.decide("transparent", "transparent", "forwarded untouched to "+upstreamURL.Host)
+	}
+	faultsMu.RLock()
+	chaos := faults
+	faultsMu.RUnlock()
+	if chaos.Enabled && chaos.matches(r.URL.Path) {
+		sim.check("chaos", "match", fmt.Sprintf("chaos mode adds %dms latency, drops %.1f%% and fails %.1f%% of these requests", chaos.LatencyMs, chaos.DropPercent, chaos.ErrorPercent))
+	}
+
+	// Control headers
+	overrides, status, err := parseRequestOverrides(r.Header)
+	if err != nil {
+		errType := "invalid_request_error"
+		if status == http.StatusForbidden {
+			errType = "override_not_allowed"
+		}
+		sim.fail("overrides", "reject", status, errType, err.Error())
+		return sim
+	}
+	sim.check("overrides", "pass", "")
+	sim.TraceLevel = overrides.traceLevel
+
+	// The proxy's own rewrites, which the rules see; hooks are not run
+	body = injectUserField(r.URL.Path, body, identity)
+	body = resolveModelAlias(body)
+	if translated, changes := translateReasoningParams(r.URL.Path, body); len(changes) > 0 {
+		body = translated
+	}
+	body, _ = resizeEmbeddingRequest(r.URL.Path, body)
+	if forwarded := bodyModel(body); forwarded != sim.Model {
+		sim.Model = forwarded
+	}
+
+	routing := &simulatedRouting{upstreamRouting: upstreamRouting{Via: "default"}}
+	target := overrides.target(r.URL.Path, r.URL.RawQuery)
+	if overrides.upstream != nil {
+		routing.Via = "override"
+	} else if upstreamPool != nil {
+		routing.Via = "pool"
+		weights := upstreamPool.effectiveWeights()
+		total := 0.0
+		for _, weight := range weights {
+			total += weight
+		}
+		routing.PoolShares = make(map[string]float64)
+		for i, m := range upstreamPool.members {
+			if total > 0 {
+				routing.PoolShares[m.base.String()] = weights[i] / total
+			}
+		}
+		// The upstream shown is the member most likely to get the request
+		likeliest := 0
+		for i := range weights {
+			if weights[i] > weights[likeliest] {
+				likeliest = i
+			}
+		}
+		target = upstreamPool.members[likeliest].target(r.URL.Path, r.URL.RawQuery)
+	}
+	canaryPossible := overrides.upstream == nil && upstreamCanary.matches(r.URL.Path)
+	if canaryPossible {
+		if percent := upstreamCanary.status().Percent; percent > 0 {
+			routing.CanaryPercent = percent
+		}
+	}
+
+	// Guardrail, routing and trace rules
+	var quarantineReasons []string
+	if requestRules == nil {
+		sim.check("rules", "skip", "no -rules-file")
+	} else {
+		decision := requestRules.evaluate(newRuleEnv(r, identity, body), false)
+		switch rule := decision.guardrail; {
+		case rule == nil:
+			sim.check("guardrails", "pass", "")
+		case rule.Action == "block":
+			message := rule.Message
+			if message == "" {
+				message = "This request was blocked by the proxy's guardrail " + rule.Name
+			}
+			sim.check("guardrails", "fail", "guardrail "+rule.Name+" blocks the request")
+			if sim.Outcome.Action == "" {
+				sim.Outcome = policyOutcome{Action: "block", Status: http.StatusForbidden, ErrorType: "request_blocked", Reason: message, Stage: "guardrails"}
+			}
+		default:
+			sim.check("guardrails", "match", "guardrail "+rule.Name+" quarantines the request")
+			quarantineReasons = append(quarantineReasons, "rule: "+rule.Name)
+		}
+		if decision.traceLevel != "" {
+			sim.TraceLevel = decision.traceLevel
+		}
+		if route := decision.route; route == nil {
+			sim.check("routes", "pass", "no routing rule matches")
+		} else if overrides.upstream != nil {
+			sim.check("routes", "match", "routing rule "+route.Name+" matches, but X-Proxy-Upstream takes precedence")
+		} else {
+			sim.check("routes", "match", "routing rule "+route.Name+" sends the request to "+route.target.Host)
+			target = route.targetFor(r.URL.Path, r.URL.RawQuery)
+			routing.Via, routing.Rule, routing.PoolShares = "rule", route.Name, nil
+		}
+	}
+	if routing.CanaryPercent > 0 {
+		detail := fmt.Sprintf("the canary %s takes %.1f%% of these requests", upstreamCanary.base.Host, routing.CanaryPercent)
+		if routing.Via == "rule" {
+			detail += ", ahead of the routing rule"
+		}
+		sim.check("canary", "match", detail)
+	}
+
+	// Quarantine policy
+	if requestQuarantine != nil {
+		quarantineReasons = append(quarantineReasons, requestQuarantine.policy.check(body, r.Header)...)
+	}
+	if len(quarantineReasons) > 0 {
+		sim.check("quarantine", "fail", strings.Join(quarantineReasons, "; "))
+		if sim.Outcome.Action == "" {
+			sim.Outcome = policyOutcome{Action: "quarantine", Status: http.StatusForbidden, ErrorType: "request_quarantined", Reason: strings.Join(quarantineReasons, "; "), Stage: "quarantine"}
+		}
+	} else if requestQuarantine != nil {
+		sim.check("quarantine", "pass", "")
+	}
+	r.Header.Del(quarantineHeader)
+
+	// Response caches
+	if cache, key := cacheForRequest(r, body); cache != nil && !overrides.noCache {
+		if _, ok := cache.Peek(key); ok {
+			sim.check("cache", "match", "a cached response would be served")
+			sim.decide("cache", "cache_hit", "answered from the response cache")
+		} else {
+			sim.check("cache", "pass", "no cached response; the answer would be stored")
+		}
+	}
+	if key := negativeCacheKey(r, body, overrides); key != "" {
+		if entry, ok := negativeCache.Peek(key); ok {
+			sim.check("negative_cache", "match", "the same request was rejected with "+entry.Status)
+			sim.decide("negative_cache", "cache_hit", "answered with the remembered "+entry.Status)
+		}
+	}
+
+	routing.send(target, caller.upstreamHeader(r.Header))
+	timeout, _ := modelTimeout(sim.Model)
+	if deadline := upstreamDeadline(sim.Model, overrides.timeout); deadline > 0 {
+		timeout = deadline
+	}
+	routing.Timeout = timeout.String()
+	sim.Routing = routing
+	if sim.Outcome.Action == "" {
+		sim.Outcome = policyOutcome{Action: "forward", Reason: "forwarded to " + routing.Upstream + " via " + routing.Via}
+	}
+	return sim
+}
+
+// handlePolicySimulate serves POST /policy/simulate, reporting which limits, budgets,
+// guardrails and routing rules would apply to a request and what the forwarder would
+// do with it, without forwarding it
+func handlePolicySimulate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "invalid_request_error", "use POST")
+		return
+	}
+	var request policySimulationRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid simulation: "+err.Error())
+		return
+	}
+	if request.TraceID == "" && request.Path == "" {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "give a path or a trace_id")
+		return
+	}
+	simulated, body, err := simulatedHTTPRequest(request, r.RemoteAddr)
+	if err != nil {
+		status := http.StatusBadRequest
+		if request.TraceID != "" && strings.HasPrefix(err.Error(), "no stored trace") {
+			status = http.StatusNotFound
+		}
+		writeJSONError(w, status, "invalid_request_error", err.Error())
+		return
+	}
+	credential := simulationCredential(request, simulated.Header)
+	sim := simulatePolicy(simulated, body)
+	sim.Credential = credential
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sim)
+}
+
+// simulationCredential reports which credential a simulated request carries: the
+// one stored in its trace, unless the simulation's headers replace it
+func simulationCredential(sim policySimulationRequest, header http.Header) *simulatedCredential {
+	key := maskedAPIKey(header)
+	if key == "" {
+		return nil
+	}
+	for name := range sim.Headers {
+		switch http.CanonicalHeaderKey(name) {
+		case "Authorization", "Api-Key":
+			return &simulatedCredential{Source: "request", Key: key}
+		}
+	}
+	if sim.TraceID != "" {
+		return &simulatedCredential{Source: "trace", Key: key}
+	}
+	return &simulatedCredential{Source: "request", Key: key}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// modelPrice is the USD price per million tokens of a model
+type modelPrice struct {
+	Input       float64 `json:"input"`
+	CachedInput float64 `json:"cached_input,omitempty"` // 0 means cached tokens cost the input price
+	Output      float64 `json:"output"`
+}
+
+// modelPrices are list prices for common models, keyed by model name prefix so dated
+// snapshots such as gpt-4o-2024-08-06 match. -pricing-file overrides and extends them.
+var modelPrices = map[string]modelPrice{
+	"gpt-4o":                 {Input: 2.50, CachedInput: 1.25, Output: 10.00},
+	"gpt-4o-mini":            {Input: 0.15, CachedInput: 0.075, Output: 0.60},
+	"gpt-4.1":                {Input: 2.00, CachedInput: 0.50, Output: 8.00},
+	"gpt-4.1-mini":           {Input: 0.40, CachedInput: 0.10, Output: 1.60},
+	"gpt-4.1-nano":           {Input: 0.10, CachedInput: 0.025, Output: 0.40},
+	"gpt-4-turbo":            {Input: 10.00, Output: 30.00},
+	"gpt-4":                  {Input: 30.00, Output: 60.00},
+	"gpt-3.5-turbo":          {Input: 0.50, Output: 1.50},
+	"o1":                     {Input: 15.00, CachedInput: 7.50, Output: 60.00},
+	"o1-mini":                {Input: 1.10, CachedInput: 0.55, Output: 4.40},
+	"o3":                     {Input: 2.00, CachedInput: 0.50, Output: 8.00},
+	"o3-mini":                {Input: 1.10, CachedInput: 0.55, Output: 4.40},
+	"o4-mini":                {Input: 1.10, CachedInput: 0.275, Output: 4.40},
+	"text-embedding-3-small": {Input: 0.02},
+	"text-embedding-3-large": {Input: 0.13},
+	"text-embedding-ada-002": {Input: 0.10},
+}
+
+// loadPricingFile merges a JSON object of model prefixes to prices into modelPrices
+func loadPricingFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read pricing file %s: %v", path, err)
+	}
+	prices := map[string]modelPrice{}
+	if err := json.Unmarshal(data, &prices); err != nil {
+		return fmt.Errorf("failed to parse pricing file %s: %v", path, err)
+	}
+	for model, price := range prices {
+		modelPrices[model] = price
+	}
+	return nil
+}
+
+// priceForModel finds the price of the longest model prefix matching model
+func priceForModel(model string) (modelPrice, bool) {
+	var best string
+	for prefix := range modelPrices {
+		if strings.HasPrefix(model, prefix) && len(prefix) > len(best) {
+			best = prefix
+		}
+	}
+	if best == "" {
+		return modelPrice{}, false
+	}
+	return modelPrices[best], true
+}
+
+// estimateCost returns the USD cost of usage at the model's list price
+func estimateCost(model string, usage tokenUsage) (float64, bool) {
+	price, ok := priceForModel(model)
+	if !ok {
+		return 0, false
+	}
+	cached := usage.PromptTokensDetails.CachedTokens
+	cachedPrice := price.CachedInput
+	if cachedPrice == 0 {
+		cachedPrice = price.Input
+	}
+	cost := float64(usage.PromptTokens-cached)*price.Input + float64(cached)*cachedPrice + float64(usage.CompletionTokens)*price.Output
+	return cost / 1e6, true
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// quarantineHeader lets request hooks flag a request for quarantine, with the
+// header value as the reason. It is never forwarded upstream.
+const quarantineHeader = "X-Proxy-Quarantine"
+
+// injectionPatterns match common prompt injection phrasings
+var injectionPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\b(ignore|disregard|forget)\b.{0,20}\b(all|any|the|your)?\s*(previous|prior|above|earlier|system)\s+(instructions|prompts?|rules|messages)`),
+	regexp.MustCompile(`(?i)\b(reveal|print|show|repeat)\b.{0,20}\b(your|the)\s+(system|hidden|initial)\s+(prompt|instructions)`),
+	regexp.MustCompile(`(?i)\byou are now\b.{0,40}\b(DAN|jailbroken|unrestricted|developer mode)\b`),
+	regexp.MustCompile(`(?i)\b(enable|enter|activate)\s+(developer|god|jailbreak)\s+mode\b`),
+}
+
+// quarantinePolicy decides which requests are held instead of forwarded
+type quarantinePolicy struct {
+	maxBodyBytes    int
+	blockedModels   map[string]bool
+	detectInjection bool
+}
+
+// quarantinedRequest is a flagged request waiting for review
+type quarantinedRequest struct {
+	Id        string      `json:"id"`
+	Timestamp time.Time   `json:"timestamp"`
+	Reasons   []string    `json:"reasons"`
+	KeyID     string      `json:"key_id"`
+	Method    string      `json:"method"`
+	URL       string      `json:"url"`
+	Header    http.Header `json:"request_headers,omitempty"`
+	Body      string      `json:"request_body,omitempty"`
+	// upstreamAuth is the upstream credential the request is released with, kept
+	// off Header so reviewers only see the client's
+	upstreamAuth string
+}
+
+// quarantineStore holds the most recent flagged requests in memory
+type quarantineStore struct {
+	policy quarantinePolicy
+	max    int
+
+	mu      sync.Mutex
+	entries []*quarantinedRequest
+}
+
+// requestQuarantine is nil unless a quarantine policy is configured
+var requestQuarantine *quarantineStore
+
+func newQuarantineStore(policy quarantinePolicy, max int) *quarantineStore {
+	return &quarantineStore{policy: policy, max: max}
+}
+
+// promptTexts collects the user-controlled text of a request body
+func promptTexts(body []byte) []string {
+	var texts []string
+	var collect func(value interface{})
+	collect = func(value interface{}) {
+		switch v := value.(type) {
+		case string:
+			texts = append(texts, v)
+		case []interface{}:
+			for _, item := range v {
+				collect(item)
+			}
+		case map[string]interface{}:
+			for _, item := range v {
+				collect(item)
+			}
+		}
+	}
+	var request map[string]interface{}
+	if json.Unmarshal(body, &request) != nil {
+		return nil
+	}
+	for _, field := range []string{"messages", "prompt", "input", "instructions"} {
+		collect(request[field])
+	}
+	return texts
+}
+
+// check returns the reasons body should be quarantined, or none
+func (p *quarantinePolicy) check(body []byte, header http.Header) []string {
+	var reasons []string
+	if reason := header.Get(quarantineHeader); reason != "" {
+		reasons = append(reasons, "hook: "+reason)
+	}
+	if p.maxBodyBytes > 0 && len(body) > p.maxBodyBytes {
+		reasons = append(reasons, fmt.Sprintf("oversized: %d bytes exceeds %d", len(body), p.maxBodyBytes))
+	}
+	if len(p.blockedModels) > 0 {
+		if model := bodyModel(body); p.blockedModels[model] {
+			reasons = append(reasons, "blocked_model: "+model)
+		}
+	}
+	if p.detectInjection {
+	texts:
+		for _, text := range promptTexts(body) {
+			for _, pattern := range injectionPatterns {
+				if match := pattern.FindString(text); match != "" {
+					reasons = append(reasons, fmt.Sprintf("injection: %q", match))
+					break texts
+				}
+			}
+		}
+	}
+	return reasons
+}
+
+// Hold stores a flagged request and returns its quarantine entry
+func (q *quarantineStore) Hold(id string, caller *principal, method, url string, header http.Header, body []byte, reasons []string) *quarantinedRequest {
+	entry := &quarantinedRequest{
+		Id:           id,
+		Timestamp:    time.Now(),
+		Reasons:      reasons,
+		KeyID:        caller.KeyID,
+		Method:       method,
+		URL:          url,
+		Header:       header,
+		Body:         string(body),
+		upstreamAuth: caller.upstreamAuth,
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.entries = append(q.entries, entry)
+	if len(q.entries) > q.max {
+		q.entries = q.entries[len(q.entries)-q.max:]
+	}
+	for _, reason := range reasons {
+		kind := strings.SplitN(reason, ":", 2)[0]
+		metrics.Add("openai_proxy_quarantined_requests_total", "Requests held in quarantine instead of forwarded.", map[string]string{"reason": kind}, 1)
+	}
+	return entry
+}
+
+// List returns the held requests, oldest first
+func (q *quarantineStore) List() []*quarantinedRequest {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]*quarantinedRequest{}, q.entries...)
+}
+
+// Get returns the held request with the given ID
+func (q *quarantineStore) Get(id string) (*quarantinedRequest, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, entry := range q.entries {
+		if entry.Id == id {
+			return entry, true
+		}
+	}
+	return nil, false
+}
+
+// Remove takes a held request out of quarantine, reporting whether it was there
+func (q *quarantineStore) Remove(id string) (*quarantinedRequest, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, entry := range q.entries {
+		if entry.Id == id {
+			q.entries = append(q.entries[:i], q.entries[i+1:]...)
+			return entry, true
+		}
+	}
+	return nil, false
+}
+
+// quarantineRequest holds the request if the policy flags it, replying to the
+// client with a 403. It returns true if the request must not be forwarded.
+func quarantineRequest(w http.ResponseWriter, traceID string, caller *principal, method, url string, header http.Header, body []byte, ruleReasons ...string) bool {
+	if requestQuarantine == nil {
+		return false
+	}
+	reasons := append(ruleReasons, requestQuarantine.policy.check(body, header)...)
+	header.Del(quarantineHeader)
+	if len(reasons) == 0 {
+		return false
+	}
+
+	requestQuarantine.Hold(traceID, caller, method, url, header, body, reasons)
+	log.Printf("🛑 Quarantined request %s from %s: %s", traceID, caller.KeyID, strings.Join(reasons, "; "))
+	w.Header().Set("X-Proxy-Quarantine-Id", traceID)
+	writeJSONError(w, http.StatusForbidden, "request_quarantined", "This request was held for review and not forwarded")
+	return true
+}
+
+// handleQuarantine serves the quarantine review API:
+//
+//	GET  /quarantine               list held requests
+//	GET  /quarantine/<id>          one held request
+//	POST /quarantine/<id>/release  forward it upstream and return the upstream response
+//	POST /quarantine/<id>/discard  drop it (DELETE /quarantine/<id> also works)
+func handleQuarantine(w http.ResponseWriter, r *http.Request) {
+	if requestQuarantine == nil {
+		writeJSONError(w, http.StatusNotFound, "not_found", "quarantine is not enabled")
+		return
+	}
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/quarantine"), "/")
+	if rest == "" {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "invalid_request_error", "use GET to list quarantined requests")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(requestQuarantine.List())
+		return
+	}
+
+	id, action, _ := strings.Cut(rest, "/")
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		entry, ok := requestQuarantine.Get(id)
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("no quarantined request with id %q", id))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entry)
+	case (action == "discard" && r.Method == http.MethodPost) || (action == "" && r.Method == http.MethodDelete):
+		if _, ok := requestQuarantine.Remove(id); !ok {
+			writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("no quarantined request with id %q", id))
+			return
+		}
+		log.Printf("🗑️ Discarded quarantined request %s", id)
+		w.WriteHeader(http.StatusNoContent)
+	case action == "release" && r.Method == http.MethodPost:
+		releaseQuarantined(w, id)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "invalid_request_error", "unsupported quarantine operation")
+	}
+}
+
+// releaseQuarantined forwards a held request and relays the upstream response to
+// the reviewer. The original client has already been answered, so this only
+// produces the upstream side effects and a trace.
+func releaseQuarantined(w http.ResponseWriter, id string) {
+	entry, ok := requestQuarantine.Remove(id)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("no quarantined request with id %q", id))
+		return
+	}
+	log.Printf("✅ Releasing quarantined request %s", id)
+
+	header := entry.Header.Clone()
+	if entry.upstreamAuth != "" {
+		header.Set("Authorization", entry.upstreamAuth)
+	}
+	routing := &upstreamRouting{Via: "quarantine"}
+	if target, err := url.Parse(entry.URL); err == nil {
+		routing.send(target, header)
+	}
+	started := time.Now()
+	resp, respBody, err := forwardUpstream(entry.Method, entry.URL, header, []byte(entry.Body))
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, "upstream_error", err.Error())
+		return
+	}
+	recordTrace(Trace{
+		Id:            generateTraceID(),
+		Timestamp:     time.Now(),
+		Method:        entry.Method,
+		URL:           entry.URL,
+		Status:        resp.Status,
+		Latency:       time.Since(started).Seconds(),
+		RequestHeader: entry.Header,
+		RequestBody:   entry.Body,
+		ResponseBody:  string(respBody),
+		Quarantine:    entry.Id,
+		Routing:       routing,
+	})
+
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	w.Write(respBody)
+}
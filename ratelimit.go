@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clientKeyID identifies the caller for per-client limits: the name of its virtual
+// key, a hash of the bearer token, so raw keys never end up in memory maps or logs,
+// or the client IP if none
+func clientKeyID(r *http.Request) string {
+	if vk, ok := lookupVirtualKey(r); ok {
+		return "vkey-" + vk.Name
+	}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		sum := sha256.Sum256([]byte(strings.TrimPrefix(auth, "Bearer ")))
+		return "key-" + hex.EncodeToString(sum[:8])
+	}
+	if id := clientCertID(r); id != "" {
+		return id
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip-" + host
+}
+
+// writeJSONError replies with an error body in the shape OpenAI clients expect
+func writeJSONError(w http.ResponseWriter, status int, errType, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": message,
+			"type":    errType,
+		},
+	})
+}
+
+// tokenBucket is the state of one client's request allowance
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter enforces a per-client requests-per-minute limit with token buckets
+type rateLimiter struct {
+	mu      sync.Mutex
+	perSec  float64
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(requestsPerMinute int) *rateLimiter {
+	return &rateLimiter{
+		perSec:  float64(requestsPerMinute) / 60,
+		burst:   float64(requestsPerMinute),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow takes one request from key's bucket. It returns whether the request may
+// proceed, the requests left, and how long to wait for the next one when refused.
+func (rl *rateLimiter) Allow(key string) (bool, int, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	bucket, ok := rl.buckets[key]
+	if !ok {
+		if len(rl.buckets) > 10000 {
+			rl.prune(now)
+		}
+		bucket = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(rl.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*rl.perSec)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / rl.perSec * float64(time.Second))
+		return false, 0, wait
+	}
+	bucket.tokens--
+	return true, int(bucket.tokens), 0
+}
+
+// Peek reports what Allow would return for key without taking a request
+func (rl *rateLimiter) Peek(key string) (bool, int, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	tokens := rl.burst
+	if bucket, ok := rl.buckets[key]; ok {
+		tokens = math.Min(rl.burst, bucket.tokens+time.Since(bucket.last).Seconds()*rl.perSec)
+	}
+	if tokens < 1 {
+		return false, 0, time.Duration((1 - tokens) / rl.perSec * float64(time.Second))
+	}
+	return true, int(tokens - 1), 0
+}
+
+// prune drops buckets that have refilled completely, which behave like new ones
+func (rl *rateLimiter) prune(now time.Time) {
+	for key, bucket := range rl.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*rl.perSec >= rl.burst {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// tokenBudget caps the tokens each client may consume per UTC day. Usage is kept in
+// usageStore, so a persistent backend carries it across restarts.
+type tokenBudget struct {
+	limit int64
+}
+
+func newTokenBudget(limit int64) *tokenBudget {
+	return &tokenBudget{limit: limit}
+}
+
+func budgetDay() string {
+	return time.Now().UTC().Format("2006-01-02")
+}
+
+// Remaining returns the tokens key may still use today. Storage errors fail open.
+func (b *tokenBudget) Remaining(key string) int64 {
+	used, err := usageStore.Used(key, budgetDay())
+	if err != nil {
+		log.Printf("❌ Failed to read token usage for %s: %v", key, err)
+		return b.limit
+	}
+	return max(b.limit-used, 0)
+}
+
+// Consume records tokens used by key and returns what is left
+func (b *tokenBudget) Consume(key string, tokens int) int64 {
+	used, err := usageStore.Add(key, budgetDay(), int64(tokens))
+	if err != nil {
+		log.Printf("❌ Failed to record token usage for %s: %v", key, err)
+		return b.limit
+	}
+	return max(b.limit-used, 0)
+}
+
+// untilBudgetReset returns the time left until budgets reset at UTC midnight
+func untilBudgetReset() time.Duration {
+	now := time.Now().UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	return midnight.Sub(now)
+}
+
+var requestRateLimiter *rateLimiter
+var requestTokenBudget *tokenBudget
+
+// isRateLimitHeader reports whether an upstream header carries OpenAI rate limit state
+func isRateLimitHeader(name string) bool {
+	return strings.HasPrefix(strings.ToLower(name), "x-ratelimit-")
+}
+
+// forwardRateLimitHeaders copies the upstream x-ratelimit-* headers to the client,
+// restoring any that a response hook dropped
+func forwardRateLimitHeaders(dst, upstream http.Header) {
+	for name, values := range upstream {
+		if isRateLimitHeader(name) && len(dst.Values(name)) == 0 {
+			for _, value := range values {
+				dst.Add(name, value)
+			}
+		}
+	}
+}
+
+// checkClientLimits applies the proxy's own rate limit and token budget. It sets
+// the X-Proxy-* headers and returns false after replying with 429 when a limit is hit.
+func checkClientLimits(w http.ResponseWriter, keyID string) bool {
+	if requestRateLimiter != nil {
+		allowed, remaining, wait := requestRateLimiter.Allow(keyID)
+		w.Header().Set("X-Proxy-RateLimit-Remaining", strconv.Itoa(remaining))
+		if !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeJSONError(w, http.StatusTooManyRequests, "proxy_rate_limit_exceeded", "Proxy rate limit exceeded, retry after the time given in Retry-After")
+			return false
+		}
+	}
+	if requestTokenBudget != nil {
+		remaining := requestTokenBudget.Remaining(keyID)
+		w.Header().Set("X-Proxy-Budget-Remaining", strconv.FormatInt(remaining, 10))
+		if remaining <= 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(untilBudgetReset().Seconds()))))
+			writeJSONError(w, http.StatusTooManyRequests, "proxy_budget_exceeded", "Daily token budget exhausted")
+			return false
+		}
+	}
+	return true
+}
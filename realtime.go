@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TranscriptEntry is a single piece of text captured from a realtime session
+type TranscriptEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Role      string    `json:"role"`   // "user" or "assistant"
+	Source    string    `json:"source"` // "text" or "audio" (transcribed audio)
+	ItemId    string    `json:"item_id,omitempty"`
+	Text      string    `json:"text"`
+}
+
+// realtimeEvent holds the fields of realtime API events we care about for transcripts
+type realtimeEvent struct {
+	Type       string `json:"type"`
+	ItemId     string `json:"item_id"`
+	Transcript string `json:"transcript"`
+	Text       string `json:"text"`
+	Item       struct {
+		Id      string `json:"id"`
+		Role    string `json:"role"`
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+	} `json:"item"`
+}
+
+// realtimeSession collects the transcript of a relayed realtime session
+type realtimeSession struct {
+	mu           sync.Mutex
+	transcript   []TranscriptEntry
+	clientFrames int
+	serverFrames int
+}
+
+func (s *realtimeSession) add(role, source, itemId, text string) {
+	if text == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.transcript = append(s.transcript, TranscriptEntry{
+		Timestamp: time.Now(),
+		Role:      role,
+		Source:    source,
+		ItemId:    itemId,
+		Text:      text,
+	})
+}
+
+// inspectClientEvent extracts text the client sends into the conversation
+func (s *realtimeSession) inspectClientEvent(data []byte) {
+	var event realtimeEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return
+	}
+	if event.Type != "conversation.item.create" {
+		return
+	}
+	role := event.Item.Role
+	if role == "" {
+		role = "user"
+	}
+	for _, part := range event.Item.Content {
+		if part.Type == "input_text" || part.Type == "text" {
+			s.add(role, "text", event.Item.Id, part.Text)
+		}
+	}
+}
+
+// inspectServerEvent extracts transcripts and text produced by the upstream
+func (s *realtimeSession) inspectServerEvent(data []byte) {
+	var event realtimeEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return
+	}
+	switch event.Type {
+	case "conversation.item.input_audio_transcription.completed":
+		s.add("user", "audio", event.ItemId, event.Transcript)
+	case "response.audio_transcript.done", "response.output_audio_transcript.done":
+		s.add("assistant", "audio", event.ItemId, event.Transcript)
+	case "response.text.done", "response.output_text.done":
+		s.add("assistant", "text", event.ItemId, event.Text)
+	}
+}
+
+// realtimeForwardHeaders lists client headers passed through to the upstream WebSocket
+var realtimeForwardHeaders = []string{"Authorization", "OpenAI-Beta", "OpenAI-Organization", "OpenAI-Project", "User-Agent"}
+
+// handleRealtime relays a realtime WebSocket session to the upstream, passing every
+// frame through untouched while recording text transcripts in the trace store
+func handleRealtime(w http.ResponseWriter, r *http.Request, caller *principal) {
+	startTime := time.Now()
+	targetURL := upstreamTarget(r.URL.Path, r.URL.RawQuery)
+	if targetURL.Scheme == "https" {
+		targetURL.Scheme = "wss"
+	} else {
+		targetURL.Scheme = "ws"
+	}
+	log.Printf("\n🎙️ === [REALTIME SESSION] ===")
+	log.Printf("🎯 Target URL: %s", targetURL.String())
+
+	upstreamHeader := make(http.Header)
+	for _, name := range realtimeForwardHeaders {
+		if value := r.Header.Get(name); value != "" {
+			upstreamHeader.Set(name, value)
+		}
+	}
+	caller.setUpstreamCredentials(upstreamHeader)
+
+	routing := &upstreamRouting{Via: "default"}
+	routing.send(targetURL, upstreamHeader)
+	dialer := websocket.Dialer{
+		HandshakeTimeout: 30 * time.Second,
+		Subprotocols:     websocket.Subprotocols(r),
+		TLSClientConfig:  pinRealtimeDial(targetURL.Host, upstreamHeader),
+	}
+	upstream, resp, err := dialer.DialContext(r.Context(), targetURL.String(), upstreamHeader)
+	if err != nil {
+		log.Printf("❌ Realtime upstream dial failed: %v", err)
+		status := http.StatusBadGateway
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		http.Error(w, "Failed to connect to upstream realtime API", status)
+		return
+	}
+	defer upstream.Close()
+
+	// Answer the client with the subprotocol the upstream selected
+	responseHeader := make(http.Header)
+	if protocol := upstream.Subprotocol(); protocol != "" {
+		responseHeader.Set("Sec-WebSocket-Protocol", protocol)
+	}
+	client, err := upgrader.Upgrade(w, r, responseHeader)
+	if err != nil {
+		log.Printf("❌ Realtime client upgrade failed: %v", err)
+		return
+	}
+	defer client.Close()
+
+	session := &realtimeSession{}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		relayFrames(client, upstream, func(data []byte) {
+			session.clientFrames++
+			session.inspectClientEvent(data)
+		})
+	}()
+	go func() {
+		defer wg.Done()
+		relayFrames(upstream, client, func(data []byte) {
+			session.serverFrames++
+			session.inspectServerEvent(data)
+		})
+	}()
+	wg.Wait()
+
+	latency := time.Since(startTime).Seconds()
+	log.Printf("🎙️ Realtime session closed after %.3fs (%d client frames, %d server frames, %d transcript entries)",
+		latency, session.clientFrames, session.serverFrames, len(session.transcript))
+
+	recordTrace(Trace{
+		Id:            generateTraceID(),
+		Timestamp:     time.Now(),
+		Method:        r.Method,
+		URL:           targetURL.String(),
+		Status:        resp.Status,
+		Latency:       latency,
+		RequestHeader: r.Header,
+		ResponseBody:  fmt.Sprintf("[REALTIME SESSION - %d client frames, %d server frames]", session.clientFrames, session.serverFrames),
+		Transcript:    session.transcript,
+		Routing:       routing,
+	})
+}
+
+// relayFrames copies messages from src to dst until either side fails. Text frames
+// are handed to inspect before being forwarded; binary frames are forwarded as-is.
+func relayFrames(src, dst *websocket.Conn, inspect func(data []byte)) {
+	for {
+		messageType, data, err := src.ReadMessage()
+		if err != nil {
+			// Propagate the close to the other side so both relays unwind
+			closeCode := websocket.CloseNormalClosure
+			closeText := ""
+			if closeErr, ok := err.(*websocket.CloseError); ok {
+				closeCode = closeErr.Code
+				closeText = closeErr.Text
+			}
+			switch closeCode {
+			case websocket.CloseNoStatusReceived, websocket.CloseAbnormalClosure, websocket.CloseTLSHandshake:
+				// These codes are reserved and must not be sent on the wire
+				closeCode = websocket.CloseNormalClosure
+			}
+			dst.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, closeText), time.Now().Add(time.Second))
+			dst.Close()
+			return
+		}
+		if messageType == websocket.TextMessage {
+			inspect(data)
+		}
+		if err := dst.WriteMessage(messageType, data); err != nil {
+			log.Printf("❌ Realtime relay write error: %v", err)
+			src.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+)
+
+// reasoningModels are the model prefixes treated as reasoning models; empty disables
+// parameter translation
+var reasoningModels []string
+
+// reasoningUnsupportedParams are sampling parameters reasoning models reject
+var reasoningUnsupportedParams = []string{"temperature", "top_p", "presence_penalty", "frequency_penalty", "logprobs", "top_logprobs", "logit_bias"}
+
+// parseReasoningModels reads -reasoning-models
+func parseReasoningModels(spec string) []string {
+	var prefixes []string
+	for _, prefix := range strings.Split(spec, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// isReasoningModel reports whether model starts with one of -reasoning-models
+func isReasoningModel(model string) bool {
+	for _, prefix := range reasoningModels {
+		if strings.HasPrefix(model, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// translateReasoningParams rewrites a chat completion request for a reasoning model:
+// max_tokens becomes max_completion_tokens and unsupported sampling parameters are
+// dropped. It returns the body and a description of each change.
+func translateReasoningParams(path string, body []byte) ([]byte, []string) {
+	if len(reasoningModels) == 0 || path != "/v1/chat/completions" || !isReasoningModel(bodyModel(body)) {
+		return body, nil
+	}
+	doc, err := parseJSONDocument(body)
+	if err != nil {
+		return body, nil
+	}
+	object, ok := doc.root.(map[string]interface{})
+	if !ok {
+		return body, nil
+	}
+	var changes []string
+	if maxTokens, ok := object["max_tokens"]; ok {
+		if _, set := object["max_completion_tokens"]; !set {
+			object["max_completion_tokens"] = maxTokens
+			changes = append(changes, "max_tokens->max_completion_tokens")
+		} else {
+			changes = append(changes, "-max_tokens")
+		}
+		delete(object, "max_tokens")
+	}
+	for _, param := range reasoningUnsupportedParams {
+		if _, ok := object[param]; ok {
+			delete(object, param)
+			changes = append(changes, "-"+param)
+		}
+	}
+	if len(changes) == 0 {
+		return body, nil
+	}
+	encoded, err := doc.encode()
+	if err != nil {
+		return body, nil
+	}
+	for _, change := range changes {
+		metrics.Add("openai_proxy_reasoning_param_translations_total", "Request parameters rewritten or dropped for reasoning models.", map[string]string{"change": change}, 1)
+	}
+	return encoded, changes
+}
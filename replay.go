@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultReplayIgnore lists response fields that differ on every call
+var defaultReplayIgnore = []string{"$.id", "$.created", "$.system_fingerprint"}
+
+// forwardUpstream sends a request to the upstream without hooks or caching and
+// returns the response with its body read and decompressed
+func forwardUpstream(method, target string, header http.Header, body []byte) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	for name, values := range header {
+		if name == "Content-Length" {
+			continue
+		}
+		req.Header[name] = append([]string(nil), values...)
+	}
+	req.Header.Set("Accept-Encoding", upstreamAcceptEncoding())
+
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to forward request: %v", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read response: %v", err)
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" {
+		if decompressed, err := decompressBody(respBody, encoding); err == nil {
+			respBody = decompressed
+			resp.Header.Del("Content-Encoding")
+		}
+	}
+	return resp, respBody, nil
+}
+
+// traceRequestURI returns the proxy path and query of a traced request. Traces
+// record the upstream URL, which may carry a base path before /v1/.
+func traceRequestURI(trace Trace) string {
+	target, err := url.Parse(trace.URL)
+	if err != nil {
+		return ""
+	}
+	path := target.Path
+	if i := strings.Index(path, "/v1/"); i > 0 {
+		path = path[i:]
+	}
+	if target.RawQuery != "" {
+		path += "?" + target.RawQuery
+	}
+	return path
+}
+
+// replayHeader authorizes the client credential a trace recorded again and returns
+// the header to replay it upstream with
+func replayHeader(trace Trace) (http.Header, error) {
+	r := httptest.NewRequest(trace.Method, traceRequestURI(trace), nil)
+	r.Header = trace.RequestHeader.Clone()
+	if r.Header == nil {
+		r.Header = http.Header{}
+	}
+	caller, rejected := verifyCredentials(r)
+	if rejected != nil {
+		return nil, fmt.Errorf("the trace's credentials are not accepted: %s", rejected.message)
+	}
+	recorder := httptest.NewRecorder()
+	if !caller.Authorize(recorder, r) {
+		return nil, fmt.Errorf("the trace's credentials are not authorized: %s", strings.TrimSpace(recorder.Body.String()))
+	}
+	return caller.upstreamHeader(r.Header), nil
+}
+
+// jsonDifference is one field that differs between the original and replayed response
+type jsonDifference struct {
+	Path     string      `json:"path"`
+	Kind     string      `json:"kind"` // added, removed or changed
+	Original interface{} `json:"original,omitempty"`
+	Replay   interface{} `json:"replay,omitempty"`
+}
+
+func formatPath(segments []pathSegment) string {
+	var b strings.Builder
+	b.WriteString("$")
+	for _, segment := range segments {
+		b.WriteString(segment.String())
+	}
+	return b.String()
+}
+
+// diffJSON appends the differences between a and b below path, skipping ignored paths
+func diffJSON(path []pathSegment, a, b interface{}, ignore map[string]bool, out *[]jsonDifference) {
+	formatted := formatPath(path)
+	if ignore[formatted] {
+		return
+	}
+	report := func(difference jsonDifference) {
+		if !ignore[difference.Path] {
+			*out = append(*out, difference)
+		}
+	}
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make(map[string]bool)
+		for key := range av {
+			keys[key] = true
+		}
+		for key := range bv {
+			keys[key] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for key := range keys {
+			sorted = append(sorted, key)
+		}
+		sort.Strings(sorted)
+		for _, key := range sorted {
+			child := append(path[:len(path):len(path)], pathSegment{key: key})
+			aChild, inA := av[key]
+			bChild, inB := bv[key]
+			switch {
+			case !inA:
+				report(jsonDifference{Path: formatPath(child), Kind: "added", Replay: bChild})
+			case !inB:
+				report(jsonDifference{Path: formatPath(child), Kind: "removed", Original: aChild})
+			default:
+				diffJSON(child, aChild, bChild, ignore, out)
+			}
+		}
+		return
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		for i := 0; i < max(len(av), len(bv)); i++ {
+			child := append(path[:len(path):len(path)], pathSegment{index: i, isIndex: true})
+			switch {
+			case i >= len(av):
+				report(jsonDifference{Path: formatPath(child), Kind: "added", Replay: bv[i]})
+			case i >= len(bv):
+				report(jsonDifference{Path: formatPath(child), Kind: "removed", Original: av[i]})
+			default:
+				diffJSON(child, av[i], bv[i], ignore, out)
+			}
+		}
+		return
+	}
+	if !reflect.DeepEqual(a, b) {
+		report(jsonDifference{Path: formatted, Kind: "changed", Original: a, Replay: b})
+	}
+}
+
+// decodeJSONBody decodes a response body, keeping numbers exact
+func decodeJSONBody(body []byte) (interface{}, bool) {
+	doc, err := parseJSONDocument(body)
+	if err != nil {
+		return nil, false
+	}
+	return doc.root, true
+}
+
+type replayResult struct {
+	Status  string  `json:"status"`
+	Latency float64 `json:"latency"`
+	Body    string  `json:"body,omitempty"`
+}
+
+type replayReport struct {
+	TraceID     string           `json:"trace_id"`
+	URL         string           `json:"url"`
+	Original    replayResult     `json:"original"`
+	Replay      replayResult     `json:"replay"`
+	Equal       bool             `json:"equal"`
+	Differences []jsonDifference `json:"differences"`
+	Ignored     []string         `json:"ignored"`
+	Note        string           `json:"note,omitempty"`
+}
+
+// handleTraceReplay re-sends a stored request to the current upstream and reports how
+// the response differs from the recorded one:
+// POST /traces/replay?id=<trace>[&model=<override>][&ignore=$.a,$.b]
+func handleTraceReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSONError(w, http.StatusMethodNotAllowed, "invalid_request_error", "replay requires POST")
+		return
+	}
+	query := r.URL.Query()
+	trace, ok := findTrace(query.Get("id"))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("no stored trace with id %q", query.Get("id")))
+		return
+	}
+	if len(trace.Transcript) > 0 {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "realtime sessions cannot be replayed")
+		return
+	}
+
+	ignorePaths := defaultReplayIgnore
+	if spec, ok := query["ignore"]; ok {
+		ignorePaths = []string{}
+		for _, path := range strings.Split(strings.Join(spec, ","), ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				ignorePaths = append(ignorePaths, path)
+			}
+		}
+	}
+	ignore := make(map[string]bool)
+	for _, path := range ignorePaths {
+		segments, err := parsePath(path)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			return
+		}
+		ignore[formatPath(segments)] = true
+	}
+
+	requestBody, original, err := traceBodies(trace)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+	body := []byte(requestBody)
+	if model := query.Get("model"); model != "" {
+		doc, err := parseJSONDocument(body)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "model override requires a JSON request body")
+			return
+		}
+		doc.root, _ = pathSet(doc.root, []pathSegment{{key: "model"}}, model)
+		if body, err = doc.encode(); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal_error", err.Error())
+			return
+		}
+	}
+
+	header, err := replayHeader(trace)
+	if err != nil {
+		writeJSONError(w, http.StatusForbidden, "invalid_request_error", err.Error())
+		return
+	}
+
+	log.Printf("🔁 Replaying trace %s against %s", trace.Id, trace.URL)
+	started := time.Now()
+	resp, respBody, err := forwardUpstream(trace.Method, trace.URL, header, body)
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, "upstream_error", err.Error())
+		return
+	}
+
+	report := replayReport{
+		TraceID:     trace.Id,
+		URL:         trace.URL,
+		Original:    replayResult{Status: trace.Status, Latency: trace.Latency},
+		Replay:      replayResult{Status: resp.Status, Latency: time.Since(started).Seconds(), Body: string(respBody)},
+		Differences: []jsonDifference{},
+		Ignored:     ignorePaths,
+	}
+	if trace.Status != resp.Status {
+		report.Differences = append(report.Differences, jsonDifference{Path: "status", Kind: "changed", Original: trace.Status, Replay: resp.Status})
+	}
+
+	switch {
+	case trace.Transparent || strings.HasPrefix(original, "[STREAMING RESPONSE"):
+		report.Note = "the original response body was not recorded (streaming or transparent route); only the status was compared"
+	default:
+		originalJSON, originalOK := decodeJSONBody([]byte(original))
+		replayJSON, replayOK := decodeJSONBody(respBody)
+		if originalOK && replayOK {
+			diffJSON(nil, originalJSON, replayJSON, ignore, &report.Differences)
+		} else if original != string(respBody) {
+			report.Note = "responses are not both JSON; compared as text"
+			report.Differences = append(report.Differences, jsonDifference{Path: "$", Kind: "changed", Original: original, Replay: string(respBody)})
+		}
+	}
+	report.Equal = len(report.Differences) == 0
+
+	log.Printf("🔁 Replay of %s finished with %d differences", trace.Id, len(report.Differences))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
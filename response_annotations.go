@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strconv"
+)
+
+// responseAnnotation is the x_proxy object added to the JSON responses of clients
+// sending X-Proxy-Annotate: true
+type responseAnnotation struct {
+	TraceID          string   `json:"trace_id"`
+	Upstream         string   `json:"upstream,omitempty"`
+	Cache            string   `json:"cache,omitempty"`
+	Model            string   `json:"model,omitempty"`
+	PromptTokens     *int     `json:"prompt_tokens,omitempty"`
+	CompletionTokens *int     `json:"completion_tokens,omitempty"`
+	TotalTokens      *int     `json:"total_tokens,omitempty"`
+	CachedTokens     int      `json:"cached_tokens,omitempty"`
+	ReasoningTokens  int      `json:"reasoning_tokens,omitempty"`
+	EstimatedCost    *float64 `json:"estimated_cost_usd,omitempty"`
+}
+
+// annotateResponse adds an x_proxy object to a JSON object response, with the
+// token usage and estimated cost it reports. Responses served from a cache cost
+// nothing. It returns false for bodies that aren't a JSON object.
+func annotateResponse(body []byte, annotation responseAnnotation) ([]byte, bool) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) < 2 || trimmed[0] != '{' || trimmed[len(trimmed)-1] != '}' || !json.Valid(trimmed) {
+		return body, false
+	}
+	annotation.Model = bodyModel(trimmed)
+	if usage, ok := parseUsage(trimmed); ok {
+		annotation.PromptTokens, annotation.CompletionTokens, annotation.TotalTokens = &usage.PromptTokens, &usage.CompletionTokens, &usage.TotalTokens
+		annotation.CachedTokens = usage.PromptTokensDetails.CachedTokens
+		annotation.ReasoningTokens = usage.CompletionTokensDetails.ReasoningTokens
+		if cost, ok := estimateCost(annotation.Model, usage); ok {
+			switch annotation.Cache {
+			case "hit", "stale", "negative":
+				cost = 0
+			}
+			// The precision of X-Proxy-Cost-Estimate
+			cost = math.Round(cost*1e6) / 1e6
+			annotation.EstimatedCost = &cost
+		}
+	}
+	encoded, err := json.Marshal(annotation)
+	if err != nil {
+		return body, false
+	}
+	// Append the field in place, keeping the upstream's formatting and key order
+	annotated := make([]byte, 0, len(trimmed)+len(encoded)+12)
+	annotated = append(annotated, trimmed[:len(trimmed)-1]...)
+	if len(bytes.TrimSpace(trimmed[1:len(trimmed)-1])) > 0 {
+		annotated = append(annotated, ',')
+	}
+	annotated = append(annotated, `"x_proxy":`...)
+	annotated = append(annotated, encoded...)
+	return append(annotated, '}'), true
+}
+
+// annotateCachedResponse returns a cache entry to serve with an x_proxy object,
+// leaving the stored entry as it is
+func annotateCachedResponse(cached *cachedResponse, annotation responseAnnotation) *cachedResponse {
+	if cached.Header.Get("Content-Encoding") != "" {
+		return cached
+	}
+	annotation.Upstream = cached.Header.Get("X-Proxy-Upstream")
+	body, ok := annotateResponse(cached.Body, annotation)
+	if !ok {
+		return cached
+	}
+	annotated := *cached
+	annotated.Header = cached.Header.Clone()
+	annotated.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	annotated.Body = body
+	return &annotated
+}
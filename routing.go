@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upstreamRouting records which backend served a forwarded request and why it
+// was picked
+type upstreamRouting struct {
+	Upstream string `json:"upstream"` // scheme and host the request was sent to
+	// Via is how the upstream was chosen: default, pool, canary, override, rule,
+	// transparent, or quarantine for released requests
+	Via    string `json:"via"`
+	Rule   string `json:"rule,omitempty"`    // the routing rule, when via is rule
+	APIKey string `json:"api_key,omitempty"` // the credential sent upstream, masked
+}
+
+// send completes the record with the request actually sent upstream
+func (u *upstreamRouting) send(target *url.URL, header http.Header) {
+	u.Upstream = target.Scheme + "://" + target.Host
+	u.APIKey = maskedAPIKey(header)
+}
+
+// maskedAPIKey returns the upstream credential of a request with all but its
+// first and last four characters hidden, or "" if it has none
+func maskedAPIKey(header http.Header) string {
+	key := strings.TrimPrefix(header.Get("Authorization"), "Bearer ")
+	if key == "" {
+		key = header.Get("Api-Key")
+	}
+	if key == "" {
+		return ""
+	}
+	if len(key) <= 12 {
+		return "***"
+	}
+	return key[:4] + "***" + key[len(key)-4:]
+}
+
+// routingAuditMax is how many routing changes the audit log keeps
+const routingAuditMax = 500
+
+// routingAuditEntry is a change to where requests are routed
+type routingAuditEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	// Actor is the admin client's address, or proxy for changes the proxy made
+	// itself
+	Actor  string      `json:"actor"`
+	Action string      `json:"action"` // startup, canary_percent or canary_rollback
+	Detail string      `json:"detail,omitempty"`
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+// routingAuditLog keeps the latest routing changes in memory; every entry is also logged
+type routingAuditLog struct {
+	mu      sync.Mutex
+	entries []routingAuditEntry
+}
+
+var routingAudit = &routingAuditLog{}
+
+// record logs a routing change and keeps it for GET /routing/audit
+func (a *routingAuditLog) record(actor, action, detail string, before, after interface{}) {
+	entry := routingAuditEntry{Timestamp: time.Now(), Actor: actor, Action: action, Detail: detail, Before: before, After: after}
+	data, _ := json.Marshal(entry)
+	log.Printf("🧾 Routing audit: %s", data)
+	metrics.Add("openai_proxy_routing_changes_total", "Changes to request routing, by action.", map[string]string{"action": action}, 1)
+	a.mu.Lock()
+	a.entries = append(a.entries, entry)
+	if len(a.entries) > routingAuditMax {
+		a.entries = a.entries[len(a.entries)-routingAuditMax:]
+	}
+	a.mu.Unlock()
+}
+
+// adminActor identifies the admin client making a change
+func adminActor(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0]) + " via " + r.RemoteAddr
+	}
+	return r.RemoteAddr
+}
+
+// routingCanary is the canary split of routingConfig
+type routingCanary struct {
+	Upstream string   `json:"upstream"`
+	Routes   []string `json:"routes,omitempty"`
+	Percent  float64  `json:"percent"`
+}
+
+// routingConfig is the routing set up at startup
+type routingConfig struct {
+	Upstream          string             `json:"upstream"`
+	Pool              map[string]float64 `json:"pool,omitempty"` // base URL to weight
+	Canary            *routingCanary     `json:"canary,omitempty"`
+	Rules             map[string]string  `json:"rules,omitempty"` // routing rule name to upstream
+	OverrideUpstreams []string           `json:"override_upstreams,omitempty"`
+}
+
+func currentRoutingConfig() routingConfig {
+	config := routingConfig{Upstream: upstreamURL.String()}
+	if upstreamPool != nil {
+		config.Pool = make(map[string]float64)
+		for _, m := range upstreamPool.members {
+			config.Pool[m.base.String()] = m.weight
+		}
+	}
+	if upstreamCanary != nil {
+		status := upstreamCanary.status()
+		config.Canary = &routingCanary{Upstream: status.Upstream, Routes: status.Routes, Percent: status.Percent}
+	}
+	if requestRules != nil && len(requestRules.Routes) > 0 {
+		config.Rules = make(map[string]string)
+		for _, rule := range requestRules.Routes {
+			config.Rules[rule.Name] = rule.Upstream
+		}
+	}
+	for base := range overrideUpstreams {
+		config.OverrideUpstreams = append(config.OverrideUpstreams, base)
+	}
+	sort.Strings(config.OverrideUpstreams)
+	return config
+}
+
+// handleRoutingAudit serves GET /routing/audit, the latest routing changes, oldest
+// first, optionally only those since ?since=<RFC 3339 time>
+func handleRoutingAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "invalid_request_error", "use GET")
+		return
+	}
+	var since time.Time
+	if value := r.URL.Query().Get("since"); value != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, value); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid since: expected an RFC 3339 time")
+			return
+		}
+	}
+	routingAudit.mu.Lock()
+	list := []routingAuditEntry{}
+	for _, entry := range routingAudit.entries {
+		if !entry.Timestamp.Before(since) {
+			list = append(list, entry)
+		}
+	}
+	routingAudit.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// routeRule sends matching requests to another upstream
+type routeRule struct {
+	Name     string `json:"name"`
+	When     string `json:"when"`
+	Upstream string `json:"upstream"`
+
+	condition compiledExpr
+	target    *url.URL
+}
+
+// targetFor returns the rule's upstream URL for path
+func (r *routeRule) targetFor(path, rawQuery string) *url.URL {
+	return &url.URL{
+		Scheme:   r.target.Scheme,
+		Host:     r.target.Host,
+		Path:     r.target.Path + path,
+		RawQuery: rawQuery,
+	}
+}
+
+// traceRule sets the trace level of matching requests
+type traceRule struct {
+	Name  string `json:"name"`
+	When  string `json:"when"`
+	Level string `json:"level"`
+
+	condition compiledExpr
+}
+
+// guardrailRule blocks or quarantines matching requests
+type guardrailRule struct {
+	Name    string `json:"name"`
+	When    string `json:"when"`
+	Action  string `json:"action"` // "block" or "quarantine"
+	Message string `json:"message,omitempty"`
+
+	condition compiledExpr
+}
+
+// ruleSet is the -rules-file. In each group the first matching rule applies.
+type ruleSet struct {
+	Routes     []*routeRule     `json:"routes"`
+	Trace      []*traceRule     `json:"trace"`
+	Guardrails []*guardrailRule `json:"guardrails"`
+}
+
+// requestRules is nil unless -rules-file is set
+var requestRules *ruleSet
+
+// ruleDecision is what the rules decided for one request
+type ruleDecision struct {
+	route      *routeRule
+	traceLevel string
+	guardrail  *guardrailRule
+}
+
+// loadRules reads and compiles a rules file
+func loadRules(path string) (*ruleSet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules file: %v", err)
+	}
+	var rules ruleSet
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("invalid rules file %s: %v", path, err)
+	}
+	compile := func(group string, i int, name, when string) (compiledExpr, error) {
+		if name == "" {
+			return nil, fmt.Errorf("invalid rules file %s: %s rule %d has no name", path, group, i+1)
+		}
+		condition, err := compileExpr(when)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rules file %s: %s rule %q: %v", path, group, name, err)
+		}
+		return condition, nil
+	}
+	for i, rule := range rules.Routes {
+		if rule.condition, err = compile("routes", i, rule.Name, rule.When); err != nil {
+			return nil, err
+		}
+		target, err := url.Parse(rule.Upstream)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			return nil, fmt.Errorf("invalid rules file %s: route %q: upstream %q is not an http(s) base URL", path, rule.Name, rule.Upstream)
+		}
+		target.Path = strings.TrimSuffix(target.Path, "/")
+		rule.target = target
+	}
+	for i, rule := range rules.Trace {
+		if rule.condition, err = compile("trace", i, rule.Name, rule.When); err != nil {
+			return nil, err
+		}
+		switch rule.Level {
+		case traceLevelFull, traceLevelMetadata, traceLevelNone:
+		default:
+			return nil, fmt.Errorf("invalid rules file %s: trace rule %q: level %q is not full, metadata or none", path, rule.Name, rule.Level)
+		}
+	}
+	for i, rule := range rules.Guardrails {
+		if rule.condition, err = compile("guardrails", i, rule.Name, rule.When); err != nil {
+			return nil, err
+		}
+		if rule.Action != "block" && rule.Action != "quarantine" {
+			return nil, fmt.Errorf("invalid rules file %s: guardrail %q: action %q is not block or quarantine", path, rule.Name, rule.Action)
+		}
+	}
+	return &rules, nil
+}
+
+// quarantines reports whether any guardrail holds requests in quarantine
+func (s *ruleSet) quarantines() bool {
+	if s == nil {
+		return false
+	}
+	for _, rule := range s.Guardrails {
+		if rule.Action == "quarantine" {
+			return true
+		}
+	}
+	return false
+}
+
+// newRuleEnv exposes a request to rule conditions as body, path, method, headers
+// (lowercased names, first values) and key (id, name and tenant of the client)
+func newRuleEnv(r *http.Request, id userIdentity, body []byte) *exprEnv {
+	var parsed interface{}
+	json.Unmarshal(body, &parsed)
+	headers := make(map[string]interface{}, len(r.Header))
+	for name, values := range r.Header {
+		if len(values) > 0 {
+			headers[strings.ToLower(name)] = values[0]
+		}
+	}
+	return &exprEnv{vars: map[string]interface{}{
+		"body":    parsed,
+		"path":    r.URL.Path,
+		"method":  r.Method,
+		"headers": headers,
+		"key": map[string]interface{}{
+			"id":     id.KeyID,
+			"name":   id.Name,
+			"tenant": id.Tenant,
+		},
+	}}
+}
+
+// matches evaluates a rule condition. A condition that fails to evaluate, for
+// example by comparing a string with a number, doesn't match. Only counted
+// evaluations show up in the rule metrics and the log.
+func (s *ruleSet) matches(group, name string, condition compiledExpr, env *exprEnv, counted bool) bool {
+	v, err := condition(env)
+	if err == nil {
+		var matched bool
+		if matched, err = exprBool(v); err == nil {
+			if matched && counted {
+				metrics.Add("openai_proxy_rule_matches_total", "Requests matched by routing, trace and guardrail rules.", map[string]string{"group": group, "rule": name}, 1)
+			}
+			return matched
+		}
+	}
+	if !counted {
+		return false
+	}
+	log.Printf("⚠️ Rule %s/%s failed to evaluate: %v", group, name, err)
+	metrics.Add("openai_proxy_rule_errors_total", "Rule conditions that failed to evaluate.", map[string]string{"group": group, "rule": name}, 1)
+	return false
+}
+
+// Evaluate applies the rules to a request
+func (s *ruleSet) Evaluate(env *exprEnv) ruleDecision {
+	return s.evaluate(env, true)
+}
+
+// evaluate applies the rules; uncounted evaluations, such as policy simulations,
+// leave no trace in the metrics
+func (s *ruleSet) evaluate(env *exprEnv, counted bool) ruleDecision {
+	var decision ruleDecision
+	for _, rule := range s.Guardrails {
+		if s.matches("guardrails", rule.Name, rule.condition, env, counted) {
+			decision.guardrail = rule
+			break
+		}
+	}
+	for _, rule := range s.Routes {
+		if s.matches("routes", rule.Name, rule.condition, env, counted) {
+			decision.route = rule
+			break
+		}
+	}
+	for _, rule := range s.Trace {
+		if s.matches("trace", rule.Name, rule.condition, env, counted) {
+			decision.traceLevel = rule.Level
+			break
+		}
+	}
+	return decision
+}
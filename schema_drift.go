@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// responseSchema is the expected shape of an endpoint's successful responses, as
+// field paths: object keys joined by dots, with [] for array items
+type responseSchema struct {
+	Required []string `json:"required"` // fields every response has
+	Optional []string `json:"optional"` // fields some responses have
+	// Open fields may hold anything, such as metadata or tool definitions
+	Open []string `json:"open"`
+}
+
+// usageFields are the token usage fields of chat completions and completions
+var usageFields = []string{
+	"usage", "usage.prompt_tokens", "usage.completion_tokens", "usage.total_tokens",
+	"usage.prompt_tokens_details", "usage.prompt_tokens_details.cached_tokens", "usage.prompt_tokens_details.audio_tokens",
+	"usage.completion_tokens_details", "usage.completion_tokens_details.reasoning_tokens", "usage.completion_tokens_details.audio_tokens",
+	"usage.completion_tokens_details.accepted_prediction_tokens", "usage.completion_tokens_details.rejected_prediction_tokens",
+}
+
+// responseSchemas are the shapes of the main OpenAI endpoints, by path.
+// -schema-drift-file overrides and extends them.
+var responseSchemas = map[string]responseSchema{
+	"/v1/chat/completions": {
+		Required: []string{"id", "object", "created", "model", "choices", "choices[].index", "choices[].message", "choices[].message.role", "choices[].finish_reason"},
+		Optional: append([]string{"system_fingerprint", "service_tier", "choices[].message.content", "choices[].message.refusal"}, usageFields...),
+		Open:     []string{"choices[].logprobs", "choices[].message.tool_calls", "choices[].message.function_call", "choices[].message.audio", "choices[].message.annotations"},
+	},
+	"/v1/completions": {
+		Required: []string{"id", "object", "created", "model", "choices", "choices[].text", "choices[].index", "choices[].finish_reason"},
+		Optional: append([]string{"system_fingerprint"}, usageFields...),
+		Open:     []string{"choices[].logprobs"},
+	},
+	"/v1/embeddings": {
+		Required: []string{"object", "data", "data[].object", "data[].index", "data[].embedding", "model"},
+		Optional: []string{"usage", "usage.prompt_tokens", "usage.total_tokens"},
+	},
+	"/v1/responses": {
+		Required: []string{"id", "object", "created_at", "status", "model", "output"},
+		Optional: []string{
+			"max_output_tokens", "max_tool_calls", "parallel_tool_calls",
+			"previous_response_id", "store", "temperature", "top_p", "top_logprobs", "truncation", "user", "service_tier",
+			"background", "prompt_cache_key", "safety_identifier", "output_text",
+			"usage", "usage.input_tokens", "usage.output_tokens", "usage.total_tokens",
+		},
+		Open: []string{
+			"output[]", "reasoning", "text", "tool_choice", "tools", "metadata", "prompt", "conversation", "error",
+			"incomplete_details", "instructions", "usage.input_tokens_details", "usage.output_tokens_details",
+		},
+	},
+	"/v1/models": {
+		Required: []string{"object", "data", "data[].id", "data[].object", "data[].created", "data[].owned_by"},
+	},
+	"/v1/moderations": {
+		Required: []string{"id", "model", "results", "results[].flagged", "results[].categories", "results[].category_scores"},
+		Open:     []string{"results[].categories", "results[].category_scores", "results[].category_applied_input_types"},
+	},
+}
+
+// loadSchemaDriftFile merges a JSON object of endpoint paths to schemas into
+// responseSchemas
+func loadSchemaDriftFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read schema drift file %s: %v", path, err)
+	}
+	schemas := map[string]responseSchema{}
+	if err := json.Unmarshal(data, &schemas); err != nil {
+		return fmt.Errorf("failed to parse schema drift file %s: %v", path, err)
+	}
+	for endpoint, schema := range schemas {
+		if !strings.HasPrefix(endpoint, "/v1/") {
+			return fmt.Errorf("invalid schema drift file %s: endpoint %q must start with /v1/", path, endpoint)
+		}
+		responseSchemas[endpoint] = schema
+	}
+	return nil
+}
+
+// schemaDrift is a difference between upstream responses and an endpoint's schema
+type schemaDrift struct {
+	Endpoint  string    `json:"endpoint"`
+	Kind      string    `json:"kind"` // unknown for a new field, missing for a vanished one
+	Field     string    `json:"field"`
+	Count     int       `json:"count"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	TraceID   string    `json:"trace_id"` // the latest response showing it
+}
+
+// schemaDriftDetector compares responses with responseSchemas and remembers the
+// differences it saw
+type schemaDriftDetector struct {
+	mu     sync.Mutex
+	drifts map[string]*schemaDrift // by endpoint, kind and field
+}
+
+// schemaDrifts is nil unless -schema-drift is set
+var schemaDrifts *schemaDriftDetector
+
+func newSchemaDriftDetector() *schemaDriftDetector {
+	return &schemaDriftDetector{drifts: make(map[string]*schemaDrift)}
+}
+
+// watches reports whether responses from path are checked
+func (d *schemaDriftDetector) watches(path string) bool {
+	if d == nil {
+		return false
+	}
+	_, ok := responseSchemas[path]
+	return ok
+}
+
+// responseFields lists the field paths of a JSON value, stopping at open fields
+func responseFields(value interface{}, prefix string, open map[string]bool, fields map[string]bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			path := key
+			if prefix != "" {
+				path = prefix + "." + key
+			}
+			fields[path] = true
+			if !open[path] {
+				responseFields(child, path, open, fields)
+			}
+		}
+	case []interface{}:
+		path := prefix + "[]"
+		if open[path] {
+			return
+		}
+		for _, child := range v {
+			if _, ok := child.(map[string]interface{}); ok {
+				fields[path] = true // the array holds objects
+			}
+			responseFields(child, path, open, fields)
+		}
+	}
+}
+
+// Check compares a successful JSON response with its endpoint's schema: fields
+// the schema doesn't know and required fields that are gone are counted and
+// logged, and alerted the first time they show up
+func (d *schemaDriftDetector) Check(path string, status int, body []byte, traceID string) {
+	if !d.watches(path) || status < 200 || status >= 300 {
+		return
+	}
+	var response map[string]interface{}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return
+	}
+	schema := responseSchemas[path]
+	open := make(map[string]bool)
+	for _, field := range schema.Open {
+		open[field] = true
+	}
+	known := make(map[string]bool)
+	for _, list := range [][]string{schema.Required, schema.Optional, schema.Open} {
+		for _, field := range list {
+			known[field] = true
+		}
+	}
+	fields := make(map[string]bool)
+	responseFields(response, "", open, fields)
+
+	var unknown, missing []string
+	for field := range fields {
+		if !known[field] && !strings.HasSuffix(field, "[]") {
+			unknown = append(unknown, field)
+		}
+	}
+	for _, field := range schema.Required {
+		// A field of objects that aren't there, such as the items of an empty
+		// array, can't be checked
+		parent := ""
+		if i := strings.LastIndex(field, "."); i >= 0 {
+			parent = field[:i]
+		}
+		if !fields[field] && (parent == "" || fields[parent]) {
+			missing = append(missing, field)
+		}
+	}
+	sort.Strings(unknown)
+	sort.Strings(missing)
+	for _, field := range unknown {
+		d.record(path, "unknown", field, traceID)
+	}
+	for _, field := range missing {
+		d.record(path, "missing", field, traceID)
+	}
+}
+
+func (d *schemaDriftDetector) record(endpoint, kind, field, traceID string) {
+	metrics.Add("openai_proxy_schema_drift_total", "Upstream responses with fields their endpoint's schema doesn't know, or without required ones, by endpoint, kind and field.", map[string]string{"endpoint": endpoint, "kind": kind, "field": field}, 1)
+	key := endpoint + " " + kind + " " + field
+	now := time.Now()
+	d.mu.Lock()
+	drift, seen := d.drifts[key]
+	if !seen {
+		drift = &schemaDrift{Endpoint: endpoint, Kind: kind, Field: field, FirstSeen: now}
+		d.drifts[key] = drift
+	}
+	drift.Count++
+	drift.LastSeen, drift.TraceID = now, traceID
+	d.mu.Unlock()
+	if seen {
+		return
+	}
+	message := fmt.Sprintf("%s responses have a field the proxy's schema doesn't know: %s", endpoint, field)
+	if kind == "missing" {
+		message = fmt.Sprintf("%s responses lack the required field %s", endpoint, field)
+	}
+	log.Printf("🧬 Schema drift: %s (trace %s)", message, traceID)
+	sendAlert(alert{Kind: "schema_drift", Key: endpoint, Message: message, Timestamp: now})
+}
+
+// list returns the drifts seen, most recent first
+func (d *schemaDriftDetector) list() []schemaDrift {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := make([]schemaDrift, 0, len(d.drifts))
+	for _, drift := range d.drifts {
+		list = append(list, *drift)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastSeen.After(list[j].LastSeen) })
+	return list
+}
+
+// handleSchemaDrift serves GET /schema-drift, the differences seen between
+// upstream responses and the endpoint schemas, and DELETE /schema-drift to forget
+// them so they are alerted again
+func handleSchemaDrift(w http.ResponseWriter, r *http.Request) {
+	if schemaDrifts == nil {
+		writeJSONError(w, http.StatusNotFound, "not_found", "schema drift detection is not enabled")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		schemaDrifts.mu.Lock()
+		schemaDrifts.drifts = make(map[string]*schemaDrift)
+		schemaDrifts.mu.Unlock()
+		log.Printf("🧬 Cleared the recorded schema drifts")
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "invalid_request_error", "use GET or DELETE")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schemaDrifts.list())
+}
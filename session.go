@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	sessionStoreMax = 10000
+	sessionTTL      = 24 * time.Hour
+)
+
+// sessionStore remembers conversation fingerprints so later turns of a chat can be
+// tied to the session of earlier ones. OpenAI doesn't return a session ID, and the
+// stateless chat API resends the whole conversation on every turn.
+//
+// A fingerprint covers the client key and the conversation's system, user and tool
+// messages. Assistant messages are left out because the proxy may never have seen
+// them whole (streamed replies), so turn N+1's prefix fingerprints the same as the
+// complete turn N request.
+type sessionStore struct {
+	mu      sync.Mutex
+	entries map[string]*sessionEntry
+}
+
+type sessionEntry struct {
+	id       string
+	lastSeen time.Time
+}
+
+var conversationSessions = &sessionStore{entries: make(map[string]*sessionEntry)}
+
+// conversationPrefixKeys returns the fingerprint of every prefix of the conversation's
+// non-assistant messages, shortest first, or nil if the body has no messages
+func conversationPrefixKeys(keyID string, body []byte) []string {
+	var request struct {
+		Messages []map[string]interface{} `json:"messages"`
+	}
+	if json.Unmarshal(body, &request) != nil || len(request.Messages) == 0 {
+		return nil
+	}
+	running := sha256.Sum256([]byte(keyID))
+	var keys []string
+	for _, message := range request.Messages {
+		if message["role"] == "assistant" {
+			continue
+		}
+		encoded, err := json.Marshal(message)
+		if err != nil {
+			return nil
+		}
+		h := sha256.New()
+		h.Write(running[:])
+		h.Write(encoded)
+		copy(running[:], h.Sum(nil))
+		keys = append(keys, hex.EncodeToString(running[:]))
+	}
+	return keys
+}
+
+// Infer returns the session ID of the conversation in body, continuing the session
+// of the longest previously seen prefix, or "" if the body is not a chat request
+func (s *sessionStore) Infer(keyID string, body []byte) string {
+	keys := conversationPrefixKeys(keyID, body)
+	if len(keys) == 0 {
+		return ""
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// A new conversation is named after its first full fingerprint, so retries of
+	// the same first turn get the same ID
+	id := "sess-" + keys[len(keys)-1][:16]
+	for i := len(keys) - 1; i >= 0; i-- {
+		if entry, ok := s.entries[keys[i]]; ok && now.Sub(entry.lastSeen) < sessionTTL {
+			id = entry.id
+			break
+		}
+	}
+	s.entries[keys[len(keys)-1]] = &sessionEntry{id: id, lastSeen: now}
+	if len(s.entries) > sessionStoreMax {
+		s.evict()
+	}
+	return id
+}
+
+// evict drops the least recently seen tenth of the fingerprints. Called with s.mu held.
+func (s *sessionStore) evict() {
+	keys := make([]string, 0, len(s.entries))
+	for key := range s.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return s.entries[keys[i]].lastSeen.Before(s.entries[keys[j]].lastSeen) })
+	for _, key := range keys[:len(keys)/10+1] {
+		delete(s.entries, key)
+	}
+}
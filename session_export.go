@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sessionTurn is one traced request of a session: the messages it added to the
+// conversation and the model's answer
+type sessionTurn struct {
+	TraceId   string                `json:"trace_id"`
+	Timestamp time.Time             `json:"timestamp"`
+	API       string                `json:"api"`
+	Model     string                `json:"model,omitempty"`
+	Status    string                `json:"status"`
+	Latency   float64               `json:"latency"`
+	Messages  []conversationMessage `json:"messages"` // new since the previous turn
+	Response  []conversationMessage `json:"response"`
+	Usage     *tokenUsage           `json:"usage,omitempty"`
+	Note      string                `json:"note,omitempty"`
+}
+
+// sessionExport is the transcript of a session across its traces
+type sessionExport struct {
+	SessionId  string        `json:"session_id"`
+	ExportedAt time.Time     `json:"exported_at"`
+	StartedAt  time.Time     `json:"started_at"`
+	EndedAt    time.Time     `json:"ended_at"`
+	Models     []string      `json:"models"`
+	Usage      tokenUsage    `json:"usage"`
+	Turns      []sessionTurn `json:"turns"`
+	// Skipped lists the session's traces that aren't conversations, such as
+	// embeddings, or whose bodies were redacted
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// sessionTraces returns the stored, visible traces of a session, oldest first
+func sessionTraces(id string) ([]Trace, error) {
+	recent, err := traceSink.List(tracesMax)
+	if err != nil {
+		return nil, err
+	}
+	annotated, err := traceSink.Annotated()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var traces []Trace
+	for _, trace := range visibleTraces(append(recent, annotated...)) {
+		if trace.SessionId == id && !seen[trace.Id] {
+			seen[trace.Id] = true
+			traces = append(traces, trace)
+		}
+	}
+	sort.SliceStable(traces, func(i, j int) bool { return traces[i].Timestamp.Before(traces[j].Timestamp) })
+	return traces, nil
+}
+
+// sameMessage reports whether two messages read the same in a transcript
+func sameMessage(a, b conversationMessage) bool {
+	encodedA, _ := json.Marshal(conversationMessage{Role: a.Role, Parts: a.Parts, ToolCalls: a.ToolCalls})
+	encodedB, _ := json.Marshal(conversationMessage{Role: b.Role, Parts: b.Parts, ToolCalls: b.ToolCalls})
+	return bytes.Equal(encodedA, encodedB)
+}
+
+// buildSessionExport turns a session's traces into turns. Chat requests resend the
+// whole history, so each turn keeps only the messages after the ones already in
+// the transcript.
+func buildSessionExport(id string, traces []Trace) *sessionExport {
+	export := &sessionExport{SessionId: id, ExportedAt: time.Now().UTC(), Models: []string{}, Turns: []sessionTurn{}}
+	var history []conversationMessage
+	models := make(map[string]bool)
+	for _, trace := range traces {
+		conversation, err := buildConversation(trace)
+		if err != nil {
+			export.Skipped = append(export.Skipped, trace.Id)
+			continue
+		}
+		messages := conversation.Messages
+		if len(messages) >= len(history) {
+			shared := 0
+			for shared < len(history) && sameMessage(messages[shared], history[shared]) {
+				shared++
+			}
+			if shared == len(history) {
+				messages = messages[shared:]
+			}
+		}
+		turn := sessionTurn{
+			TraceId:   trace.Id,
+			Timestamp: trace.Timestamp.UTC(),
+			API:       conversation.API,
+			Model:     conversation.Model,
+			Status:    trace.Status,
+			Latency:   trace.Latency,
+			Messages:  messages,
+			Response:  conversation.Response,
+			Usage:     conversation.Usage,
+			Note:      conversation.Note,
+		}
+		export.Turns = append(export.Turns, turn)
+
+		history = append(append([]conversationMessage{}, conversation.Messages...), conversation.Response...)
+		if len(conversation.Response) > 1 {
+			history = history[:len(conversation.Messages)+1] // clients continue with one choice
+		}
+		if turn.Model != "" && !models[turn.Model] {
+			models[turn.Model] = true
+			export.Models = append(export.Models, turn.Model)
+		}
+		if turn.Usage != nil {
+			export.Usage.PromptTokens += turn.Usage.PromptTokens
+			export.Usage.CompletionTokens += turn.Usage.CompletionTokens
+			export.Usage.TotalTokens += turn.Usage.TotalTokens
+			export.Usage.PromptTokensDetails.CachedTokens += turn.Usage.PromptTokensDetails.CachedTokens
+			export.Usage.CompletionTokensDetails.ReasoningTokens += turn.Usage.CompletionTokensDetails.ReasoningTokens
+		}
+		if export.StartedAt.IsZero() {
+			export.StartedAt = turn.Timestamp
+		}
+		export.EndedAt = turn.Timestamp
+	}
+	return export
+}
+
+// transcriptPart renders message content as plain text; inline images and audio
+// are named rather than embedded
+func transcriptPart(part conversationPart) string {
+	switch part.Type {
+	case "text":
+		return part.Text
+	case "refusal":
+		return "[refusal] " + part.Text
+	case "image":
+		if strings.HasPrefix(part.URL, "http") {
+			return "[image: " + part.URL + "]"
+		}
+		if part.FileID != "" {
+			return "[image: " + part.FileID + "]"
+		}
+		return "[image]"
+	case "audio":
+		if part.Text != "" {
+			return "[audio transcript] " + part.Text
+		}
+		return "[audio " + part.Format + "]"
+	case "file":
+		return "[file: " + strings.TrimSpace(part.Filename+" "+part.FileID) + "]"
+	}
+	return part.Text
+}
+
+func transcriptText(message conversationMessage) string {
+	var texts []string
+	for _, part := range message.Parts {
+		texts = append(texts, transcriptPart(part))
+	}
+	return strings.Join(texts, "\n\n")
+}
+
+// transcriptRole names a message's author, with its name or the tool call it answers
+func transcriptRole(message conversationMessage) string {
+	role := message.Role
+	if message.Name != "" {
+		role += " (" + message.Name + ")"
+	}
+	if message.ToolCallId != "" {
+		role += " → " + message.ToolCallId
+	}
+	return role
+}
+
+// turnSummary is the heading line of a turn: time, model and tokens
+func turnSummary(turn sessionTurn) string {
+	summary := []string{turn.Timestamp.Format("2006-01-02 15:04:05 UTC")}
+	if turn.Model != "" {
+		summary = append(summary, turn.Model)
+	}
+	if turn.Usage != nil {
+		summary = append(summary, fmt.Sprintf("%d tokens (%d prompt, %d completion)", turn.Usage.TotalTokens, turn.Usage.PromptTokens, turn.Usage.CompletionTokens))
+	}
+	if !strings.HasPrefix(turn.Status, "200") {
+		summary = append(summary, turn.Status)
+	}
+	return strings.Join(summary, " · ")
+}
+
+// markdownFence picks a code fence longer than any backtick run in text
+func markdownFence(text string) string {
+	fence := "```"
+	for strings.Contains(text, fence) {
+		fence += "`"
+	}
+	return fence
+}
+
+// renderSessionMarkdown formats a session export as Markdown
+func renderSessionMarkdown(export *sessionExport) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Session %s\n\n", export.SessionId)
+	fmt.Fprintf(&b, "- Turns: %d\n", len(export.Turns))
+	if len(export.Turns) > 0 {
+		fmt.Fprintf(&b, "- Time: %s – %s\n", export.StartedAt.Format("2006-01-02 15:04:05"), export.EndedAt.Format("2006-01-02 15:04:05 UTC"))
+	}
+	if len(export.Models) > 0 {
+		fmt.Fprintf(&b, "- Models: %s\n", strings.Join(export.Models, ", "))
+	}
+	fmt.Fprintf(&b, "- Tokens: %d (%d prompt, %d completion)\n", export.Usage.TotalTokens, export.Usage.PromptTokens, export.Usage.CompletionTokens)
+	if len(export.Skipped) > 0 {
+		fmt.Fprintf(&b, "- Skipped traces: %s\n", strings.Join(export.Skipped, ", "))
+	}
+	fmt.Fprintf(&b, "- Exported: %s\n", export.ExportedAt.Format(time.RFC3339))
+
+	writeMessage := func(message conversationMessage) {
+		fmt.Fprintf(&b, "\n**%s**", transcriptRole(message))
+		if message.FinishReason != "" && message.FinishReason != "stop" && message.FinishReason != "completed" {
+			fmt.Fprintf(&b, " _(%s)_", message.FinishReason)
+		}
+		b.WriteString("\n")
+		if text := transcriptText(message); text != "" {
+			b.WriteString("\n" + text + "\n")
+		}
+		for _, call := range message.ToolCalls {
+			fence := markdownFence(call.Arguments)
+			fmt.Fprintf(&b, "\nTool call `%s`", call.Name)
+			if call.Id != "" {
+				fmt.Fprintf(&b, " (%s)", call.Id)
+			}
+			fmt.Fprintf(&b, ":\n\n%sjson\n%s\n%s\n", fence, call.Arguments, fence)
+		}
+	}
+	for i, turn := range export.Turns {
+		fmt.Fprintf(&b, "\n## Turn %d · %s\n", i+1, turnSummary(turn))
+		for _, message := range turn.Messages {
+			writeMessage(message)
+		}
+		for _, message := range turn.Response {
+			writeMessage(message)
+		}
+		if turn.Note != "" {
+			fmt.Fprintf(&b, "\n> %s\n", turn.Note)
+		}
+		fmt.Fprintf(&b, "\n<sub>trace %s</sub>\n", turn.TraceId)
+	}
+	return []byte(b.String())
+}
+
+// sessionHTML is a self-contained page, so an export can be attached to a bug report
+var sessionHTML = template.Must(template.New("session").Funcs(template.FuncMap{
+	"text":    transcriptText,
+	"role":    transcriptRole,
+	"summary": turnSummary,
+	"inc":     func(i int) int { return i + 1 },
+	"time":    func(t time.Time) string { return t.Format("2006-01-02 15:04:05 UTC") },
+}).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Session {{.SessionId}}</title>
+<style>
+body{font-family:system-ui,sans-serif;max-width:52rem;margin:2rem auto;padding:0 1rem;color:#222}
+header dl{display:grid;grid-template-columns:max-content 1fr;gap:.2rem 1rem;color:#555}
+h2{font-size:1rem;border-bottom:1px solid #ddd;padding-bottom:.3rem;margin-top:2rem;color:#555}
+.message{margin:.8rem 0;padding:.6rem .8rem;border-radius:6px;background:#f6f6f6}
+.message.user{background:#eef4ff}.message.assistant{background:#f1f8ee}.message.system,.message.developer{background:#fff8e6}.message.tool{background:#f3eefa}
+.role{font-weight:600;font-size:.85rem;text-transform:uppercase;color:#555}
+.text{white-space:pre-wrap}.finish{color:#a33;font-size:.85rem}
+pre{background:#fff;border:1px solid #ddd;padding:.5rem;overflow-x:auto}
+.note{color:#a60}.trace{color:#999;font-size:.8rem}
+</style></head><body>
+<header><h1>Session {{.SessionId}}</h1><dl>
+<dt>Turns</dt><dd>{{len .Turns}}</dd>
+{{if .Turns}}<dt>Time</dt><dd>{{time .StartedAt}} – {{time .EndedAt}}</dd>{{end}}
+{{if .Models}}<dt>Models</dt><dd>{{range $i, $m := .Models}}{{if $i}}, {{end}}{{$m}}{{end}}</dd>{{end}}
+<dt>Tokens</dt><dd>{{.Usage.TotalTokens}} ({{.Usage.PromptTokens}} prompt, {{.Usage.CompletionTokens}} completion)</dd>
+{{if .Skipped}}<dt>Skipped traces</dt><dd>{{range $i, $id := .Skipped}}{{if $i}}, {{end}}{{$id}}{{end}}</dd>{{end}}
+<dt>Exported</dt><dd>{{time .ExportedAt}}</dd>
+</dl></header>
+{{define "message"}}<div class="message {{.Role}}"><div class="role">{{role .}}{{if and .FinishReason (ne .FinishReason "stop") (ne .FinishReason "completed")}} <span class="finish">{{.FinishReason}}</span>{{end}}</div>
+{{with text .}}<div class="text">{{.}}</div>{{end}}
+{{range .ToolCalls}}<div>Tool call <code>{{.Name}}</code>{{if .Id}} ({{.Id}}){{end}}</div><pre>{{.Arguments}}</pre>{{end}}
+</div>{{end}}
+{{range $i, $turn := .Turns}}<section><h2>Turn {{inc $i}} · {{summary $turn}}</h2>
+{{range .Messages}}{{template "message" .}}{{end}}
+{{range .Response}}{{template "message" .}}{{end}}
+{{if .Note}}<p class="note">{{.Note}}</p>{{end}}
+<div class="trace">trace {{.TraceId}}</div></section>
+{{end}}</body></html>
+`))
+
+// handleSessionSubresource serves GET /sessions/<id>/export?format=markdown|json|html,
+// the transcript of every stored trace carrying the session ID
+func handleSessionSubresource(w http.ResponseWriter, r *http.Request) {
+	id, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/sessions/"), "/export")
+	if !ok || id == "" {
+		writeJSONError(w, http.StatusNotFound, "not_found", "unknown session resource")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "invalid_request_error", "use GET")
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "markdown"
+	}
+	if format != "markdown" && format != "json" && format != "html" {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("invalid format %q: expected markdown, json or html", format))
+		return
+	}
+	traces, err := sessionTraces(id)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "storage_error", "failed to list traces: "+err.Error())
+		return
+	}
+	if len(traces) == 0 {
+		writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("no stored traces with session id %q", id))
+		return
+	}
+	export := buildSessionExport(id, traces)
+
+	filename := "session-" + strings.Map(func(r rune) rune {
+		if r == '"' || r == '/' || r == '\\' || r < ' ' {
+			return '_'
+		}
+		return r
+	}, id)
+	switch format {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `inline; filename="`+filename+`.json"`)
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(export)
+	case "markdown":
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		w.Header().Set("Content-Disposition", `inline; filename="`+filename+`.md"`)
+		w.Write(renderSessionMarkdown(export))
+	case "html":
+		var page bytes.Buffer
+		if err := sessionHTML.Execute(&page, export); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal_error", "failed to render the session: "+err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Disposition", `inline; filename="`+filename+`.html"`)
+		w.Write(page.Bytes())
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// sseEvent is a single server-sent event
+type sseEvent struct {
+	Event string `json:"event,omitempty"`
+	Data  string `json:"data"`
+	Id    string `json:"id,omitempty"`
+	Retry int    `json:"retry,omitempty"` // reconnection time in milliseconds, 0 if unset
+}
+
+// sseDone is the data payload OpenAI sends to terminate a stream
+const sseDone = "[DONE]"
+
+// parseSSE splits text into complete events. Text after the last blank line is an
+// incomplete event and is returned as rest so it can be prepended to the next chunk.
+func parseSSE(text string) (events []sseEvent, rest string) {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+
+	for {
+		end := strings.Index(text, "\n\n")
+		if end < 0 {
+			return events, text
+		}
+		block := text[:end]
+		text = text[end+2:]
+
+		var event sseEvent
+		var data []string
+		hasData := false
+		for _, line := range strings.Split(block, "\n") {
+			if line == "" || strings.HasPrefix(line, ":") {
+				continue // comment or keep-alive
+			}
+			field, value, _ := strings.Cut(line, ":")
+			value = strings.TrimPrefix(value, " ")
+			switch field {
+			case "event":
+				event.Event = value
+			case "data":
+				data = append(data, value)
+				hasData = true
+			case "id":
+				event.Id = value
+			case "retry":
+				if retry, err := strconv.Atoi(value); err == nil {
+					event.Retry = retry
+				}
+			}
+		}
+		if !hasData && event.Event == "" && event.Id == "" && event.Retry == 0 {
+			continue
+		}
+		event.Data = strings.Join(data, "\n")
+		events = append(events, event)
+	}
+}
+
+// encodeSSE renders events in wire format, each terminated by a blank line
+func encodeSSE(events []sseEvent) string {
+	var b strings.Builder
+	for _, event := range events {
+		if event.Event != "" {
+			b.WriteString("event: " + event.Event + "\n")
+		}
+		if event.Id != "" {
+			b.WriteString("id: " + event.Id + "\n")
+		}
+		if event.Retry > 0 {
+			b.WriteString("retry: " + strconv.Itoa(event.Retry) + "\n")
+		}
+		for _, line := range strings.Split(event.Data, "\n") {
+			b.WriteString("data: " + line + "\n")
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
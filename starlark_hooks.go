@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	starlarkjson "go.starlark.net/lib/json"
+	"go.starlark.net/starlark"
+)
+
+// ScriptHookBackend is a scripting language implementation of the hook contract:
+// processRequest(body, headers), processResponse(body, headers) and onTrace(trace)
+type ScriptHookBackend interface {
+	LoadHookScript(scriptPath string) error
+	// LoadHookSource loads a script from its source; name is used in errors
+	LoadHookSource(name, source string) error
+	ExecuteRequestHook(traceID string, body []byte, headers http.Header) ([]byte, http.Header, error)
+	ExecuteResponseHook(traceID string, body []byte, headers http.Header) ([]byte, http.Header, error)
+	// HasRequestHook reports whether the loaded script defines a request hook
+	HasRequestHook() bool
+	// HasResponseHook reports whether the loaded script defines processResponse
+	HasResponseHook() bool
+	ExecuteTraceHook(trace Trace) bool
+}
+
+// scriptHooks is the backend selected by -hook-backend
+var scriptHooks ScriptHookBackend = luaHookManager
+
+// StarlarkHookManager runs hooks written in Starlark. Starlark has no I/O and its
+// module globals are frozen after loading, so one loaded program is shared by all
+// requests and each call gets its own thread with a step budget.
+type StarlarkHookManager struct {
+	mu          sync.RWMutex
+	globals     starlark.StringDict
+	enabled     bool
+	hasRequest  bool
+	hasResponse bool
+	hasTrace    bool
+}
+
+var starlarkHookManager = &StarlarkHookManager{}
+
+// newStarlarkThread creates a thread whose print() goes to the leveled logger
+func newStarlarkThread(traceID string) *starlark.Thread {
+	thread := &starlark.Thread{
+		Name: "hook",
+		Print: func(_ *starlark.Thread, msg string) {
+			logEvent(levelInfo, "starlark", traceID, msg, nil)
+		},
+	}
+	if *starlarkMaxSteps > 0 {
+		thread.SetMaxExecutionSteps(*starlarkMaxSteps)
+	}
+	return thread
+}
+
+// LoadHookScript loads a Starlark file defining processRequest, processResponse and/or onTrace
+func (shm *StarlarkHookManager) LoadHookScript(scriptPath string) error {
+	data, err := os.ReadFile(scriptPath)
+	if err != nil {
+		return fmt.Errorf("failed to read Starlark script file %s: %v", scriptPath, err)
+	}
+	return shm.LoadHookSource(scriptPath, string(data))
+}
+
+// LoadHookSource loads a Starlark script from its source; name is used in errors
+func (shm *StarlarkHookManager) LoadHookSource(name, source string) error {
+	shm.mu.Lock()
+	defer shm.mu.Unlock()
+
+	predeclared := starlark.StringDict{"json": starlarkjson.Module}
+	globals, err := starlark.ExecFile(newStarlarkThread(""), name, source, predeclared)
+	if err != nil {
+		return fmt.Errorf("failed to load Starlark script %s: %v", name, err)
+	}
+
+	isFunc := func(name string) bool {
+		_, ok := globals[name].(starlark.Callable)
+		return ok
+	}
+	hasRequest, hasResponse, hasTrace := isFunc("processRequest"), isFunc("processResponse"), isFunc("onTrace")
+	if !hasRequest && !hasResponse && !hasTrace {
+		return fmt.Errorf("Starlark script must define at least one of 'processRequest', 'processResponse' or 'onTrace' functions")
+	}
+
+	shm.globals = globals
+	shm.hasRequest = hasRequest
+	shm.hasResponse = hasResponse
+	shm.hasTrace = hasTrace
+	shm.enabled = true
+
+	log.Printf("✅ Starlark hook script loaded successfully (processRequest: %v, processResponse: %v, onTrace: %v)", hasRequest, hasResponse, hasTrace)
+	return nil
+}
+
+// httpHeaderToStarlarkDict converts http.Header to a dict of lower-cased names to lists
+func httpHeaderToStarlarkDict(headers http.Header) *starlark.Dict {
+	dict := starlark.NewDict(len(headers))
+	for name, values := range headers {
+		list := make([]starlark.Value, len(values))
+		for i, value := range values {
+			list[i] = starlark.String(value)
+		}
+		dict.SetKey(starlark.String(strings.ToLower(name)), starlark.NewList(list))
+	}
+	return dict
+}
+
+// starlarkDictToHttpHeader converts a dict of names to a list (or single string) of values
+func starlarkDictToHttpHeader(dict *starlark.Dict) http.Header {
+	headers := make(http.Header)
+	for _, item := range dict.Items() {
+		name, ok := starlark.AsString(item[0])
+		if !ok {
+			continue
+		}
+		if value, ok := starlark.AsString(item[1]); ok {
+			headers[name] = []string{value}
+			continue
+		}
+		iterable, ok := item[1].(starlark.Iterable)
+		if !ok {
+			continue
+		}
+		iter := iterable.Iterate()
+		var v starlark.Value
+		for iter.Next(&v) {
+			if value, ok := starlark.AsString(v); ok {
+				headers[name] = append(headers[name], value)
+			}
+		}
+		iter.Done()
+	}
+	return headers
+}
+
+// goToStarlark converts a decoded JSON value to the equivalent Starlark value
+func goToStarlark(value interface{}) starlark.Value {
+	switch v := value.(type) {
+	case nil:
+		return starlark.None
+	case bool:
+		return starlark.Bool(v)
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return starlark.MakeInt64(int64(v))
+		}
+		return starlark.Float(v)
+	case string:
+		return starlark.String(v)
+	case []interface{}:
+		list := make([]starlark.Value, len(v))
+		for i, item := range v {
+			list[i] = goToStarlark(item)
+		}
+		return starlark.NewList(list)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		dict := starlark.NewDict(len(v))
+		for _, key := range keys {
+			dict.SetKey(starlark.String(key), goToStarlark(v[key]))
+		}
+		return dict
+	}
+	return starlark.String(fmt.Sprint(value))
+}
+
+// callBodyHook calls a (body, headers) -> (body, headers) function
+func (shm *StarlarkHookManager) callBodyHook(name, traceID string, body []byte, headers http.Header) ([]byte, http.Header, error) {
+	args := starlark.Tuple{starlark.String(body), httpHeaderToStarlarkDict(headers)}
+	result, err := starlark.Call(newStarlarkThread(traceID), shm.globals[name], args, nil)
+	if err != nil {
+		log.Printf("❌ Error calling %s function: %v", name, err)
+		return body, headers, nil // Return original on error
+	}
+
+	tuple, ok := result.(starlark.Tuple)
+	if !ok || len(tuple) != 2 {
+		log.Printf("❌ %s must return (body, headers), got %s", name, result.Type())
+		return body, headers, nil
+	}
+
+	resultBody := body
+	if modifiedBody, ok := starlark.AsString(tuple[0]); ok {
+		resultBody = []byte(modifiedBody)
+	}
+	resultHeaders := headers
+	if modifiedHeaders, ok := tuple[1].(*starlark.Dict); ok {
+		resultHeaders = starlarkDictToHttpHeader(modifiedHeaders)
+	}
+	return resultBody, resultHeaders, nil
+}
+
+// ExecuteRequestHook executes the Starlark request hook if available
+func (shm *StarlarkHookManager) ExecuteRequestHook(traceID string, body []byte, headers http.Header) ([]byte, http.Header, error) {
+	shm.mu.RLock()
+	defer shm.mu.RUnlock()
+
+	if !shm.enabled || !shm.hasRequest {
+		return body, headers, nil
+	}
+	body, headers, err := shm.callBodyHook("processRequest", traceID, body, headers)
+	log.Printf("🔧 Starlark request hook executed")
+	return body, headers, err
+}
+
+// HasRequestHook reports whether the loaded script defines processRequest
+func (shm *StarlarkHookManager) HasRequestHook() bool {
+	shm.mu.RLock()
+	defer shm.mu.RUnlock()
+	return shm.enabled && shm.hasRequest
+}
+
+// HasResponseHook reports whether the loaded script defines processResponse
+func (shm *StarlarkHookManager) HasResponseHook() bool {
+	shm.mu.RLock()
+	defer shm.mu.RUnlock()
+	return shm.enabled && shm.hasResponse
+}
+
+// ExecuteResponseHook executes the Starlark response hook if available
+func (shm *StarlarkHookManager) ExecuteResponseHook(traceID string, body []byte, headers http.Header) ([]byte, http.Header, error) {
+	shm.mu.RLock()
+	defer shm.mu.RUnlock()
+
+	if !shm.enabled || !shm.hasResponse {
+		return body, headers, nil
+	}
+	body, headers, err := shm.callBodyHook("processResponse", traceID, body, headers)
+	log.Printf("🔧 Starlark response hook executed")
+	return body, headers, err
+}
+
+// ExecuteTraceHook calls the Starlark onTrace function with the completed trace.
+// It returns false if the script asked for the trace to be dropped.
+func (shm *StarlarkHookManager) ExecuteTraceHook(trace Trace) bool {
+	shm.mu.RLock()
+	defer shm.mu.RUnlock()
+
+	if !shm.enabled || !shm.hasTrace {
+		return true
+	}
+
+	data, err := json.Marshal(trace)
+	if err != nil {
+		log.Printf("❌ Error encoding trace for onTrace: %v", err)
+		return true
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		log.Printf("❌ Error converting trace for onTrace: %v", err)
+		return true
+	}
+
+	result, err := starlark.Call(newStarlarkThread(trace.Id), shm.globals["onTrace"], starlark.Tuple{goToStarlark(decoded)}, nil)
+	if err != nil {
+		log.Printf("❌ Error calling onTrace function: %v", err)
+		return true // Keep the trace on error
+	}
+	// Only an explicit False drops the trace
+	return result != starlark.False
+}
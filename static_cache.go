@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// staticCacheRetention is how long past its TTL an entry with upstream validators
+// is kept for conditional revalidation
+const staticCacheRetention = time.Hour
+
+// staticCacheVary are the request headers besides the credential that select a
+// different answer from rarely-changing endpoints
+var staticCacheVary = []string{"OpenAI-Organization", "OpenAI-Project", "OpenAI-Beta"}
+
+// staticCacheRule caches GET responses from endpoints under a path prefix
+type staticCacheRule struct {
+	prefix string
+	ttl    time.Duration
+	// generation is bumped by writes under the prefix, which orphans the entries
+	// stored before them
+	generation atomic.Int64
+}
+
+// staticCacheRules are the -static-cache rules, longest prefix first
+var staticCacheRules []*staticCacheRule
+
+var staticCache CacheStore
+
+// parseStaticCacheRules parses -static-cache, comma-separated prefix=ttl pairs
+func parseStaticCacheRules(spec string) ([]*staticCacheRule, error) {
+	var rules []*staticCacheRule
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, ttlText, ok := strings.Cut(entry, "=")
+		if !ok || !strings.HasPrefix(prefix, "/v1/") {
+			return nil, fmt.Errorf("invalid -static-cache entry %q: expected /v1/<path>=<ttl>", entry)
+		}
+		ttl, err := time.ParseDuration(ttlText)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid -static-cache TTL %q for %s: expected a positive duration such as 5m", ttlText, prefix)
+		}
+		rules = append(rules, &staticCacheRule{prefix: strings.TrimSuffix(prefix, "/"), ttl: ttl})
+	}
+	sort.SliceStable(rules, func(i, j int) bool { return len(rules[i].prefix) > len(rules[j].prefix) })
+	return rules, nil
+}
+
+// staticCacheRuleFor returns the rule whose prefix covers path, or nil
+func staticCacheRuleFor(path string) *staticCacheRule {
+	for _, rule := range staticCacheRules {
+		if path == rule.prefix || strings.HasPrefix(path, rule.prefix+"/") {
+			return rule
+		}
+	}
+	return nil
+}
+
+// staticLookup is a GET request to a cached endpoint: its key and the stored
+// response, fresh or due for revalidation
+type staticLookup struct {
+	rule  *staticCacheRule
+	key   string
+	entry *cachedResponse // nil on a miss
+	// ifNoneMatch and ifModifiedSince are the client's own validators, answered
+	// by the proxy instead of the upstream
+	ifNoneMatch     string
+	ifModifiedSince string
+}
+
+// lookupStaticCache finds the cached answer to a GET request under a -static-cache
+// prefix. Writes under a prefix invalidate what was cached for it. It returns nil
+// for requests the static cache doesn't handle. X-Proxy-No-Cache is left to the
+// caller, which checks it against the override policy.
+func lookupStaticCache(r *http.Request) *staticLookup {
+	if staticCache == nil {
+		return nil
+	}
+	rule := staticCacheRuleFor(r.URL.Path)
+	if rule == nil {
+		return nil
+	}
+	if r.Method != http.MethodGet {
+		if r.Method != http.MethodHead && r.Method != http.MethodOptions {
+			rule.generation.Add(1)
+		}
+		return nil
+	}
+	if *modelCatalogEnabled && (r.URL.Path == "/v1/models" || strings.HasPrefix(r.URL.Path, "/v1/models/")) || isTransparentRoute(r.URL.Path) {
+		return nil
+	}
+
+	key := sha256.New()
+	fmt.Fprintf(key, "static\n%s\n%d\n%s\n", rule.prefix, rule.generation.Load(), r.URL.RequestURI())
+	credential := sha256.Sum256([]byte(r.Header.Get("Authorization")))
+	key.Write(credential[:])
+	for _, name := range staticCacheVary {
+		key.Write([]byte("\n" + r.Header.Get(name)))
+	}
+	lookup := &staticLookup{
+		rule:            rule,
+		key:             hex.EncodeToString(key.Sum(nil)),
+		ifNoneMatch:     r.Header.Get("If-None-Match"),
+		ifModifiedSince: r.Header.Get("If-Modified-Since"),
+	}
+	if entry, ok := staticCache.Get(lookup.key); ok {
+		lookup.entry = entry
+	}
+	return lookup
+}
+
+// fresh reports whether the stored response is within its rule's TTL
+func (l *staticLookup) fresh() bool {
+	return l != nil && l.entry != nil && time.Since(l.entry.StoredAt) < l.rule.ttl
+}
+
+// revalidate sets the stored response's upstream validators on the request to
+// the upstream, in place of the client's, and reports whether it had any
+func (l *staticLookup) revalidate(header http.Header) bool {
+	if l == nil || l.entry == nil || l.fresh() {
+		return false
+	}
+	etag := l.entry.Header.Get("ETag")
+	if strings.HasPrefix(etag, proxyETagPrefix) {
+		etag = "" // computed by the proxy, unknown to the upstream
+	}
+	lastModified := l.entry.Header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return false
+	}
+	header.Del("If-None-Match")
+	header.Del("If-Modified-Since")
+	if etag != "" {
+		header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		header.Set("If-Modified-Since", lastModified)
+	}
+	return true
+}
+
+// notModified reports whether the client's validators match the stored response
+func (l *staticLookup) notModified(entry *cachedResponse) bool {
+	if l.ifNoneMatch != "" {
+		etag := entry.Header.Get("ETag")
+		for _, candidate := range strings.Split(l.ifNoneMatch, ",") {
+			if candidate = strings.TrimSpace(candidate); candidate == "*" || candidate == etag {
+				return etag != ""
+			}
+		}
+		return false
+	}
+	if l.ifModifiedSince != "" {
+		since, err := http.ParseTime(l.ifModifiedSince)
+		modified, modErr := http.ParseTime(entry.Header.Get("Last-Modified"))
+		return err == nil && modErr == nil && !modified.After(since)
+	}
+	return false
+}
+
+// serve answers the client from a stored response, with a 304 when its own
+// validators still match. outcome is hit or revalidated.
+func (l *staticLookup) serve(w http.ResponseWriter, entry *cachedResponse, outcome string) string {
+	status := entry.Status
+	cached := entry
+	if l.notModified(entry) {
+		status, outcome = "304 Not Modified", "not_modified"
+		cached = &cachedResponse{StatusCode: http.StatusNotModified, Header: entry.Header.Clone()}
+		cached.Header.Del("Content-Length")
+		cached.Header.Del("Content-Type")
+	}
+	w.Header().Set("X-Proxy-Cache", outcome)
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(entry.StoredAt).Seconds())))
+	serveCachedResponse(w, cached)
+	l.count(outcome)
+	log.Printf("💾 Static cache %s: %s (%s)", outcome, l.rule.prefix, shortKey(l.key))
+	return status
+}
+
+// refreshed restarts the TTL of the stored response after the upstream answered
+// 304 to its validators
+func (l *staticLookup) refreshed(header http.Header) *cachedResponse {
+	entry := *l.entry
+	entry.Header = entry.Header.Clone()
+	for _, name := range []string{"ETag", "Last-Modified", "Cache-Control", "Expires", "Date"} {
+		if value := header.Get(name); value != "" {
+			entry.Header.Set(name, value)
+		}
+	}
+	entry.StoredAt = time.Now()
+	staticCache.Set(l.key, &entry)
+	return &entry
+}
+
+// store caches a 200 response, giving it an ETag of its own when the upstream
+// sent none so polling clients can ask for a 304
+func (l *staticLookup) store(resp *http.Response, header http.Header, body []byte) {
+	if header.Get("ETag") == "" {
+		sum := sha256.Sum256(body)
+		header.Set("ETag", proxyETagPrefix+hex.EncodeToString(sum[:8])+`"`)
+	}
+	// Hits get a trace ID and age of their own
+	header = header.Clone()
+	header.Del("X-Proxy-Trace-Id")
+	header.Del("Age")
+	storeCachedResponse(staticCache, l.key, resp, header, body)
+	l.count("miss")
+}
+
+func (l *staticLookup) count(outcome string) {
+	metrics.Add("openai_proxy_static_cache_requests_total", "GET requests to -static-cache endpoints, by path prefix and outcome.", map[string]string{"prefix": l.rule.prefix, "outcome": outcome}, 1)
+}
+
+// proxyETagPrefix marks the ETags the proxy computes for responses without one
+const proxyETagPrefix = `W/"proxy-`
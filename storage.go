@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceSink stores recorded traces. The forwarder only talks to this interface, so
+// a new backend needs an implementation and a case in openStorage.
+type TraceSink interface {
+	// Record stores a trace
+	Record(trace Trace) error
+	// List returns up to limit of the most recent traces, oldest first
+	List(limit int) ([]Trace, error)
+	// Get returns the trace with the given ID
+	Get(id string) (Trace, bool, error)
+	// Update replaces a stored trace with the same ID, reporting whether it existed
+	Update(trace Trace) (bool, error)
+	// Annotated returns every stored trace with annotations, oldest first. Sinks
+	// never evict annotated traces.
+	Annotated() ([]Trace, error)
+}
+
+// UsageStore keeps the tokens each client key used per UTC day, for the token budget
+// and the usage forecast
+type UsageStore interface {
+	// Add records tokens used by key on day and returns the day's new total
+	Add(key, day string, tokens int64) (int64, error)
+	// Used returns the tokens key used on day
+	Used(key, day string) (int64, error)
+	// Totals returns the tokens of every key starting with prefix on day
+	Totals(day, prefix string) (map[string]int64, error)
+}
+
+// usageRetention is how long usage counters are kept: two days for the token
+// budget, or -usage-history-days for the forecast
+func usageRetention() time.Duration {
+	return max(48*time.Hour, time.Duration(*usageHistoryDays)*24*time.Hour)
+}
+
+var (
+	traceSink  TraceSink  = newMemoryTraceSink(tracesMax)
+	usageStore UsageStore = newMemoryUsageStore()
+)
+
+// storedTraces returns every trace the sink holds: the latest ones, up to what any
+// backend keeps, and the annotated ones it never evicts
+func storedTraces() ([]Trace, error) {
+	latest, err := traceSink.List(max(tracesMax, *traceStoreMax))
+	if err != nil {
+		return nil, err
+	}
+	annotated, err := traceSink.Annotated()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(latest))
+	for _, trace := range latest {
+		seen[trace.Id] = true
+	}
+	for _, trace := range annotated {
+		if !seen[trace.Id] {
+			latest = append(latest, trace)
+		}
+	}
+	return latest, nil
+}
+
+// memoryTraceSink keeps the latest traces, plus annotated ones, in a slice; they are
+// lost on restart
+type memoryTraceSink struct {
+	mu     sync.RWMutex
+	max    int
+	traces []Trace
+}
+
+func newMemoryTraceSink(max int) *memoryTraceSink {
+	return &memoryTraceSink{max: max}
+}
+
+func (s *memoryTraceSink) Record(trace Trace) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.traces = append(s.traces, trace)
+	unannotated := 0
+	for _, t := range s.traces {
+		if !t.annotated() {
+			unannotated++
+		}
+	}
+	if excess := unannotated - s.max; excess > 0 {
+		kept := s.traces[:0]
+		for _, t := range s.traces {
+			if excess > 0 && !t.annotated() {
+				excess--
+				continue
+			}
+			kept = append(kept, t)
+		}
+		s.traces = kept
+	}
+	return nil
+}
+
+func (s *memoryTraceSink) List(limit int) ([]Trace, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	start := max(len(s.traces)-limit, 0)
+	return append([]Trace{}, s.traces[start:]...), nil
+}
+
+func (s *memoryTraceSink) Get(id string) (Trace, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i := len(s.traces) - 1; i >= 0; i-- {
+		if s.traces[i].Id == id {
+			return s.traces[i], true, nil
+		}
+	}
+	return Trace{}, false, nil
+}
+
+func (s *memoryTraceSink) Update(trace Trace) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.traces) - 1; i >= 0; i-- {
+		if s.traces[i].Id == trace.Id {
+			s.traces[i] = trace
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryTraceSink) Annotated() ([]Trace, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := []Trace{}
+	for _, t := range s.traces {
+		if t.annotated() {
+			list = append(list, t)
+		}
+	}
+	return list, nil
+}
+
+// memoryUsageStore counts usage in memory, dropping days past usageRetention
+type memoryUsageStore struct {
+	mu   sync.Mutex
+	days map[string]map[string]int64
+}
+
+func newMemoryUsageStore() *memoryUsageStore {
+	return &memoryUsageStore{days: make(map[string]map[string]int64)}
+}
+
+func (s *memoryUsageStore) Add(key, day string, tokens int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	used, ok := s.days[day]
+	if !ok {
+		used = make(map[string]int64)
+		s.days[day] = used
+		oldest := time.Now().UTC().Add(-usageRetention()).Format("2006-01-02")
+		for d := range s.days {
+			if d < oldest {
+				delete(s.days, d)
+			}
+		}
+	}
+	used[key] += tokens
+	return used[key], nil
+}
+
+func (s *memoryUsageStore) Used(key, day string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.days[day][key], nil
+}
+
+func (s *memoryUsageStore) Totals(day, prefix string) (map[string]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	totals := make(map[string]int64)
+	for key, tokens := range s.days[day] {
+		if strings.HasPrefix(key, prefix) {
+			totals[key] = tokens
+		}
+	}
+	return totals, nil
+}
+
+// storageBackend opens the stores of one persistence backend
+type storageBackend interface {
+	TraceSink() TraceSink
+	UsageStore() UsageStore
+	// CacheStore returns a response cache in its own namespace
+	CacheStore(namespace string, ttl time.Duration) CacheStore
+}
+
+// openStorage connects the backend named by -storage (for traces and usage) and
+// -cache-storage (for response caches). Backends used by both are opened once.
+func openStorage() (cacheBackend storageBackend, err error) {
+	backends := map[string]storageBackend{}
+	open := func(name string) (storageBackend, error) {
+		if backend, ok := backends[name]; ok {
+			return backend, nil
+		}
+		var backend storageBackend
+		var err error
+		switch name {
+		case "sqlite":
+			backend, err = openSQLiteStorage(*sqlitePath)
+		case "redis":
+			backend, err = openRedisStorage(*redisURL, *redisPrefix)
+		default:
+			return nil, fmt.Errorf("unknown storage backend %q: expected memory, sqlite or redis", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		backends[name] = backend
+		return backend, nil
+	}
+
+	if *storageName != "memory" {
+		backend, err := open(*storageName)
+		if err != nil {
+			return nil, err
+		}
+		traceSink, usageStore = backend.TraceSink(), backend.UsageStore()
+		log.Printf("🗃️ Storing traces and usage in %s", *storageName)
+		seedTraceSeq()
+	}
+	if *cacheStorageName != "" {
+		if cacheBackend, err = open(*cacheStorageName); err != nil {
+			return nil, err
+		}
+		log.Printf("🗃️ Storing response caches in %s", *cacheStorageName)
+	}
+	return cacheBackend, nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisTimeout bounds every Redis call, so a slow server delays requests only briefly
+const redisTimeout = 2 * time.Second
+
+// redisStorage keeps traces, usage and caches in Redis, so several proxy instances
+// can share them
+type redisStorage struct {
+	client *redis.Client
+	prefix string
+}
+
+func openRedisStorage(rawURL, prefix string) (*redisStorage, error) {
+	options, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -redis-url %q: %v", rawURL, err)
+	}
+	client := redis.NewClient(options)
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to Redis at %s: %v", options.Addr, err)
+	}
+	return &redisStorage{client: client, prefix: prefix}, nil
+}
+
+func redisContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), redisTimeout)
+}
+
+func (s *redisStorage) TraceSink() TraceSink   { return &redisTraceSink{s} }
+func (s *redisStorage) UsageStore() UsageStore { return &redisUsageStore{s} }
+
+func (s *redisStorage) CacheStore(namespace string, ttl time.Duration) CacheStore {
+	return &redisCache{storage: s, namespace: namespace, ttl: ttl}
+}
+
+// redisTraceSink stores each trace under its own key and keeps a list of IDs, newest
+// first, trimmed to -trace-store-max. Annotated traces are also in a set, and their
+// keys outlive the trimming.
+type redisTraceSink struct {
+	*redisStorage
+}
+
+func (t *redisTraceSink) traceKey(id string) string { return t.prefix + "trace:" + id }
+func (t *redisTraceSink) annotatedKey() string      { return t.prefix + "traces:annotated" }
+
+func (t *redisTraceSink) Record(trace Trace) error {
+	data, err := json.Marshal(trace)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := redisContext()
+	defer cancel()
+	listKey := t.prefix + "traces"
+	pipe := t.client.TxPipeline()
+	pipe.Set(ctx, t.traceKey(trace.Id), data, 0)
+	pipe.LPush(ctx, listKey, trace.Id)
+	dropped := pipe.LRange(ctx, listKey, int64(*traceStoreMax), -1)
+	pipe.LTrim(ctx, listKey, 0, int64(*traceStoreMax)-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	for _, id := range dropped.Val() {
+		if annotated, _ := t.client.SIsMember(ctx, t.annotatedKey(), id).Result(); !annotated {
+			t.client.Del(ctx, t.traceKey(id))
+		}
+	}
+	return nil
+}
+
+func (t *redisTraceSink) Update(trace Trace) (bool, error) {
+	data, err := json.Marshal(trace)
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := redisContext()
+	defer cancel()
+	// SET XX only replaces a trace that is still stored
+	updated, err := t.client.SetXX(ctx, t.traceKey(trace.Id), data, redis.KeepTTL).Result()
+	if err != nil || !updated {
+		return false, err
+	}
+	if trace.annotated() {
+		err = t.client.SAdd(ctx, t.annotatedKey(), trace.Id).Err()
+	} else {
+		err = t.client.SRem(ctx, t.annotatedKey(), trace.Id).Err()
+	}
+	return true, err
+}
+
+func (t *redisTraceSink) Annotated() ([]Trace, error) {
+	ctx, cancel := redisContext()
+	defer cancel()
+	ids, err := t.client.SMembers(ctx, t.annotatedKey()).Result()
+	if err != nil || len(ids) == 0 {
+		return []Trace{}, err
+	}
+	list, err := t.fetch(ctx, ids)
+	sort.Slice(list, func(i, j int) bool { return list[i].Timestamp.Before(list[j].Timestamp) })
+	return list, err
+}
+
+func (t *redisTraceSink) List(limit int) ([]Trace, error) {
+	ctx, cancel := redisContext()
+	defer cancel()
+	ids, err := t.client.LRange(ctx, t.prefix+"traces", 0, int64(limit)-1).Result()
+	if err != nil || len(ids) == 0 {
+		return []Trace{}, err
+	}
+	// The list is newest first; traces are returned oldest first
+	for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+		ids[i], ids[j] = ids[j], ids[i]
+	}
+	return t.fetch(ctx, ids)
+}
+
+// fetch loads the traces with the given IDs, skipping any that no longer exist
+func (t *redisTraceSink) fetch(ctx context.Context, ids []string) ([]Trace, error) {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = t.traceKey(id)
+	}
+	values, err := t.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Trace, 0, len(values))
+	for _, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var trace Trace
+		if err := json.Unmarshal([]byte(data), &trace); err != nil {
+			return nil, err
+		}
+		list = append(list, trace)
+	}
+	return list, nil
+}
+
+func (t *redisTraceSink) Get(id string) (Trace, bool, error) {
+	ctx, cancel := redisContext()
+	defer cancel()
+	data, err := t.client.Get(ctx, t.traceKey(id)).Bytes()
+	if err == redis.Nil {
+		return Trace{}, false, nil
+	}
+	if err != nil {
+		return Trace{}, false, err
+	}
+	var trace Trace
+	if err := json.Unmarshal(data, &trace); err != nil {
+		return Trace{}, false, err
+	}
+	return trace, true, nil
+}
+
+// redisUsageStore keeps one counter per key and day, expiring after usageRetention
+type redisUsageStore struct {
+	*redisStorage
+}
+
+func (u *redisUsageStore) usageKey(key, day string) string {
+	return u.prefix + "usage:" + day + ":" + key
+}
+
+func (u *redisUsageStore) Add(key, day string, tokens int64) (int64, error) {
+	ctx, cancel := redisContext()
+	defer cancel()
+	pipe := u.client.TxPipeline()
+	total := pipe.IncrBy(ctx, u.usageKey(key, day), tokens)
+	pipe.Expire(ctx, u.usageKey(key, day), usageRetention())
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return total.Val(), nil
+}
+
+func (u *redisUsageStore) Used(key, day string) (int64, error) {
+	ctx, cancel := redisContext()
+	defer cancel()
+	used, err := u.client.Get(ctx, u.usageKey(key, day)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return used, err
+}
+
+func (u *redisUsageStore) Totals(day, prefix string) (map[string]int64, error) {
+	ctx, cancel := redisContext()
+	defer cancel()
+	dayPrefix := u.usageKey("", day)
+	var keys []string
+	iter := u.client.Scan(ctx, 0, redisGlobEscaper.Replace(dayPrefix+prefix)+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	totals := make(map[string]int64)
+	if len(keys) == 0 {
+		return totals, nil
+	}
+	values, err := u.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, value := range values {
+		if s, ok := value.(string); ok {
+			tokens, _ := strconv.ParseInt(s, 10, 64)
+			totals[strings.TrimPrefix(keys[i], dayPrefix)] = tokens
+		}
+	}
+	return totals, nil
+}
+
+// redisGlobEscaper quotes the SCAN MATCH metacharacters in key IDs
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// redisCache stores each response as a hash of its metadata and body, expired by
+// Redis after the TTL
+type redisCache struct {
+	storage   *redisStorage
+	namespace string
+	ttl       time.Duration // 0 keeps entries until Redis evicts them
+}
+
+func (c *redisCache) cacheKey(key string) string {
+	return c.storage.prefix + "cache:" + c.namespace + ":" + key
+}
+
+func (c *redisCache) Get(key string) (*cachedResponse, bool) {
+	ctx, cancel := redisContext()
+	defer cancel()
+	fields, err := c.storage.client.HGetAll(ctx, c.cacheKey(key)).Result()
+	if err != nil {
+		log.Printf("❌ Redis cache read failed: %v", err)
+		return nil, false
+	}
+	if len(fields) == 0 {
+		return nil, false
+	}
+	var response cachedResponse
+	if err := json.Unmarshal([]byte(fields["meta"]), &response); err != nil {
+		log.Printf("⚠️ Corrupt Redis cache entry %s: %v", key, err)
+		return nil, false
+	}
+	response.Body = []byte(fields["body"])
+	return &response, true
+}
+
+// Peek is Get: reading an entry doesn't change which entries Redis evicts first
+func (c *redisCache) Peek(key string) (*cachedResponse, bool) {
+	return c.Get(key)
+}
+
+func (c *redisCache) Set(key string, response *cachedResponse) {
+	meta, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("❌ Failed to encode cache entry: %v", err)
+		return
+	}
+	ctx, cancel := redisContext()
+	defer cancel()
+	pipe := c.storage.client.TxPipeline()
+	pipe.HSet(ctx, c.cacheKey(key), "meta", meta, "body", response.Body)
+	if c.ttl > 0 {
+		pipe.Expire(ctx, c.cacheKey(key), c.ttl)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("❌ Redis cache write failed: %v", err)
+	}
+}
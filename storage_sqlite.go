@@ -0,0 +1,271 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteStorage persists traces, usage and caches in one SQLite database file
+type sqliteStorage struct {
+	db *sql.DB
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS traces (
+	id TEXT PRIMARY KEY,
+	timestamp INTEGER NOT NULL,
+	data TEXT NOT NULL,
+	annotated INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS traces_timestamp ON traces (timestamp);
+CREATE TABLE IF NOT EXISTS usage (
+	key TEXT NOT NULL,
+	day TEXT NOT NULL,
+	tokens INTEGER NOT NULL,
+	PRIMARY KEY (key, day)
+);
+CREATE TABLE IF NOT EXISTS cache (
+	namespace TEXT NOT NULL,
+	key TEXT NOT NULL,
+	meta TEXT NOT NULL,
+	body BLOB NOT NULL,
+	stored_at INTEGER NOT NULL,
+	PRIMARY KEY (namespace, key)
+);
+`
+
+func openSQLiteStorage(path string) (*sqliteStorage, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SQLite database %s: %v", path, err)
+	}
+	// SQLite allows one writer at a time; a single connection avoids lock errors
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize SQLite database %s: %v", path, err)
+	}
+	// Databases created before trace annotations lack the annotated column
+	if _, err := db.Exec(`ALTER TABLE traces ADD COLUMN annotated INTEGER NOT NULL DEFAULT 0`); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate SQLite database %s: %v", path, err)
+	}
+	return &sqliteStorage{db: db}, nil
+}
+
+func (s *sqliteStorage) TraceSink() TraceSink   { return &sqliteTraceSink{s.db} }
+func (s *sqliteStorage) UsageStore() UsageStore { return &sqliteUsageStore{s.db} }
+
+func (s *sqliteStorage) CacheStore(namespace string, ttl time.Duration) CacheStore {
+	cache := &sqliteCache{db: s.db, namespace: namespace, ttl: ttl}
+	if ttl > 0 {
+		go cache.pruneLoop(sqliteCachePruneInterval)
+	}
+	return cache
+}
+
+type sqliteTraceSink struct {
+	db *sql.DB
+}
+
+func (t *sqliteTraceSink) Record(trace Trace) error {
+	data, err := json.Marshal(trace)
+	if err != nil {
+		return err
+	}
+	if _, err := t.db.Exec(`INSERT OR REPLACE INTO traces (id, timestamp, data, annotated) VALUES (?, ?, ?, ?)`, trace.Id, trace.Timestamp.UnixNano(), string(data), trace.annotated()); err != nil {
+		return err
+	}
+	// Keep the table bounded, like the in-memory list but larger. Annotated traces stay.
+	_, err = t.db.Exec(`DELETE FROM traces WHERE annotated = 0 AND timestamp < (SELECT timestamp FROM traces WHERE annotated = 0 ORDER BY timestamp DESC LIMIT 1 OFFSET ?)`, *traceStoreMax-1)
+	return err
+}
+
+func (t *sqliteTraceSink) Update(trace Trace) (bool, error) {
+	data, err := json.Marshal(trace)
+	if err != nil {
+		return false, err
+	}
+	result, err := t.db.Exec(`UPDATE traces SET data = ?, annotated = ? WHERE id = ?`, string(data), trace.annotated(), trace.Id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (t *sqliteTraceSink) Annotated() ([]Trace, error) {
+	rows, err := t.db.Query(`SELECT data FROM traces WHERE annotated = 1 ORDER BY timestamp`)
+	if err != nil {
+		return nil, err
+	}
+	return scanTraces(rows)
+}
+
+func (t *sqliteTraceSink) List(limit int) ([]Trace, error) {
+	rows, err := t.db.Query(`SELECT data FROM (SELECT data, timestamp FROM traces ORDER BY timestamp DESC LIMIT ?) ORDER BY timestamp`, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanTraces(rows)
+}
+
+// scanTraces decodes the data column of trace rows
+func scanTraces(rows *sql.Rows) ([]Trace, error) {
+	defer rows.Close()
+	list := []Trace{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var trace Trace
+		if err := json.Unmarshal([]byte(data), &trace); err != nil {
+			return nil, err
+		}
+		list = append(list, trace)
+	}
+	return list, rows.Err()
+}
+
+func (t *sqliteTraceSink) Get(id string) (Trace, bool, error) {
+	var data string
+	err := t.db.QueryRow(`SELECT data FROM traces WHERE id = ?`, id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return Trace{}, false, nil
+	}
+	if err != nil {
+		return Trace{}, false, err
+	}
+	var trace Trace
+	if err := json.Unmarshal([]byte(data), &trace); err != nil {
+		return Trace{}, false, err
+	}
+	return trace, true, nil
+}
+
+type sqliteUsageStore struct {
+	db *sql.DB
+}
+
+func (u *sqliteUsageStore) Add(key, day string, tokens int64) (int64, error) {
+	var total int64
+	err := u.db.QueryRow(`INSERT INTO usage (key, day, tokens) VALUES (?, ?, ?)
+		ON CONFLICT (key, day) DO UPDATE SET tokens = tokens + excluded.tokens
+		RETURNING tokens`, key, day, tokens).Scan(&total)
+	return total, err
+}
+
+func (u *sqliteUsageStore) Used(key, day string) (int64, error) {
+	var used int64
+	err := u.db.QueryRow(`SELECT tokens FROM usage WHERE key = ? AND day = ?`, key, day).Scan(&used)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return used, err
+}
+
+func (u *sqliteUsageStore) Totals(day, prefix string) (map[string]int64, error) {
+	rows, err := u.db.Query(`SELECT key, tokens FROM usage WHERE day = ? AND substr(key, 1, ?) = ?`, day, len(prefix), prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	totals := make(map[string]int64)
+	for rows.Next() {
+		var key string
+		var tokens int64
+		if err := rows.Scan(&key, &tokens); err != nil {
+			return nil, err
+		}
+		totals[key] = tokens
+	}
+	return totals, rows.Err()
+}
+
+// sqliteCachePruneInterval is how often expired cache rows are deleted
+const sqliteCachePruneInterval = 10 * time.Minute
+
+// sqliteCache is one namespace of the cache table. Expired entries are removed
+// when they are next read, and periodically by pruneLoop.
+type sqliteCache struct {
+	db        *sql.DB
+	namespace string
+	ttl       time.Duration // 0 keeps entries forever
+}
+
+func (c *sqliteCache) Get(key string) (*cachedResponse, bool) {
+	response, expired, ok := c.read(key)
+	if expired {
+		c.db.Exec(`DELETE FROM cache WHERE namespace = ? AND key = ?`, c.namespace, key)
+	}
+	return response, ok
+}
+
+// Peek is Get without deleting an expired entry
+func (c *sqliteCache) Peek(key string) (*cachedResponse, bool) {
+	response, _, ok := c.read(key)
+	return response, ok
+}
+
+// read loads the entry for key, reporting whether it was found but has expired
+func (c *sqliteCache) read(key string) (*cachedResponse, bool, bool) {
+	var meta string
+	var body []byte
+	err := c.db.QueryRow(`SELECT meta, body FROM cache WHERE namespace = ? AND key = ?`, c.namespace, key).Scan(&meta, &body)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("❌ SQLite cache read failed: %v", err)
+		}
+		return nil, false, false
+	}
+	var response cachedResponse
+	if err := json.Unmarshal([]byte(meta), &response); err != nil {
+		log.Printf("⚠️ Corrupt SQLite cache entry %s: %v", key, err)
+		return nil, false, false
+	}
+	if c.ttl > 0 && time.Since(response.StoredAt) > c.ttl {
+		return nil, true, false
+	}
+	response.Body = body
+	return &response, false, true
+}
+
+func (c *sqliteCache) Set(key string, response *cachedResponse) {
+	meta, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("❌ Failed to encode cache entry: %v", err)
+		return
+	}
+	if _, err := c.db.Exec(`INSERT OR REPLACE INTO cache (namespace, key, meta, body, stored_at) VALUES (?, ?, ?, ?, ?)`,
+		c.namespace, key, string(meta), response.Body, response.StoredAt.UnixNano()); err != nil {
+		log.Printf("❌ SQLite cache write failed: %v", err)
+	}
+}
+
+// pruneLoop deletes the namespace's expired rows every interval, so entries that are
+// never read again don't stay in the database
+func (c *sqliteCache) pruneLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		if n, err := c.prune(); err != nil {
+			log.Printf("❌ SQLite cache prune failed: %v", err)
+		} else if n > 0 {
+			log.Printf("🧹 Pruned %d expired %s cache entries", n, c.namespace)
+		}
+	}
+}
+
+// prune deletes the namespace's rows stored longer than the TTL ago
+func (c *sqliteCache) prune() (int64, error) {
+	result, err := c.db.Exec(`DELETE FROM cache WHERE namespace = ? AND stored_at < ?`, c.namespace, time.Now().Add(-c.ttl).UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// validStreamRetryMode reports whether mode is a supported -stream-retry
+func validStreamRetryMode(mode string) bool {
+	switch mode {
+	case "off", "discard", "stitch":
+		return true
+	}
+	return false
+}
+
+// streamRetry records on a trace that its stream was cut off and sent again
+type streamRetry struct {
+	Mode    string `json:"mode"`
+	Reason  string `json:"reason"`  // how the first attempt ended
+	Outcome string `json:"outcome"` // recovered, mismatch, failed or unstitchable
+	// DiscardedBytes is output of the first attempt the client never saw, and
+	// SkippedBytes output of the retry dropped because the client already had it
+	DiscardedBytes int    `json:"discarded_bytes,omitempty"`
+	SkippedBytes   int    `json:"skipped_bytes,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// streamFinished reports whether an event ends an OpenAI stream: [DONE] for chat
+// and completions, a terminal event for the Responses API, or an in-band error
+func streamFinished(event sseEvent) bool {
+	if event.Data == sseDone || event.Event == "error" {
+		return true
+	}
+	var payload struct {
+		Type  string          `json:"type"`
+		Error json.RawMessage `json:"error"`
+	}
+	if json.Unmarshal([]byte(event.Data), &payload) != nil {
+		return false
+	}
+	switch payload.Type {
+	case "response.completed", "response.incomplete", "response.failed", "error":
+		return true
+	}
+	return len(payload.Error) > 0 && string(payload.Error) != "null"
+}
+
+// retryingStream reads an upstream SSE stream event by event and, when it ends
+// without finishing, sends the request once more. In discard mode the events are
+// held back until the stream finishes, so a cut-off attempt is dropped unseen; in
+// stitch mode they go out as they arrive and the retry's events are trimmed to
+// the text the client doesn't have yet.
+type retryingStream struct {
+	ctx    context.Context
+	mode   string
+	body   io.Reader
+	retry  func() (io.ReadCloser, error) // nil once used
+	closer io.Closer                     // the retry's body
+
+	buf      []byte
+	rest     string       // incomplete event of the current attempt
+	out      bytes.Buffer // complete events not yet read
+	finished bool         // the current attempt finished its stream
+	ended    bool
+	err      error
+
+	// Stitching tracks the text of each choice the client got and the retry repeated
+	forwarded    int
+	unstitchable bool
+	sent         map[int]string
+	repeated     map[int]string
+	stitching    bool
+
+	info *streamRetry
+}
+
+func newRetryingStream(ctx context.Context, mode string, body io.Reader, retry func() (io.ReadCloser, error)) *retryingStream {
+	return &retryingStream{ctx: ctx, mode: mode, body: body, retry: retry, sent: make(map[int]string), repeated: make(map[int]string)}
+}
+
+func (s *retryingStream) Read(p []byte) (int, error) {
+	if s.buf == nil {
+		s.buf = make([]byte, 32*1024)
+	}
+	for s.out.Len() == 0 || s.holding() {
+		if s.ended {
+			if s.out.Len() > 0 {
+				break
+			}
+			if s.err != nil {
+				return 0, s.err
+			}
+			return 0, io.EOF
+		}
+		n, err := s.body.Read(s.buf)
+		if n > 0 {
+			s.feed(string(s.buf[:n]))
+		}
+		if err != nil {
+			s.attemptEnded(err)
+		}
+	}
+	return s.out.Read(p)
+}
+
+// holding reports whether discard mode still holds back the first attempt
+func (s *retryingStream) holding() bool {
+	return s.mode == "discard" && s.retry != nil && !s.finished
+}
+
+// feed splits text into complete events and queues them for the client
+func (s *retryingStream) feed(text string) {
+	text = strings.ReplaceAll(s.rest+text, "\r\n", "\n")
+	end := strings.LastIndex(text, "\n\n")
+	if end < 0 {
+		s.rest = text
+		return
+	}
+	s.rest = text[end+2:]
+	events, _ := parseSSE(text[:end+2])
+	for _, event := range events {
+		if streamFinished(event) {
+			s.finished = true
+		}
+		if s.stitching {
+			var ok bool
+			if event, ok = s.stitch(event); !ok {
+				continue
+			}
+		} else if s.retry != nil {
+			s.track(event)
+		}
+		s.out.WriteString(encodeSSE([]sseEvent{event}))
+	}
+}
+
+// streamChoices is the part of a chat or completions chunk that carries text
+type streamChoices struct {
+	Choices []struct {
+		Index int `json:"index"`
+		Delta *struct {
+			Content      string          `json:"content"`
+			ToolCalls    json.RawMessage `json:"tool_calls"`
+			FunctionCall json.RawMessage `json:"function_call"`
+		} `json:"delta"`
+		Text string `json:"text"`
+	} `json:"choices"`
+}
+
+// track remembers the text of the first attempt's choices. Streams whose output
+// isn't choice text, such as tool calls or Responses API events, can't be stitched.
+func (s *retryingStream) track(event sseEvent) {
+	s.forwarded++
+	if event.Data == sseDone {
+		return
+	}
+	var chunk streamChoices
+	if json.Unmarshal([]byte(event.Data), &chunk) != nil || !strings.Contains(event.Data, `"choices"`) {
+		s.unstitchable = true
+		return
+	}
+	for _, choice := range chunk.Choices {
+		if choice.Delta != nil {
+			if len(choice.Delta.ToolCalls) > 0 || len(choice.Delta.FunctionCall) > 0 {
+				s.unstitchable = true
+			}
+			s.sent[choice.Index] += choice.Delta.Content
+		}
+		s.sent[choice.Index] += choice.Text
+	}
+}
+
+// stitch trims a retried event to the text the client hasn't seen. Events that
+// add nothing new are dropped until every choice caught up.
+func (s *retryingStream) stitch(event sseEvent) (sseEvent, bool) {
+	if event.Data == sseDone {
+		return event, true
+	}
+	var chunk map[string]interface{}
+	if json.Unmarshal([]byte(event.Data), &chunk) != nil {
+		return event, true
+	}
+	choices, _ := chunk["choices"].([]interface{})
+	keep := len(choices) == 0 // usage and other choice-less chunks pass
+	for _, c := range choices {
+		choice, _ := c.(map[string]interface{})
+		if choice == nil {
+			continue
+		}
+		index := 0
+		if i, ok := choice["index"].(float64); ok {
+			index = int(i)
+		}
+		field, holder := "text", choice
+		if delta, ok := choice["delta"].(map[string]interface{}); ok {
+			field, holder = "content", delta
+		}
+		text, _ := holder[field].(string)
+		sent, before := s.sent[index], len(s.repeated[index])
+		s.repeated[index] += text
+		if overlap := min(len(s.repeated[index]), len(sent)); overlap > before && s.repeated[index][before:overlap] != sent[before:overlap] {
+			s.info.Outcome = "mismatch"
+		}
+		if skip := min(max(len(sent)-before, 0), len(text)); skip > 0 {
+			s.info.SkippedBytes += skip
+			text = text[skip:]
+			holder[field] = text
+		}
+		if text != "" || choice["finish_reason"] != nil {
+			keep = true
+		}
+	}
+	if !keep {
+		return event, false
+	}
+	data, err := json.Marshal(chunk)
+	if err != nil {
+		return event, true
+	}
+	event.Data = string(data)
+	return event, true
+}
+
+// attemptEnded handles the end of an attempt's body and retries a stream that
+// stopped before it finished
+func (s *retryingStream) attemptEnded(err error) {
+	if err == io.EOF {
+		err = nil
+	}
+	if s.finished || s.retry == nil || s.ctx.Err() != nil {
+		s.end(err)
+		return
+	}
+	reason := "ended before its final event"
+	if err != nil {
+		reason = "failed: " + err.Error()
+	}
+	s.info = &streamRetry{Mode: s.mode, Reason: reason, Outcome: "recovered"}
+	retry := s.retry
+	if s.mode == "stitch" && s.unstitchable && s.forwarded > 0 {
+		s.info.Outcome = "unstitchable"
+		s.retry = nil
+		log.Printf("🔁 Upstream stream %s after %d events that can't be stitched, not retrying", reason, s.forwarded)
+		s.end(err)
+		return
+	}
+	log.Printf("🔁 Upstream stream %s, retrying once (%s)", reason, s.mode)
+	body, retryErr := retry()
+	s.retry = nil
+	if retryErr != nil {
+		log.Printf("❌ Stream retry failed: %v", retryErr)
+		s.info.Outcome, s.info.Error = "failed", retryErr.Error()
+		s.end(err)
+		return
+	}
+	if s.mode == "discard" {
+		s.info.DiscardedBytes = s.out.Len() + len(s.rest)
+		s.out.Reset()
+	}
+	s.body, s.closer, s.rest = body, body, ""
+	s.stitching = s.mode == "stitch" && s.forwarded > 0
+}
+
+// end finishes the stream; an incomplete last event is passed on as the proxy
+// would without retries
+func (s *retryingStream) end(err error) {
+	if s.info != nil {
+		if !s.finished && s.info.Outcome != "failed" && s.info.Outcome != "unstitchable" {
+			s.info.Outcome = "failed"
+			if err != nil {
+				s.info.Error = err.Error()
+			} else {
+				s.info.Error = "the retry also ended before its final event"
+			}
+		}
+		metrics.Add("openai_proxy_stream_retries_total", "Streams retried after the upstream cut them off, by -stream-retry mode and outcome.", map[string]string{"mode": s.info.Mode, "outcome": s.info.Outcome}, 1)
+	}
+	s.out.WriteString(s.rest)
+	s.rest = ""
+	s.ended, s.err = true, err
+}
+
+// Info returns the retry to record on the trace, nil if the stream wasn't retried
+func (s *retryingStream) Info() *streamRetry {
+	if s == nil {
+		return nil
+	}
+	return s.info
+}
+
+// Close closes the retried body; the first attempt's is closed by the caller
+func (s *retryingStream) Close() {
+	if s != nil && s.closer != nil {
+		s.closer.Close()
+	}
+}
+
+// resendStream sends a streamed request again for a retry and returns its decoded
+// body, captured like the first attempt's
+func resendStream(ctx context.Context, req *http.Request, body []byte, capture *captureSession) (io.ReadCloser, error) {
+	retryReq := req.Clone(ctx)
+	retryReq.Body = io.NopCloser(bytes.NewReader(body))
+	resp, err := upstreamClientFor(ctx).Do(retryReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Content-Type"), "text/event-stream") {
+		resp.Body.Close()
+		return nil, fmt.Errorf("retry answered %s (%s)", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	resp.Body = capture.Response(resp)
+	encoding := responseEncoding(resp.Header)
+	if encoding == "" {
+		return resp.Body, nil
+	}
+	decoded, err := decodingReader(encoding, resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to decode %s retry: %v", encoding, err)
+	}
+	return readCloser{decoded, resp.Body}, nil
+}
+
+// readCloser closes a decoder and the body under it
+type readCloser struct {
+	io.ReadCloser
+	body io.Closer
+}
+
+func (rc readCloser) Close() error {
+	rc.ReadCloser.Close()
+	return rc.body.Close()
+}
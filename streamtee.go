@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// teedStream is the complete raw body of one streamed response
+type teedStream struct {
+	traceID     string
+	path        string
+	contentType string
+	body        []byte
+	truncated   bool
+}
+
+// streamTeeBuffer collects a stream in memory up to -stream-tee-max-bytes, so the
+// client path never waits on a sink
+type streamTeeBuffer struct {
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (b *streamTeeBuffer) Write(p []byte) (int, error) {
+	if room := *streamTeeMaxBytes - b.buf.Len(); room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+// streamTeeQueue hands finished streams to the sink worker; nil unless a
+// -stream-tee-* sink is configured
+var streamTeeQueue chan teedStream
+
+// streamTeeEnabled reports whether streams are teed to any sink
+func streamTeeEnabled() bool {
+	return streamTeeQueue != nil
+}
+
+// startStreamTee starts the worker delivering teed streams to the configured sinks
+func startStreamTee() error {
+	if *streamTeeDir == "" && *streamTeeWebhook == "" && *streamTeeKafkaTopic == "" {
+		return nil
+	}
+	if *streamTeeDir != "" {
+		if err := os.MkdirAll(*streamTeeDir, 0o755); err != nil {
+			return fmt.Errorf("failed to create -stream-tee-dir: %v", err)
+		}
+	}
+	streamTeeQueue = make(chan teedStream, 256)
+	go func() {
+		for stream := range streamTeeQueue {
+			deliverTeedStream(stream)
+		}
+	}()
+	return nil
+}
+
+// teeStream queues a finished stream for the sinks, dropping it if the worker is
+// backed up
+func teeStream(stream teedStream) {
+	select {
+	case streamTeeQueue <- stream:
+	default:
+		log.Printf("⚠️ Stream tee queue full, dropping stream of %s", stream.traceID)
+		metrics.Add("openai_proxy_stream_tee_total", "Streams teed to external sinks, by sink and outcome.", map[string]string{"sink": "queue", "outcome": "dropped"}, 1)
+	}
+}
+
+// deliverTeedStream writes one stream to every configured sink
+func deliverTeedStream(stream teedStream) {
+	count := func(sink string, err error) {
+		outcome := "ok"
+		if err != nil {
+			outcome = "error"
+			log.Printf("❌ Stream tee to %s failed for %s: %v", sink, stream.traceID, err)
+		}
+		metrics.Add("openai_proxy_stream_tee_total", "Streams teed to external sinks, by sink and outcome.", map[string]string{"sink": sink, "outcome": outcome}, 1)
+	}
+	if *streamTeeDir != "" {
+		count("file", os.WriteFile(filepath.Join(*streamTeeDir, stream.traceID+".sse"), stream.body, 0o644))
+	}
+	if *streamTeeWebhook != "" {
+		count("webhook", postTeedStream(stream))
+	}
+	if *streamTeeKafkaTopic != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		count("kafka", kafkaProduce(ctx, *streamTeeKafkaTopic, []byte(stream.traceID), stream.body, stream.metadata()))
+		cancel()
+	}
+}
+
+// metadata describes a stream for webhook and Kafka headers
+func (s teedStream) metadata() map[string]string {
+	return map[string]string{
+		"X-Proxy-Trace-Id":  s.traceID,
+		"X-Proxy-Path":      s.path,
+		"Content-Type":      s.contentType,
+		"X-Proxy-Truncated": fmt.Sprint(s.truncated),
+	}
+}
+
+// postTeedStream sends the raw stream as the body of a POST to -stream-tee-webhook
+func postTeedStream(stream teedStream) error {
+	req, err := http.NewRequest(http.MethodPost, *streamTeeWebhook, bytes.NewReader(stream.body))
+	if err != nil {
+		return err
+	}
+	for name, value := range stream.metadata() {
+		req.Header.Set(name, value)
+	}
+	resp, err := alertClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", *streamTeeWebhook, resp.Status)
+	}
+	return nil
+}
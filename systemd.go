@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// systemdAdminSocket is the FileDescriptorName that hands a socket to the admin server
+const systemdAdminSocket = "admin"
+
+// systemdSockets holds the listeners passed by systemd socket activation, by
+// FileDescriptorName; nil when the proxy wasn't socket-activated
+var systemdSockets map[string][]net.Listener
+
+// watchdogProbe is a forwarder address the watchdog connects to before each ping,
+// so a proxy that stopped accepting connections gets restarted
+var watchdogProbe net.Addr
+
+// listenersBound counts the servers still binding; readiness is signaled once
+// every one of them listens
+var listenersBound sync.WaitGroup
+
+// systemdListeners returns the sockets systemd passed through LISTEN_FDS, by name.
+// The variables are cleared so processes the proxy starts don't claim them.
+func systemdListeners() (map[string][]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	sockets := make(map[string][]net.Listener)
+	// Passed descriptors start after stdin, stdout and stderr
+	for i := 0; i < count; i++ {
+		fd := 3 + i
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("systemd socket %d (%s) is not a stream socket: %v", fd, name, err)
+		}
+		sockets[name] = append(sockets[name], listener)
+	}
+	return sockets, nil
+}
+
+// inheritedListeners returns the socket-activated listeners of the admin server,
+// named admin, or of the forwarder, all the others
+func inheritedListeners(admin bool) []net.Listener {
+	var listeners []net.Listener
+	for name, sockets := range systemdSockets {
+		if (name == systemdAdminSocket) == admin {
+			listeners = append(listeners, sockets...)
+		}
+	}
+	return listeners
+}
+
+// listenerURL names a listener in logs; systemd may pass Unix sockets
+func listenerURL(scheme string, addr net.Addr) string {
+	if addr.Network() == "unix" {
+		return scheme + "+unix:" + addr.String()
+	}
+	return scheme + "://" + addr.String()
+}
+
+// systemdSocketName returns the FileDescriptorName of a socket-activated listener
+func systemdSocketName(listener net.Listener) string {
+	for name, sockets := range systemdSockets {
+		for _, socket := range sockets {
+			if socket == listener {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// sdNotify sends a state such as READY=1 to the systemd service manager. It does
+// nothing unless the proxy runs as a Type=notify service.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:] // abstract namespace
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to reach NOTIFY_SOCKET: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("failed to notify systemd: %v", err)
+	}
+	return nil
+}
+
+// systemdWatchdogInterval returns how often to ping the watchdog: half its
+// WatchdogSec timeout, or 0 when no watchdog watches this process
+func systemdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// notifySystemdReady waits for the servers to listen, tells systemd the service
+// is ready and keeps its watchdog fed
+func notifySystemdReady() {
+	listenersBound.Wait()
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	status := "Forwarding requests"
+	if loadShed != nil {
+		status = "Load " + loadShed.snapshot().Level
+	}
+	if err := sdNotify("READY=1\nSTATUS=" + status); err != nil {
+		log.Printf("❌ %v", err)
+		return
+	}
+	log.Printf("🐧 Notified systemd that the proxy is ready")
+	interval := systemdWatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	log.Printf("🐧 Pinging the systemd watchdog every %v", interval)
+	for range time.Tick(interval) {
+		conn, err := net.DialTimeout(watchdogProbe.Network(), watchdogProbe.String(), interval/2)
+		if err != nil {
+			log.Printf("❌ Skipping the systemd watchdog ping, the forwarder doesn't accept connections: %v", err)
+			continue
+		}
+		conn.Close()
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			log.Printf("❌ %v", err)
+		}
+	}
+}
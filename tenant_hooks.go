@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// tenantHookQuotaWindow is the period -tenant-hook-cpu-quota applies to
+const tenantHookQuotaWindow = time.Minute
+
+// tenantHook is one tenant's Lua script with its own execution slots, time quota
+// and counters, so an expensive or failing script only affects its tenant
+type tenantHook struct {
+	tenant      string
+	script      string
+	hasRequest  bool
+	hasResponse bool
+	slots       chan struct{}
+
+	mu          sync.Mutex
+	windowStart time.Time
+	used        time.Duration
+	calls       int64
+	errors      int64
+	timeouts    int64
+	throttled   int64
+}
+
+// tenantHookSet holds the scripts of -tenant-hooks-dir, keyed by tenant
+type tenantHookSet struct {
+	tenants map[string]*tenantHook
+}
+
+// tenantHooks is nil unless -tenant-hooks-dir is set
+var tenantHooks *tenantHookSet
+
+// loadTenantHooks loads every <tenant>.lua file in dir
+func loadTenantHooks(dir string) (*tenantHookSet, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.lua"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tenant hooks: %v", err)
+	}
+	set := &tenantHookSet{tenants: make(map[string]*tenantHook)}
+	for _, file := range files {
+		tenant := strings.TrimSuffix(filepath.Base(file), ".lua")
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tenant hook %s: %v", file, err)
+		}
+		hook := &tenantHook{
+			tenant: tenant,
+			script: string(data),
+			slots:  make(chan struct{}, max(*tenantHookConcurrency, 1)),
+		}
+		L := hook.newState("")
+		err = L.DoString(hook.script)
+		if err == nil {
+			hook.hasRequest = L.GetGlobal("processRequest").Type() == lua.LTFunction
+			hook.hasResponse = L.GetGlobal("processResponse").Type() == lua.LTFunction
+		}
+		L.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load tenant hook %s: %v", file, err)
+		}
+		if !hook.hasRequest && !hook.hasResponse {
+			return nil, fmt.Errorf("tenant hook %s must define 'processRequest' or 'processResponse'", file)
+		}
+		set.tenants[tenant] = hook
+		log.Printf("✅ Tenant hook loaded for %s (processRequest: %v, processResponse: %v)", tenant, hook.hasRequest, hook.hasResponse)
+	}
+	return set, nil
+}
+
+// newState creates a Lua state whose kv and cache modules only see the tenant's keys
+func (h *tenantHook) newState(traceID string) *lua.LState {
+	L := lua.NewState()
+	preloadLuaModules(L, traceID)
+	L.PreloadModule("kv", luaKVLoaderFor("tenant:"+h.tenant+":"))
+	L.PreloadModule("cache", luaCacheLoaderFor("tenant:"+h.tenant+":"))
+	return L
+}
+
+// reserve checks the tenant's time quota for the current window
+func (h *tenantHook) reserve() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if now := time.Now(); now.Sub(h.windowStart) >= tenantHookQuotaWindow {
+		h.windowStart, h.used = now, 0
+	}
+	if *tenantHookCPUQuota > 0 && h.used >= *tenantHookCPUQuota {
+		h.throttled++
+		return false
+	}
+	h.calls++
+	return true
+}
+
+// finish charges a call's run time to the quota and counts its outcome
+func (h *tenantHook) finish(elapsed time.Duration, outcome string) {
+	h.mu.Lock()
+	h.used += elapsed
+	switch outcome {
+	case "error":
+		h.errors++
+	case "timeout":
+		h.timeouts++
+	}
+	h.mu.Unlock()
+	h.count(outcome)
+	metrics.Observe("openai_proxy_tenant_hook_seconds", "Run time of tenant hook calls.", map[string]string{"tenant": h.tenant}, elapsed.Seconds())
+}
+
+func (h *tenantHook) count(outcome string) {
+	metrics.Add("openai_proxy_tenant_hook_calls_total", "Tenant hook calls, by tenant and outcome.", map[string]string{"tenant": h.tenant, "outcome": outcome}, 1)
+}
+
+// run calls fn(body, headers) in a fresh state. Like the global hooks, a call
+// that fails, times out or is over quota leaves the body and headers unchanged.
+func (h *tenantHook) run(fn, traceID string, body []byte, headers http.Header) ([]byte, http.Header) {
+	timeout := *tenantHookTimeout
+	if timeout <= 0 {
+		timeout = time.Hour
+	}
+	waited := time.NewTimer(timeout)
+	defer waited.Stop()
+	select {
+	case h.slots <- struct{}{}:
+		defer func() { <-h.slots }()
+	case <-waited.C:
+		log.Printf("⏳ Tenant %s hook skipped: all %d slots busy", h.tenant, cap(h.slots))
+		h.mu.Lock()
+		h.throttled++
+		h.mu.Unlock()
+		h.count("busy")
+		return body, headers
+	}
+	if !h.reserve() {
+		log.Printf("⏳ Tenant %s hook skipped: %v quota per %v used up", h.tenant, *tenantHookCPUQuota, tenantHookQuotaWindow)
+		h.count("throttled")
+		return body, headers
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	L := h.newState(traceID)
+	defer L.Close()
+	L.SetContext(ctx)
+
+	err := L.DoString(h.script)
+	if err == nil {
+		L.Push(L.GetGlobal(fn))
+		L.Push(lua.LString(string(body)))
+		L.Push(httpHeaderToLuaTable(L, headers))
+		err = L.PCall(2, 2, nil)
+	}
+	if err != nil {
+		outcome := "error"
+		if ctx.Err() != nil {
+			outcome = "timeout"
+		}
+		log.Printf("❌ Tenant %s %s failed (%s): %v", h.tenant, fn, outcome, err)
+		h.finish(time.Since(start), outcome)
+		return body, headers
+	}
+
+	if modified := L.Get(-2); modified.Type() == lua.LTString {
+		body = []byte(modified.String())
+	}
+	if modified, ok := L.Get(-1).(*lua.LTable); ok {
+		headers = luaTableToHttpHeader(L, modified)
+	}
+	h.finish(time.Since(start), "ok")
+	log.Printf("🔧 Tenant %s %s executed in %v", h.tenant, fn, time.Since(start).Round(time.Microsecond))
+	return body, headers
+}
+
+// ExecuteRequestHook runs the tenant's processRequest, if it has one
+func (s *tenantHookSet) ExecuteRequestHook(tenant, traceID string, body []byte, headers http.Header) ([]byte, http.Header) {
+	if s == nil {
+		return body, headers
+	}
+	if hook := s.tenants[tenant]; hook != nil && hook.hasRequest {
+		return hook.run("processRequest", traceID, body, headers)
+	}
+	return body, headers
+}
+
+// ExecuteResponseHook runs the tenant's processResponse, if it has one
+func (s *tenantHookSet) ExecuteResponseHook(tenant, traceID string, body []byte, headers http.Header) ([]byte, http.Header) {
+	if s == nil {
+		return body, headers
+	}
+	if hook := s.tenants[tenant]; hook != nil && hook.hasResponse {
+		return hook.run("processResponse", traceID, body, headers)
+	}
+	return body, headers
+}
+
+// defines reports whether the tenant's script has processRequest, or with
+// response set processResponse
+func (s *tenantHookSet) defines(tenant string, response bool) bool {
+	if s == nil || s.tenants[tenant] == nil {
+		return false
+	}
+	if response {
+		return s.tenants[tenant].hasResponse
+	}
+	return s.tenants[tenant].hasRequest
+}
+
+// hasResponseHooks reports whether any tenant defines processResponse
+func (s *tenantHookSet) hasResponseHooks() bool {
+	if s == nil {
+		return false
+	}
+	for _, hook := range s.tenants {
+		if hook.hasResponse {
+			return true
+		}
+	}
+	return false
+}
+
+// tenantHookStats is one entry of GET /tenant-hooks
+type tenantHookStats struct {
+	Tenant      string  `json:"tenant"`
+	Request     bool    `json:"process_request"`
+	Response    bool    `json:"process_response"`
+	Calls       int64   `json:"calls"`
+	Errors      int64   `json:"errors"`
+	Timeouts    int64   `json:"timeouts"`
+	Throttled   int64   `json:"throttled"`
+	Busy        int     `json:"busy_slots"`
+	QuotaUsedMs float64 `json:"quota_used_ms"`
+}
+
+// handleTenantHooks serves GET /tenant-hooks on the admin server
+func handleTenantHooks(w http.ResponseWriter, r *http.Request) {
+	if tenantHooks == nil {
+		writeJSONError(w, http.StatusNotFound, "not_found", "tenant hooks are not enabled")
+		return
+	}
+	stats := []tenantHookStats{}
+	for _, hook := range tenantHooks.tenants {
+		hook.mu.Lock()
+		used := hook.used
+		if time.Since(hook.windowStart) >= tenantHookQuotaWindow {
+			used = 0
+		}
+		stats = append(stats, tenantHookStats{
+			Tenant:      hook.tenant,
+			Request:     hook.hasRequest,
+			Response:    hook.hasResponse,
+			Calls:       hook.calls,
+			Errors:      hook.errors,
+			Timeouts:    hook.timeouts,
+			Throttled:   hook.throttled,
+			Busy:        len(hook.slots),
+			QuotaUsedMs: float64(used) / float64(time.Millisecond),
+		})
+		hook.mu.Unlock()
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Tenant < stats[j].Tenant })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// testcaseMaxChoices caps the choices and tool calls a generated test asserts on
+const testcaseMaxChoices = 4
+
+// testcaseHeaders are the request headers besides the credential a generated test
+// sends, because they change what the upstream answers
+var testcaseHeaders = []string{"OpenAI-Beta"}
+
+// testAssertion is one check a generated test makes on the response body. path
+// leads to the field through object keys and array indexes.
+type testAssertion struct {
+	path  []interface{} // string keys and int indexes
+	kind  string        // equals, prefix, length or present
+	value interface{}   // the expected string, or length
+}
+
+// traceTestCase is the language-independent part of a generated test
+type traceTestCase struct {
+	trace      Trace
+	name       string
+	method     string
+	path       string
+	headers    [][2]string
+	body       string // indented JSON, or empty
+	status     int
+	stream     bool // the response is an event stream
+	assertions []testAssertion
+}
+
+// buildTraceTestCase derives the request and the assertions of a test from a
+// recorded exchange. Generated text isn't asserted on, since models don't repeat
+// themselves; the status, object types, finish reasons, tool names and sizes are.
+func buildTraceTestCase(trace Trace) (*traceTestCase, error) {
+	requestBody, responseBody, err := traceBodies(trace)
+	if err != nil {
+		return nil, err
+	}
+	target, err := url.Parse(trace.URL)
+	if err != nil {
+		return nil, fmt.Errorf("trace %s has an invalid URL: %v", trace.Id, err)
+	}
+	status, err := strconv.Atoi(strings.Fields(trace.Status + " 0")[0])
+	if err != nil || status == 0 {
+		return nil, fmt.Errorf("trace %s has no upstream status to assert on", trace.Id)
+	}
+	if trace.RedactedAt != nil {
+		return nil, fmt.Errorf("trace %s was redacted", trace.Id)
+	}
+	tc := &traceTestCase{
+		trace:  trace,
+		name:   testcaseName(trace.Id),
+		method: trace.Method,
+		path:   target.RequestURI(),
+		status: status,
+	}
+	var request map[string]interface{}
+	if requestBody != "" {
+		var indented bytes.Buffer
+		if json.Indent(&indented, []byte(requestBody), "", "  ") != nil || json.Unmarshal([]byte(requestBody), &request) != nil {
+			return nil, fmt.Errorf("trace %s has a non-JSON request body, which can't be turned into a test", trace.Id)
+		}
+		tc.body = indented.String()
+		tc.headers = append(tc.headers, [2]string{"Content-Type", "application/json"})
+	} else if trace.Method != http.MethodGet && trace.Method != http.MethodDelete {
+		return nil, fmt.Errorf("trace %s has no recorded request body", trace.Id)
+	}
+	for _, name := range testcaseHeaders {
+		if value := trace.RequestHeader.Get(name); value != "" {
+			tc.headers = append(tc.headers, [2]string{name, value})
+		}
+	}
+
+	// Traces keep streamed responses only when they were captured
+	trimmed := strings.TrimSpace(responseBody)
+	if streamed, _ := request["stream"].(bool); streamed && status == http.StatusOK || strings.HasPrefix(trimmed, "data:") || strings.HasPrefix(trimmed, "event:") {
+		tc.stream = true
+		return tc, nil
+	}
+	var response map[string]interface{}
+	if json.Unmarshal([]byte(trimmed), &response) == nil {
+		requestModel, _ := request["model"].(string)
+		tc.assertions = responseAssertions(response, requestModel)
+	}
+	return tc, nil
+}
+
+// testcaseName turns a trace ID into a test function name
+func testcaseName(id string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, id)
+}
+
+// responseAssertions picks the stable fields of an API response to assert on
+func responseAssertions(response map[string]interface{}, requestModel string) []testAssertion {
+	var assertions []testAssertion
+	equals := func(value interface{}, path ...interface{}) {
+		if s, ok := value.(string); ok && s != "" {
+			assertions = append(assertions, testAssertion{path: path, kind: "equals", value: s})
+		}
+	}
+	if apiErr, ok := response["error"].(map[string]interface{}); ok {
+		equals(apiErr["type"], "error", "type")
+		equals(apiErr["code"], "error", "code")
+		return assertions
+	}
+	equals(response["object"], "object")
+	if model, ok := response["model"].(string); ok {
+		// Upstreams answer with a dated snapshot of the requested model
+		if requestModel != "" && strings.HasPrefix(model, requestModel) {
+			assertions = append(assertions, testAssertion{path: []interface{}{"model"}, kind: "prefix", value: requestModel})
+		} else {
+			equals(model, "model")
+		}
+	}
+	if choices, ok := response["choices"].([]interface{}); ok {
+		assertions = append(assertions, testAssertion{path: []interface{}{"choices"}, kind: "length", value: len(choices)})
+		for i, item := range choices[:min(len(choices), testcaseMaxChoices)] {
+			choice, _ := item.(map[string]interface{})
+			equals(choice["finish_reason"], "choices", i, "finish_reason")
+			message, _ := choice["message"].(map[string]interface{})
+			equals(message["role"], "choices", i, "message", "role")
+			if content, ok := message["content"].(string); ok && content != "" {
+				assertions = append(assertions, testAssertion{path: []interface{}{"choices", i, "message", "content"}, kind: "present"})
+			}
+			if calls, ok := message["tool_calls"].([]interface{}); ok {
+				assertions = append(assertions, testAssertion{path: []interface{}{"choices", i, "message", "tool_calls"}, kind: "length", value: len(calls)})
+				for j, item := range calls[:min(len(calls), testcaseMaxChoices)] {
+					call, _ := item.(map[string]interface{})
+					function, _ := call["function"].(map[string]interface{})
+					equals(function["name"], "choices", i, "message", "tool_calls", j, "function", "name")
+				}
+			}
+		}
+	}
+	if data, ok := response["data"].([]interface{}); ok {
+		assertions = append(assertions, testAssertion{path: []interface{}{"data"}, kind: "length", value: len(data)})
+		if len(data) > 0 {
+			first, _ := data[0].(map[string]interface{})
+			if embedding, ok := first["embedding"].([]interface{}); ok {
+				assertions = append(assertions, testAssertion{path: []interface{}{"data", 0, "embedding"}, kind: "length", value: len(embedding)})
+			}
+		}
+	}
+	equals(response["status"], "status")
+	if usage, ok := response["usage"].(map[string]interface{}); ok {
+		if _, ok := usage["total_tokens"]; ok {
+			assertions = append(assertions, testAssertion{path: []interface{}{"usage", "total_tokens"}, kind: "present"})
+		}
+	}
+	return assertions
+}
+
+// goQuote returns a Go string literal, raw when the text allows
+func goQuote(s string) string {
+	if !strings.Contains(s, "`") && !strings.Contains(s, "\r") {
+		return "`" + s + "`"
+	}
+	return strconv.Quote(s)
+}
+
+// pyQuote returns a Python string literal
+func pyQuote(s string) string {
+	encoded, _ := json.Marshal(s)
+	return string(encoded)
+}
+
+// describe names the field of an assertion in failure messages
+func (a testAssertion) describe() string {
+	var parts []string
+	for _, segment := range a.path {
+		parts = append(parts, fmt.Sprint(segment))
+	}
+	return strings.Join(parts, ".")
+}
+
+// renderGoTestCase renders a test case as a Go test
+func renderGoTestCase(tc *traceTestCase) string {
+	var b strings.Builder
+	imports := map[string]bool{"net/http": true, "os": true, "testing": true}
+	imports["strings"] = tc.body != "" || tc.stream || hasAssertion(tc, "prefix")
+	imports["io"] = tc.stream
+	imports["encoding/json"] = !tc.stream && len(tc.assertions) > 0
+	imports["fmt"] = !tc.stream && hasAssertion(tc, "prefix")
+	fmt.Fprintf(&b, "package proxytest\n\nimport (\n")
+	for _, name := range []string{"encoding/json", "fmt", "io", "net/http", "os", "strings", "testing"} {
+		if imports[name] {
+			fmt.Fprintf(&b, "\t%q\n", name)
+		}
+	}
+	fmt.Fprintf(&b, ")\n\n")
+	fmt.Fprintf(&b, "// TestTrace%s replays trace %s, recorded %s: %s %s answered %s.\n", tc.name, tc.trace.Id, tc.trace.Timestamp.UTC().Format("2006-01-02 15:04:05 MST"), tc.method, tc.path, tc.trace.Status)
+	fmt.Fprintf(&b, "// It sends the request to OPENAI_BASE_URL, the proxy on localhost:8080 by default, with OPENAI_API_KEY.\n")
+	fmt.Fprintf(&b, "func TestTrace%s(t *testing.T) {\n", tc.name)
+	fmt.Fprintf(&b, "\tbaseURL := os.Getenv(\"OPENAI_BASE_URL\")\n\tif baseURL == \"\" {\n\t\tbaseURL = \"http://localhost:8080\"\n\t}\n")
+	bodyArg := "nil"
+	if tc.body != "" {
+		fmt.Fprintf(&b, "\tbody := %s\n", goQuote(tc.body))
+		bodyArg = "strings.NewReader(body)"
+	}
+	fmt.Fprintf(&b, "\treq, err := http.NewRequest(%q, baseURL+%q, %s)\n\tif err != nil {\n\t\tt.Fatal(err)\n\t}\n", tc.method, tc.path, bodyArg)
+	fmt.Fprintf(&b, "\treq.Header.Set(\"Authorization\", \"Bearer \"+os.Getenv(\"OPENAI_API_KEY\"))\n")
+	for _, header := range tc.headers {
+		fmt.Fprintf(&b, "\treq.Header.Set(%q, %q)\n", header[0], header[1])
+	}
+	fmt.Fprintf(&b, "\tresp, err := http.DefaultClient.Do(req)\n\tif err != nil {\n\t\tt.Fatal(err)\n\t}\n\tdefer resp.Body.Close()\n\n")
+	fmt.Fprintf(&b, "\tif resp.StatusCode != %d {\n\t\tt.Fatalf(\"status = %%d, want %d\", resp.StatusCode)\n\t}\n", tc.status, tc.status)
+	if tc.stream {
+		fmt.Fprintf(&b, "\tstream, err := io.ReadAll(resp.Body)\n\tif err != nil {\n\t\tt.Fatal(err)\n\t}\n")
+		fmt.Fprintf(&b, "\tif !strings.Contains(string(stream), \"data: \") {\n\t\tt.Errorf(\"response is not an event stream: %%.200s\", stream)\n\t}\n}\n")
+		return b.String()
+	}
+	if len(tc.assertions) == 0 {
+		fmt.Fprintf(&b, "}\n")
+		return b.String()
+	}
+	fmt.Fprintf(&b, "\tvar got interface{}\n\tif err := json.NewDecoder(resp.Body).Decode(&got); err != nil {\n\t\tt.Fatal(err)\n\t}\n")
+	for _, a := range tc.assertions {
+		var path []string
+		for _, segment := range a.path {
+			if s, ok := segment.(string); ok {
+				path = append(path, strconv.Quote(s))
+			} else {
+				path = append(path, fmt.Sprint(segment))
+			}
+		}
+		field := "field(got, " + strings.Join(path, ", ") + ")"
+		switch a.kind {
+		case "equals":
+			fmt.Fprintf(&b, "\tif v := %s; v != %q {\n\t\tt.Errorf(\"%s = %%v, want %%q\", v, %q)\n\t}\n", field, a.value, a.describe(), a.value)
+		case "prefix":
+			fmt.Fprintf(&b, "\tif v := fmt.Sprint(%s); !strings.HasPrefix(v, %q) {\n\t\tt.Errorf(\"%s = %%q, want a %%q model\", v, %q)\n\t}\n", field, a.value, a.describe(), a.value)
+		case "length":
+			fmt.Fprintf(&b, "\tif v, _ := %s.([]interface{}); len(v) != %d {\n\t\tt.Errorf(\"len(%s) = %%d, want %d\", len(v))\n\t}\n", field, a.value, a.describe(), a.value)
+		case "present":
+			fmt.Fprintf(&b, "\tif v := %s; v == nil || v == \"\" {\n\t\tt.Errorf(\"%s is missing\")\n\t}\n", field, a.describe())
+		}
+	}
+	fmt.Fprintf(&b, "}\n\n")
+	fmt.Fprintf(&b, "// field returns the value at path in a decoded JSON document, or nil\nfunc field(v interface{}, path ...interface{}) interface{} {\n")
+	fmt.Fprintf(&b, "\tfor _, segment := range path {\n\t\tswitch key := segment.(type) {\n")
+	fmt.Fprintf(&b, "\t\tcase string:\n\t\t\tobject, _ := v.(map[string]interface{})\n\t\t\tv = object[key]\n")
+	fmt.Fprintf(&b, "\t\tcase int:\n\t\t\tarray, _ := v.([]interface{})\n\t\t\tif key >= len(array) {\n\t\t\t\treturn nil\n\t\t\t}\n\t\t\tv = array[key]\n\t\t}\n\t}\n\treturn v\n}\n")
+	return b.String()
+}
+
+func hasAssertion(tc *traceTestCase, kind string) bool {
+	for _, a := range tc.assertions {
+		if a.kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// renderPythonTestCase renders a test case as a pytest test that also runs as a
+// script, using only the standard library
+func renderPythonTestCase(tc *traceTestCase) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "import json\nimport os\nimport urllib.error\nimport urllib.request\n\n\n")
+	fmt.Fprintf(&b, "def test_trace_%s():\n", strings.ToLower(tc.name))
+	fmt.Fprintf(&b, "    \"\"\"Replays trace %s, recorded %s: %s %s answered %s.\n\n", tc.trace.Id, tc.trace.Timestamp.UTC().Format("2006-01-02 15:04:05 MST"), tc.method, tc.path, tc.trace.Status)
+	fmt.Fprintf(&b, "    Sends the request to OPENAI_BASE_URL, the proxy on localhost:8080 by default, with OPENAI_API_KEY.\n    \"\"\"\n")
+	fmt.Fprintf(&b, "    base_url = os.environ.get(\"OPENAI_BASE_URL\", \"http://localhost:8080\")\n")
+	data := "None"
+	if tc.body != "" {
+		if !strings.Contains(tc.body, "'''") {
+			fmt.Fprintf(&b, "    body = r'''%s'''\n", tc.body)
+		} else {
+			fmt.Fprintf(&b, "    body = %s\n", pyQuote(tc.body))
+		}
+		data = "body.encode()"
+	}
+	fmt.Fprintf(&b, "    request = urllib.request.Request(base_url + %s, data=%s, method=%s)\n", pyQuote(tc.path), data, pyQuote(tc.method))
+	fmt.Fprintf(&b, "    request.add_header(\"Authorization\", \"Bearer \" + os.environ.get(\"OPENAI_API_KEY\", \"\"))\n")
+	for _, header := range tc.headers {
+		fmt.Fprintf(&b, "    request.add_header(%s, %s)\n", pyQuote(header[0]), pyQuote(header[1]))
+	}
+	fmt.Fprintf(&b, "    try:\n        with urllib.request.urlopen(request) as response:\n            status, raw = response.status, response.read()\n")
+	fmt.Fprintf(&b, "    except urllib.error.HTTPError as error:\n        status, raw = error.code, error.read()\n\n")
+	fmt.Fprintf(&b, "    assert status == %d, raw[:500]\n", tc.status)
+	if tc.stream {
+		fmt.Fprintf(&b, "    assert b\"data: \" in raw, raw[:200]\n")
+	} else if len(tc.assertions) > 0 {
+		fmt.Fprintf(&b, "    got = json.loads(raw)\n")
+		for _, a := range tc.assertions {
+			parent, last := "got", ""
+			for i, segment := range a.path {
+				index := fmt.Sprint(segment)
+				if s, ok := segment.(string); ok {
+					index = pyQuote(s)
+				}
+				if i == len(a.path)-1 {
+					last = index
+				} else {
+					parent += "[" + index + "]"
+				}
+			}
+			field := parent + "[" + last + "]"
+			switch a.kind {
+			case "equals":
+				fmt.Fprintf(&b, "    assert %s == %s\n", field, pyQuote(a.value.(string)))
+			case "prefix":
+				fmt.Fprintf(&b, "    assert %s.startswith(%s)\n", field, pyQuote(a.value.(string)))
+			case "length":
+				fmt.Fprintf(&b, "    assert len(%s) == %d\n", field, a.value)
+			case "present":
+				fmt.Fprintf(&b, "    assert %s.get(%s) not in (None, \"\")\n", parent, last)
+			}
+		}
+	}
+	fmt.Fprintf(&b, "\n\nif __name__ == \"__main__\":\n    test_trace_%s()\n    print(\"ok\")\n", strings.ToLower(tc.name))
+	return b.String()
+}
+
+// handleTraceTestCase serves GET /traces/<id>/testcase?lang=go|python, a test
+// that sends the traced request again and checks the answer's key fields
+func handleTraceTestCase(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "invalid_request_error", "use GET")
+		return
+	}
+	lang := r.URL.Query().Get("lang")
+	if lang == "" {
+		lang = "go"
+	}
+	if lang != "go" && lang != "python" {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "lang must be go or python")
+		return
+	}
+	trace, ok := findTrace(id)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("no stored trace with id %q", id))
+		return
+	}
+	tc, err := buildTraceTestCase(trace)
+	if err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, "invalid_request_error", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if lang == "python" {
+		w.Header().Set("Content-Disposition", `inline; filename="test_trace_`+strings.ToLower(tc.name)+`.py"`)
+		fmt.Fprint(w, renderPythonTestCase(tc))
+		return
+	}
+	w.Header().Set("Content-Disposition", `inline; filename="trace_`+strings.ToLower(tc.name)+`_test.go"`)
+	fmt.Fprint(w, renderGoTestCase(tc))
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// streamEvent is one SSE event of a captured stream, timed by the upstream chunk
+// that completed it
+type streamEvent struct {
+	Index    int       `json:"index"`
+	Time     time.Time `json:"time"`
+	OffsetMs float64   `json:"offset_ms"` // since the request was received
+	GapMs    float64   `json:"gap_ms"`    // since the previous event, or the response headers
+	Chunk    int       `json:"chunk"`     // index of the chunk record
+	sseEvent
+}
+
+// traceEvents is the body of GET /traces/<id>/events
+type traceEvents struct {
+	TraceId     string        `json:"trace_id"`
+	CaptureFile string        `json:"capture_file"`
+	Encoding    string        `json:"encoding,omitempty"`
+	ResponseMs  float64       `json:"response_ms"` // upstream status and headers
+	FirstMs     float64       `json:"first_event_ms,omitempty"`
+	EndMs       float64       `json:"end_ms"`
+	Chunks      int           `json:"chunks"`
+	MaxGapMs    float64       `json:"max_gap_ms"`
+	MaxGapEvent int           `json:"max_gap_event"` // the event that ended the longest gap
+	Stalls      []int         `json:"stalls"`        // events after a gap of at least ?stall_ms
+	Done        bool          `json:"done"`          // the stream ended with [DONE]
+	Error       string        `json:"error,omitempty"`
+	Events      []streamEvent `json:"events"`
+}
+
+// chunkFeeder reads the bodies of chunk records in order and remembers which one
+// the latest bytes came from, so decoded output can be attributed to a chunk
+type chunkFeeder struct {
+	chunks  []captureRecord
+	next    int
+	pending []byte
+	current int
+}
+
+func (f *chunkFeeder) Read(p []byte) (int, error) {
+	for len(f.pending) == 0 {
+		if f.next == len(f.chunks) {
+			return 0, io.EOF
+		}
+		f.current, f.pending = f.next, f.chunks[f.next].Body
+		f.next++
+	}
+	n := copy(p, f.pending)
+	f.pending = f.pending[n:]
+	return n, nil
+}
+
+// capturedStreamEvents parses the SSE events of a trace's captured response. A
+// compressed stream is decoded first; decoders read ahead, so its events are timed
+// to within a chunk.
+func capturedStreamEvents(path, traceID string, stall float64) (*traceEvents, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open capture file %s: %v", path, err)
+	}
+	defer f.Close()
+	result := &traceEvents{TraceId: traceID, CaptureFile: path, Stalls: []int{}, Events: []streamEvent{}}
+	var response *captureRecord
+	var chunks []captureRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 256<<20)
+	for scanner.Scan() {
+		var record captureRecord
+		if json.Unmarshal(scanner.Bytes(), &record) != nil || record.TraceID != traceID {
+			continue
+		}
+		switch record.Type {
+		case "response":
+			// A stream sent again by -stream-retry restarts the events
+			response, chunks, result.Error = &record, nil, ""
+		case "chunk":
+			chunks = append(chunks, record)
+		case "error":
+			result.Error = record.Error
+			result.EndMs = record.OffsetMs
+		case "end":
+			result.EndMs = record.OffsetMs
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read capture file %s: %v", path, err)
+	}
+	if response == nil {
+		return nil, fmt.Errorf("capture file %s has no response for trace %s", path, traceID)
+	}
+	if contentType := response.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/event-stream") {
+		return nil, fmt.Errorf("trace %s response is %q, not an event stream", traceID, contentType)
+	}
+	result.ResponseMs = response.OffsetMs
+	result.Chunks = len(chunks)
+
+	feeder := &chunkFeeder{chunks: chunks}
+	var body io.Reader = feeder
+	if result.Encoding = responseEncoding(response.Header); result.Encoding != "" {
+		decoded, err := decodingReader(result.Encoding, feeder)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode captured stream: %v", err)
+		}
+		defer decoded.Close()
+		body = decoded
+	}
+
+	previous := result.ResponseMs
+	add := func(events []sseEvent, chunk int) {
+		for _, event := range events {
+			at := chunks[chunk]
+			e := streamEvent{Index: len(result.Events), Time: at.Time, OffsetMs: at.OffsetMs, GapMs: math.Round((at.OffsetMs-previous)*1000) / 1000, Chunk: chunk, sseEvent: event}
+			previous = at.OffsetMs
+			if e.Index == 0 {
+				result.FirstMs = e.OffsetMs
+			}
+			if e.GapMs > result.MaxGapMs {
+				result.MaxGapMs, result.MaxGapEvent = e.GapMs, e.Index
+			}
+			if stall > 0 && e.GapMs >= stall {
+				result.Stalls = append(result.Stalls, e.Index)
+			}
+			result.Done = event.Data == sseDone
+			result.Events = append(result.Events, e)
+		}
+	}
+	var rest string
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			var events []sseEvent
+			events, rest = parseSSE(rest + string(buf[:n]))
+			add(events, feeder.current)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode captured stream: %v", err)
+		}
+	}
+	if strings.TrimSpace(rest) != "" && len(chunks) > 0 {
+		// A stream cut off mid-event still shows what arrived
+		events, _ := parseSSE(rest + "\n\n")
+		add(events, len(chunks)-1)
+	}
+	return result, nil
+}
+
+// handleTraceEvents serves GET /traces/<id>/events: the SSE events of a captured
+// stream with their arrival times, for spotting uneven pacing and stalls.
+// ?stall_ms= sets the gap listed as a stall (default 1000).
+func handleTraceEvents(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "invalid_request_error", "use GET")
+		return
+	}
+	stall := 1000.0
+	if value := r.URL.Query().Get("stall_ms"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || parsed < 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "stall_ms must be a non-negative number")
+			return
+		}
+		stall = parsed
+	}
+	trace, ok := findTrace(id)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("no stored trace with id %q", id))
+		return
+	}
+	if trace.CaptureFile == "" {
+		writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("trace %s was not captured; enable -capture-dir to record streams", id))
+		return
+	}
+	events, err := capturedStreamEvents(trace.CaptureFile, trace.Id, stall)
+	if err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, "invalid_request_error", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
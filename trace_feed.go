@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// traceFeedResumeMax is how many of the latest stored traces a resuming /ws
+// client may catch up on
+const traceFeedResumeMax = 1000
+
+// traceFeedPendingMax is how many traces the hub holds back behind a missing one
+// before it gives up waiting for it
+const traceFeedPendingMax = 1000
+
+// traceSeq numbers recorded traces, so /ws clients can resume after the last one
+// they received
+var traceSeq atomic.Int64
+
+// seedTraceSeq continues the numbering of a persistent trace store after a restart
+func seedTraceSeq() {
+	// Traces are listed by timestamp, which a clock step can put out of order with
+	// their sequence numbers, so take the highest of all of them
+	traces, err := storedTraces()
+	if err != nil {
+		log.Printf("❌ Failed to read the stored traces: %v", err)
+		return
+	}
+	var seq int64
+	for _, trace := range traces {
+		seq = max(seq, trace.Seq)
+	}
+	traceSeq.Store(seq)
+}
+
+// feedSubscription is a /ws client joining the hub. Resuming clients get the
+// traces after since instead of the latest ones.
+type feedSubscription struct {
+	conn   *websocket.Conn
+	since  int64
+	resume bool
+}
+
+// parseFeedSubscription reads the ?since= sequence number of a /ws request
+func parseFeedSubscription(r *http.Request) (feedSubscription, error) {
+	value := r.URL.Query().Get("since")
+	if value == "" {
+		return feedSubscription{}, nil
+	}
+	since, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || since < 0 {
+		return feedSubscription{}, fmt.Errorf("invalid since %q: expected the seq of the last trace received", value)
+	}
+	return feedSubscription{since: since, resume: true}, nil
+}
+
+// feedBacklog returns the traces a new /ws client gets first, oldest first: the
+// latest ones, or for a resuming client the stored ones it missed. Only traces up
+// to the hub's delivered sequence number are included; the rest are broadcast.
+func feedBacklog(subscription feedSubscription, delivered int64) ([]Trace, error) {
+	if !subscription.resume {
+		stored, err := traceSink.List(tracesMax)
+		var backlog []Trace
+		for _, trace := range visibleTraces(stored) {
+			if trace.Seq <= delivered {
+				backlog = append(backlog, trace)
+			}
+		}
+		return backlog, err
+	}
+	stored, err := traceSink.List(traceFeedResumeMax)
+	if err != nil {
+		return nil, err
+	}
+	var missed []Trace
+	for _, trace := range visibleTraces(stored) {
+		if trace.Seq > subscription.since && trace.Seq <= delivered {
+			missed = append(missed, trace)
+		}
+	}
+	metrics.Add("openai_proxy_trace_feed_resumes_total", "WebSocket trace feed clients resuming with ?since=.", nil, 1)
+	metrics.Add("openai_proxy_trace_feed_resumed_traces_total", "Missed traces sent to resuming WebSocket trace feed clients.", nil, float64(len(missed)))
+	return missed, nil
+}
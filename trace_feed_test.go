@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestHubDeliversTracesInSequence(t *testing.T) {
+	h := newHub()
+	h.delivered = 10
+
+	h.pending[12] = Trace{Seq: 12}
+	h.pending[13] = Trace{Seq: 13}
+	h.flush()
+	if h.delivered != 10 {
+		t.Fatalf("delivered %d ahead of missing trace 11", h.delivered)
+	}
+
+	h.pending[11] = Trace{Seq: 11}
+	h.flush()
+	if h.delivered != 13 || len(h.pending) != 0 {
+		t.Fatalf("delivered %d with %d pending, want 13 and none", h.delivered, len(h.pending))
+	}
+}
+
+func TestHubSkipsLongGaps(t *testing.T) {
+	h := newHub()
+	for seq := int64(2); seq <= traceFeedPendingMax+2; seq++ {
+		h.pending[seq] = Trace{Seq: seq}
+	}
+	h.flush()
+	if h.delivered != traceFeedPendingMax+2 || len(h.pending) != 0 {
+		t.Fatalf("delivered %d with %d pending after a long gap", h.delivered, len(h.pending))
+	}
+}
+
+func TestFeedBacklogStopsAtDelivered(t *testing.T) {
+	saved := traceSink
+	defer func() { traceSink = saved }()
+	traceSink = newMemoryTraceSink(tracesMax)
+	for seq := int64(1); seq <= 5; seq++ {
+		traceSink.Record(Trace{Id: generateTraceID(), Seq: seq})
+	}
+
+	missed, err := feedBacklog(feedSubscription{since: 2, resume: true}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missed) != 2 || missed[0].Seq != 3 || missed[1].Seq != 4 {
+		t.Fatalf("resumed backlog %v, want traces 3 and 4", missed)
+	}
+}
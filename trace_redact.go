@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// redactTrace strips the bodies and credentials of a trace, and with headers all
+// its request headers, keeping status, latency, usage, timings and annotations
+func redactTrace(trace Trace, headers bool) Trace {
+	trace.RequestBody, trace.ResponseBody = "", ""
+	trace.RequestBlob, trace.ResponseBlob = "", ""
+	if len(trace.Transcript) > 0 {
+		transcript := make([]TranscriptEntry, len(trace.Transcript))
+		for i, entry := range trace.Transcript {
+			entry.Text = ""
+			transcript[i] = entry
+		}
+		trace.Transcript = transcript
+	}
+	if headers {
+		trace.RequestHeader = nil
+	} else if trace.RequestHeader != nil {
+		trace.RequestHeader = trace.RequestHeader.Clone()
+		for _, name := range []string{"Authorization", "Api-Key", "Openai-Api-Key"} {
+			trace.RequestHeader.Del(name)
+		}
+	}
+	now := time.Now()
+	trace.RedactedAt = &now
+	return trace
+}
+
+// redactCapture blanks the bodies of a trace's records in its capture file. The
+// new file replaces the old one under captureWriteMu, and exchanges still writing
+// to it reopen it to continue at its new end.
+func redactCapture(path, traceID string) error {
+	captureWriteMu.Lock()
+	defer captureWriteMu.Unlock()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read capture file %s: %v", path, err)
+	}
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 256<<20)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var record captureRecord
+		if json.Unmarshal(line, &record) == nil && record.TraceID == traceID && len(record.Body) > 0 {
+			record.Bytes = int64(len(record.Body))
+			record.Body = nil
+			if line, err = json.Marshal(record); err != nil {
+				return err
+			}
+		}
+		out.Write(line)
+		out.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read capture file %s: %v", path, err)
+	}
+	// Write to a temporary name first so a failure never leaves a partial file
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to rewrite capture file %s: %v", path, err)
+	}
+	if _, err := tmp.Write(out.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to rewrite capture file %s: %v", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to rewrite capture file %s: %v", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to replace capture file %s: %v", path, err)
+	}
+	captureRewrites[path]++
+	return nil
+}
+
+// releaseTraceBlobs deletes the blobs a redacted trace referred to, unless another
+// stored trace still refers to them
+func releaseTraceBlobs(traceID string, hashes ...string) error {
+	if traceBlobs == nil {
+		return nil
+	}
+	stored, err := storedTraces()
+	if err != nil {
+		return fmt.Errorf("failed to list traces referring to blobs: %v", err)
+	}
+	referenced := make(map[string]bool)
+	for _, trace := range stored {
+		if trace.Id != traceID {
+			referenced[trace.RequestBlob], referenced[trace.ResponseBlob] = true, true
+		}
+	}
+	for _, hash := range hashes {
+		if hash == "" || referenced[hash] {
+			continue
+		}
+		if err := traceBlobs.Delete(hash); err != nil {
+			return err
+		}
+		log.Printf("🧽 Deleted blob %s of redacted trace %s", hash, traceID)
+	}
+	return nil
+}
+
+// visibleTraces drops soft-deleted traces from a listing
+func visibleTraces(list []Trace) []Trace {
+	visible := list[:0:0]
+	for _, trace := range list {
+		if trace.DeletedAt == nil {
+			visible = append(visible, trace)
+		}
+	}
+	return visible
+}
+
+// handleTraceRedaction serves POST /traces/<id>/redact, which strips a trace's
+// bodies (and with ?headers=true its request headers) for good, and POST
+// /traces/<id>/restore, which undoes a soft delete
+func handleTraceRedaction(w http.ResponseWriter, r *http.Request, id, action string) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "invalid_request_error", "use POST")
+		return
+	}
+	trace, ok := findTrace(id)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("no stored trace with id %q", id))
+		return
+	}
+	switch action {
+	case "redact":
+		blobs := []string{trace.RequestBlob, trace.ResponseBlob}
+		trace = redactTrace(trace, r.URL.Query().Get("headers") == "true")
+		if trace.CaptureFile != "" {
+			if err := redactCapture(trace.CaptureFile, trace.Id); err != nil {
+				writeJSONError(w, http.StatusInternalServerError, "storage_error", err.Error())
+				return
+			}
+		}
+		// The blobs are deleted once no stored trace refers to them anymore
+		if !storeTraceEdit(w, trace) {
+			return
+		}
+		if err := releaseTraceBlobs(trace.Id, blobs...); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "storage_error", err.Error())
+			return
+		}
+		answerTraceEdit(w, trace, action)
+		return
+	case "restore":
+		trace.DeletedAt = nil
+	}
+	updateTrace(w, trace, action)
+}
+
+// updateTrace stores a changed trace and answers with it
+func updateTrace(w http.ResponseWriter, trace Trace, action string) {
+	if storeTraceEdit(w, trace) {
+		answerTraceEdit(w, trace, action)
+	}
+}
+
+// storeTraceEdit stores a changed trace, answering with an error if it fails
+func storeTraceEdit(w http.ResponseWriter, trace Trace) bool {
+	updated, err := traceSink.Update(trace)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "storage_error", "failed to update trace: "+err.Error())
+		return false
+	}
+	if !updated {
+		writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("trace %q was evicted", trace.Id))
+		return false
+	}
+	return true
+}
+
+func answerTraceEdit(w http.ResponseWriter, trace Trace, action string) {
+	log.Printf("🧽 Trace %s: %s", trace.Id, action)
+	metrics.Add("openai_proxy_trace_edits_total", "Traces redacted, soft-deleted or restored through the admin API.", map[string]string{"action": action}, 1)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(trace)
+}
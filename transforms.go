@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// responseTransform is a built-in cleanup of the text a model generated
+type responseTransform struct {
+	name  string
+	apply func(text string) string
+}
+
+// responseTransforms run in order on buffered responses, after the hooks
+var responseTransforms []responseTransform
+
+// fenceLine matches a markdown code fence line such as ``` or ```json
+var fenceLine = regexp.MustCompile("(?m)^[ \t]*```[\\w+-]*[ \t]*\r?\n?")
+
+// stripFences removes markdown code fence lines, keeping the fenced content
+func stripFences(text string) string {
+	return fenceLine.ReplaceAllString(text, "")
+}
+
+// extractJSON returns the first complete JSON object or array in text, or text
+// unchanged when it contains none
+func extractJSON(text string) string {
+	for i, c := range text {
+		if c != '{' && c != '[' {
+			continue
+		}
+		decoder := json.NewDecoder(strings.NewReader(text[i:]))
+		var value json.RawMessage
+		if decoder.Decode(&value) == nil {
+			return string(value)
+		}
+	}
+	return text
+}
+
+// parseResponseTransforms reads -response-transforms, e.g. "strip_fences,trim,max_length=2000"
+func parseResponseTransforms(spec string) ([]responseTransform, error) {
+	var transforms []responseTransform
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, arg, hasArg := strings.Cut(entry, "=")
+		transform := responseTransform{name: name}
+		switch name {
+		case "strip_fences":
+			transform.apply = stripFences
+		case "extract_json":
+			transform.apply = extractJSON
+		case "trim":
+			transform.apply = strings.TrimSpace
+		case "max_length":
+			limit, err := strconv.Atoi(arg)
+			if !hasArg || err != nil || limit <= 0 {
+				return nil, fmt.Errorf("invalid -response-transforms entry %q: max_length needs a positive length, e.g. max_length=2000", entry)
+			}
+			transform.apply = func(text string) string {
+				if runes := []rune(text); len(runes) > limit {
+					return string(runes[:limit])
+				}
+				return text
+			}
+		default:
+			return nil, fmt.Errorf("invalid -response-transforms entry %q: expected strip_fences, extract_json, trim or max_length=<n>", entry)
+		}
+		if hasArg && name != "max_length" {
+			return nil, fmt.Errorf("invalid -response-transforms entry %q: %s takes no argument", entry, name)
+		}
+		transforms = append(transforms, transform)
+	}
+	return transforms, nil
+}
+
+// generatedTexts calls visit with a setter for each generated text of a chat
+// completion, completion or Responses API body
+func generatedTexts(root interface{}, visit func(text string, set func(string))) {
+	object, ok := root.(map[string]interface{})
+	if !ok {
+		return
+	}
+	each := func(value interface{}, fn func(item map[string]interface{})) {
+		items, _ := value.([]interface{})
+		for _, item := range items {
+			if item, ok := item.(map[string]interface{}); ok {
+				fn(item)
+			}
+		}
+	}
+	field := func(item map[string]interface{}, key string) {
+		if text, ok := item[key].(string); ok {
+			visit(text, func(s string) { item[key] = s })
+		}
+	}
+	each(object["choices"], func(choice map[string]interface{}) {
+		if message, ok := choice["message"].(map[string]interface{}); ok {
+			field(message, "content")
+		}
+		field(choice, "text")
+	})
+	each(object["output"], func(item map[string]interface{}) {
+		each(item["content"], func(part map[string]interface{}) {
+			if part["type"] == "output_text" {
+				field(part, "text")
+			}
+		})
+	})
+	field(object, "output_text")
+}
+
+// applyResponseTransforms runs the configured transforms on the generated text of
+// a JSON response body. It returns the new body and the transforms that changed it.
+func applyResponseTransforms(body []byte) ([]byte, []string) {
+	if len(responseTransforms) == 0 || len(bytes.TrimSpace(body)) == 0 {
+		return body, nil
+	}
+	doc, err := parseJSONDocument(body)
+	if err != nil {
+		return body, nil
+	}
+	changed := make(map[string]bool)
+	generatedTexts(doc.root, func(text string, set func(string)) {
+		original := text
+		for _, transform := range responseTransforms {
+			if transformed := transform.apply(text); transformed != text {
+				changed[transform.name] = true
+				text = transformed
+			}
+		}
+		if text != original {
+			set(text)
+		}
+	})
+	if len(changed) == 0 {
+		return body, nil
+	}
+	encoded, err := doc.encode()
+	if err != nil {
+		return body, nil
+	}
+	var applied []string
+	for _, transform := range responseTransforms {
+		if changed[transform.name] {
+			applied = append(applied, transform.name)
+			metrics.Add("openai_proxy_response_transforms_total", "Responses changed by built-in response transforms.", map[string]string{"transform": transform.name}, 1)
+		}
+	}
+	return encoded, applied
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+)
+
+// transparentRoutes are the path prefixes forwarded without inspection
+var transparentRoutes []string
+
+// parseTransparentRoutes validates the comma-separated -transparent-routes prefixes
+func parseTransparentRoutes(spec string) ([]string, error) {
+	var routes []string
+	for _, route := range strings.Split(spec, ",") {
+		route = strings.TrimSpace(route)
+		if route == "" {
+			continue
+		}
+		if !strings.HasPrefix(route, "/v1/") {
+			return nil, fmt.Errorf("invalid transparent route %q: must start with /v1/", route)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// isTransparentRoute reports whether path matches one of the transparent prefixes
+func isTransparentRoute(path string) bool {
+	for _, route := range transparentRoutes {
+		if strings.HasPrefix(path, route) {
+			return true
+		}
+	}
+	return false
+}
+
+// countingResponseWriter records the status and size of a response written by the
+// reverse proxy. Unwrap lets http.ResponseController reach the real writer's Flush.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (cw *countingResponseWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *countingResponseWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	n, err := cw.ResponseWriter.Write(p)
+	cw.bytes += int64(n)
+	return n, err
+}
+
+func (cw *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// newTransparentProxy returns a reverse proxy to the upstream that streams bodies
+// in both directions untouched: no buffering, no decompression and no hooks
+func newTransparentProxy(transport http.RoundTripper) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(upstreamURL)
+		},
+		Transport: transport,
+		// Flush immediately so server-sent events aren't delayed
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("❌ Transparent request failed: %v", err)
+			http.Error(w, "Failed to forward request", http.StatusBadGateway)
+		},
+	}
+}
+
+// serveTransparent forwards a request through proxy and records a trace with
+// metadata only; request and response bodies are never read by the proxy
+func serveTransparent(proxy *httputil.ReverseProxy, w http.ResponseWriter, r *http.Request, caller *principal) {
+	startTime := time.Now()
+	traceID := generateTraceID()
+	targetURL := upstreamTarget(r.URL.Path, r.URL.RawQuery)
+
+	// Control headers don't apply to transparent routes, but are still never forwarded
+	for _, name := range []string{overrideNoCache, overrideTimeout, overrideUpstream, overrideTraceLevel} {
+		r.Header.Del(name)
+	}
+
+	w.Header().Set("X-Proxy-Trace-Id", traceID)
+	w.Header().Set("X-Proxy-Upstream", targetURL.Host)
+	// The upstream credential goes on a copy, so the trace keeps the client's
+	out := r.Clone(r.Context())
+	caller.setUpstreamCredentials(out.Header)
+	routing := &upstreamRouting{Via: "transparent"}
+	routing.send(targetURL, out.Header)
+	cw := &countingResponseWriter{ResponseWriter: w}
+	proxy.ServeHTTP(cw, out)
+
+	status := cw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	latency := time.Since(startTime).Seconds()
+	log.Printf("⚡ Transparent %s %s -> %d (%d bytes, %.3fs)", r.Method, r.URL.Path, status, cw.bytes, latency)
+
+	recordTrace(Trace{
+		Id:            traceID,
+		Timestamp:     time.Now(),
+		Method:        r.Method,
+		URL:           targetURL.String(),
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		Latency:       latency,
+		SessionId:     cw.Header().Get("X-Session-Id"),
+		RequestHeader: r.Header,
+		ResponseBody:  fmt.Sprintf("[TRANSPARENT RESPONSE - %d bytes]", cw.bytes),
+		Transparent:   true,
+		Routing:       routing,
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// pinnedTransport carries requests to hosts with -upstream-host or -upstream-sni
+// applied; nil when neither is set
+var pinnedTransport *http.Transport
+
+// upstreamSNIName is the TLS server name presented to pinned hosts: -upstream-sni,
+// or the -upstream-host name
+var upstreamSNIName string
+
+// configureUpstreamHost validates -upstream-host and -upstream-sni and sets up the
+// transport that presents them
+func configureUpstreamHost() error {
+	if *upstreamHostHeader == "" && *upstreamSNI == "" {
+		return nil
+	}
+	if strings.ContainsAny(*upstreamHostHeader, "/ ") {
+		return fmt.Errorf("invalid -upstream-host %q: expected a host name with an optional port, such as api.openai.com", *upstreamHostHeader)
+	}
+	if strings.ContainsAny(*upstreamSNI, "/: ") {
+		return fmt.Errorf("invalid -upstream-sni %q: expected a host name without a port, such as api.openai.com", *upstreamSNI)
+	}
+	upstreamSNIName = *upstreamSNI
+	if upstreamSNIName == "" {
+		upstreamSNIName = strings.Split(*upstreamHostHeader, ":")[0]
+	}
+	pinnedTransport = upstreamTransport.Clone()
+	pinnedTransport.TLSClientConfig = &tls.Config{ServerName: upstreamSNIName}
+	// A custom TLS config would otherwise turn HTTP/2 off
+	pinnedTransport.ForceAttemptHTTP2 = true
+	return nil
+}
+
+// upstreamHostPinned reports whether -upstream-host and -upstream-sni apply to a
+// connect address: -upstream and the -upstream-pool members. Canary, override and
+// rule upstreams keep their own names.
+func upstreamHostPinned(host string) bool {
+	if pinnedTransport == nil {
+		return false
+	}
+	if host == upstreamURL.Host {
+		return true
+	}
+	if upstreamPool != nil {
+		for _, m := range upstreamPool.members {
+			if m.base.Host == host {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pinnedHostTransport sends pinned requests with the overridden Host header and
+// SNI, and everything else through upstreamTransport unchanged
+type pinnedHostTransport struct{}
+
+func (pinnedHostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !upstreamHostPinned(req.URL.Host) {
+		return upstreamTransport.RoundTrip(req)
+	}
+	if *upstreamHostHeader != "" {
+		// A RoundTripper must not modify the caller's request
+		req = req.Clone(req.Context())
+		req.Host = *upstreamHostHeader
+	}
+	return pinnedTransport.RoundTrip(req)
+}
+
+// pinRealtimeDial applies the overrides to a realtime WebSocket dial of host
+func pinRealtimeDial(host string, header http.Header) *tls.Config {
+	if !upstreamHostPinned(host) {
+		return nil
+	}
+	if *upstreamHostHeader != "" {
+		header.Set("Host", *upstreamHostHeader)
+	}
+	return &tls.Config{ServerName: upstreamSNIName}
+}
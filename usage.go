@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+)
+
+// tokenUsage is the usage object OpenAI attaches to completion and embedding responses
+type tokenUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+
+	PromptTokensDetails struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"prompt_tokens_details"`
+	CompletionTokensDetails struct {
+		ReasoningTokens int `json:"reasoning_tokens"` // hidden reasoning, included in CompletionTokens
+	} `json:"completion_tokens_details"`
+}
+
+// parseUsage extracts the usage object from a JSON response body
+func parseUsage(body []byte) (tokenUsage, bool) {
+	var response struct {
+		Usage *tokenUsage `json:"usage"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil || response.Usage == nil {
+		return tokenUsage{}, false
+	}
+	usage := *response.Usage
+	if usage.TotalTokens == 0 {
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	}
+	return usage, true
+}
+
+// bodyModel returns the model field of a JSON request or response body, if any
+func bodyModel(body []byte) string {
+	var payload struct {
+		Model string `json:"model"`
+	}
+	json.Unmarshal(body, &payload)
+	return payload.Model
+}
+
+// usageAccounted reports whether anything reads response usage: the token budget,
+// anomaly detection, usage events or the usage history
+func usageAccounted() bool {
+	return requestTokenBudget != nil ||
+		usageAnomalies != nil ||
+		(eventBus != nil && *eventUsageTopic != "") ||
+		*usageHistoryDays > 0
+}
+
+// streamUsageEndpoints are the endpoints whose streams only report usage when the
+// request sets stream_options.include_usage
+var streamUsageEndpoints = map[string]bool{
+	"/v1/chat/completions": true,
+	"/v1/completions":      true,
+}
+
+// requestStreamUsage asks the upstream to end a streamed chat or completions
+// response with a usage chunk, so streamed tokens are accounted like buffered ones.
+// Nothing is changed when no usage is accounted or the client asked for usage
+// itself. It reports whether it set stream_options.include_usage; the proxy then
+// keeps the chunk the client didn't ask for out of its stream.
+func requestStreamUsage(path string, body []byte) ([]byte, bool) {
+	if !streamUsageEndpoints[path] || !usageAccounted() {
+		return body, false
+	}
+	doc, err := parseJSONDocument(body)
+	if err != nil {
+		return body, false
+	}
+	object, ok := doc.root.(map[string]interface{})
+	if !ok {
+		return body, false
+	}
+	if stream, _ := object["stream"].(bool); !stream {
+		return body, false
+	}
+	options, _ := object["stream_options"].(map[string]interface{})
+	if options == nil {
+		options = make(map[string]interface{})
+	}
+	if included, _ := options["include_usage"].(bool); included {
+		return body, false
+	}
+	options["include_usage"] = true
+	object["stream_options"] = options
+	encoded, err := doc.encode()
+	if err != nil {
+		return body, false
+	}
+	return encoded, true
+}
+
+// streamUsage reads an SSE stream through, remembering the usage reported by its
+// chat or completions usage chunk or its Responses API response.completed event
+type streamUsage struct {
+	src   io.Reader
+	strip bool // drop usage-only chunks, which requestStreamUsage asked for
+
+	buf  []byte
+	rest string // incomplete event
+	out  bytes.Buffer // complete events not yet read
+	err  error
+
+	usage tokenUsage
+	model string
+	found bool
+}
+
+func newStreamUsage(src io.Reader, strip bool) *streamUsage {
+	return &streamUsage{src: src, strip: strip}
+}
+
+func (s *streamUsage) Read(p []byte) (int, error) {
+	if s.buf == nil {
+		s.buf = make([]byte, 32*1024)
+	}
+	for s.out.Len() == 0 {
+		if s.err != nil {
+			if s.rest != "" {
+				s.out.WriteString(s.rest)
+				s.rest = ""
+				break
+			}
+			return 0, s.err
+		}
+		n, err := s.src.Read(s.buf)
+		if n > 0 {
+			s.feed(string(s.buf[:n]))
+		}
+		s.err = err
+	}
+	return s.out.Read(p)
+}
+
+// feed passes complete events on, unless they are usage chunks to strip
+func (s *streamUsage) feed(text string) {
+	text = strings.ReplaceAll(s.rest+text, "\r\n", "\n")
+	for {
+		end := strings.Index(text, "\n\n")
+		if end < 0 {
+			s.rest = text
+			return
+		}
+		block := text[:end+2]
+		text = text[end+2:]
+		events, _ := parseSSE(block)
+		drop := false
+		for _, event := range events {
+			if s.observe(event) && s.strip {
+				drop = true
+			}
+		}
+		if !drop {
+			s.out.WriteString(block)
+		}
+	}
+}
+
+// observe records the usage an event reports, and whether it is a usage-only chunk
+func (s *streamUsage) observe(event sseEvent) bool {
+	var chunk struct {
+		Model    string          `json:"model"`
+		Choices  json.RawMessage `json:"choices"`
+		Usage    *tokenUsage     `json:"usage"`
+		Response *struct {
+			Model string `json:"model"`
+			Usage *struct {
+				InputTokens        int `json:"input_tokens"`
+				OutputTokens       int `json:"output_tokens"`
+				TotalTokens        int `json:"total_tokens"`
+				InputTokensDetails struct {
+					CachedTokens int `json:"cached_tokens"`
+				} `json:"input_tokens_details"`
+				OutputTokensDetails struct {
+					ReasoningTokens int `json:"reasoning_tokens"`
+				} `json:"output_tokens_details"`
+			} `json:"usage"`
+		} `json:"response"`
+	}
+	if event.Data == sseDone || json.Unmarshal([]byte(event.Data), &chunk) != nil {
+		return false
+	}
+	switch {
+	case chunk.Usage != nil:
+		s.usage, s.model, s.found = *chunk.Usage, chunk.Model, true
+		if s.usage.TotalTokens == 0 {
+			s.usage.TotalTokens = s.usage.PromptTokens + s.usage.CompletionTokens
+		}
+		return strings.TrimSpace(string(chunk.Choices)) == "[]"
+	case chunk.Response != nil && chunk.Response.Usage != nil:
+		usage := chunk.Response.Usage
+		s.usage = tokenUsage{PromptTokens: usage.InputTokens, CompletionTokens: usage.OutputTokens, TotalTokens: usage.TotalTokens}
+		s.usage.PromptTokensDetails.CachedTokens = usage.InputTokensDetails.CachedTokens
+		s.usage.CompletionTokensDetails.ReasoningTokens = usage.OutputTokensDetails.ReasoningTokens
+		if s.usage.TotalTokens == 0 {
+			s.usage.TotalTokens = s.usage.PromptTokens + s.usage.CompletionTokens
+		}
+		s.model, s.found = chunk.Response.Model, true
+	}
+	return false
+}
+
+// Usage returns the usage the stream reported and the model it named
+func (s *streamUsage) Usage() (tokenUsage, string, bool) {
+	return s.usage, s.model, s.found
+}
+
+// chargeUsage accounts the tokens a forwarded response used: it publishes the usage
+// event, records the usage history and anomaly baseline, and charges the client's
+// daily budget. It returns the budget left, or -1 without a budget.
+func chargeUsage(traceID, path, model, fingerprint string, id userIdentity, usage tokenUsage) int64 {
+	publishUsage(usageEvent{
+		TraceID:          traceID,
+		Timestamp:        time.Now(),
+		KeyID:            id.KeyID,
+		KeyName:          id.Name,
+		Tenant:           id.Tenant,
+		Path:             path,
+		Model:            model,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		TotalTokens:      usage.TotalTokens,
+		CachedTokens:     usage.PromptTokensDetails.CachedTokens,
+		ReasoningTokens:  usage.CompletionTokensDetails.ReasoningTokens,
+		Fingerprint:      fingerprint,
+	})
+	recordUsageHistory(id, model, usage)
+	if usageAnomalies != nil {
+		usageAnomalies.ObserveTokens(id.KeyID, usage.TotalTokens)
+	}
+	if requestTokenBudget == nil {
+		return -1
+	}
+	return requestTokenBudget.Consume(id.KeyID, usage.TotalTokens)
+}
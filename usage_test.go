@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestStreamUsage(t *testing.T) {
+	if _, injected := requestStreamUsage("/v1/chat/completions", []byte(`{"model":"gpt-4o","stream":true}`)); injected {
+		t.Fatal("include_usage requested while no usage is accounted")
+	}
+	saved := requestTokenBudget
+	defer func() { requestTokenBudget = saved }()
+	requestTokenBudget = newTokenBudget(100)
+
+	body, injected := requestStreamUsage("/v1/chat/completions", []byte(`{"model":"gpt-4o","stream":true,"temperature":0.7}`))
+	if !injected {
+		t.Fatal("include_usage was not requested for a stream")
+	}
+	var request struct {
+		Temperature   json.Number `json:"temperature"`
+		StreamOptions struct {
+			IncludeUsage bool `json:"include_usage"`
+		} `json:"stream_options"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil || !request.StreamOptions.IncludeUsage || request.Temperature != "0.7" {
+		t.Fatalf("rewritten body %s", body)
+	}
+
+	for _, body := range []string{
+		`{"model":"gpt-4o","stream":true,"stream_options":{"include_usage":true}}`,
+		`{"model":"gpt-4o"}`,
+	} {
+		if _, injected := requestStreamUsage("/v1/chat/completions", []byte(body)); injected {
+			t.Errorf("include_usage injected into %s", body)
+		}
+	}
+}
+
+func TestStreamedUsageChargesBudget(t *testing.T) {
+	savedBudget, savedStore := requestTokenBudget, usageStore
+	defer func() { requestTokenBudget, usageStore = savedBudget, savedStore }()
+	requestTokenBudget = newTokenBudget(100)
+	usageStore = newMemoryUsageStore()
+
+	stream := "data: {\"model\":\"gpt-4o\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hi\"}}],\"usage\":null}\n\n" +
+		"data: {\"model\":\"gpt-4o\",\"choices\":[],\"usage\":{\"prompt_tokens\":80,\"completion_tokens\":40,\"total_tokens\":120}}\n\n" +
+		"data: [DONE]\n\n"
+	meter := newStreamUsage(&oneByteReader{strings.NewReader(stream)}, true)
+	forwarded, err := io.ReadAll(meter)
+	if err != nil {
+		t.Fatalf("reading the stream: %v", err)
+	}
+	if strings.Contains(string(forwarded), "total_tokens") || !strings.Contains(string(forwarded), `"Hi"`) || !strings.HasSuffix(string(forwarded), "data: [DONE]\n\n") {
+		t.Fatalf("client stream %q", forwarded)
+	}
+
+	usage, model, ok := meter.Usage()
+	if !ok || usage.TotalTokens != 120 || model != "gpt-4o" {
+		t.Fatalf("usage %+v of %q, found %v", usage, model, ok)
+	}
+	if remaining := chargeUsage("trace", "/v1/chat/completions", model, "", userIdentity{KeyID: "key-1"}, usage); remaining != 0 {
+		t.Errorf("remaining budget %d, want 0", remaining)
+	}
+
+	w := httptest.NewRecorder()
+	if checkClientLimits(w, "key-1") || w.Code != http.StatusTooManyRequests {
+		t.Fatalf("key over its budget was let through (status %d)", w.Code)
+	}
+}
+
+func TestStreamUsageKeepsRequestedChunk(t *testing.T) {
+	stream := "data: {\"model\":\"gpt-4o\",\"choices\":[],\"usage\":{\"prompt_tokens\":1,\"completion_tokens\":2,\"total_tokens\":3}}\n\n" +
+		"data: [DONE]\n\n"
+	meter := newStreamUsage(strings.NewReader(stream), false)
+	forwarded, err := io.ReadAll(meter)
+	if err != nil || string(forwarded) != stream {
+		t.Fatalf("client stream %q, %v; want it unchanged", forwarded, err)
+	}
+	if usage, _, ok := meter.Usage(); !ok || usage.TotalTokens != 3 {
+		t.Fatalf("usage %+v, found %v", usage, ok)
+	}
+}
+
+// oneByteReader splits events across reads, as a slow upstream does
+type oneByteReader struct {
+	r io.Reader
+}
+
+func (r *oneByteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return r.r.Read(p[:1])
+}
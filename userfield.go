@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// userFieldEndpoints are the JSON endpoints whose bodies accept a "user" field
+var userFieldEndpoints = []string{
+	"/v1/chat/completions",
+	"/v1/completions",
+	"/v1/embeddings",
+	"/v1/images/generations",
+	"/v1/responses",
+}
+
+var userFieldPlaceholder = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// userIdentity is what a -user-field-template can refer to
+type userIdentity struct {
+	KeyID  string // the proxy's client key ID, as used for rate limits
+	Name   string // virtual key name, or the key ID for other credentials
+	Tenant string // virtual key tenant, or the name when it has none
+	User   string // the "user" the client sent, if any
+}
+
+func (id userIdentity) placeholder(name string) (string, bool) {
+	switch name {
+	case "key_id":
+		return id.KeyID, true
+	case "key_name":
+		return id.Name, true
+	case "tenant":
+		return id.Tenant, true
+	case "user":
+		return id.User, true
+	}
+	return "", false
+}
+
+// validateUserFieldTemplate rejects templates with unknown placeholders
+func validateUserFieldTemplate(template string) error {
+	for _, match := range userFieldPlaceholder.FindAllStringSubmatch(template, -1) {
+		if _, ok := (userIdentity{}).placeholder(match[1]); !ok {
+			return fmt.Errorf("invalid -user-field-template %q: unknown placeholder {%s} (use {key_id}, {key_name}, {tenant} or {user})", template, match[1])
+		}
+	}
+	return nil
+}
+
+// newUserIdentity describes the client behind a request for the user field
+func newUserIdentity(keyID string, vk *virtualKey) userIdentity {
+	id := userIdentity{KeyID: keyID, Name: keyID, Tenant: keyID}
+	if vk != nil {
+		id.Name, id.Tenant = vk.Name, vk.Name
+		if vk.Tenant != "" {
+			id.Tenant = vk.Tenant
+		}
+	}
+	return id
+}
+
+// injectUserField sets the "user" field of a JSON request body from -user-field-template,
+// so OpenAI's abuse monitoring attributes requests to the same identities as the proxy.
+// Bodies of other endpoints, or that aren't JSON objects, are returned unchanged.
+func injectUserField(path string, body []byte, id userIdentity) []byte {
+	if *userFieldTemplate == "" || len(body) == 0 {
+		return body
+	}
+	supported := false
+	for _, endpoint := range userFieldEndpoints {
+		if path == endpoint {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		return body
+	}
+	doc, err := parseJSONDocument(body)
+	if err != nil {
+		return body
+	}
+	object, ok := doc.root.(map[string]interface{})
+	if !ok {
+		return body
+	}
+	if user, ok := object["user"].(string); ok {
+		id.User = user
+	}
+
+	user := userFieldPlaceholder.ReplaceAllStringFunc(*userFieldTemplate, func(match string) string {
+		value, _ := id.placeholder(strings.Trim(match, "{}"))
+		return value
+	})
+	if user == "" {
+		return body
+	}
+	object["user"] = user
+	encoded, err := doc.encode()
+	if err != nil {
+		return body
+	}
+	return encoded
+}
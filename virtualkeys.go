@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// endpointScopes maps scope names to the API path prefixes they cover
+var endpointScopes = map[string][]string{
+	"chat":        {"/v1/chat/"},
+	"completions": {"/v1/completions"},
+	"responses":   {"/v1/responses"},
+	"embeddings":  {"/v1/embeddings"},
+	"audio":       {"/v1/audio/"},
+	"images":      {"/v1/images/"},
+	"moderations": {"/v1/moderations"},
+	"models":      {"/v1/models"},
+	"files":       {"/v1/files", "/v1/uploads"},
+	"batches":     {"/v1/batches"},
+	"fine_tuning": {"/v1/fine_tuning/"},
+	"assistants":  {"/v1/assistants", "/v1/threads", "/v1/vector_stores"},
+	"realtime":    {"/v1/realtime"},
+}
+
+// virtualKey is a proxy-issued API key that stands in for an upstream key. Clients
+// never see the upstream key, and each virtual key can be limited to some endpoints.
+type virtualKey struct {
+	Key                 string   `json:"key"`
+	Name                string   `json:"name"`
+	Tenant              string   `json:"tenant,omitempty"`
+	UpstreamKey         string   `json:"upstream_key,omitempty"`
+	UpstreamKeySecret   string   `json:"upstream_key_secret,omitempty"` // resolved with secrets.get semantics
+	Scopes              []string `json:"scopes,omitempty"`
+	MonthlyBudgetUSD    float64  `json:"monthly_budget_usd,omitempty"` // flagged by GET /usage/forecast
+	ClientCerts         []string `json:"client_certs,omitempty"`       // certificate identities that authenticate as this key
+	allowed, disallowed []string // path prefixes
+}
+
+// virtualKeys maps virtual key tokens to their definitions; nil when none are configured
+var virtualKeys map[string]*virtualKey
+
+// scopePrefixes expands a scope name, or a literal path prefix starting with "/"
+func scopePrefixes(scope string) ([]string, error) {
+	if strings.HasPrefix(scope, "/") {
+		return []string{scope}, nil
+	}
+	if scope == "*" {
+		return []string{"/v1/"}, nil
+	}
+	prefixes, ok := endpointScopes[scope]
+	if !ok {
+		return nil, fmt.Errorf("unknown scope %q", scope)
+	}
+	return prefixes, nil
+}
+
+// loadVirtualKeys reads a JSON array of virtual keys, returning them by token and
+// by client certificate identity. Scopes such as "chat" or "/v1/embeddings" grant
+// access; a "!" prefix, as in "!files", denies it. A key with only denials may
+// call everything else.
+func loadVirtualKeys(path string) (map[string]*virtualKey, map[string]*virtualKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read virtual keys file %s: %v", path, err)
+	}
+	var list []*virtualKey
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse virtual keys file %s: %v", path, err)
+	}
+
+	keys := make(map[string]*virtualKey, len(list))
+	certs := make(map[string]*virtualKey)
+	for i, vk := range list {
+		if (vk.Key == "" && len(vk.ClientCerts) == 0) || vk.Name == "" {
+			return nil, nil, fmt.Errorf("virtual keys file %s: entry %d needs a key or client_certs, and a name", path, i)
+		}
+		if vk.Key != "" && keys[vk.Key] != nil {
+			return nil, nil, fmt.Errorf("virtual keys file %s: duplicate key for %q", path, vk.Name)
+		}
+		for _, identity := range vk.ClientCerts {
+			if other := certs[identity]; other != nil {
+				return nil, nil, fmt.Errorf("virtual keys file %s: client certificate %q is mapped to both %q and %q", path, identity, other.Name, vk.Name)
+			}
+			certs[identity] = vk
+		}
+		for _, scope := range vk.Scopes {
+			deny := strings.HasPrefix(scope, "!")
+			prefixes, err := scopePrefixes(strings.TrimPrefix(scope, "!"))
+			if err != nil {
+				return nil, nil, fmt.Errorf("virtual keys file %s: key %q: %v", path, vk.Name, err)
+			}
+			if deny {
+				vk.disallowed = append(vk.disallowed, prefixes...)
+			} else {
+				vk.allowed = append(vk.allowed, prefixes...)
+			}
+		}
+		if vk.Key != "" {
+			keys[vk.Key] = vk
+		}
+	}
+	return keys, certs, nil
+}
+
+// configuredVirtualKeys returns every virtual key once, whether it has a token,
+// client certificates or both
+func configuredVirtualKeys() []*virtualKey {
+	seen := make(map[*virtualKey]bool)
+	var list []*virtualKey
+	for _, index := range []map[string]*virtualKey{virtualKeys, clientCertKeys} {
+		for _, vk := range index {
+			if !seen[vk] {
+				seen[vk] = true
+				list = append(list, vk)
+			}
+		}
+	}
+	return list
+}
+
+// Allows reports whether the key's scopes cover path. Non-canonical paths are
+// never allowed, since prefixes can't be matched against them reliably.
+func (vk *virtualKey) Allows(path string) bool {
+	if !canonicalPath(path) {
+		return false
+	}
+	for _, prefix := range vk.disallowed {
+		if strings.HasPrefix(path, prefix) {
+			return false
+		}
+	}
+	if len(vk.allowed) == 0 {
+		return true
+	}
+	for _, prefix := range vk.allowed {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamAuthorization returns the Authorization header to send upstream
+func (vk *virtualKey) upstreamAuthorization() (string, error) {
+	if vk.UpstreamKeySecret != "" {
+		key, ok := lookupSecret(vk.UpstreamKeySecret)
+		if !ok {
+			return "", fmt.Errorf("secret %q for virtual key %q is not set", vk.UpstreamKeySecret, vk.Name)
+		}
+		return "Bearer " + key, nil
+	}
+	if vk.UpstreamKey != "" {
+		return "Bearer " + vk.UpstreamKey, nil
+	}
+	return "", fmt.Errorf("virtual key %q has no upstream key", vk.Name)
+}
+
+// lookupVirtualKey returns the virtual key presented by the request, if any: its
+// token, or else the key its client certificate is mapped to. In -client-cert-mode
+// mapped only the certificate counts.
+func lookupVirtualKey(r *http.Request) (*virtualKey, bool) {
+	if clientCAs != nil && *clientCertMode == "mapped" {
+		return lookupClientCertKey(r)
+	}
+	if virtualKeys != nil {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if vk, ok := virtualKeys[token]; ok {
+			return vk, true
+		}
+	}
+	return lookupClientCertKey(r)
+}
+
+// authorizeVirtualKey enforces the scopes of the request's virtual key and returns
+// its upstream key's Authorization. It returns false if the request was rejected.
+func authorizeVirtualKey(w http.ResponseWriter, r *http.Request, vk *virtualKey) (string, bool) {
+	if !vk.Allows(r.URL.Path) {
+		log.Printf("🚫 Virtual key %q is not scoped for %s", vk.Name, r.URL.Path)
+		metrics.Add("openai_proxy_virtual_key_denied_total", "Requests rejected because the virtual key's scopes don't cover the endpoint.", map[string]string{"key": vk.Name}, 1)
+		writeJSONError(w, http.StatusForbidden, "insufficient_scope", fmt.Sprintf("This key is not allowed to call %s", r.URL.Path))
+		return "", false
+	}
+	auth, err := vk.upstreamAuthorization()
+	if err != nil {
+		log.Printf("❌ %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "server_error", "The proxy has no upstream credentials for this key")
+		return "", false
+	}
+	return auth, true
+}
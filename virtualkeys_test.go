@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func loadTestVirtualKeys(t *testing.T, data string) map[string]*virtualKey {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, _, err := loadVirtualKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestScopesRejectNonCanonicalPaths(t *testing.T) {
+	keys := loadTestVirtualKeys(t, `[
+		{"key": "vk-embed", "name": "embedder", "upstream_key": "sk-1", "scopes": ["embeddings"]},
+		{"key": "vk-nofiles", "name": "nofiles", "upstream_key": "sk-2", "scopes": ["!files"]}
+	]`)
+	embedder, nofiles := keys["vk-embed"], keys["vk-nofiles"]
+
+	if !embedder.Allows("/v1/embeddings") || !nofiles.Allows("/v1/chat/completions") {
+		t.Fatal("scopes deny the endpoints they cover")
+	}
+	for _, tc := range []struct {
+		key  *virtualKey
+		path string
+	}{
+		{embedder, "/v1/embeddings/../files"},
+		{embedder, "/v1/embeddings/./../files"},
+		{nofiles, "/v1//files"},
+		{nofiles, "/v1/./files"},
+	} {
+		if tc.key.Allows(tc.path) {
+			t.Errorf("key %s allows %s", tc.key.Name, tc.path)
+		}
+	}
+}
+
+func TestCanonicalRequestPath(t *testing.T) {
+	for raw, want := range map[string]bool{
+		"/v1/chat/completions":     true,
+		"/v1/models/":              true,
+		"/v1/embeddings/../files":  false,
+		"/v1//files":               false,
+		"/v1/./files":              false,
+		"/v1/chat%2Fcompletions":   false,
+		"/v1/files%2f..%2fbatches": false,
+	} {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := canonicalRequestPath(u); got != want {
+			t.Errorf("canonicalRequestPath(%s) = %v, want %v", raw, got, want)
+		}
+	}
+}
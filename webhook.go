@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	webhookLogSize    = 500             // deliveries kept for GET /webhooks/deliveries
+	webhookWorkers    = 4               // concurrent POSTs
+	webhookMaxBackoff = 5 * time.Minute // longest wait between attempts
+)
+
+// webhookAttempt is one POST of a delivery
+type webhookAttempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs float64   `json:"duration_ms"`
+}
+
+// webhookDelivery is one notification for a webhook URL and the attempts to
+// deliver it
+type webhookDelivery struct {
+	ID            string           `json:"id"`
+	Event         string           `json:"event"` // trace, job, alert or slack
+	URL           string           `json:"url"`
+	Status        string           `json:"status"` // pending, retrying, delivered or failed
+	CreatedAt     time.Time        `json:"created_at"`
+	NextAttemptAt *time.Time       `json:"next_attempt_at,omitempty"`
+	Attempts      []webhookAttempt `json:"attempts"`
+	Bytes         int              `json:"bytes"`
+
+	body []byte // kept until the delivery succeeds, for retries and redelivery
+}
+
+// webhookDispatcher POSTs notifications in the background, signing them with
+// -webhook-secret and retrying failures with exponential backoff. The latest
+// deliveries are kept for GET /webhooks/deliveries.
+type webhookDispatcher struct {
+	mu    sync.Mutex
+	log   []*webhookDelivery // oldest first
+	queue chan *webhookDelivery
+}
+
+var webhooks = &webhookDispatcher{queue: make(chan *webhookDelivery, 1024)}
+
+// run delivers queued notifications until the process exits
+func (d *webhookDispatcher) run() {
+	for i := 0; i < webhookWorkers; i++ {
+		go func() {
+			for delivery := range d.queue {
+				d.attempt(delivery)
+			}
+		}()
+	}
+}
+
+// send queues payload as a JSON POST to url
+func (d *webhookDispatcher) send(event, url string, payload interface{}) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("❌ Failed to encode %s webhook: %v", event, err)
+		return
+	}
+	delivery := &webhookDelivery{
+		ID:        "whd_" + generateTraceID(),
+		Event:     event,
+		URL:       url,
+		Status:    "pending",
+		CreatedAt: time.Now(),
+		Attempts:  []webhookAttempt{},
+		Bytes:     len(body),
+		body:      body,
+	}
+	d.mu.Lock()
+	d.log = append(d.log, delivery)
+	if len(d.log) > webhookLogSize {
+		d.log = d.log[len(d.log)-webhookLogSize:]
+	}
+	d.mu.Unlock()
+	d.enqueue(delivery)
+}
+
+func (d *webhookDispatcher) enqueue(delivery *webhookDelivery) {
+	select {
+	case d.queue <- delivery:
+	default:
+		log.Printf("⚠️ Webhook queue full, dropping %s delivery %s", delivery.Event, delivery.ID)
+		d.mu.Lock()
+		delivery.Status, delivery.NextAttemptAt = "failed", nil
+		delivery.Attempts = append(delivery.Attempts, webhookAttempt{At: time.Now(), Error: "the webhook queue was full"})
+		d.mu.Unlock()
+		d.count(delivery, "dropped")
+	}
+}
+
+// webhookSignature signs a payload for X-Proxy-Webhook-Signature: the hex
+// HMAC-SHA256 of the timestamp, a dot and the body
+func webhookSignature(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// retryableWebhookStatus reports whether a receiver's answer may change on retry
+func retryableWebhookStatus(code int) bool {
+	return code == http.StatusRequestTimeout || code == http.StatusTooEarly || code == http.StatusTooManyRequests || code >= 500
+}
+
+// attempt POSTs a delivery once and schedules the next attempt when it fails
+func (d *webhookDispatcher) attempt(delivery *webhookDelivery) {
+	d.mu.Lock()
+	number := len(delivery.Attempts) + 1
+	body := delivery.body
+	d.mu.Unlock()
+
+	result := webhookAttempt{At: time.Now()}
+	var retryAfter time.Duration
+	err := func() error {
+		req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "openai_proxy-webhook")
+		req.Header.Set("X-Proxy-Webhook-Id", delivery.ID)
+		req.Header.Set("X-Proxy-Webhook-Event", delivery.Event)
+		req.Header.Set("X-Proxy-Webhook-Attempt", strconv.Itoa(number))
+		if *webhookSecret != "" {
+			secret, ok := lookupSecret(*webhookSecret)
+			if !ok {
+				return fmt.Errorf("secret %q of -webhook-secret is not set", *webhookSecret)
+			}
+			req.Header.Set("X-Proxy-Webhook-Signature", webhookSignature(secret, result.At.Unix(), body))
+		}
+		resp, err := alertClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		result.StatusCode = resp.StatusCode
+		if resp.StatusCode >= 300 {
+			if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+				retryAfter = time.Duration(seconds) * time.Second
+			}
+			return fmt.Errorf("%s returned %s", delivery.URL, resp.Status)
+		}
+		return nil
+	}()
+	result.DurationMs = float64(time.Since(result.At).Microseconds()) / 1000
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	retry := err != nil && number < *webhookMaxAttempts && (result.StatusCode == 0 || retryableWebhookStatus(result.StatusCode))
+	backoff := min(time.Second<<(number-1), webhookMaxBackoff)
+	if retryAfter > 0 {
+		backoff = min(retryAfter, webhookMaxBackoff)
+	}
+	d.mu.Lock()
+	delivery.Attempts = append(delivery.Attempts, result)
+	delivery.NextAttemptAt = nil
+	switch {
+	case err == nil:
+		delivery.Status, delivery.body = "delivered", nil
+	case retry:
+		next := time.Now().Add(backoff)
+		delivery.Status, delivery.NextAttemptAt = "retrying", &next
+	default:
+		delivery.Status = "failed"
+	}
+	d.mu.Unlock()
+
+	switch {
+	case err == nil:
+		d.count(delivery, "delivered")
+	case retry:
+		log.Printf("📮 %s webhook %s attempt %d failed, retrying in %v: %v", delivery.Event, delivery.ID, number, backoff, err)
+		d.count(delivery, "retried")
+		time.AfterFunc(backoff, func() { d.enqueue(delivery) })
+	default:
+		log.Printf("❌ %s webhook %s failed after %d attempts: %v", delivery.Event, delivery.ID, number, err)
+		d.count(delivery, "failed")
+	}
+}
+
+func (d *webhookDispatcher) count(delivery *webhookDelivery, outcome string) {
+	metrics.Add("openai_proxy_webhook_deliveries_total", "Webhook delivery attempts, by event and outcome.", map[string]string{"event": delivery.Event, "outcome": outcome}, 1)
+}
+
+// deliveries returns copies of the logged deliveries, newest first
+func (d *webhookDispatcher) deliveries() []webhookDelivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := make([]webhookDelivery, 0, len(d.log))
+	for i := len(d.log) - 1; i >= 0; i-- {
+		delivery := *d.log[i]
+		delivery.Attempts = append([]webhookAttempt{}, delivery.Attempts...)
+		list = append(list, delivery)
+	}
+	return list
+}
+
+// redeliver sends a failed delivery again, with a fresh set of attempts
+func (d *webhookDispatcher) redeliver(id string) (webhookDelivery, int, error) {
+	d.mu.Lock()
+	var found *webhookDelivery
+	for _, delivery := range d.log {
+		if delivery.ID == id {
+			found = delivery
+		}
+	}
+	if found == nil {
+		d.mu.Unlock()
+		return webhookDelivery{}, http.StatusNotFound, fmt.Errorf("no logged webhook delivery with id %q", id)
+	}
+	if found.Status != "failed" {
+		status := found.Status
+		d.mu.Unlock()
+		return webhookDelivery{}, http.StatusConflict, fmt.Errorf("delivery %s is %s; only failed deliveries can be redelivered", id, status)
+	}
+	found.Status, found.Attempts = "pending", []webhookAttempt{}
+	snapshot := *found
+	d.mu.Unlock()
+	log.Printf("📮 Redelivering %s webhook %s", found.Event, id)
+	d.enqueue(found)
+	return snapshot, http.StatusAccepted, nil
+}
+
+// notifyTraceWebhook posts a recorded trace to -trace-webhook-url, with
+// credentials masked as in capture files
+func notifyTraceWebhook(trace Trace) {
+	if *traceWebhookURL == "" {
+		return
+	}
+	trace.RequestHeader = redactCaptureHeader(trace.RequestHeader)
+	webhooks.send("trace", *traceWebhookURL, trace)
+}
+
+// handleWebhookDeliveries serves GET /webhooks/deliveries, the latest deliveries
+// filtered by ?status= and ?event=, GET /webhooks/deliveries/<id> and POST
+// /webhooks/deliveries/<id>/redeliver
+func handleWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/webhooks/deliveries"), "/")
+	id, action, _ := strings.Cut(rest, "/")
+	switch {
+	case action == "redeliver":
+		if r.Method != http.MethodPost {
+			writeJSONError(w, http.StatusMethodNotAllowed, "invalid_request_error", "use POST")
+			return
+		}
+		delivery, status, err := webhooks.redeliver(id)
+		if err != nil {
+			writeJSONError(w, status, "invalid_request_error", err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(delivery)
+		return
+	case action != "":
+		writeJSONError(w, http.StatusNotFound, "not_found", "unknown webhook delivery resource")
+		return
+	case r.Method != http.MethodGet:
+		writeJSONError(w, http.StatusMethodNotAllowed, "invalid_request_error", "use GET")
+		return
+	}
+
+	query := r.URL.Query()
+	list := []webhookDelivery{}
+	for _, delivery := range webhooks.deliveries() {
+		if id != "" && delivery.ID != id {
+			continue
+		}
+		if status := query.Get("status"); status != "" && delivery.Status != status {
+			continue
+		}
+		if event := query.Get("event"); event != "" && delivery.Event != event {
+			continue
+		}
+		list = append(list, delivery)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if id != "" {
+		if len(list) == 0 {
+			writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("no logged webhook delivery with id %q", id))
+			return
+		}
+		json.NewEncoder(w).Encode(list[0])
+		return
+	}
+	json.NewEncoder(w).Encode(list)
+}